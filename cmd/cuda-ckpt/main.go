@@ -5,6 +5,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/kybernate/kybernate-evaluation/pkg/cuda"
 )
@@ -15,9 +17,23 @@ func main() {
 		pid       = flag.Int("pid", 0, "Process ID of the CUDA process")
 		timeoutMs = flag.Uint("timeout", 5000, "Lock timeout in milliseconds")
 		listGPUs  = flag.Bool("list-gpus", false, "List available GPUs")
+		showCaps  = flag.Bool("capabilities", false, "Show CUDA driver capabilities")
+		gpuMap    = flag.String("gpu-map", "", "GPU remapping for restore: old=new[,old=new...] (UUIDs or local device indices)")
+		ckptDir   = flag.String("checkpoint-dir", "", "Checkpoint directory whose gpu-devices.json lists the GPUs the process used (required with --gpu-map)")
 	)
 	flag.Parse()
 
+	// Capability report (works without a usable driver)
+	if *showCaps {
+		caps := cuda.ProbeDriver()
+		fmt.Println(caps)
+		if err := caps.Err(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Initialize CUDA
 	ckpt, err := cuda.NewCheckpointer()
 	if err != nil {
@@ -50,6 +66,32 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Resolve the GPU map up front so that restore fails before touching the process
+	var (
+		plan *cuda.MigrationPlan
+		used [][16]byte
+	)
+	if *gpuMap != "" {
+		plan, err = parseGPUMap(ckpt, *gpuMap)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --gpu-map: %v\n", err)
+			os.Exit(1)
+		}
+		if *ckptDir == "" {
+			fmt.Fprintf(os.Stderr, "Error: --gpu-map requires --checkpoint-dir\n")
+			os.Exit(1)
+		}
+		used, err = cuda.ReadUsedGPUs(*ckptDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read the GPUs the process used: %v\n", err)
+			os.Exit(1)
+		}
+		if err := cuda.ValidateGPUMap(used, plan.Pairs()); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --gpu-map: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	switch *action {
 	case "state":
 		state, err := ckpt.GetState(*pid)
@@ -74,7 +116,13 @@ func main() {
 		fmt.Println("VRAM checkpointed to RAM")
 
 	case "restore":
-		if err := ckpt.Restore(*pid); err != nil {
+		if plan != nil {
+			fmt.Printf("Remapping GPUs: %s\n", plan)
+			err = ckpt.RestoreWithGPUMap(*pid, used, plan.Pairs())
+		} else {
+			err = ckpt.Restore(*pid)
+		}
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to restore: %v\n", err)
 			os.Exit(1)
 		}
@@ -97,7 +145,13 @@ func main() {
 
 	case "full-restore":
 		fmt.Printf("Performing full restore (RAM→VRAM + unlock) for PID %d...\n", *pid)
-		if err := ckpt.RestoreFull(*pid); err != nil {
+		if plan != nil {
+			fmt.Printf("Remapping GPUs: %s\n", plan)
+			err = ckpt.RestoreWithMigration(*pid, used, plan)
+		} else {
+			err = ckpt.RestoreFull(*pid)
+		}
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "Failed: %v\n", err)
 			os.Exit(1)
 		}
@@ -108,6 +162,7 @@ func main() {
 		fmt.Println()
 		fmt.Println("Usage:")
 		fmt.Println("  cuda-ckpt --list-gpus                    List available GPUs")
+		fmt.Println("  cuda-ckpt --capabilities                 Show CUDA driver capabilities")
 		fmt.Println("  cuda-ckpt --action state --pid <PID>     Get checkpoint state")
 		fmt.Println("  cuda-ckpt --action lock --pid <PID>      Lock process")
 		fmt.Println("  cuda-ckpt --action checkpoint --pid <PID> Checkpoint VRAM to RAM")
@@ -118,5 +173,53 @@ func main() {
 		fmt.Println()
 		fmt.Println("Options:")
 		fmt.Println("  --timeout <ms>  Lock timeout in milliseconds (default: 5000)")
+		fmt.Println("  --gpu-map <map> Remap GPUs on restore/full-restore, e.g.")
+		fmt.Println("                  GPU-aaaa...=GPU-bbbb...,GPU-cccc...=GPU-dddd... or 0=2,1=3")
+		fmt.Println("                  Every GPU the process used must be mapped exactly once")
+		fmt.Println("  --checkpoint-dir <dir>")
+		fmt.Println("                  Checkpoint whose gpu-devices.json lists the GPUs the")
+		fmt.Println("                  process used; required with --gpu-map")
+	}
+}
+
+// parseGPUMap parses old=new pairs where each side is a GPU UUID or a
+// device index on this node
+func parseGPUMap(ckpt *cuda.Checkpointer, s string) (*cuda.MigrationPlan, error) {
+	plan := &cuda.MigrationPlan{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		oldStr, newStr, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid mapping %q (expected old=new)", entry)
+		}
+		source, err := resolveGPU(ckpt, oldStr)
+		if err != nil {
+			return nil, err
+		}
+		target, err := resolveGPU(ckpt, newStr)
+		if err != nil {
+			return nil, err
+		}
+		plan.Mappings = append(plan.Mappings, cuda.GPUMapping{Source: *source, Target: *target})
+	}
+	if len(plan.Mappings) == 0 {
+		return nil, fmt.Errorf("empty GPU map")
+	}
+	return plan, nil
+}
+
+// resolveGPU turns a UUID or a local device index into a GPUInfo
+func resolveGPU(ckpt *cuda.Checkpointer, s string) (*cuda.GPUInfo, error) {
+	s = strings.TrimSpace(s)
+	if index, err := strconv.Atoi(s); err == nil {
+		return ckpt.GetDeviceUUID(index)
+	}
+	uuid, err := cuda.ParseUUID(s)
+	if err != nil {
+		return nil, err
 	}
+	return &cuda.GPUInfo{Index: -1, UUID: uuid}, nil
 }
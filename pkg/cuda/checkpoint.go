@@ -4,51 +4,6 @@
 // Reference: https://docs.nvidia.com/cuda/cuda-driver-api/group__CUDA__CHECKPOINT.html
 package cuda
 
-/*
-#cgo LDFLAGS: -lcuda
-#cgo CFLAGS: -I/usr/local/cuda/include
-
-#include <cuda.h>
-#include <stdlib.h>
-
-// Wrapper functions for Go - using types from cuda.h
-
-static CUresult cuda_init() {
-    return cuInit(0);
-}
-
-static CUresult cuda_checkpoint_lock(int pid, unsigned int timeout_ms) {
-    CUcheckpointLockArgs args = {0};
-    args.timeoutMs = timeout_ms;
-    return cuCheckpointProcessLock(pid, &args);
-}
-
-static CUresult cuda_checkpoint_checkpoint(int pid) {
-    CUcheckpointCheckpointArgs args = {0};
-    return cuCheckpointProcessCheckpoint(pid, &args);
-}
-
-static CUresult cuda_checkpoint_restore(int pid) {
-    CUcheckpointRestoreArgs args = {0};
-    args.gpuPairsCount = 0;
-    args.gpuPairs = NULL;
-    return cuCheckpointProcessRestore(pid, &args);
-}
-
-static CUresult cuda_checkpoint_unlock(int pid) {
-    CUcheckpointUnlockArgs args = {0};
-    return cuCheckpointProcessUnlock(pid, &args);
-}
-
-static CUresult cuda_checkpoint_get_state(int pid, int* state) {
-    CUprocessState s;
-    CUresult result = cuCheckpointProcessGetState(pid, &s);
-    *state = (int)s;
-    return result;
-}
-*/
-import "C"
-
 import (
 	"fmt"
 )
@@ -75,6 +30,21 @@ func (s ProcessState) String() string {
 	}
 }
 
+// CUDA driver error codes returned by the checkpoint and device APIs.
+// The values match CUresult in cuda.h.
+const (
+	ErrCodeSuccess        = 0
+	ErrCodeInvalidValue   = 1
+	ErrCodeNotInitialized = 3
+	ErrCodeNoDevice       = 100
+	ErrCodeInvalidDevice  = 101
+	ErrCodeIllegalState   = 401
+	ErrCodeNotReady       = 600
+	ErrCodeNotSupported   = 801
+	ErrCodeTimeout        = 909
+	ErrCodeUnknown        = 999
+)
+
 // CUDAError wraps a CUDA error code
 type CUDAError struct {
 	Code    int
@@ -85,67 +55,74 @@ func (e *CUDAError) Error() string {
 	return fmt.Sprintf("CUDA error %d: %s", e.Code, e.Message)
 }
 
-// cudaError converts a CUresult to a Go error
-func cudaError(result C.CUresult, operation string) error {
-	if result == C.CUDA_SUCCESS {
+// cudaError converts a CUresult code to a Go error
+func cudaError(code int, operation string) error {
+	if code == ErrCodeSuccess {
 		return nil
 	}
 	return &CUDAError{
-		Code:    int(result),
+		Code:    code,
 		Message: fmt.Sprintf("%s failed", operation),
 	}
 }
 
 // Checkpointer provides GPU checkpoint/restore functionality
 type Checkpointer struct {
+	driver      Driver
 	initialized bool
 }
 
-// NewCheckpointer creates a new CUDA checkpointer
+// NewCheckpointer creates a new CUDA checkpointer backed by the driver
+// selected through KYBERNATE_CUDA_DRIVER (see DefaultDriver).
+// On hosts without a usable libcuda it returns a *DriverUnavailableError.
 func NewCheckpointer() (*Checkpointer, error) {
-	result := C.cuda_init()
-	if err := cudaError(result, "cuInit"); err != nil {
+	driver, err := DefaultDriver()
+	if err != nil {
+		return nil, err
+	}
+	return NewCheckpointerWithDriver(driver)
+}
+
+// NewCheckpointerWithDriver creates a checkpointer on top of an explicit driver
+func NewCheckpointerWithDriver(driver Driver) (*Checkpointer, error) {
+	if err := driver.Init(); err != nil {
 		return nil, err
 	}
-	return &Checkpointer{initialized: true}, nil
+	return &Checkpointer{driver: driver, initialized: true}, nil
+}
+
+// Driver returns the driver backing this checkpointer
+func (c *Checkpointer) Driver() Driver {
+	return c.driver
 }
 
 // GetState returns the current checkpoint state of a process
 func (c *Checkpointer) GetState(pid int) (ProcessState, error) {
-	var state C.int
-	result := C.cuda_checkpoint_get_state(C.int(pid), &state)
-	if err := cudaError(result, "cuCheckpointProcessGetState"); err != nil {
-		return StateRunning, err
-	}
-	return ProcessState(state), nil
+	return c.driver.ProcessGetState(pid)
 }
 
 // Lock locks a CUDA process, blocking further CUDA API calls
 // timeoutMs specifies the timeout in milliseconds (0 = no timeout)
 func (c *Checkpointer) Lock(pid int, timeoutMs uint) error {
-	result := C.cuda_checkpoint_lock(C.int(pid), C.uint(timeoutMs))
-	return cudaError(result, "cuCheckpointProcessLock")
+	return c.driver.ProcessLock(pid, timeoutMs)
 }
 
 // Checkpoint moves GPU memory contents to host memory
 // The process must be in LOCKED state
 func (c *Checkpointer) Checkpoint(pid int) error {
-	result := C.cuda_checkpoint_checkpoint(C.int(pid))
-	return cudaError(result, "cuCheckpointProcessCheckpoint")
+	return c.driver.ProcessCheckpoint(pid)
 }
 
 // Restore moves host memory contents back to GPU memory
 // The process must be in CHECKPOINTED state
 func (c *Checkpointer) Restore(pid int) error {
-	result := C.cuda_checkpoint_restore(C.int(pid))
-	return cudaError(result, "cuCheckpointProcessRestore")
+	return c.driver.ProcessRestore(pid, nil)
 }
 
 // Unlock unlocks a CUDA process, allowing CUDA API calls
 // The process must be in LOCKED state
 func (c *Checkpointer) Unlock(pid int) error {
-	result := C.cuda_checkpoint_unlock(C.int(pid))
-	return cudaError(result, "cuCheckpointProcessUnlock")
+	return c.driver.ProcessUnlock(pid)
 }
 
 // CheckpointFull performs a complete VRAM → Host RAM checkpoint
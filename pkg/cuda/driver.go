@@ -0,0 +1,92 @@
+package cuda
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// DriverEnv selects the driver used by NewCheckpointer: "native" (default) or "sim"
+	DriverEnv = "KYBERNATE_CUDA_DRIVER"
+
+	// SimStateEnv points the simulated driver at its JSON state file
+	SimStateEnv = "KYBERNATE_CUDA_SIM_STATE"
+
+	DriverNative = "native"
+	DriverSim    = "sim"
+)
+
+// Driver is the CUDA driver surface used by Checkpointer.
+// The native implementation calls into libcuda; SimDriver is an in-memory
+// stand-in that follows the same state machine and error codes.
+type Driver interface {
+	// Init initializes the driver (cuInit)
+	Init() error
+
+	ProcessGetState(pid int) (ProcessState, error)
+	ProcessLock(pid int, timeoutMs uint) error
+	ProcessCheckpoint(pid int) error
+	// ProcessRestore restores device memory, remapping devices according to
+	// pairs. An empty pairs list restores onto the original devices.
+	ProcessRestore(pid int, pairs []GPUPair) error
+	ProcessUnlock(pid int) error
+
+	DeviceGetCount() (int, error)
+	DeviceGetUUID(device int) ([16]byte, error)
+}
+
+// GPUPair maps the GPU a process was checkpointed on to the GPU it is restored onto
+type GPUPair struct {
+	Old [16]byte
+	New [16]byte
+}
+
+// DefaultDriver returns the driver selected by the KYBERNATE_CUDA_DRIVER
+// environment variable. The simulated driver keeps its state in the file
+// named by KYBERNATE_CUDA_SIM_STATE so that several processes (shim, ctl,
+// runtime wrapper) observe the same simulated GPUs.
+func DefaultDriver() (Driver, error) {
+	switch name := os.Getenv(DriverEnv); name {
+	case "", DriverNative:
+		return nativeDriver()
+	case DriverSim:
+		return OpenSimDriver(SimStatePath())
+	default:
+		return nil, fmt.Errorf("unknown CUDA driver %q (expected %q or %q)", name, DriverNative, DriverSim)
+	}
+}
+
+// SimulatorSelected reports whether the simulated driver is selected
+func SimulatorSelected() bool {
+	return os.Getenv(DriverEnv) == DriverSim
+}
+
+// SimStatePath returns the state file used by the simulated driver
+func SimStatePath() string {
+	if path := os.Getenv(SimStateEnv); path != "" {
+		return path
+	}
+	return filepath.Join(os.TempDir(), "kybernate-cuda-sim.json")
+}
+
+// FormatUUID formats a GPU UUID the way nvidia-smi prints it
+// (GPU-xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx)
+func FormatUUID(uuid [16]byte) string {
+	h := hex.EncodeToString(uuid[:])
+	return fmt.Sprintf("GPU-%s-%s-%s-%s-%s", h[0:8], h[8:12], h[12:16], h[16:20], h[20:32])
+}
+
+// ParseUUID parses a GPU UUID with or without the "GPU-" prefix and dashes
+func ParseUUID(s string) ([16]byte, error) {
+	var uuid [16]byte
+	raw := strings.ReplaceAll(strings.TrimPrefix(strings.TrimSpace(s), "GPU-"), "-", "")
+	b, err := hex.DecodeString(raw)
+	if err != nil || len(b) != len(uuid) {
+		return uuid, fmt.Errorf("invalid GPU UUID %q", s)
+	}
+	copy(uuid[:], b)
+	return uuid, nil
+}
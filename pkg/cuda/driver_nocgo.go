@@ -0,0 +1,13 @@
+//go:build !cgo
+
+package cuda
+
+// ProbeDriver reports an unloaded driver; libcuda can only be opened with cgo
+func ProbeDriver() Capabilities {
+	return Capabilities{}
+}
+
+// nativeDriver is unavailable without cgo; use the simulated driver instead
+func nativeDriver() (Driver, error) {
+	return nil, ProbeDriver().Err()
+}
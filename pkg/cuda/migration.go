@@ -1,54 +1,20 @@
 // Package cuda - GPU UUID remapping for cross-node migration
 package cuda
 
-/*
-#cgo LDFLAGS: -lcuda
-#cgo CFLAGS: -I/usr/local/cuda/include
-
-#include <cuda.h>
-#include <string.h>
-
-// Restore with GPU remapping
-static CUresult cuda_checkpoint_restore_remap(int pid, 
-    char* old_uuid, char* new_uuid) {
-    
-    CUcheckpointGpuPair pair;
-    memcpy(pair.oldUuid.bytes, old_uuid, 16);
-    memcpy(pair.newUuid.bytes, new_uuid, 16);
-    
-    CUcheckpointRestoreArgs args = {0};
-    args.gpuPairsCount = 1;
-    args.gpuPairs = &pair;
-    
-    return cuCheckpointProcessRestore(pid, &args);
-}
-
-// Get device UUID
-static CUresult cuda_get_device_uuid(int device, char* uuid_out) {
-    CUdevice dev;
-    CUresult result = cuDeviceGet(&dev, device);
-    if (result != CUDA_SUCCESS) return result;
-    
-    CUuuid uuid;
-    result = cuDeviceGetUuid(&uuid, dev);
-    if (result != CUDA_SUCCESS) return result;
-    
-    memcpy(uuid_out, uuid.bytes, 16);
-    return CUDA_SUCCESS;
-}
-
-// Get device count
-static CUresult cuda_get_device_count(int* count) {
-    return cuDeviceGetCount(count);
-}
-*/
-import "C"
 import (
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"unsafe"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
+// GPUDevicesFile lists the GPUs a checkpointed process used; kybernate
+// writes it into every checkpoint directory
+const GPUDevicesFile = "gpu-devices.json"
+
 // GPUInfo represents information about a GPU device
 type GPUInfo struct {
 	Index int
@@ -62,67 +28,191 @@ func (g *GPUInfo) UUIDString() string {
 
 // GetDeviceCount returns the number of CUDA devices
 func (c *Checkpointer) GetDeviceCount() (int, error) {
-	var count C.int
-	result := C.cuda_get_device_count(&count)
-	if err := cudaError(result, "cuDeviceGetCount"); err != nil {
-		return 0, err
-	}
-	return int(count), nil
+	return c.driver.DeviceGetCount()
 }
 
 // GetDeviceUUID returns the UUID of a specific GPU device
 func (c *Checkpointer) GetDeviceUUID(deviceIndex int) (*GPUInfo, error) {
-	var uuid [16]C.char
-	result := C.cuda_get_device_uuid(C.int(deviceIndex), &uuid[0])
-	if err := cudaError(result, "cuDeviceGetUuid"); err != nil {
+	uuid, err := c.driver.DeviceGetUUID(deviceIndex)
+	if err != nil {
 		return nil, err
 	}
+	return &GPUInfo{Index: deviceIndex, UUID: uuid}, nil
+}
+
+// ValidateGPUMap checks that pairs is a full bijection over used, the GPUs
+// the process had contexts on: every used GPU is mapped exactly once and no
+// two GPUs are mapped onto the same target.
+func ValidateGPUMap(used [][16]byte, pairs []GPUPair) error {
+	if len(pairs) != len(used) {
+		return fmt.Errorf("GPU map has %d pairs but the process used %d GPUs", len(pairs), len(used))
+	}
+
+	isUsed := make(map[[16]byte]bool, len(used))
+	for _, u := range used {
+		if isUsed[u] {
+			return fmt.Errorf("GPU %s listed twice as used", FormatUUID(u))
+		}
+		isUsed[u] = true
+	}
+
+	sources := make(map[[16]byte]bool, len(pairs))
+	targets := make(map[[16]byte]bool, len(pairs))
+	for _, p := range pairs {
+		if !isUsed[p.Old] {
+			return fmt.Errorf("GPU %s is not used by the process", FormatUUID(p.Old))
+		}
+		if sources[p.Old] {
+			return fmt.Errorf("GPU %s is mapped more than once", FormatUUID(p.Old))
+		}
+		if targets[p.New] {
+			return fmt.Errorf("GPU %s is the target of more than one mapping", FormatUUID(p.New))
+		}
+		sources[p.Old] = true
+		targets[p.New] = true
+	}
+	return nil
+}
+
+// ReadUsedGPUs returns the GPUs recorded in the gpu-devices.json of the
+// checkpoint directory dir
+func ReadUsedGPUs(dir string) ([][16]byte, error) {
+	data, err := os.ReadFile(filepath.Join(dir, GPUDevicesFile))
+	if err != nil {
+		return nil, err
+	}
+	var devices []struct {
+		UUID string `json:"uuid"`
+	}
+	if err := json.Unmarshal(data, &devices); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", GPUDevicesFile, err)
+	}
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("%s lists no GPUs", GPUDevicesFile)
+	}
+	used := make([][16]byte, 0, len(devices))
+	for _, dev := range devices {
+		uuid, err := ParseUUID(dev.UUID)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", GPUDevicesFile, err)
+		}
+		used = append(used, uuid)
+	}
+	return used, nil
+}
 
-	info := &GPUInfo{Index: deviceIndex}
-	for i := 0; i < 16; i++ {
-		info.UUID[i] = byte(uuid[i])
+// RestoreWithGPUMap restores VRAM, moving each GPU the process used
+// (used) onto the target given by pairs. pairs must be a full bijection
+// over used, see ValidateGPUMap.
+func (c *Checkpointer) RestoreWithGPUMap(pid int, used [][16]byte, pairs []GPUPair) error {
+	if err := ValidateGPUMap(used, pairs); err != nil {
+		return fmt.Errorf("invalid GPU map: %w", err)
 	}
-	return info, nil
+	return c.driver.ProcessRestore(pid, pairs)
 }
 
 // RestoreWithRemap restores VRAM with GPU remapping for migration
 // oldUUID: UUID of the GPU where the checkpoint was created
 // newUUID: UUID of the GPU to restore onto
 func (c *Checkpointer) RestoreWithRemap(pid int, oldUUID, newUUID [16]byte) error {
-	oldPtr := (*C.char)(unsafe.Pointer(&oldUUID[0]))
-	newPtr := (*C.char)(unsafe.Pointer(&newUUID[0]))
+	return c.RestoreWithGPUMap(pid, [][16]byte{oldUUID}, []GPUPair{{Old: oldUUID, New: newUUID}})
+}
 
-	result := C.cuda_checkpoint_restore_remap(C.int(pid), oldPtr, newPtr)
-	return cudaError(result, "cuCheckpointProcessRestore (remap)")
+// GPUMapping maps one source GPU onto one target GPU
+type GPUMapping struct {
+	Source GPUInfo
+	Target GPUInfo
 }
 
-// MigrationPlan represents a plan for migrating a GPU process
+// MigrationPlan represents a plan for migrating a GPU process.
+// It holds one mapping per GPU the process used.
 type MigrationPlan struct {
-	SourceGPU GPUInfo
-	TargetGPU GPUInfo
+	Mappings []GPUMapping
+}
+
+// Pairs returns the plan as old→new UUID pairs for the restore call
+func (p *MigrationPlan) Pairs() []GPUPair {
+	pairs := make([]GPUPair, 0, len(p.Mappings))
+	for _, m := range p.Mappings {
+		pairs = append(pairs, GPUPair{Old: m.Source.UUID, New: m.Target.UUID})
+	}
+	return pairs
+}
+
+// SourceUUIDs returns the UUIDs of the GPUs the plan moves processes off
+func (p *MigrationPlan) SourceUUIDs() [][16]byte {
+	uuids := make([][16]byte, 0, len(p.Mappings))
+	for _, m := range p.Mappings {
+		uuids = append(uuids, m.Source.UUID)
+	}
+	return uuids
+}
+
+// String renders the plan as "src=dst,src=dst"
+func (p *MigrationPlan) String() string {
+	parts := make([]string, 0, len(p.Mappings))
+	for _, m := range p.Mappings {
+		parts = append(parts, FormatUUID(m.Source.UUID)+"="+FormatUUID(m.Target.UUID))
+	}
+	return strings.Join(parts, ",")
+}
+
+// NewMigrationPlan builds a plan from old→new UUID pairs.
+// Device indices are unknown and left at -1.
+func NewMigrationPlan(pairs []GPUPair) *MigrationPlan {
+	plan := &MigrationPlan{}
+	for _, p := range pairs {
+		plan.Mappings = append(plan.Mappings, GPUMapping{
+			Source: GPUInfo{Index: -1, UUID: p.Old},
+			Target: GPUInfo{Index: -1, UUID: p.New},
+		})
+	}
+	return plan
 }
 
 // CreateMigrationPlan creates a migration plan from source to target GPU
 func (c *Checkpointer) CreateMigrationPlan(sourceIndex, targetIndex int) (*MigrationPlan, error) {
-	source, err := c.GetDeviceUUID(sourceIndex)
-	if err != nil {
-		return nil, fmt.Errorf("get source GPU: %w", err)
-	}
+	return c.CreateMultiMigrationPlan(map[int]int{sourceIndex: targetIndex})
+}
 
-	target, err := c.GetDeviceUUID(targetIndex)
-	if err != nil {
-		return nil, fmt.Errorf("get target GPU: %w", err)
+// CreateMultiMigrationPlan creates a migration plan for several GPUs on
+// this node, keyed by source device index with the target index as value
+func (c *Checkpointer) CreateMultiMigrationPlan(indices map[int]int) (*MigrationPlan, error) {
+	plan := &MigrationPlan{}
+	for sourceIndex, targetIndex := range indices {
+		source, err := c.GetDeviceUUID(sourceIndex)
+		if err != nil {
+			return nil, fmt.Errorf("get source GPU %d: %w", sourceIndex, err)
+		}
+
+		target, err := c.GetDeviceUUID(targetIndex)
+		if err != nil {
+			return nil, fmt.Errorf("get target GPU %d: %w", targetIndex, err)
+		}
+
+		plan.Mappings = append(plan.Mappings, GPUMapping{Source: *source, Target: *target})
 	}
 
-	return &MigrationPlan{
-		SourceGPU: *source,
-		TargetGPU: *target,
-	}, nil
+	// Keep the order stable (map iteration is random)
+	sort.Slice(plan.Mappings, func(i, j int) bool {
+		return plan.Mappings[i].Source.Index < plan.Mappings[j].Source.Index
+	})
+
+	targets := make(map[[16]byte]bool, len(plan.Mappings))
+	for _, m := range plan.Mappings {
+		if targets[m.Target.UUID] {
+			return nil, fmt.Errorf("GPU %s is the target of more than one mapping", FormatUUID(m.Target.UUID))
+		}
+		targets[m.Target.UUID] = true
+	}
+	return plan, nil
 }
 
-// RestoreWithMigration restores with GPU migration
-func (c *Checkpointer) RestoreWithMigration(pid int, plan *MigrationPlan) error {
-	if err := c.RestoreWithRemap(pid, plan.SourceGPU.UUID, plan.TargetGPU.UUID); err != nil {
+// RestoreWithMigration restores with GPU migration and unlocks the
+// process. used are the GPUs the process had contexts on at checkpoint
+// time; the plan must map each of them exactly once.
+func (c *Checkpointer) RestoreWithMigration(pid int, used [][16]byte, plan *MigrationPlan) error {
+	if err := c.RestoreWithGPUMap(pid, used, plan.Pairs()); err != nil {
 		return err
 	}
 	return c.Unlock(pid)
@@ -0,0 +1,77 @@
+package cuda
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreWithMigrationChecksUsedGPUs(t *testing.T) {
+	simGPU2 := [16]byte{0x0e, 15: 0x30}
+	simGPU3 := [16]byte{0x0f, 15: 0x40}
+	tests := []struct {
+		name    string
+		pairs   []GPUPair
+		wantErr bool
+	}{
+		{"full map", []GPUPair{{simGPU0, simGPU2}, {simGPU1, simGPU3}}, false},
+		{"swap", []GPUPair{{simGPU0, simGPU1}, {simGPU1, simGPU0}}, false},
+		{"partial map", []GPUPair{{simGPU0, simGPU2}}, true},
+		{"unused source", []GPUPair{{simGPU0, simGPU2}, {simGPU3, simGPU1}}, true},
+		{"shared target", []GPUPair{{simGPU0, simGPU2}, {simGPU1, simGPU2}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const pid = 21
+			sim := NewSimDriver(simGPU0, simGPU1, simGPU2, simGPU3)
+			if err := sim.AddProcess(pid, "worker", 1024, simGPU0, simGPU1); err != nil {
+				t.Fatalf("AddProcess: %v", err)
+			}
+			c, err := NewCheckpointerWithDriver(sim)
+			if err != nil {
+				t.Fatalf("NewCheckpointerWithDriver: %v", err)
+			}
+			if err := c.CheckpointFull(pid, 0); err != nil {
+				t.Fatalf("CheckpointFull: %v", err)
+			}
+
+			used := [][16]byte{simGPU0, simGPU1}
+			err = c.RestoreWithMigration(pid, used, NewMigrationPlan(tt.pairs))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RestoreWithMigration: err = %v, want error %v", err, tt.wantErr)
+			}
+			want := StateRunning
+			if tt.wantErr {
+				// A rejected map must not reach the driver
+				want = StateCheckpointed
+			}
+			expectState(t, c, pid, want)
+		})
+	}
+}
+
+func TestReadUsedGPUs(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := ReadUsedGPUs(dir); err == nil {
+		t.Fatal("ReadUsedGPUs succeeded without a gpu-devices.json")
+	}
+
+	data := `[{"index": 0, "uuid": "` + FormatUUID(simGPU0) + `"}, {"index": 1, "uuid": "` + FormatUUID(simGPU1) + `"}]`
+	if err := os.WriteFile(filepath.Join(dir, GPUDevicesFile), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	used, err := ReadUsedGPUs(dir)
+	if err != nil {
+		t.Fatalf("ReadUsedGPUs: %v", err)
+	}
+	if len(used) != 2 || used[0] != simGPU0 || used[1] != simGPU1 {
+		t.Fatalf("ReadUsedGPUs = %v, want [%s %s]", used, FormatUUID(simGPU0), FormatUUID(simGPU1))
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, GPUDevicesFile), []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadUsedGPUs(dir); err == nil {
+		t.Fatal("ReadUsedGPUs accepted an empty GPU list")
+	}
+}
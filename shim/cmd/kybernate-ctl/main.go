@@ -5,19 +5,41 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/kybernate/kybernate/pkg/cgroup"
+	"github.com/kybernate/kybernate/pkg/compat"
+	"github.com/kybernate/kybernate/pkg/config"
 	"github.com/kybernate/kybernate/pkg/cuda"
+	"github.com/kybernate/kybernate/pkg/journal"
+	"github.com/kybernate/kybernate/pkg/logging"
+	"github.com/kybernate/kybernate/pkg/manifest"
+	"github.com/kybernate/kybernate/pkg/oplock"
+	"github.com/kybernate/kybernate/pkg/readiness"
+	"github.com/kybernate/kybernate/pkg/suspend"
 )
 
-const (
-	defaultCheckpointDir = "/var/lib/kybernate/checkpoints"
+// tool names the log file of kybernate-ctl
+const tool = "kybernate-ctl"
+
+var (
+	// conf locates runc, the checkpoints and the state directories
+	conf *config.Config
+	// logger logs as configured by setupLogging, under the correlation ID
+	logger = logging.Discard
+	// commandLogger is logger without the correlation ID
+	commandLogger = logging.Discard
+	// correlation names the operation of this command in the logs of the
+	// shim, kybernate-runtime and kybernate-ctl
+	correlation string
 )
 
 func main() {
@@ -26,11 +48,27 @@ func main() {
 		os.Exit(1)
 	}
 
+	var confErr error
+	conf, confErr = config.Load("")
+	setupLogging(os.Args[1])
+	setCorrelation(logging.CorrelationFromEnv())
+	if confErr != nil {
+		warn("invalid configuration, using the built-in profile", confErr)
+	}
+
+	if conf.Features.Reconcile {
+		reconcile()
+	}
+
 	switch os.Args[1] {
 	case "checkpoint":
 		checkpointCmd(os.Args[2:])
 	case "restore":
 		restoreCmd(os.Args[2:])
+	case "suspend":
+		suspendCmd(os.Args[2:])
+	case "resume":
+		resumeCmd(os.Args[2:])
 	case "list":
 		listCmd(os.Args[2:])
 	case "status":
@@ -42,19 +80,23 @@ func main() {
 }
 
 func printUsage() {
-	fmt.Println(`kybernate-ctl - GPU Container Checkpoint Manager
+	fmt.Print(`kybernate-ctl - GPU Container Checkpoint Manager
 
 Usage:
-  kybernate-ctl checkpoint -n <namespace> -p <pod> -c <container>
-  kybernate-ctl restore -n <namespace> -p <pod> -c <container> --from <checkpoint-path>
+  kybernate-ctl checkpoint -n <namespace> -p <pod> -c <container> [--timeout 60s] [--raise-memory-limit] [--lock-mode skip|wait]
+  kybernate-ctl restore -n <namespace> -p <pod> -c <container> --from <checkpoint-path> [--timeout 60s] [--compat-policy warn|enforce|strict]
+  kybernate-ctl suspend -n <namespace> -p <pod> -c <container> [--freeze] [--timeout 60s] [--raise-memory-limit] [--lock-mode skip|wait]
+  kybernate-ctl resume -n <namespace> -p <pod> -c <container> [--timeout 60s] [--lock-mode skip|wait]
   kybernate-ctl list [-n <namespace>]
   kybernate-ctl status -n <namespace> -p <pod> -c <container>
 
 Commands:
   checkpoint   Create a GPU-aware checkpoint of a container
   restore      Restore a container from a checkpoint
-  list         List available checkpoints
-  status       Show checkpoint status of a container
+  suspend      Park a container's VRAM in host memory, keeping it in place
+  resume       Bring a suspended container's VRAM back
+  list         List available checkpoints and suspended containers
+  status       Show checkpoint and suspend status of a container
 
 Examples:
   # Checkpoint a GPU container
@@ -63,6 +105,10 @@ Examples:
   # Restore from checkpoint
   kybernate-ctl restore -n kybernate-system -p gpu-test -c cuda --from /var/lib/kybernate/checkpoints/...
 
+  # Free the GPU while keeping the container, then bring it back
+  kybernate-ctl suspend -n kybernate-system -p gpu-test -c cuda --freeze
+  kybernate-ctl resume -n kybernate-system -p gpu-test -c cuda
+
   # List all checkpoints
   kybernate-ctl list
 `)
@@ -73,7 +119,12 @@ func checkpointCmd(args []string) {
 	namespace := fs.String("n", "default", "Namespace")
 	pod := fs.String("p", "", "Pod name")
 	container := fs.String("c", "", "Container name")
-	outputDir := fs.String("o", defaultCheckpointDir, "Output directory")
+	outputDir := fs.String("o", conf.Paths.CheckpointDir, "Output directory")
+	defaults := defaultTimeouts()
+	timeout := fs.Duration("timeout", defaults.Checkpoint, "Timeout for the CUDA checkpoint of all GPU processes")
+	restoreTimeout := fs.Duration("restore-timeout", defaults.Restore, "Timeout for the CUDA restore of the GPU processes after the CRIU checkpoint")
+	raiseLimit := fs.Bool("raise-memory-limit", defaultOffload().RaiseLimit, "Temporarily raise the container memory limit if VRAM does not fit")
+	lockMode := fs.String("lock-mode", string(defaultLockMode()), "If another tool holds the container: skip or wait")
 	fs.Parse(args)
 
 	if *pod == "" || *container == "" {
@@ -91,11 +142,15 @@ func checkpointCmd(args []string) {
 		os.Exit(1)
 	}
 	fmt.Printf("Container ID: %s\n", containerID)
-
-	// Step 2: Find GPU process
-	gpuPID := findGPUProcess(containerID)
-	if gpuPID > 0 {
-		fmt.Printf("GPU Process PID: %d\n", gpuPID)
+	fmt.Printf("Correlation ID: %s\n", correlation)
+	logger = logger.With(logging.KeyContainer, containerID)
+	lock := acquireLock(containerID, "checkpoint", *lockMode, *timeout)
+	defer lock.Release()
+
+	// Step 2: Find GPU processes
+	gpuPIDs := findGPUProcesses(containerID)
+	if len(gpuPIDs) > 0 {
+		fmt.Printf("GPU Process PIDs: %s\n", formatPIDs(gpuPIDs))
 	} else {
 		fmt.Println("No GPU process detected (CPU-only checkpoint)")
 	}
@@ -109,52 +164,123 @@ func checkpointCmd(args []string) {
 	}
 	fmt.Printf("Checkpoint path: %s\n", checkpointPath)
 	fmt.Println()
+	logger.Info("Checkpointing container", "path", checkpointPath, logging.KeyPIDs, gpuPIDs)
+
+	start := time.Now()
+	meta := manifest.New("kybernate-ctl", checkpointPath)
+	meta.Workload = manifest.Workload{
+		Namespace:   *namespace,
+		Pod:         *pod,
+		Container:   *container,
+		ContainerID: containerID,
+		Image:       getContainerImage(containerID),
+	}
+	meta.CorrelationID = correlation
+
+	// A raised memory limit is put back before exiting
+	var offload *cuda.OffloadReservation
+	var op *journal.Operation
+	releaseOffload := func() {
+		if err := offload.Release(); err != nil {
+			warn("memory limit not restored", err)
+		}
+	}
 
 	// Step 4: CUDA Checkpoint (if GPU)
-	if gpuPID > 0 {
+	if len(gpuPIDs) > 0 {
+		// Record the GPUs in use so restore can remap onto different ones
+		processes, err := cuda.RecordProcesses(checkpointPath, gpuPIDs)
+		if err != nil {
+			warn("could not record GPU processes", err)
+		}
+		for _, dev := range cuda.UnionGPUs(processes) {
+			fmt.Printf("GPU %d: %s (%s, %d MiB)\n", dev.Index, dev.UUID, dev.Name, dev.MemoryTotal/(1024*1024))
+		}
+
+		// Refuse before locking if the device memory cannot fit into host memory
+		offload, err = cuda.PreflightOffload(gpuPIDs, cuda.OffloadOptions{RaiseLimit: *raiseLimit})
+		if err != nil {
+			fail("Host memory preflight failed", err)
+		}
+		fmt.Printf("Host memory: %s\n", offload)
+		meta.Sizes.VRAM = offload.Bytes
+
+		op, err = journal.New(conf.JournalDir()).Begin(containerID, "kybernate-ctl", gpuPIDs, checkpointPath)
+		if err != nil {
+			warn("could not start journal", err)
+		}
+		record(op, journal.StageLocked, nil)
+
 		fmt.Println("[Stage 1/2] CUDA Checkpoint (VRAM → RAM)...")
-		if err := cudaCheckpoint(gpuPID); err != nil {
+		stageStart := time.Now()
+		if err := cudaCheckpoint(gpuPIDs, *timeout); err != nil {
 			fmt.Printf("CUDA checkpoint failed: %v\n", err)
+			logger.Error("CUDA checkpoint failed", logging.KeyStage, "cuda-checkpoint", logging.KeyPIDs, gpuPIDs, logging.Err(err))
+			record(op, journal.StageRolledBack, err)
+			releaseOffload()
 			os.Exit(1)
 		}
+		meta.Timings.CUDACheckpoint = time.Since(stageStart)
+		logger.Info("CUDA checkpoint successful", logging.KeyStage, "cuda-checkpoint", logging.KeyPIDs, gpuPIDs, logging.KeyDuration, meta.Timings.CUDACheckpoint)
+		record(op, journal.StageCUDACheckpointed, nil)
+		ckpt, _ := cuda.NewCheckpointer()
+		meta.GPU = manifest.DescribeGPU(ckpt, gpuPIDs, processes)
 		fmt.Println("✓ CUDA checkpoint successful - VRAM transferred to RAM")
 		fmt.Println()
 	}
 
+	// Record the node, restores are checked against it
+	meta.Host = describeHost(containerID, gpuPIDs, meta.GPU)
+
 	// Step 5: CRIU Checkpoint (RAM → Disk)
 	fmt.Println("[Stage 2/2] CRIU Checkpoint (RAM → Disk)...")
+	stageStart := time.Now()
 	if err := criuCheckpoint(containerID, checkpointPath); err != nil {
 		fmt.Printf("CRIU checkpoint failed: %v\n", err)
+		logger.Error("CRIU checkpoint failed", logging.KeyStage, "criu-dump", logging.Err(err))
 		// Try to restore CUDA state
-		if gpuPID > 0 {
-			_ = cudaRestore(gpuPID)
+		if len(gpuPIDs) > 0 {
+			if restoreErr := cudaRestore(gpuPIDs, *restoreTimeout); restoreErr != nil {
+				warn("GPU processes left checkpointed", restoreErr)
+			} else {
+				record(op, journal.StageRolledBack, err)
+			}
 		}
+		releaseOffload()
 		os.Exit(1)
 	}
+	meta.Timings.CRIUDump = time.Since(stageStart)
+	logger.Info("CRIU checkpoint successful", logging.KeyStage, "criu-dump", logging.KeyDuration, meta.Timings.CRIUDump)
+	record(op, journal.StageCRIUDone, nil)
 	fmt.Println("✓ CRIU checkpoint successful - container state saved to disk")
 	fmt.Println()
 
+	// The container was left running: bring its VRAM back
+	if len(gpuPIDs) > 0 {
+		latency := op.SinceCheckpoint()
+		if err := cudaRestore(gpuPIDs, *restoreTimeout); err != nil {
+			warn("GPU processes left checkpointed", err)
+		} else {
+			meta.Timings.SnapshotToResume = latency
+			record(op, journal.StageResumed, nil)
+			logger.Info("GPU processes resumed", logging.KeyPIDs, gpuPIDs, "snapshotToResume", latency)
+			fmt.Printf("✓ GPU processes resumed - snapshot-to-resume latency %s\n", latency.Round(time.Millisecond))
+			fmt.Println()
+		}
+	}
+	releaseOffload()
+
 	// Step 6: Save metadata
-	metadata := map[string]interface{}{
-		"namespace":      *namespace,
-		"pod":            *pod,
-		"container":      *container,
-		"containerID":    containerID,
-		"gpuPID":         gpuPID,
-		"timestamp":      timestamp,
-		"checkpointPath": checkpointPath,
-	}
-	metadataPath := filepath.Join(checkpointPath, "kybernate-metadata.json")
-	metadataJSON, _ := json.MarshalIndent(metadata, "", "  ")
-	os.WriteFile(metadataPath, metadataJSON, 0644)
+	meta.Timings.Total = time.Since(start)
+	if err := meta.Write(checkpointPath); err != nil {
+		warn("could not write checkpoint manifest", err)
+	}
+	logger.Info("Checkpoint complete", "path", checkpointPath, logging.KeyDuration, meta.Timings.Total)
 
 	fmt.Println("=" + strings.Repeat("=", 50))
 	fmt.Printf("✓ Checkpoint complete: %s\n", checkpointPath)
 
-	// Show disk usage
-	cmd := exec.Command("du", "-sh", checkpointPath)
-	output, _ := cmd.Output()
-	fmt.Printf("  Size: %s", output)
+	fmt.Printf("  Size: %s\n", cgroup.FormatBytes(meta.Sizes.Checkpoint))
 }
 
 func restoreCmd(args []string) {
@@ -163,6 +289,8 @@ func restoreCmd(args []string) {
 	pod := fs.String("p", "", "Pod name")
 	container := fs.String("c", "", "Container name")
 	from := fs.String("from", "", "Checkpoint path to restore from")
+	timeout := fs.Duration("timeout", defaultTimeouts().Restore, "Timeout for the CUDA restore of all GPU processes")
+	compatPolicy := fs.String("compat-policy", string(defaultCompatPolicy()), "Refuse restores onto a node unlike the checkpoint's: warn, enforce or strict")
 	fs.Parse(args)
 
 	if *from == "" {
@@ -174,19 +302,32 @@ func restoreCmd(args []string) {
 	fmt.Println("=" + strings.Repeat("=", 50))
 
 	// Load metadata
-	metadataPath := filepath.Join(*from, "kybernate-metadata.json")
-	metadataJSON, err := os.ReadFile(metadataPath)
+	meta, err := manifest.Read(*from)
 	if err != nil {
-		fmt.Printf("Error reading metadata: %v\n", err)
-		os.Exit(1)
+		fail("Error reading metadata", err)
+	}
+	// The restore logs under the checkpoint's ID unless given one
+	if os.Getenv(logging.CorrelationEnv) == "" && meta.CorrelationID != "" {
+		setCorrelation(meta.CorrelationID)
+	}
+	fmt.Printf("Original pod: %s (checkpointed by %s at %s)\n", meta.Workload, meta.Tool, meta.CreatedAt.Format(time.RFC3339))
+	fmt.Printf("Correlation ID: %s\n", correlation)
+	logger.Info("Restoring checkpoint", "path", *from, "workload", meta.Workload.String())
+	if meta.Degraded != nil {
+		warn(fmt.Sprintf("checkpoint is degraded, GPU state was not captured (%s failed)", meta.Degraded.Phase), errors.New(meta.Degraded.Error))
 	}
 
-	var metadata map[string]interface{}
-	json.Unmarshal(metadataJSON, &metadata)
-	fmt.Printf("Original pod: %s/%s/%s\n", metadata["namespace"], metadata["pod"], metadata["container"])
+	// A degraded checkpoint holds running CUDA processes, there is nothing to restore
+	hasGPU := meta.GPU != nil && meta.Degraded == nil
 
-	containerID := metadata["containerID"].(string)
-	gpuPID := int(metadata["gpuPID"].(float64))
+	policy, err := compat.ParsePolicy(*compatPolicy, compat.DefaultPolicy)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := checkCompat(meta, hasGPU, policy); err != nil {
+		fail("Refusing restore", err)
+	}
 
 	// Step 1: CRIU Restore (Disk → RAM)
 	fmt.Println()
@@ -195,6 +336,7 @@ func restoreCmd(args []string) {
 	newContainerID, newPID, err := criuRestore(*from, *namespace, *pod, *container)
 	if err != nil {
 		fmt.Printf("CRIU restore failed: %v\n", err)
+		logger.Error("CRIU restore failed", logging.KeyStage, "criu-restore", logging.Err(err))
 		fmt.Println()
 		fmt.Println("Note: Full restore requires Kubernetes CRI restore support.")
 		fmt.Println("Alternative: Create a new pod and use 'kybernate-ctl cuda-restore <pid>'")
@@ -203,31 +345,162 @@ func restoreCmd(args []string) {
 	fmt.Printf("✓ Container restored: %s (PID: %d)\n", newContainerID, newPID)
 
 	// Step 2: CUDA Restore (if GPU)
-	if gpuPID > 0 && newPID > 0 {
+	if hasGPU && newPID > 0 {
 		fmt.Println()
 		fmt.Println("[Stage 2/2] CUDA Restore (RAM → VRAM)...")
-		if err := cudaRestore(newPID); err != nil {
-			fmt.Printf("CUDA restore failed: %v\n", err)
-			os.Exit(1)
+		stageStart := time.Now()
+		if err := cudaRestoreOnto(newContainerID, newPID, *from, *timeout); err != nil {
+			fail("CUDA restore failed", err)
 		}
+		logger.Info("CUDA restore successful", logging.KeyStage, "cuda-restore", logging.KeyPID, newPID, logging.KeyDuration, time.Since(stageStart))
 		fmt.Println("✓ CUDA restore successful - VRAM restored")
 	}
 
 	fmt.Println()
 	fmt.Println("=" + strings.Repeat("=", 50))
 	fmt.Printf("✓ Restore complete\n")
-	_ = containerID // Used in future implementation
+}
+
+func suspendCmd(args []string) {
+	fs := flag.NewFlagSet("suspend", flag.ExitOnError)
+	namespace := fs.String("n", "default", "Namespace")
+	pod := fs.String("p", "", "Pod name")
+	container := fs.String("c", "", "Container name")
+	freeze := fs.Bool("freeze", false, "Also freeze the container's cgroup")
+	defaults := defaultTimeouts()
+	timeout := fs.Duration("timeout", defaults.Checkpoint, "Timeout for the CUDA checkpoint of all GPU processes")
+	raiseLimit := fs.Bool("raise-memory-limit", defaultOffload().RaiseLimit, "Temporarily raise the container memory limit if VRAM does not fit")
+	stateDir := fs.String("state-dir", conf.SuspendDir(), "Directory of suspended container records")
+	lockMode := fs.String("lock-mode", string(defaultLockMode()), "If another tool holds the container: skip or wait")
+	fs.Parse(args)
+
+	if *pod == "" || *container == "" {
+		fmt.Println("Error: pod and container are required")
+		os.Exit(1)
+	}
+
+	fmt.Printf("Suspending %s/%s/%s\n", *namespace, *pod, *container)
+	fmt.Println("=" + strings.Repeat("=", 50))
+
+	containerID, err := getContainerID(*namespace, *pod, *container)
+	if err != nil {
+		fmt.Printf("Error getting container ID: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Container ID: %s\n", containerID)
+	fmt.Printf("Correlation ID: %s\n", correlation)
+	logger = logger.With(logging.KeyContainer, containerID)
+	lock := acquireLock(containerID, "suspend", *lockMode, *timeout)
+	defer lock.Release()
+
+	gpuPIDs := findGPUProcesses(containerID)
+	if len(gpuPIDs) == 0 {
+		fmt.Println("Error: no GPU process found, nothing to suspend")
+		os.Exit(1)
+	}
+	fmt.Printf("GPU Process PIDs: %s\n", formatPIDs(gpuPIDs))
+
+	ckpt, err := cuda.NewCheckpointer()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	rec := &suspend.Record{
+		ContainerID: containerID,
+		Namespace:   *namespace,
+		Pod:         *pod,
+		Container:   *container,
+		Source:      "kybernate-ctl",
+	}
+	opts := suspend.Options{
+		Freeze:   *freeze,
+		Offload:  cuda.OffloadOptions{RaiseLimit: *raiseLimit},
+		Timeouts: cuda.Timeouts{Checkpoint: *timeout, Restore: defaults.Restore},
+	}
+	start := time.Now()
+	if err := suspend.Suspend(context.Background(), ckpt, suspend.NewStore(*stateDir), rec, gpuPIDs, opts); err != nil {
+		fail("Suspend failed", err)
+	}
+	logger.Info("Container suspended", logging.KeyPIDs, gpuPIDs, logging.KeyDuration, time.Since(start), "vram", cgroup.FormatBytes(rec.VRAMBytes))
+
+	if rec.Offload.Raised() {
+		fmt.Printf("Host memory: %s\n", rec.Offload)
+	}
+	fmt.Printf("VRAM parked in host memory: %s\n", cgroup.FormatBytes(rec.VRAMBytes))
+	if rec.Freezer != nil {
+		fmt.Printf("Frozen cgroup: %s\n", rec.Freezer)
+	}
+	fmt.Println()
+	fmt.Println("=" + strings.Repeat("=", 50))
+	fmt.Println("✓ Container suspended")
+}
+
+func resumeCmd(args []string) {
+	fs := flag.NewFlagSet("resume", flag.ExitOnError)
+	namespace := fs.String("n", "default", "Namespace")
+	pod := fs.String("p", "", "Pod name")
+	container := fs.String("c", "", "Container name")
+	defaults := defaultTimeouts()
+	timeout := fs.Duration("timeout", defaults.Restore, "Timeout for the CUDA restore of all GPU processes")
+	stateDir := fs.String("state-dir", conf.SuspendDir(), "Directory of suspended container records")
+	lockMode := fs.String("lock-mode", string(defaultLockMode()), "If another tool holds the container: skip or wait")
+	fs.Parse(args)
+
+	if *pod == "" || *container == "" {
+		fmt.Println("Error: pod and container are required")
+		os.Exit(1)
+	}
+
+	fmt.Printf("Resuming %s/%s/%s\n", *namespace, *pod, *container)
+	fmt.Println("=" + strings.Repeat("=", 50))
+
+	containerID, err := getContainerID(*namespace, *pod, *container)
+	if err != nil {
+		fmt.Printf("Error getting container ID: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Container ID: %s\n", containerID)
+	fmt.Printf("Correlation ID: %s\n", correlation)
+	logger = logger.With(logging.KeyContainer, containerID)
+	lock := acquireLock(containerID, "resume", *lockMode, *timeout)
+	defer lock.Release()
+
+	ckpt, err := cuda.NewCheckpointer()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	start := time.Now()
+	opts := suspend.Options{Timeouts: cuda.Timeouts{Checkpoint: defaults.Checkpoint, Restore: *timeout}}
+	rec, err := suspend.Resume(context.Background(), ckpt, suspend.NewStore(*stateDir), containerID, opts)
+	if err != nil {
+		fail("Resume failed", err)
+	}
+	logger.Info("Container resumed", logging.KeyPIDs, rec.PIDs, logging.KeyDuration, time.Since(start))
+
+	fmt.Printf("GPU Process PIDs: %s\n", formatPIDs(rec.PIDs))
+	fmt.Printf("Suspended for: %s\n", start.Sub(rec.SuspendedAt).Round(time.Second))
+	fmt.Printf("Resume took: %s\n", time.Since(start).Round(time.Millisecond))
+	if rec.ReleaseError != "" {
+		warn("memory limit not restored", errors.New(rec.ReleaseError))
+	}
+	fmt.Println()
+	fmt.Println("=" + strings.Repeat("=", 50))
+	fmt.Println("✓ Container resumed")
 }
 
 func listCmd(args []string) {
 	fs := flag.NewFlagSet("list", flag.ExitOnError)
 	namespace := fs.String("n", "", "Filter by namespace")
+	stateDir := fs.String("state-dir", conf.SuspendDir(), "Directory of suspended container records")
 	fs.Parse(args)
 
 	fmt.Println("Available checkpoints:")
 	fmt.Println("=" + strings.Repeat("=", 70))
 
-	baseDir := defaultCheckpointDir
+	baseDir := conf.Paths.CheckpointDir
 	if *namespace != "" {
 		baseDir = filepath.Join(baseDir, *namespace)
 	}
@@ -236,21 +509,43 @@ func listCmd(args []string) {
 		if err != nil || !info.IsDir() {
 			return nil
 		}
-		metadataPath := filepath.Join(path, "kybernate-metadata.json")
-		if _, err := os.Stat(metadataPath); err == nil {
-			metadataJSON, _ := os.ReadFile(metadataPath)
-			var metadata map[string]interface{}
-			json.Unmarshal(metadataJSON, &metadata)
-
-			fmt.Printf("%-50s %s/%s/%s\n",
-				path,
-				metadata["namespace"],
-				metadata["pod"],
-				metadata["container"],
-			)
+		meta, err := manifest.Read(path)
+		if err != nil {
+			if !errors.Is(err, manifest.ErrNotFound) {
+				fmt.Printf("%-50s invalid: %v\n", path, err)
+			}
+			return nil
+		}
+		status := ""
+		if meta.Degraded != nil {
+			status = " (degraded)"
 		}
+		fmt.Printf("%-50s %s%s\n", path, meta.Workload, status)
 		return nil
 	})
+
+	records, err := suspend.NewStore(*stateDir).List()
+	if err != nil {
+		warn("could not read suspended containers", err)
+		return
+	}
+	var suspended []*suspend.Record
+	for _, rec := range records {
+		if *namespace == "" || rec.Namespace == *namespace {
+			suspended = append(suspended, rec)
+		}
+	}
+	if len(suspended) == 0 {
+		return
+	}
+
+	fmt.Println()
+	fmt.Println("Suspended containers:")
+	fmt.Println("=" + strings.Repeat("=", 70))
+	for _, rec := range suspended {
+		fmt.Printf("%-50s %s, since %s\n", rec.Name(), cgroup.FormatBytes(rec.VRAMBytes),
+			rec.SuspendedAt.Format(time.RFC3339))
+	}
 }
 
 func statusCmd(args []string) {
@@ -258,6 +553,7 @@ func statusCmd(args []string) {
 	namespace := fs.String("n", "default", "Namespace")
 	pod := fs.String("p", "", "Pod name")
 	container := fs.String("c", "", "Container name")
+	stateDir := fs.String("state-dir", conf.SuspendDir(), "Directory of suspended container records")
 	fs.Parse(args)
 
 	if *pod == "" || *container == "" {
@@ -274,27 +570,52 @@ func statusCmd(args []string) {
 	fmt.Printf("Container: %s/%s/%s\n", *namespace, *pod, *container)
 	fmt.Printf("Container ID: %s\n", containerID)
 
-	gpuPID := findGPUProcess(containerID)
-	if gpuPID > 0 {
-		fmt.Printf("GPU Process PID: %d\n", gpuPID)
+	if owner, err := oplock.Holder(conf.LockDir(), containerID); err != nil {
+		warn("could not read lock", err)
+	} else if owner != nil {
+		fmt.Printf("Busy: %s\n", owner)
+	}
 
-		ckpt, err := cuda.NewCheckpointer()
-		if err == nil {
-			state, err := ckpt.GetState(gpuPID)
-			if err == nil {
-				fmt.Printf("CUDA State: %s\n", state)
-			}
+	if rec, err := suspend.NewStore(*stateDir).Load(containerID); err != nil {
+		warn("could not read suspend record", err)
+	} else if rec != nil {
+		fmt.Printf("Suspended: since %s (%s ago)\n", rec.SuspendedAt.Format(time.RFC3339),
+			time.Since(rec.SuspendedAt).Round(time.Second))
+		fmt.Printf("  VRAM in host memory: %s\n", cgroup.FormatBytes(rec.VRAMBytes))
+		if rec.Freezer != nil {
+			fmt.Printf("  Frozen cgroup: %s\n", rec.Freezer)
 		}
+		if rec.Offload.Raised() {
+			fmt.Printf("  Host memory: %s\n", rec.Offload)
+		}
+	} else {
+		fmt.Println("Suspended: no")
+	}
+
+	if st, err := readiness.NewStore(conf.RestoreDir()).Load(containerID); err != nil {
+		warn("could not read restore status", err)
+	} else if st != nil {
+		fmt.Printf("GPU restore: %s\n", st)
+	}
+
+	gpuPIDs := findGPUProcesses(containerID)
+	if len(gpuPIDs) > 0 {
+		ckpt, ckptErr := cuda.NewCheckpointer()
+		processes, _ := cuda.FindGPUProcesses()
+		for _, gpuPID := range gpuPIDs {
+			fmt.Printf("GPU Process PID: %d\n", gpuPID)
+
+			if ckptErr == nil {
+				state, err := ckpt.GetState(gpuPID)
+				if err == nil {
+					fmt.Printf("  CUDA State: %s\n", state)
+				}
+			}
 
-		// Show GPU memory
-		cmd := exec.Command("nvidia-smi", "--query-compute-apps=pid,used_memory",
-			"--format=csv,noheader")
-		output, _ := cmd.Output()
-		for _, line := range strings.Split(string(output), "\n") {
-			if strings.Contains(line, fmt.Sprintf("%d", gpuPID)) {
-				parts := strings.Split(line, ",")
-				if len(parts) >= 2 {
-					fmt.Printf("GPU Memory: %s\n", strings.TrimSpace(parts[1]))
+			// Show GPU memory
+			for _, proc := range processes {
+				if proc.PID == gpuPID {
+					fmt.Printf("  GPU Memory: %d MiB (%s)\n", proc.UsedMemory/(1024*1024), proc.GPUUUID)
 				}
 			}
 		}
@@ -305,6 +626,122 @@ func statusCmd(args []string) {
 
 // Helper functions
 
+// setupLogging configures logger from conf and the KYBERNATE_LOG_*
+// variables for command. Records only go to the log file; if none can be
+// opened, nothing is logged, as the terminal belongs to the command's
+// output.
+func setupLogging(command string) {
+	def, confErr := conf.Logging(tool, logging.Config{
+		Level:      slog.LevelInfo,
+		Output:     logging.OutputFile,
+		Format:     logging.FormatText,
+		MaxSize:    logging.DefaultMaxSize,
+		MaxBackups: logging.DefaultMaxBackups,
+	})
+	cfg, cfgErr := logging.ConfigFromEnv(def)
+	l, _, err := logging.New(cfg, "kybernate-ctl", config.FallbackLogFile(tool))
+	if err != nil {
+		return
+	}
+	commandLogger = l.With("command", command)
+	logger = commandLogger
+	if confErr != nil {
+		warn("invalid log configuration", confErr)
+	}
+	if cfgErr != nil {
+		warn("invalid log configuration", cfgErr)
+	}
+}
+
+// setCorrelation makes id the correlation ID of this command, also for
+// the commands it runs
+func setCorrelation(id string) {
+	correlation = id
+	os.Setenv(logging.CorrelationEnv, id)
+	logger = commandLogger.With(logging.KeyCorrelation, id)
+}
+
+// warn reports a problem that does not stop the command
+func warn(msg string, err error) {
+	fmt.Printf("Warning: %s: %v\n", msg, err)
+	logger.Warn(msg, logging.Err(err))
+}
+
+// fail reports the error that stops the command and exits
+func fail(msg string, err error) {
+	fmt.Printf("%s: %v\n", msg, err)
+	logger.Error(msg, logging.Err(err))
+	os.Exit(1)
+}
+
+// reconcile closes checkpoints left open by a crashed shim, runtime
+// wrapper or kybernate-ctl before running any command
+func reconcile() {
+	ckpt, err := cuda.NewCheckpointer()
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeouts().Restore)
+	defer cancel()
+
+	results, err := journal.Reconcile(ctx, ckpt, journal.New(conf.JournalDir()), "kybernate-ctl")
+	if err != nil {
+		warn("journal reconcile failed", err)
+		return
+	}
+	for _, r := range results {
+		fmt.Printf("Reconciled: %s\n", r)
+		logger.Info("Journal reconcile", "result", r.String())
+	}
+}
+
+// defaultLockMode returns the lock mode used when no flag is given,
+// taking KYBERNATE_LOCK_MODE into account
+func defaultLockMode() oplock.Mode {
+	mode, err := oplock.ModeFromEnv(oplock.ModeSkip)
+	if err != nil {
+		warn("ignoring lock mode", err)
+	}
+	return mode
+}
+
+// defaultCompatPolicy returns the compatibility policy used when no flag
+// is given, taking KYBERNATE_COMPAT_POLICY into account
+func defaultCompatPolicy() compat.Policy {
+	policy, err := compat.PolicyFromEnv(compat.DefaultPolicy)
+	if err != nil {
+		warn("ignoring compatibility policy", err)
+	}
+	return policy
+}
+
+// acquireLock takes the container's node-wide lock for op, so the shim
+// and kybernate-runtime cannot work on its GPU state at the same time. In
+// wait mode it waits at most timeout. If the container stays busy, the
+// command is skipped.
+func acquireLock(containerID, op, mode string, timeout time.Duration) *oplock.Lock {
+	m, err := oplock.ParseMode(mode, oplock.ModeSkip)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	lock, err := oplock.Acquire(ctx, conf.LockDir(), containerID, oplock.Owner{Tool: "kybernate-ctl", Op: op, Correlation: correlation}, m)
+	if err != nil {
+		fail("Skipping "+op, err)
+	}
+	return lock
+}
+
+// record appends stage to the journal of op; failures are only reported
+func record(op *journal.Operation, stage journal.Stage, cause error) {
+	if err := op.Record(stage, cause); err != nil {
+		warn(fmt.Sprintf("could not journal %s", stage), err)
+	}
+}
+
 func getContainerID(namespace, pod, container string) (string, error) {
 	cmd := exec.Command("crictl", "ps", "-q",
 		"--label", fmt.Sprintf("io.kubernetes.pod.namespace=%s", namespace),
@@ -314,14 +751,7 @@ func getContainerID(namespace, pod, container string) (string, error) {
 	output, err := cmd.Output()
 	if err != nil {
 		// Fallback to kubectl + ctr
-		cmd = exec.Command("bash", "-c", fmt.Sprintf(
-			`sudo microk8s.ctr --namespace k8s.io containers ls | grep -v pause | grep "$(kubectl get pod %s -n %s -o jsonpath='{.status.containerStatuses[?(@.name=="%s")].containerID}' | sed 's/containerd:\/\///')" | awk '{print $1}'`,
-			pod, namespace, container,
-		))
-		output, err = cmd.Output()
-		if err != nil {
-			return "", err
-		}
+		return containerIDFromPod(namespace, pod, container)
 	}
 
 	containerID := strings.TrimSpace(string(output))
@@ -331,105 +761,227 @@ func getContainerID(namespace, pod, container string) (string, error) {
 	return containerID, nil
 }
 
-func findGPUProcess(containerID string) int {
-	cmd := exec.Command("nvidia-smi", "--query-compute-apps=pid", "--format=csv,noheader")
-	output, err := cmd.Output()
+// containerIDFromPod takes the container ID from the pod's status and
+// checks with the ctr of the configuration that containerd knows it
+func containerIDFromPod(namespace, pod, container string) (string, error) {
+	if conf.Containerd.Ctr == "" {
+		return "", fmt.Errorf("crictl failed and no ctr is configured (containerd.ctr)")
+	}
+	output, err := exec.Command("kubectl", "get", "pod", pod, "-n", namespace, "-o",
+		fmt.Sprintf(`jsonpath={.status.containerStatuses[?(@.name=="%s")].containerID}`, container),
+	).Output()
+	if err != nil {
+		return "", fmt.Errorf("kubectl get pod %s: %w", pod, err)
+	}
+	// containerd://<id>
+	status := strings.TrimSpace(string(output))
+	_, containerID, _ := strings.Cut(status, "://")
+	if containerID == "" {
+		return "", fmt.Errorf("container not found")
+	}
+
+	if output, err := exec.Command(conf.Containerd.Ctr,
+		"--address", conf.Containerd.Address, "--namespace", conf.Containerd.Namespace,
+		"containers", "info", containerID,
+	).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("%s containers info %s: %v: %s", conf.Containerd.Ctr, containerID, err, strings.TrimSpace(string(output)))
+	}
+	return containerID, nil
+}
+
+// getContainerImage returns the image of a container as reported by
+// crictl, or "" if it cannot be inspected
+func getContainerImage(containerID string) string {
+	output, err := exec.Command("crictl", "inspect", "-o", "json", containerID).Output()
 	if err != nil {
-		return 0
+		return ""
+	}
+	var inspect struct {
+		Status struct {
+			Image struct {
+				Image string `json:"image"`
+			} `json:"image"`
+		} `json:"status"`
 	}
+	if err := json.Unmarshal(output, &inspect); err != nil {
+		return ""
+	}
+	return inspect.Status.Image.Image
+}
 
-	// Also get the container's init PID from runc state
-	statePath := fmt.Sprintf("/run/containerd/runc/k8s.io/%s/state.json", containerID)
-	stateData, err := os.ReadFile(statePath)
+// defaultTimeouts returns the CUDA timeouts used when no flag is given,
+// taking KYBERNATE_CUDA_*_TIMEOUT into account
+func defaultTimeouts() cuda.Timeouts {
+	timeouts, err := cuda.TimeoutsFromEnv(conf.Timeouts)
 	if err != nil {
-		return 0
+		warn("ignoring CUDA timeouts", err)
 	}
+	return timeouts
+}
+
+// defaultOffload returns the VRAM offload options used when no flag is
+// given, taking KYBERNATE_RAISE_MEMORY_LIMIT into account
+func defaultOffload() cuda.OffloadOptions {
+	opts, err := cuda.OffloadOptionsFromEnv(cuda.OffloadOptions{})
+	if err != nil {
+		warn("ignoring offload options", err)
+	}
+	return opts
+}
 
+// findGPUProcesses returns all GPU processes of a container: those in its
+// cgroup and those in the process tree of its init process
+func findGPUProcesses(containerID string) []int {
+	// The container's init PID from runc state, if it is there
 	var state struct {
 		InitProcessPID int `json:"init_process_pid"`
 	}
-	json.Unmarshal(stateData, &state)
-	initPID := state.InitProcessPID
+	statePath := filepath.Join(conf.RuncRoot(), containerID, "state.json")
+	if stateData, err := os.ReadFile(statePath); err == nil {
+		json.Unmarshal(stateData, &state)
+	}
 
-	for _, line := range strings.Split(string(output), "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-		var pid int
-		fmt.Sscanf(line, "%d", &pid)
+	pids, err := cuda.FindGPUProcessesAmong(cuda.ContainerProcesses(containerID, state.InitProcessPID))
+	if err != nil {
+		return nil
+	}
+	return pids
+}
 
-		// Check if PID belongs to this container via cgroup
-		cgroupPath := fmt.Sprintf("/proc/%d/cgroup", pid)
-		data, err := os.ReadFile(cgroupPath)
-		if err != nil {
-			continue
-		}
-		if strings.Contains(string(data), containerID) {
-			return pid
-		}
+// describeHost records this node for a checkpoint of the container,
+// with the libraries mounted into it and the GPUs its workload uses
+func describeHost(containerID string, gpuPIDs []int, gpu *manifest.GPU) *compat.Host {
+	var uuids []string
+	if gpu != nil {
+		uuids = gpu.UUIDs
+	}
+	pids := gpuPIDs
+	if len(pids) == 0 {
+		pids = cuda.ContainerProcesses(containerID, 0)
+	}
+	if len(pids) == 0 {
+		return compat.Describe(nil, uuids)
+	}
+	return compat.ForProcess(pids[0], uuids)
+}
 
-		// Also check if PID is a child of init process
-		ppidPath := fmt.Sprintf("/proc/%d/stat", pid)
-		ppidData, err := os.ReadFile(ppidPath)
-		if err != nil {
-			continue
-		}
-		// Parse PPID from stat file (4th field)
-		fields := strings.Fields(string(ppidData))
-		if len(fields) > 3 {
-			var ppid int
-			fmt.Sscanf(fields[3], "%d", &ppid)
-			if ppid == initPID {
-				return pid
-			}
-		}
+// checkCompat compares this node with the checkpoint's and returns an
+// error if policy refuses the restore
+func checkCompat(meta *manifest.Manifest, gpuState bool, policy compat.Policy) error {
+	if meta.Host == nil {
+		fmt.Println("Checkpoint records no node, skipping compatibility check")
+		return nil
+	}
+	report := compat.Compare(meta.Host, compat.Probe(), gpuState)
+	fmt.Printf("Node compatibility: %s\n", report.Level)
+	for _, f := range report.Findings {
+		fmt.Printf("  %s\n", f)
+	}
+	logger.Info("Node compatibility checked", "level", report.Level.String(), "policy", string(policy), "findings", report.Summary())
+	return report.Check(policy)
+}
+
+func formatPIDs(pids []int) string {
+	parts := make([]string, 0, len(pids))
+	for _, pid := range pids {
+		parts = append(parts, fmt.Sprintf("%d", pid))
 	}
-	return 0
+	return strings.Join(parts, ", ")
 }
 
-func cudaCheckpoint(pid int) error {
+// cudaCheckpoint locks all GPU processes, then checkpoints all of them.
+// On failure every process is left running.
+func cudaCheckpoint(pids []int, timeout time.Duration) error {
 	ckpt, err := cuda.NewCheckpointer()
 	if err != nil {
 		return err
 	}
 
-	state, err := ckpt.GetState(pid)
+	for _, pid := range pids {
+		state, err := ckpt.GetState(pid)
+		if err != nil {
+			return err
+		}
+		if state != cuda.StateRunning {
+			return fmt.Errorf("process %d not in running state: %s", pid, state)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return ckpt.CheckpointGroup(ctx, pids)
+}
+
+// cudaRestore brings checkpointed GPU processes back to running, all or none
+func cudaRestore(pids []int, timeout time.Duration) error {
+	ckpt, err := cuda.NewCheckpointer()
 	if err != nil {
 		return err
 	}
 
-	if state != cuda.StateRunning {
-		return fmt.Errorf("process not in running state: %s", state)
+	checkpointed := ckpt.ProcessesInState(pids, cuda.StateCheckpointed)
+	if len(checkpointed) == 0 {
+		return fmt.Errorf("no process in checkpointed state")
 	}
 
-	return ckpt.CheckpointFull(pid, 60000)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return ckpt.RestoreGroup(ctx, checkpointed, nil)
 }
 
-func cudaRestore(pid int) error {
+// cudaRestoreOnto restores all checkpointed processes of container id,
+// whose init process is pid, remapping their GPUs if the restored
+// container was assigned different ones
+func cudaRestoreOnto(id string, pid int, checkpointPath string, timeout time.Duration) error {
 	ckpt, err := cuda.NewCheckpointer()
 	if err != nil {
 		return err
 	}
 
-	state, err := ckpt.GetState(pid)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	pids := ckpt.ProcessesInState(cuda.ContainerProcesses(id, pid), cuda.StateCheckpointed)
+	if len(pids) == 0 {
+		return fmt.Errorf("no process in checkpointed state under PID %d", pid)
+	}
+	fmt.Printf("Checkpointed GPU processes: %s\n", formatPIDs(pids))
+
+	all, err := cuda.ListGPUs()
 	if err != nil {
-		return err
+		warn("could not list GPUs, restoring without remap", err)
+		return ckpt.RestoreGroup(ctx, pids, nil)
+	}
+
+	target := cuda.VisibleGPUs(processEnv(pid), all)
+	if len(target) == 0 {
+		target = all
 	}
 
-	if state != cuda.StateCheckpointed {
-		return fmt.Errorf("process not in checkpointed state: %s", state)
+	plan, err := ckpt.RestoreGroupOnto(ctx, pids, checkpointPath, target)
+	if plan != nil {
+		fmt.Printf("GPU assignment changed, remapped: %s\n", plan)
+		logger.Info("GPU assignment changed, remapped device memory", logging.KeyPIDs, pids, "plan", plan.String())
 	}
+	return err
+}
 
-	return ckpt.RestoreFull(pid)
+// processEnv returns the environment of a process from /proc
+func processEnv(pid int) []string {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", pid))
+	if err != nil {
+		return nil
+	}
+	return strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
 }
 
 func criuCheckpoint(containerID, checkpointPath string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, "sudo", "/snap/microk8s/current/bin/runc",
-		"--root", "/run/containerd/runc/k8s.io",
+	// The runtime, if it is kybernate-runtime, logs under the same ID
+	cmd := exec.CommandContext(ctx, "sudo", "--preserve-env="+logging.CorrelationEnv, conf.Runtime.Runc,
+		"--root", conf.RuncRoot(),
 		"checkpoint",
 		"--image-path", checkpointPath,
 		"--leave-running",
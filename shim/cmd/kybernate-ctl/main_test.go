@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kybernate/kybernate/pkg/cuda"
+)
+
+func TestFormatPIDs(t *testing.T) {
+	for _, tt := range []struct {
+		pids []int
+		want string
+	}{
+		{nil, ""},
+		{[]int{42}, "42"},
+		{[]int{42, 43, 7}, "42, 43, 7"},
+	} {
+		if got := formatPIDs(tt.pids); got != tt.want {
+			t.Errorf("formatPIDs(%v) = %q, want %q", tt.pids, got, tt.want)
+		}
+	}
+}
+
+// useSimulator selects the simulated driver for kybernate-ctl's
+// checkpointers and returns a handle on its shared state file, on which
+// the test process is a running CUDA process
+func useSimulator(t *testing.T) (*cuda.SimDriver, int) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sim.json")
+	t.Setenv(cuda.DriverEnv, cuda.DriverSim)
+	t.Setenv(cuda.SimStateEnv, path)
+
+	sim, err := cuda.OpenSimDriver(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuid, _ := cuda.ParseUUID("GPU-00000000-0000-0000-0000-000000000001")
+	if err := sim.AddDevice(uuid); err != nil {
+		t.Fatal(err)
+	}
+	pid := os.Getpid()
+	if err := sim.AddProcess(pid, "trainer", 1<<20, uuid); err != nil {
+		t.Fatal(err)
+	}
+	return sim, pid
+}
+
+func expectState(t *testing.T, sim *cuda.SimDriver, pid int, want cuda.ProcessState) {
+	t.Helper()
+	p, ok := sim.Process(pid)
+	if !ok || p.State != want {
+		t.Fatalf("simulated process: %+v, want %s", p, want)
+	}
+}
+
+func TestSuspendResume(t *testing.T) {
+	sim, pid := useSimulator(t)
+
+	if err := cudaRestore([]int{pid}, time.Second); err == nil {
+		t.Error("cudaRestore of a running process succeeded")
+	}
+	if err := cudaCheckpoint([]int{pid}, time.Second); err != nil {
+		t.Fatalf("cudaCheckpoint: %v", err)
+	}
+	expectState(t, sim, pid, cuda.StateCheckpointed)
+	if err := cudaCheckpoint([]int{pid}, time.Second); err == nil {
+		t.Error("cudaCheckpoint of a checkpointed process succeeded")
+	}
+	if err := cudaRestore([]int{pid}, time.Second); err != nil {
+		t.Fatalf("cudaRestore: %v", err)
+	}
+	expectState(t, sim, pid, cuda.StateRunning)
+}
+
+func TestRestoreFaultLeavesCheckpointed(t *testing.T) {
+	sim, pid := useSimulator(t)
+	if err := cudaCheckpoint([]int{pid}, time.Second); err != nil {
+		t.Fatalf("cudaCheckpoint: %v", err)
+	}
+	if err := sim.FailNext(cuda.SimOpRestore, cuda.ErrCodeNotReady); err != nil {
+		t.Fatal(err)
+	}
+	if err := cudaRestore([]int{pid}, time.Second); err == nil {
+		t.Fatal("cudaRestore succeeded despite the injected fault")
+	}
+	expectState(t, sim, pid, cuda.StateCheckpointed)
+}
@@ -4,29 +4,45 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/kybernate/kybernate/pkg/compat"
+	"github.com/kybernate/kybernate/pkg/config"
 	"github.com/kybernate/kybernate/pkg/cuda"
+	"github.com/kybernate/kybernate/pkg/journal"
+	"github.com/kybernate/kybernate/pkg/logging"
+	"github.com/kybernate/kybernate/pkg/manifest"
+	"github.com/kybernate/kybernate/pkg/oplock"
 )
 
-const (
-	// DefaultRuntime is the OCI runtime to delegate to
-	DefaultRuntime = "nvidia-container-runtime"
+// tool names the runtime's log file
+const tool = "kybernate-runtime"
 
-	// FallbackRuntime is used if nvidia-container-runtime is not available
-	FallbackRuntime = "runc"
+// logger logs as configured by setupLogging
+var logger = logging.Discard
 
-	// LogFile for debugging
-	LogFile = "/tmp/kybernate-runtime.log"
-)
+// conf locates the OCI runtimes and state directories
+var conf *config.Config
 
 func main() {
+	var confErr error
+	conf, confErr = config.Load("")
+	closeLog := setupLogging()
+	defer closeLog()
+	if confErr != nil {
+		logger.Warn("Invalid configuration, using the built-in profile", logging.Err(confErr))
+	}
+
 	// Find the underlying runtime
 	runtime := findRuntime()
 
@@ -49,36 +65,19 @@ func main() {
 	execRuntime(runtime, args)
 }
 
-// findRuntime returns the path to the underlying OCI runtime
+// findRuntime returns the path to the underlying OCI runtime, the first
+// of the configured delegates found
 func findRuntime() string {
-	// Check for nvidia-container-runtime first
-	if path, err := exec.LookPath(DefaultRuntime); err == nil {
-		return path
-	}
-
-	// Fall back to runc
-	if path, err := exec.LookPath(FallbackRuntime); err == nil {
-		return path
-	}
-
-	// Last resort - use absolute paths
-	for _, path := range []string{
-		"/usr/bin/nvidia-container-runtime",
-		"/usr/bin/runc",
-		"/usr/sbin/runc",
-	} {
-		if _, err := os.Stat(path); err == nil {
-			return path
-		}
+	path, err := conf.Delegate()
+	if err != nil {
+		fatal(err.Error())
 	}
-
-	fatal("no OCI runtime found")
-	return ""
+	return path
 }
 
 // handleCheckpoint intercepts checkpoint commands to perform CUDA checkpoint
 func handleCheckpoint(runtime string, args []string) {
-	debugLog("Checkpoint command detected")
+	logger.Debug("Checkpoint command detected")
 
 	// For checkpoint, we get the container ID as the last argument
 	containerID := ""
@@ -89,30 +88,146 @@ func handleCheckpoint(runtime string, args []string) {
 	// Find root path for container state
 	rootPath := findRootArg(args)
 	if rootPath == "" {
-		rootPath = "/run/containerd/runc/k8s.io"
+		rootPath = conf.RuncRoot()
 	}
 
+	var offload *cuda.OffloadReservation
+	var op *journal.Operation
+	var lock *oplock.Lock
+	// meta is written once the dump completes, if there is an image path
+	var meta *manifest.Manifest
+	start := time.Now()
+	imagePath := findImagePathArg(args)
+	restoreTimeout := conf.Timeouts.Restore
+
 	// Get container PID from state
 	pid := findContainerPIDFromState(rootPath, containerID)
 	if pid > 0 {
-		debugLog(fmt.Sprintf("Found container init PID %d for checkpoint", pid))
-
-		// Find GPU process (may be the init process or a child)
-		gpuPID := findGPUProcessPID(pid)
-		if gpuPID > 0 {
-			debugLog(fmt.Sprintf("GPU process detected (PID %d), performing CUDA checkpoint", gpuPID))
-
-			// Perform CUDA checkpoint before CRIU
-			if err := cudaCheckpoint(gpuPID); err != nil {
-				debugLog(fmt.Sprintf("CUDA checkpoint failed: %v (continuing with CRIU)", err))
-			} else {
-				debugLog("CUDA checkpoint successful - VRAM transferred to RAM")
+		annotations := bundleAnnotations(findBundleFromState(rootPath, containerID))
+		correlation := logging.FirstCorrelation(os.Getenv(logging.CorrelationEnv), annotations[logging.CorrelationAnnotation])
+		logger = logger.With(logging.KeyContainer, containerID, logging.KeyCorrelation, correlation)
+		logger.Info("Checkpointing container", logging.KeyPID, pid, "path", imagePath)
+
+		if imagePath != "" {
+			meta = manifest.New("kybernate-runtime", imagePath)
+			meta.Workload = manifest.WorkloadFromAnnotations(containerID, annotations)
+			meta.CorrelationID = correlation
+		}
+
+		// Find all GPU processes (the init process and/or its descendants)
+		gpuPIDs, err := findGPUProcessPIDs(pid)
+		if err != nil && workloadPolicy(annotations) == cuda.PolicyFailClosed {
+			// Without discovery the dump could silently miss the GPU state
+			logger.Error("GPU process discovery failed, aborting checkpoint", logging.KeyStage, "discovery", "policy", cuda.PolicyFailClosed, logging.Err(err))
+			fatal(fmt.Sprintf("checkpoint %s: GPU process discovery failed: %v", containerID, err))
+		}
+		if err != nil {
+			logger.Warn("GPU process discovery failed, continuing with CRIU, GPU state may be lost", logging.KeyStage, "discovery", logging.Err(err))
+		}
+		if len(gpuPIDs) > 0 {
+			logger.Info("GPU processes detected, performing CUDA checkpoint", logging.KeyPIDs, gpuPIDs)
+
+			restoreTimeout = workloadTimeouts(annotations).Restore
+
+			// Own the container's GPU state until the dump is done
+			lock, err = acquire(containerID, correlation, gpuPIDs, annotations)
+			switch {
+			case errors.Is(err, errSkip):
+				// Stacked below the shim, which holds the lock, moved the VRAM
+				// and writes the manifest
+				meta = nil
+			case err != nil:
+				logger.Error("Refusing checkpoint", logging.Err(err))
+				fatal(fmt.Sprintf("checkpoint %s: %v", containerID, err))
+			default:
+				// Refuse before locking if the device memory cannot fit into host memory
+				reservation, err := cuda.PreflightOffload(gpuPIDs, workloadOffload(annotations))
+				if err != nil {
+					logger.Error("Refusing checkpoint", logging.Err(err))
+					fatal(fmt.Sprintf("checkpoint %s: %v", containerID, err))
+				}
+				logger.Info("Host memory reserved for the device memory", "reservation", reservation.String())
+				offload = reservation
+				processes, err := cuda.DescribeProcesses(gpuPIDs)
+				if err != nil {
+					logger.Warn("Failed to describe GPU processes", logging.Err(err))
+				}
+
+				op, err = journal.New(conf.JournalDir()).Begin(containerID, "kybernate-runtime", gpuPIDs, imagePath)
+				if err != nil {
+					logger.Warn("Failed to start journal", logging.Err(err))
+				}
+				record(op, journal.StageLocked, nil)
+
+				// Perform CUDA checkpoint before CRIU
+				stageStart := time.Now()
+				err = cudaCheckpoint(gpuPIDs, workloadTimeouts(annotations).Checkpoint)
+				elapsed := time.Since(stageStart)
+				if meta != nil {
+					meta.Timings.CUDACheckpoint = elapsed
+					meta.Sizes.VRAM = reservation.Bytes
+				}
+				if err != nil {
+					record(op, journal.StageRolledBack, err)
+					op = nil
+					if workloadPolicy(annotations) == cuda.PolicyFailClosed {
+						logger.Error("CUDA checkpoint failed, aborting checkpoint", logging.KeyStage, "cuda-checkpoint", "policy", cuda.PolicyFailClosed, logging.Err(err))
+						offload.Release()
+						fatal(fmt.Sprintf("checkpoint %s: CUDA checkpoint failed: %v", containerID, err))
+					}
+					logger.Warn("CUDA checkpoint failed, continuing with CRIU", logging.KeyStage, "cuda-checkpoint", logging.Err(err))
+					markDegraded(imagePath, gpuPIDs, err)
+				} else {
+					logger.Info("CUDA checkpoint successful, VRAM transferred to RAM", logging.KeyStage, "cuda-checkpoint", logging.KeyPIDs, gpuPIDs, logging.KeyDuration, elapsed)
+					record(op, journal.StageCUDACheckpointed, nil)
+					if meta != nil {
+						ckpt, _ := cuda.NewCheckpointer()
+						meta.GPU = manifest.DescribeGPU(ckpt, gpuPIDs, processes)
+					}
+				}
 			}
 		} else {
-			debugLog("Not a GPU process, skipping CUDA checkpoint")
+			logger.Info("Not a GPU process, skipping CUDA checkpoint")
+		}
+
+		if meta != nil {
+			// Record the node, restores are checked against it
+			var uuids []string
+			if meta.GPU != nil {
+				uuids = meta.GPU.UUIDs
+			}
+			meta.Host = compat.ForProcess(pid, uuids)
+		}
+
+		if lock != nil || offload.Raised() || meta != nil {
+			// exec would leave nobody to journal the CRIU stage, put the
+			// memory limit back, hold the lock or write the manifest
+			criuStart := time.Now()
+			runRuntime(runtime, args, func(err error) {
+				criuDump := time.Since(criuStart)
+				if err != nil {
+					logger.Error("CRIU checkpoint failed", logging.KeyStage, "criu-dump", logging.Err(err))
+				} else {
+					logger.Info("CRIU checkpoint done", logging.KeyStage, "criu-dump", logging.KeyDuration, criuDump)
+				}
+				resumed := finishCheckpoint(op, err, containsArg(args, "--leave-running"), restoreTimeout)
+				if releaseErr := offload.Release(); releaseErr != nil {
+					logger.Warn("Memory limit not restored", logging.Err(releaseErr))
+				}
+				lock.Release()
+				if err == nil && meta != nil {
+					meta.Timings.CRIUDump = criuDump
+					meta.Timings.SnapshotToResume = resumed
+					meta.Timings.Total = time.Since(start)
+					if err := meta.Write(imagePath); err != nil {
+						logger.Warn("Failed to write checkpoint manifest", logging.Err(err))
+					}
+				}
+			})
+			return
 		}
 	} else {
-		debugLog(fmt.Sprintf("Could not find PID for container %s", containerID))
+		logger.Warn("Could not find PID of container", logging.KeyContainer, containerID)
 	}
 
 	// Delegate to actual runtime
@@ -121,7 +236,7 @@ func handleCheckpoint(runtime string, args []string) {
 
 // handleRestore intercepts restore commands to perform CUDA restore
 func handleRestore(runtime string, args []string) {
-	debugLog("Restore command detected")
+	logger.Debug("Restore command detected")
 
 	// For restore, we need to call the runtime first, then restore CUDA state
 	// This is more complex because we need the PID after restore
@@ -162,13 +277,28 @@ func findRootArg(args []string) string {
 	return ""
 }
 
+// findImagePathArg extracts the checkpoint directory from command args
+func findImagePathArg(args []string) string {
+	for i, arg := range args {
+		if arg == "--image-path" {
+			if i+1 < len(args) {
+				return args[i+1]
+			}
+		}
+		if strings.HasPrefix(arg, "--image-path=") {
+			return strings.TrimPrefix(arg, "--image-path=")
+		}
+	}
+	return ""
+}
+
 // findContainerPIDFromState reads the container PID from runc state
 func findContainerPIDFromState(rootPath, containerID string) int {
 	// runc stores state in {root}/{containerID}/state.json
 	statePath := filepath.Join(rootPath, containerID, "state.json")
 	data, err := os.ReadFile(statePath)
 	if err != nil {
-		debugLog(fmt.Sprintf("Failed to read state.json: %v", err))
+		logger.Warn("Failed to read state.json", logging.Err(err))
 		return 0
 	}
 
@@ -177,7 +307,7 @@ func findContainerPIDFromState(rootPath, containerID string) int {
 		Pid  int `json:"pid"`
 	}
 	if err := json.Unmarshal(data, &state); err != nil {
-		debugLog(fmt.Sprintf("Failed to parse state.json: %v", err))
+		logger.Warn("Failed to parse state.json", logging.Err(err))
 		return 0
 	}
 
@@ -187,55 +317,171 @@ func findContainerPIDFromState(rootPath, containerID string) int {
 	return state.Pid
 }
 
-// isGPUProcess checks if a process is using GPU
-func isGPUProcess(pid int) bool {
-	return findGPUProcessPID(pid) > 0
+// findBundleFromState reads the bundle path runc recorded in the
+// container's state labels
+func findBundleFromState(rootPath, containerID string) string {
+	data, err := os.ReadFile(filepath.Join(rootPath, containerID, "state.json"))
+	if err != nil {
+		return ""
+	}
+
+	var state struct {
+		Config struct {
+			Labels []string `json:"labels"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return ""
+	}
+	for _, label := range state.Config.Labels {
+		if strings.HasPrefix(label, "bundle=") {
+			return strings.TrimPrefix(label, "bundle=")
+		}
+	}
+	return ""
 }
 
-// findGPUProcessPID finds the actual GPU process PID (may be a child of the given pid)
-func findGPUProcessPID(pid int) int {
-	// Check nvidia-smi for this PID and its children
-	cmd := exec.Command("nvidia-smi", "--query-compute-apps=pid", "--format=csv,noheader")
-	output, err := cmd.Output()
+// bundleAnnotations reads the OCI annotations of a bundle
+func bundleAnnotations(bundlePath string) map[string]string {
+	if bundlePath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(bundlePath, "config.json"))
 	if err != nil {
-		return 0
+		return nil
+	}
+	var config struct {
+		Annotations map[string]string `json:"annotations"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil
 	}
+	return config.Annotations
+}
 
-	gpuPids := make(map[int]bool)
-	for _, line := range strings.Split(string(output), "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-		var gpuPid int
-		fmt.Sscanf(line, "%d", &gpuPid)
-		if gpuPid > 0 {
-			gpuPids[gpuPid] = true
-		}
+// workloadTimeouts returns the CUDA timeouts for a container: the
+// configured ones, overridden by the environment, overridden by its
+// annotations
+func workloadTimeouts(annotations map[string]string) cuda.Timeouts {
+	timeouts, err := cuda.TimeoutsFromEnv(conf.Timeouts)
+	if err != nil {
+		logger.Warn("Ignoring CUDA timeout override", logging.Err(err))
+	}
+	t, err := cuda.TimeoutsFromAnnotations(annotations, timeouts)
+	if err != nil {
+		logger.Warn("Ignoring CUDA timeout annotation", logging.Err(err))
+		return timeouts
+	}
+	return t
+}
+
+// workloadOffload returns the VRAM offload options for a container, in
+// the same order of precedence as workloadTimeouts
+func workloadOffload(annotations map[string]string) cuda.OffloadOptions {
+	opts, err := cuda.OffloadOptionsFromEnv(cuda.OffloadOptions{})
+	if err != nil {
+		logger.Warn("Ignoring offload override", logging.Err(err))
+	}
+	o, err := cuda.OffloadOptionsFromAnnotations(annotations, opts)
+	if err != nil {
+		logger.Warn("Ignoring offload annotation", logging.Err(err))
+		return opts
+	}
+	return o
+}
+
+// acquire takes the container's lock for the checkpoint, recording its
+// correlation ID. A lock held by another tool is an error, unless the
+// lock mode is skip and that tool already moved the VRAM of pids; then
+// nil is returned without a lock.
+func acquire(containerID, correlation string, pids []int, annotations map[string]string) (*oplock.Lock, error) {
+	mode, err := oplock.ModeFromEnv(oplock.ModeSkip)
+	if err != nil {
+		logger.Warn("Ignoring lock mode override", logging.Err(err))
+	}
+	if m, err := oplock.ModeFromAnnotations(annotations, mode); err != nil {
+		logger.Warn("Ignoring lock mode annotation", logging.Err(err))
+	} else {
+		mode = m
 	}
 
-	// Check if the init pid itself is a GPU process
-	if gpuPids[pid] {
-		return pid
+	ctx, cancel := context.WithTimeout(context.Background(), workloadTimeouts(annotations).Checkpoint)
+	defer cancel()
+	lock, err := oplock.Acquire(ctx, conf.LockDir(), containerID, oplock.Owner{Tool: "kybernate-runtime", Op: "checkpoint", Correlation: correlation}, mode)
+	if err == nil || mode != oplock.ModeSkip || !errors.Is(err, oplock.ErrBusy) {
+		return lock, err
 	}
 
-	// Check child processes recursively
-	return findGPUChild(pid, gpuPids)
+	ckpt, cerr := cuda.NewCheckpointer()
+	if cerr != nil || len(ckpt.ProcessesInState(pids, cuda.StateRunning)) > 0 {
+		return nil, err
+	}
+	logger.Info("VRAM already moved, skipping CUDA stage", "lock", err.Error())
+	return nil, errSkip
+}
+
+// errSkip tells handleCheckpoint to leave the CUDA stage to the lock owner
+var errSkip = errors.New("CUDA stage owned by another tool")
+
+// workloadPolicy returns the CUDA failure policy of the workload
+func workloadPolicy(annotations map[string]string) cuda.FailurePolicy {
+	policy, err := cuda.FailurePolicyFromEnv(cuda.DefaultFailurePolicy)
+	if err != nil {
+		logger.Warn("Ignoring failure policy override", logging.Err(err))
+	}
+	p, err := cuda.FailurePolicyFromAnnotations(annotations, policy)
+	if err != nil {
+		logger.Warn("Ignoring failure policy annotation", logging.Err(err))
+		return policy
+	}
+	return p
 }
 
-// findGPUChild recursively searches for a GPU process in the process tree
-func findGPUChild(pid int, gpuPids map[int]bool) int {
-	childPids := getChildPIDs(pid)
-	for _, childPid := range childPids {
-		if gpuPids[childPid] {
-			return childPid
+// markDegraded records in the checkpoint directory that the dump lacks
+// the GPU state
+func markDegraded(imagePath string, pids []int, cause error) {
+	if imagePath == "" {
+		return
+	}
+	err := os.MkdirAll(imagePath, 0755)
+	if err == nil {
+		err = cuda.MarkDegraded(imagePath, pids, cause)
+	}
+	if err != nil {
+		logger.Warn("Failed to mark checkpoint degraded", logging.Err(err))
+	}
+}
+
+// isGPUProcess checks if a process is using GPU
+func isGPUProcess(pid int) bool {
+	pids, _ := findGPUProcessPIDs(pid)
+	return len(pids) > 0
+}
+
+// findGPUProcessPIDs finds all GPU processes in the process tree of pid
+// (the process itself and its descendants)
+func findGPUProcessPIDs(pid int) ([]int, error) {
+	processes, err := cuda.FindGPUProcesses()
+	if err != nil {
+		return nil, err
+	}
+
+	gpuPids := make(map[int]bool)
+	for _, proc := range processes {
+		if proc.PID > 0 {
+			gpuPids[proc.PID] = true
 		}
-		// Recursively check grandchildren
-		if found := findGPUChild(childPid, gpuPids); found > 0 {
-			return found
+	}
+
+	var found []int
+	for _, p := range append([]int{pid}, getChildPIDs(pid)...) {
+		if gpuPids[p] {
+			found = append(found, p)
+			// A process may be listed once per GPU
+			delete(gpuPids, p)
 		}
 	}
-	return 0
+	return found, nil
 }
 
 // getChildPIDs returns all child PIDs of a process
@@ -286,9 +532,11 @@ func findContainerPID(bundlePath string) int {
 	return pid
 }
 
-// cudaCheckpoint performs CUDA checkpoint using the cuda package
-func cudaCheckpoint(pid int) error {
-	debugLog(fmt.Sprintf("Performing CUDA checkpoint for PID %d", pid))
+// cudaCheckpoint checkpoints all GPU processes of a container together
+// using the cuda package. Either all of them end up checkpointed or all
+// are left running.
+func cudaCheckpoint(pids []int, timeout time.Duration) error {
+	logger.Debug("Performing CUDA checkpoint", logging.KeyPIDs, pids)
 
 	// Create checkpointer
 	ckpt, err := cuda.NewCheckpointer()
@@ -297,22 +545,73 @@ func cudaCheckpoint(pid int) error {
 	}
 
 	// Get current state
-	state, err := ckpt.GetState(pid)
-	if err != nil {
-		return fmt.Errorf("failed to get process state: %w", err)
+	for _, pid := range pids {
+		state, err := ckpt.GetState(pid)
+		if err != nil {
+			return fmt.Errorf("failed to get state of PID %d: %w", pid, err)
+		}
+		logger.Debug("CUDA process state", logging.KeyPID, pid, "state", state)
 	}
-	debugLog(fmt.Sprintf("Current process state: %s", state))
 
-	// Perform full checkpoint (Lock + Checkpoint)
-	// Use 30 second timeout
-	if err := ckpt.CheckpointFull(pid, 30000); err != nil {
+	// Lock all, then checkpoint all (rolled back on failure or timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := ckpt.CheckpointGroup(ctx, pids); err != nil {
 		return fmt.Errorf("checkpoint failed: %w", err)
 	}
-
-	debugLog(fmt.Sprintf("CUDA checkpoint successful for PID %d - VRAM transferred to RAM", pid))
 	return nil
 }
 
+// finishCheckpoint journals the outcome of the CRIU stage. The GPU
+// processes are restored if the CRIU stage failed, so the workload keeps
+// running, and after a dump with --leave-running, which keeps the
+// container running. It returns the snapshot-to-resume latency if the
+// processes were resumed after the dump.
+func finishCheckpoint(op *journal.Operation, criuErr error, leaveRunning bool, timeout time.Duration) time.Duration {
+	if op == nil {
+		return 0
+	}
+	if criuErr == nil {
+		record(op, journal.StageCRIUDone, nil)
+		if !leaveRunning {
+			return 0
+		}
+	} else {
+		logger.Info("Restoring GPU processes after failed CRIU checkpoint", logging.KeyPIDs, op.PIDs)
+	}
+
+	ckpt, err := cuda.NewCheckpointer()
+	if err != nil {
+		logger.Error("Failed to create checkpointer", logging.Err(err))
+		return 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, r := range ckpt.Release(ctx, op.PIDs) {
+		if r.Err != nil {
+			// Left open for the next reconcile
+			logger.Error("Failed to restore CUDA process", logging.KeyPID, r.PID, "state", r.From, logging.Err(r.Err))
+			return 0
+		}
+	}
+
+	if criuErr != nil {
+		record(op, journal.StageRolledBack, criuErr)
+		return 0
+	}
+	latency := op.SinceCheckpoint()
+	record(op, journal.StageResumed, nil)
+	logger.Info("Resumed GPU processes after checkpoint", logging.KeyPIDs, op.PIDs, "snapshotToResume", latency)
+	return latency
+}
+
+// record appends stage to the journal of op; failures are only logged
+func record(op *journal.Operation, stage journal.Stage, cause error) {
+	if err := op.Record(stage, cause); err != nil {
+		logger.Warn("Failed to journal stage", logging.KeyStage, stage, logging.Err(err))
+	}
+}
+
 // containsArg checks if args contain a specific argument
 func containsArg(args []string, target string) bool {
 	for _, arg := range args {
@@ -327,7 +626,7 @@ func containsArg(args []string, target string) bool {
 func execRuntime(runtime string, args []string) {
 	allArgs := append([]string{runtime}, args...)
 
-	debugLog(fmt.Sprintf("Executing: %s %v", runtime, args))
+	logger.Debug("Executing runtime", "runtime", runtime)
 
 	// Use syscall.Exec to replace the current process
 	if err := syscall.Exec(runtime, allArgs, os.Environ()); err != nil {
@@ -335,21 +634,55 @@ func execRuntime(runtime string, args []string) {
 	}
 }
 
-func debugLog(msg string) {
-	f, err := os.OpenFile(LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// runRuntime runs the runtime as a child, calls done with its result
+// once it exits and exits with the child's status
+func runRuntime(runtime string, args []string, done func(err error)) {
+	logger.Debug("Running runtime", "runtime", runtime)
+
+	cmd := exec.Command(runtime, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err := cmd.Run()
+
+	done(err)
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		os.Exit(exitErr.ExitCode())
+	}
 	if err != nil {
-		return
+		fatal(fmt.Sprintf("failed to run %s: %v", runtime, err))
 	}
-	defer f.Close()
+}
 
-	data, _ := json.Marshal(map[string]string{
-		"msg":  msg,
-		"args": strings.Join(os.Args, " "),
+// setupLogging configures logger from conf and the KYBERNATE_LOG_*
+// variables. Each record carries the command line the runtime was invoked
+// with. It returns the function that closes the log file.
+func setupLogging() func() {
+	def, confErr := conf.Logging(tool, logging.Config{
+		Level:      slog.LevelInfo,
+		Output:     logging.OutputFile,
+		Format:     logging.FormatJSON,
+		MaxSize:    logging.DefaultMaxSize,
+		MaxBackups: logging.DefaultMaxBackups,
 	})
-	f.WriteString(string(data) + "\n")
+	cfg, cfgErr := logging.ConfigFromEnv(def)
+	l, closer, err := logging.New(cfg, "kybernate-runtime", config.FallbackLogFile(tool))
+	if err != nil {
+		// The runtime's stderr belongs to its caller, which reports it as
+		// the error of the command, so nothing is logged there unless asked
+		l = logging.Discard
+	}
+	logger = l.With("args", strings.Join(os.Args, " "))
+	if confErr != nil {
+		logger.Warn("Invalid log configuration", logging.Err(confErr))
+	}
+	if cfgErr != nil {
+		logger.Warn("Invalid log configuration", logging.Err(cfgErr))
+	}
+	return func() { closer.Close() }
 }
 
 func fatal(msg string) {
+	logger.Error(msg)
 	fmt.Fprintf(os.Stderr, "kybernate-runtime: %s\n", msg)
 	os.Exit(1)
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kybernate/kybernate/pkg/cuda"
+	"github.com/kybernate/kybernate/pkg/journal"
+)
+
+func TestFindArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		find   func([]string) string
+		expect string
+	}{
+		{"bundle flag", []string{"create", "--bundle", "/b", "id"}, findBundleArg, "/b"},
+		{"bundle short", []string{"create", "-b", "/b", "id"}, findBundleArg, "/b"},
+		{"bundle inline", []string{"create", "--bundle=/b", "id"}, findBundleArg, "/b"},
+		{"bundle missing value", []string{"create", "--bundle"}, findBundleArg, ""},
+		{"root", []string{"--root", "/run/runc", "checkpoint", "id"}, findRootArg, "/run/runc"},
+		{"root inline", []string{"--root=/run/runc", "checkpoint", "id"}, findRootArg, "/run/runc"},
+		{"image path", []string{"checkpoint", "--image-path", "/ckpt", "id"}, findImagePathArg, "/ckpt"},
+		{"image path inline", []string{"checkpoint", "--image-path=/ckpt", "id"}, findImagePathArg, "/ckpt"},
+		{"image path absent", []string{"checkpoint", "id"}, findImagePathArg, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.find(tt.args); got != tt.expect {
+				t.Errorf("got %q, want %q", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestFindContainerPIDFromState(t *testing.T) {
+	root := t.TempDir()
+	for id, state := range map[string]string{
+		"init":   `{"init_process_pid": 42, "pid": 7}`,
+		"pid":    `{"pid": 7}`,
+		"broken": `{`,
+	} {
+		if err := os.MkdirAll(filepath.Join(root, id), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, id, "state.json"), []byte(state), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for id, want := range map[string]int{"init": 42, "pid": 7, "broken": 0, "missing": 0} {
+		if got := findContainerPIDFromState(root, id); got != want {
+			t.Errorf("%s: PID %d, want %d", id, got, want)
+		}
+	}
+}
+
+// useSimulator selects the simulated driver for the wrapper's checkpointers,
+// with the test process as a running CUDA process, and returns a handle on
+// the shared state file
+func useSimulator(t *testing.T) (*cuda.SimDriver, int) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sim.json")
+	t.Setenv(cuda.DriverEnv, cuda.DriverSim)
+	t.Setenv(cuda.SimStateEnv, path)
+
+	sim, err := cuda.OpenSimDriver(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuid, _ := cuda.ParseUUID("GPU-00000000-0000-0000-0000-000000000001")
+	if err := sim.AddDevice(uuid); err != nil {
+		t.Fatal(err)
+	}
+	pid := os.Getpid()
+	if err := sim.AddProcess(pid, "trainer", 1<<20, uuid); err != nil {
+		t.Fatal(err)
+	}
+	return sim, pid
+}
+
+func expectState(t *testing.T, sim *cuda.SimDriver, pid int, want cuda.ProcessState) {
+	t.Helper()
+	p, ok := sim.Process(pid)
+	if !ok || p.State != want {
+		t.Fatalf("simulated process: %+v, want %s", p, want)
+	}
+}
+
+func TestCheckpointThenFinish(t *testing.T) {
+	tests := []struct {
+		name         string
+		criuErr      error
+		leaveRunning bool
+		state        cuda.ProcessState
+		stage        journal.Stage
+	}{
+		{"dump and exit", nil, false, cuda.StateCheckpointed, journal.StageCRIUDone},
+		{"leave running", nil, true, cuda.StateRunning, journal.StageResumed},
+		{"CRIU failed", errors.New("criu: dump failed"), false, cuda.StateRunning, journal.StageRolledBack},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sim, pid := useSimulator(t)
+			if err := cudaCheckpoint([]int{pid}, time.Second); err != nil {
+				t.Fatalf("cudaCheckpoint: %v", err)
+			}
+			expectState(t, sim, pid, cuda.StateCheckpointed)
+
+			j := journal.New(t.TempDir())
+			op, err := j.Begin("abc", tool, []int{pid}, "/ckpt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			record(op, journal.StageCUDACheckpointed, nil)
+			finishCheckpoint(op, tt.criuErr, tt.leaveRunning, time.Second)
+
+			expectState(t, sim, pid, tt.state)
+			last, err := j.Last("abc")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if last.Stage != tt.stage {
+				t.Errorf("journal stage %s, want %s", last.Stage, tt.stage)
+			}
+		})
+	}
+}
+
+func TestCheckpointFaultLeavesRunning(t *testing.T) {
+	sim, pid := useSimulator(t)
+	if err := sim.FailNext(cuda.SimOpCheckpoint, cuda.ErrCodeNotReady); err != nil {
+		t.Fatal(err)
+	}
+	if err := cudaCheckpoint([]int{pid}, time.Second); err == nil {
+		t.Fatal("cudaCheckpoint succeeded despite the injected fault")
+	}
+	expectState(t, sim, pid, cuda.StateRunning)
+}
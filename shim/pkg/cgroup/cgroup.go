@@ -0,0 +1,103 @@
+// Package cgroup locates the cgroup of a container or of one of its
+// processes, lists the processes in it, reads and adjusts its memory
+// accounting and freezes it. Both the unified (v2) hierarchy and the v1
+// controllers are supported.
+package cgroup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Root is where the cgroup filesystems are mounted
+const Root = "/sys/fs/cgroup"
+
+// ErrNotFound is returned when a process has no cgroup for a controller
+var ErrNotFound = errors.New("cgroup not found")
+
+// Cgroup is a directory in the cgroup filesystem
+type Cgroup struct {
+	// Path is the absolute directory of the cgroup
+	Path string `json:"path"`
+	// V2 is true for the unified hierarchy
+	V2 bool `json:"v2,omitempty"`
+	// Controller names the v1 hierarchy the cgroup belongs to
+	Controller string `json:"controller,omitempty"`
+}
+
+func (c *Cgroup) String() string {
+	return c.Path
+}
+
+// ForPID returns the memory cgroup of pid, read from /proc/<pid>/cgroup.
+// On hybrid hosts the v1 memory controller takes precedence, because
+// that is where the memory limit is enforced.
+func ForPID(pid int) (*Cgroup, error) {
+	return ForController(pid, "memory")
+}
+
+// ForController returns the cgroup of pid that handles controller: the v1
+// hierarchy of that controller if mounted, else the unified hierarchy
+func ForController(pid int, controller string) (*Cgroup, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var unified string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Format: hierarchy-ID:controller-list:path
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			unified = parts[2]
+			continue
+		}
+		for _, c := range strings.Split(parts[1], ",") {
+			if c == controller {
+				return &Cgroup{Path: filepath.Join(Root, controller, parts[2]), Controller: controller}, nil
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if unified == "" {
+		return nil, fmt.Errorf("%s of PID %d: %w", controller, pid, ErrNotFound)
+	}
+	return &Cgroup{Path: filepath.Join(Root, unified), V2: true}, nil
+}
+
+// Parent returns the enclosing cgroup, or nil at the root of the hierarchy
+func (c *Cgroup) Parent() *Cgroup {
+	root := filepath.Join(Root, c.Controller)
+	if filepath.Clean(c.Path) == root {
+		return nil
+	}
+	parent := filepath.Dir(c.Path)
+	if !strings.HasPrefix(parent, root) {
+		return nil
+	}
+	return &Cgroup{Path: parent, V2: c.V2, Controller: c.Controller}
+}
+
+func (c *Cgroup) read(file string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(c.Path, file))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (c *Cgroup) write(file, value string) error {
+	return os.WriteFile(filepath.Join(c.Path, file), []byte(value), 0644)
+}
@@ -0,0 +1,156 @@
+package cgroup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxContainerDepth bounds the search for a container cgroup. The
+// deepest kubelet layout is kubepods/<qos>/pod<uid>/<container>.
+const maxContainerDepth = 5
+
+// v1Controllers are the v1 hierarchies searched for a container, in
+// order; each of them holds every process of the host
+var v1Controllers = []string{"pids", "memory", "cpu,cpuacct", "systemd"}
+
+// NamesContainer reports whether a component of the cgroup path names the
+// cgroup of container id. The cgroupfs driver names it after the ID, the
+// systemd driver <prefix>-<id>.scope, e.g. cri-containerd-<id>.scope.
+// Only the full component matches, so an ID prefix names no container.
+func NamesContainer(path, id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, name := range strings.Split(path, "/") {
+		if isContainerDir(name, id) {
+			return true
+		}
+	}
+	return false
+}
+
+func isContainerDir(name, id string) bool {
+	return name == id || strings.HasSuffix(name, "-"+id+".scope")
+}
+
+// FindContainer returns the cgroup of the first of ids that has one
+func FindContainer(ids ...string) (*Cgroup, error) {
+	return FindContainerIn(Root, ids...)
+}
+
+// FindContainerIn searches the cgroup filesystem mounted at root: the
+// unified hierarchy on cgroup v2, else a v1 hierarchy that tracks every
+// process. The result is the cgroup of the first of ids that has one.
+func FindContainerIn(root string, ids ...string) (*Cgroup, error) {
+	hierarchy := &Cgroup{Path: root, V2: true}
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil {
+		hierarchy = nil
+		for _, controller := range v1Controllers {
+			if fi, err := os.Stat(filepath.Join(root, controller)); err == nil && fi.IsDir() {
+				hierarchy = &Cgroup{Path: filepath.Join(root, controller), Controller: controller}
+				break
+			}
+		}
+		if hierarchy == nil {
+			return nil, fmt.Errorf("no cgroup hierarchy below %s", root)
+		}
+	}
+
+	found := map[string]string{}
+	base := strings.Count(hierarchy.Path, string(filepath.Separator))
+	err := filepath.WalkDir(hierarchy.Path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Cgroups come and go while we walk
+			if path != hierarchy.Path && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		for _, id := range ids {
+			if id != "" && isContainerDir(d.Name(), id) {
+				if _, ok := found[id]; !ok {
+					found[id] = path
+				}
+				return fs.SkipDir
+			}
+		}
+		if strings.Count(path, string(filepath.Separator))-base >= maxContainerDepth {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		if path, ok := found[id]; ok {
+			return &Cgroup{Path: path, V2: hierarchy.V2, Controller: hierarchy.Controller}, nil
+		}
+	}
+	return nil, fmt.Errorf("container %v: %w", ids, ErrNotFound)
+}
+
+// Procs returns the processes of the cgroup and of the cgroups below it,
+// ordered by PID
+func (c *Cgroup) Procs() ([]int, error) {
+	var pids []int
+	err := filepath.WalkDir(c.Path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path != c.Path && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		procs, err := readProcs(filepath.Join(path, "cgroup.procs"))
+		if err != nil && !(path != c.Path && errors.Is(err, fs.ErrNotExist)) {
+			return err
+		}
+		pids = append(pids, procs...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Ints(pids)
+	return pids, nil
+}
+
+// ContainerProcesses returns the processes in the cgroup of container id
+func ContainerProcesses(id string) ([]int, error) {
+	c, err := FindContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.Procs()
+}
+
+func readProcs(path string) ([]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var pids []int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if pid, err := strconv.Atoi(strings.TrimSpace(scanner.Text())); err == nil && pid > 0 {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, scanner.Err()
+}
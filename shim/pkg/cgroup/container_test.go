@@ -0,0 +1,181 @@
+package cgroup
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testID      = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	testSandbox = "fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210"
+)
+
+// mkTree creates the directories of paths below root, and a file for each
+// path ending in a file name of the cgroup filesystem
+func mkTree(t *testing.T, root string, paths ...string) {
+	t.Helper()
+	for _, p := range paths {
+		full := filepath.Join(root, p)
+		if strings.HasPrefix(filepath.Base(p), "cgroup.") {
+			if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(full, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(full, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestNamesContainer(t *testing.T) {
+	tests := []struct {
+		path string
+		id   string
+		want bool
+	}{
+		{"/kubepods/burstable/pod1234/" + testID, testID, true},
+		{"/kubepods.slice/kubepods-pod1234.slice/cri-containerd-" + testID + ".scope", testID, true},
+		{"/system.slice/docker-" + testID + ".scope", testID, true},
+		{"/kubepods/burstable/pod1234/" + testID, testID[:12], false},
+		{"/kubepods.slice/cri-containerd-" + testID + ".scope", testID[:12], false},
+		{"/kubepods/burstable/pod1234/" + testID, testSandbox, false},
+		{"/kubepods/burstable/pod1234/" + testID, "", false},
+	}
+	for _, tt := range tests {
+		if got := NamesContainer(tt.path, tt.id); got != tt.want {
+			t.Errorf("NamesContainer(%s, %.12s) = %v, want %v", tt.path, tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestFindContainerIn(t *testing.T) {
+	systemd := "kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod1234.slice/cri-containerd-" + testID + ".scope"
+	cgroupfs := "kubepods/burstable/pod1234/" + testID
+	tests := []struct {
+		name string
+		tree []string
+		ids  []string
+		// want is the path of the container cgroup below the temp root,
+		// "" if none is found
+		want       string
+		v2         bool
+		controller string
+	}{
+		{
+			name: "v2 systemd",
+			tree: []string{"cgroup.controllers", systemd},
+			ids:  []string{testID},
+			want: systemd,
+			v2:   true,
+		},
+		{
+			name: "v2 cgroupfs",
+			tree: []string{"cgroup.controllers", cgroupfs},
+			ids:  []string{testID},
+			want: cgroupfs,
+			v2:   true,
+		},
+		{
+			name:       "v1 pids",
+			tree:       []string{"memory/" + cgroupfs, "pids/" + cgroupfs},
+			ids:        []string{testID},
+			want:       "pids/" + cgroupfs,
+			controller: "pids",
+		},
+		{
+			name:       "v1 systemd hierarchy only",
+			tree:       []string{"systemd/" + systemd},
+			ids:        []string{testID},
+			want:       "systemd/" + systemd,
+			controller: "systemd",
+		},
+		{
+			name: "first id with a cgroup wins",
+			tree: []string{"cgroup.controllers", cgroupfs, "kubepods/burstable/pod1234/" + testSandbox},
+			ids:  []string{"", "unknown", testSandbox, testID},
+			want: "kubepods/burstable/pod1234/" + testSandbox,
+			v2:   true,
+		},
+		{
+			name: "prefix matches nothing",
+			tree: []string{"cgroup.controllers", cgroupfs, systemd},
+			ids:  []string{testID[:12]},
+		},
+		{
+			name: "below search depth",
+			tree: []string{"cgroup.controllers", "a/b/c/d/e/" + testID},
+			ids:  []string{testID},
+		},
+		{
+			name: "no hierarchy",
+			tree: []string{"misc"},
+			ids:  []string{testID},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			mkTree(t, root, tt.tree...)
+
+			got, err := FindContainerIn(root, tt.ids...)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("found %s, want none", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FindContainerIn: %v", err)
+			}
+			want := &Cgroup{Path: filepath.Join(root, tt.want), V2: tt.v2, Controller: tt.controller}
+			if *got != *want {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestFindContainerInNotFound(t *testing.T) {
+	root := t.TempDir()
+	mkTree(t, root, "cgroup.controllers", "kubepods")
+	if _, err := FindContainerIn(root, testID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestProcs(t *testing.T) {
+	root := t.TempDir()
+	container := filepath.Join(root, "kubepods", testID)
+	mkTree(t, root, "kubepods/"+testID+"/sub/child")
+	for file, procs := range map[string]string{
+		"cgroup.procs":             "7\n3\n",
+		"sub/cgroup.procs":         "12\n\n",
+		"sub/child/cgroup.procs":   "5\n",
+		"sub/child/cgroup.threads": "99\n",
+	} {
+		if err := os.WriteFile(filepath.Join(container, file), []byte(procs), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pids, err := (&Cgroup{Path: container, V2: true}).Procs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{3, 5, 7, 12}; !reflect.DeepEqual(pids, want) {
+		t.Errorf("Procs = %v, want %v", pids, want)
+	}
+
+	// The container's own cgroup.procs must exist
+	if _, err := (&Cgroup{Path: filepath.Join(root, "kubepods")}).Procs(); err == nil {
+		t.Error("Procs of a cgroup without cgroup.procs succeeded")
+	}
+}
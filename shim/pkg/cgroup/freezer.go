@@ -0,0 +1,79 @@
+package cgroup
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// How long Freeze and Thaw wait for the kernel to report the new state
+const freezeTimeout = 10 * time.Second
+
+// FreezerForPID returns the cgroup that freezes pid and its siblings
+func FreezerForPID(pid int) (*Cgroup, error) {
+	return ForController(pid, "freezer")
+}
+
+// Freeze stops every task in the cgroup and waits until the kernel
+// reports the cgroup frozen
+func (c *Cgroup) Freeze() error {
+	return c.setFrozen(true)
+}
+
+// Thaw resumes the tasks of a frozen cgroup
+func (c *Cgroup) Thaw() error {
+	return c.setFrozen(false)
+}
+
+// Frozen reports whether the cgroup is currently frozen
+func (c *Cgroup) Frozen() (bool, error) {
+	if c.V2 {
+		events, err := c.read("cgroup.events")
+		if err != nil {
+			return false, err
+		}
+		for _, line := range strings.Split(events, "\n") {
+			if line == "frozen 1" {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	state, err := c.read("freezer.state")
+	if err != nil {
+		return false, err
+	}
+	return state == "FROZEN", nil
+}
+
+func (c *Cgroup) setFrozen(frozen bool) error {
+	var err error
+	switch {
+	case c.V2 && frozen:
+		err = c.write("cgroup.freeze", "1")
+	case c.V2:
+		err = c.write("cgroup.freeze", "0")
+	case frozen:
+		err = c.write("freezer.state", "FROZEN")
+	default:
+		err = c.write("freezer.state", "THAWED")
+	}
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(freezeTimeout)
+	for {
+		state, err := c.Frozen()
+		if err != nil {
+			return err
+		}
+		if state == frozen {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("cgroup %s did not reach frozen=%v within %s", c, frozen, freezeTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
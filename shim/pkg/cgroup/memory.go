@@ -0,0 +1,102 @@
+package cgroup
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Unlimited is returned as the memory limit of cgroups without one
+const Unlimited int64 = -1
+
+// v1 reports "no limit" as a page-aligned value close to MaxInt64
+const v1Unlimited = int64(1) << 62
+
+// MemoryLimit returns memory.max (v2) or memory.limit_in_bytes (v1)
+func (c *Cgroup) MemoryLimit() (int64, error) {
+	file := "memory.limit_in_bytes"
+	if c.V2 {
+		file = "memory.max"
+	}
+	value, err := c.read(file)
+	if err != nil {
+		return 0, err
+	}
+	if value == "max" {
+		return Unlimited, nil
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse %s of %s: %w", file, c.Path, err)
+	}
+	if !c.V2 && limit >= v1Unlimited {
+		return Unlimited, nil
+	}
+	return limit, nil
+}
+
+// MemoryUsage returns memory.current (v2) or memory.usage_in_bytes (v1)
+func (c *Cgroup) MemoryUsage() (int64, error) {
+	file := "memory.usage_in_bytes"
+	if c.V2 {
+		file = "memory.current"
+	}
+	value, err := c.read(file)
+	if err != nil {
+		return 0, err
+	}
+	usage, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse %s of %s: %w", file, c.Path, err)
+	}
+	return usage, nil
+}
+
+// SetMemoryLimit writes the memory limit; Unlimited removes it
+func (c *Cgroup) SetMemoryLimit(limit int64) error {
+	if c.V2 {
+		value := strconv.FormatInt(limit, 10)
+		if limit == Unlimited {
+			value = "max"
+		}
+		return c.write("memory.max", value)
+	}
+	return c.write("memory.limit_in_bytes", strconv.FormatInt(limit, 10))
+}
+
+// MemAvailable returns MemAvailable from /proc/meminfo in bytes
+func MemAvailable() (int64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Format: MemAvailable:   12345678 kB
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parse MemAvailable: %w", err)
+		}
+		return kb * 1024, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("MemAvailable not found in /proc/meminfo")
+}
+
+// FormatBytes renders a byte count in MiB for messages
+func FormatBytes(b int64) string {
+	if b == Unlimited {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d MiB", b/(1024*1024))
+}
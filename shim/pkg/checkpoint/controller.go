@@ -12,7 +12,11 @@ import (
 	"strings"
 	"time"
 
+	"github.com/kybernate/kybernate/pkg/compat"
+	"github.com/kybernate/kybernate/pkg/config"
 	"github.com/kybernate/kybernate/pkg/cuda"
+	"github.com/kybernate/kybernate/pkg/logging"
+	"github.com/kybernate/kybernate/pkg/manifest"
 )
 
 // CheckpointController manages GPU container checkpoint/restore operations
@@ -20,6 +24,13 @@ type CheckpointController struct {
 	cudaCheckpointer *cuda.Checkpointer
 	checkpointDir    string
 	nodeName         string
+	// Timeouts apply to requests that do not set their own
+	Timeouts cuda.Timeouts
+	// Kubelet is where the kubelet's checkpoint API is reached if kubectl
+	// cannot checkpoint; it defaults to that of the node's profile
+	Kubelet config.Kubelet
+	// dump takes the CRIU checkpoint; nil uses kubernetesCheckpoint
+	dump func(ctx context.Context, req *CheckpointRequest, checkpointPath string) error
 }
 
 // NewCheckpointController creates a new checkpoint controller
@@ -35,6 +46,8 @@ func NewCheckpointController(checkpointDir string) (*CheckpointController, error
 		cudaCheckpointer: ckpt,
 		checkpointDir:    checkpointDir,
 		nodeName:         nodeName,
+		Timeouts:         cuda.DefaultTimeouts,
+		Kubelet:          config.Detected().Kubelet,
 	}, nil
 }
 
@@ -45,6 +58,10 @@ type CheckpointRequest struct {
 	ContainerName string
 	ContainerID   string
 	GPUProcessPID int
+	// CUDATimeout bounds lock + checkpoint; 0 uses the controller default
+	CUDATimeout time.Duration
+	// CorrelationID names the checkpoint in the logs; "" generates one
+	CorrelationID string
 }
 
 // CheckpointResult contains the result of a checkpoint operation
@@ -52,7 +69,9 @@ type CheckpointResult struct {
 	CheckpointPath string
 	CUDAState      string
 	Duration       time.Duration
-	Error          error
+	// Manifest is written into CheckpointPath on success
+	Manifest *manifest.Manifest
+	Error    error
 }
 
 // Checkpoint performs a full GPU container checkpoint
@@ -70,6 +89,14 @@ func (c *CheckpointController) Checkpoint(ctx context.Context, req *CheckpointRe
 		return result
 	}
 	result.CheckpointPath = checkpointPath
+	meta := manifest.New("checkpoint-controller", checkpointPath)
+	meta.Workload = manifest.Workload{
+		Namespace:   req.Namespace,
+		Pod:         req.PodName,
+		Container:   req.ContainerName,
+		ContainerID: req.ContainerID,
+	}
+	meta.CorrelationID = logging.FirstCorrelation(req.CorrelationID)
 
 	// Stage 1: CUDA Checkpoint (if GPU process)
 	if req.GPUProcessPID > 0 {
@@ -82,25 +109,53 @@ func (c *CheckpointController) Checkpoint(ctx context.Context, req *CheckpointRe
 
 		if state == cuda.StateRunning {
 			// Perform CUDA checkpoint: Lock + Checkpoint (VRAM → RAM)
-			if err := c.cudaCheckpointer.CheckpointFull(req.GPUProcessPID, 60000); err != nil {
+			cudaCtx, cancel := context.WithTimeout(ctx, orDefault(req.CUDATimeout, c.Timeouts.Checkpoint))
+			stageStart := time.Now()
+			err := c.cudaCheckpointer.CheckpointFullContext(cudaCtx, req.GPUProcessPID)
+			cancel()
+			meta.Timings.CUDACheckpoint = time.Since(stageStart)
+			if err != nil {
 				result.Error = fmt.Errorf("CUDA checkpoint failed: %w", err)
 				return result
 			}
 			result.CUDAState = "checkpointed"
 		}
+		meta.GPU = manifest.DescribeGPU(c.cudaCheckpointer, []int{req.GPUProcessPID}, nil)
+	}
+
+	// Record the node, restores are checked against it
+	if req.GPUProcessPID > 0 {
+		meta.Host = compat.ForProcess(req.GPUProcessPID, meta.GPU.UUIDs)
+	} else {
+		meta.Host = compat.Describe(nil, nil)
 	}
 
 	// Stage 2: Kubernetes Checkpoint API (CRIU)
-	if err := c.kubernetesCheckpoint(ctx, req, checkpointPath); err != nil {
+	dump := c.dump
+	if dump == nil {
+		dump = c.kubernetesCheckpoint
+	}
+	criuStart := time.Now()
+	if err := dump(ctx, req, checkpointPath); err != nil {
 		// Try to restore CUDA state on failure
 		if req.GPUProcessPID > 0 {
-			_ = c.cudaCheckpointer.RestoreFull(req.GPUProcessPID)
+			cudaCtx, cancel := context.WithTimeout(context.Background(), c.Timeouts.Restore)
+			_ = c.cudaCheckpointer.RestoreFullContext(cudaCtx, req.GPUProcessPID)
+			cancel()
 		}
 		result.Error = fmt.Errorf("Kubernetes checkpoint failed: %w", err)
 		return result
 	}
 
+	meta.Timings.CRIUDump = time.Since(criuStart)
+
 	result.Duration = time.Since(start)
+	meta.Timings.Total = result.Duration
+	if err := meta.Write(checkpointPath); err != nil {
+		result.Error = fmt.Errorf("failed to write checkpoint manifest: %w", err)
+		return result
+	}
+	result.Manifest = meta
 	return result
 }
 
@@ -119,12 +174,12 @@ func (c *CheckpointController) kubernetesCheckpoint(ctx context.Context, req *Ch
 	}
 
 	// Fallback: Use kubelet checkpoint API directly
-	kubeletEndpoint := fmt.Sprintf("https://localhost:10250/checkpoint/%s/%s/%s",
-		req.Namespace, req.PodName, req.ContainerName)
+	kubeletEndpoint := fmt.Sprintf("%s/checkpoint/%s/%s/%s",
+		strings.TrimSuffix(c.Kubelet.Address, "/"), req.Namespace, req.PodName, req.ContainerName)
 
 	curlCmd := exec.CommandContext(ctx, "curl", "-k", "-X", "POST",
-		"--cert", "/var/snap/microk8s/current/certs/kubelet.crt",
-		"--key", "/var/snap/microk8s/current/certs/kubelet.key",
+		"--cert", c.Kubelet.Cert,
+		"--key", c.Kubelet.Key,
 		kubeletEndpoint,
 	)
 	output, err = curlCmd.CombinedOutput()
@@ -141,6 +196,11 @@ type RestoreRequest struct {
 	PodName        string
 	ContainerName  string
 	CheckpointPath string
+	// CUDATimeout bounds restore + unlock; 0 uses the controller default
+	CUDATimeout time.Duration
+	// CompatPolicy decides whether a checkpoint of an unlike node is
+	// refused; "" uses compat.DefaultPolicy
+	CompatPolicy compat.Policy
 }
 
 // RestoreResult contains the result of a restore operation
@@ -149,7 +209,11 @@ type RestoreResult struct {
 	NewGPUPID      int
 	CUDAState      string
 	Duration       time.Duration
-	Error          error
+	// Manifest describes the checkpoint that was restored
+	Manifest *manifest.Manifest
+	// Compat compares this node with the checkpoint's, if it records one
+	Compat *compat.Report
+	Error  error
 }
 
 // Restore performs a full GPU container restore
@@ -160,6 +224,25 @@ func (c *CheckpointController) Restore(ctx context.Context, req *RestoreRequest)
 	start := time.Now()
 	result := &RestoreResult{}
 
+	meta, err := manifest.Read(req.CheckpointPath)
+	if err != nil {
+		result.Error = fmt.Errorf("invalid checkpoint: %w", err)
+		return result
+	}
+	result.Manifest = meta
+
+	if meta.Host != nil {
+		policy := req.CompatPolicy
+		if policy == "" {
+			policy = compat.DefaultPolicy
+		}
+		result.Compat = compat.Compare(meta.Host, compat.Probe(), meta.GPU != nil && meta.Degraded == nil)
+		if err := result.Compat.Check(policy); err != nil {
+			result.Error = err
+			return result
+		}
+	}
+
 	// Stage 1: Create container from checkpoint
 	containerID, gpuPID, err := c.restoreFromCheckpoint(ctx, req)
 	if err != nil {
@@ -179,7 +262,10 @@ func (c *CheckpointController) Restore(ctx context.Context, req *RestoreRequest)
 
 		if state == cuda.StateCheckpointed {
 			// Perform CUDA restore: Restore + Unlock (RAM → VRAM)
-			if err := c.cudaCheckpointer.RestoreFull(gpuPID); err != nil {
+			cudaCtx, cancel := context.WithTimeout(ctx, orDefault(req.CUDATimeout, c.Timeouts.Restore))
+			err := c.cudaCheckpointer.RestoreFullContext(cudaCtx, gpuPID)
+			cancel()
+			if err != nil {
 				result.Error = fmt.Errorf("CUDA restore failed: %w", err)
 				return result
 			}
@@ -212,37 +298,13 @@ func (c *CheckpointController) restoreFromCheckpoint(ctx context.Context, req *R
 
 // FindGPUProcess finds the GPU process PID for a container
 func (c *CheckpointController) FindGPUProcess(containerID string) (int, error) {
-	// Get container init PID from runc state
-	statePath := filepath.Join("/run/containerd/runc/k8s.io", containerID, "state.json")
-
-	// Read state.json to get init PID
-	// Then find GPU child process using nvidia-smi
-
-	cmd := exec.Command("nvidia-smi", "--query-compute-apps=pid", "--format=csv,noheader")
-	output, err := cmd.Output()
-	if err != nil {
-		return 0, nil // No GPU processes
-	}
-
-	for _, line := range strings.Split(string(output), "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-		var pid int
-		fmt.Sscanf(line, "%d", &pid)
+	pid, _ := cuda.FindGPUProcessForContainer(containerID)
+	return pid, nil
+}
 
-		// Check if this PID belongs to the container
-		// by checking /proc/PID/cgroup
-		cgroupPath := fmt.Sprintf("/proc/%d/cgroup", pid)
-		data, err := os.ReadFile(cgroupPath)
-		if err != nil {
-			continue
-		}
-		if strings.Contains(string(data), containerID) {
-			return pid, nil
-		}
+func orDefault(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
 	}
-
-	return 0, nil
+	return def
 }
@@ -0,0 +1,154 @@
+package checkpoint
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kybernate/kybernate/pkg/cuda"
+	"github.com/kybernate/kybernate/pkg/manifest"
+)
+
+const (
+	testGPU  = "GPU-00000000-0000-0000-0000-000000000001"
+	testVRAM = 64 << 20
+)
+
+// newSimController returns a controller on a simulated GPU, on which the
+// test process is a running CUDA process, and the simulated driver
+func newSimController(t *testing.T) (*CheckpointController, *cuda.SimDriver, int) {
+	t.Helper()
+	pid := os.Getpid()
+	uuid, err := cuda.ParseUUID(testGPU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim := cuda.NewSimDriver(uuid)
+	if err := sim.AddProcess(pid, "trainer", testVRAM, uuid); err != nil {
+		t.Fatalf("AddProcess: %v", err)
+	}
+	cuda.SetDiscoverer(&cuda.FixtureDiscoverer{Fixture: cuda.GPUFixture{
+		Devices:   []cuda.GPUDevice{{Index: 0, UUID: testGPU, Name: "Simulated GPU"}},
+		Processes: []cuda.GPUProcess{{PID: pid, UsedMemory: testVRAM, Name: "trainer", GPUUUID: testGPU}},
+	}})
+	t.Cleanup(func() { cuda.SetDiscoverer(nil) })
+
+	ckpt, err := cuda.NewCheckpointerWithDriver(sim)
+	if err != nil {
+		t.Fatalf("NewCheckpointerWithDriver: %v", err)
+	}
+	c := &CheckpointController{
+		cudaCheckpointer: ckpt,
+		checkpointDir:    t.TempDir(),
+		Timeouts:         cuda.DefaultTimeouts,
+	}
+	return c, sim, pid
+}
+
+func expectState(t *testing.T, sim *cuda.SimDriver, pid int, want cuda.ProcessState) {
+	t.Helper()
+	p, ok := sim.Process(pid)
+	if !ok {
+		t.Fatalf("simulated process %d is gone", pid)
+	}
+	if p.State != want {
+		t.Fatalf("simulated process is %s, want %s", p.State, want)
+	}
+}
+
+func TestControllerCheckpoint(t *testing.T) {
+	c, sim, pid := newSimController(t)
+	var dumped cuda.ProcessState
+	c.dump = func(ctx context.Context, req *CheckpointRequest, dir string) error {
+		// CRIU only runs once the device memory is in host memory
+		p, _ := sim.Process(pid)
+		dumped = p.State
+		return os.WriteFile(filepath.Join(dir, "pages-1.img"), []byte("dump"), 0644)
+	}
+
+	req := &CheckpointRequest{Namespace: "ml", PodName: "trainer-0", ContainerName: "trainer", ContainerID: "abc", GPUProcessPID: pid, CorrelationID: "ckpt-1"}
+	result := c.Checkpoint(context.Background(), req)
+	if result.Error != nil {
+		t.Fatalf("Checkpoint: %v", result.Error)
+	}
+	if dumped != cuda.StateCheckpointed {
+		t.Errorf("CRIU ran while the process was %s, want checkpointed", dumped)
+	}
+	expectState(t, sim, pid, cuda.StateCheckpointed)
+	if result.CUDAState != "checkpointed" {
+		t.Errorf("CUDAState = %q, want checkpointed", result.CUDAState)
+	}
+	if want := filepath.Join(c.checkpointDir, "ml", "trainer-0", "trainer"); result.CheckpointPath != want {
+		t.Errorf("CheckpointPath = %s, want %s", result.CheckpointPath, want)
+	}
+
+	meta, err := manifest.Read(result.CheckpointPath)
+	if err != nil {
+		t.Fatalf("manifest: %v", err)
+	}
+	if meta.Tool != "checkpoint-controller" || meta.CorrelationID != "ckpt-1" || meta.Workload.Pod != "trainer-0" {
+		t.Errorf("manifest = %+v, want the controller's checkpoint of trainer-0", meta)
+	}
+	if meta.GPU == nil || len(meta.GPU.Processes) != 1 || meta.GPU.Processes[0].State != cuda.StateCheckpointed.String() {
+		t.Errorf("manifest GPU = %+v, want one checkpointed process", meta.GPU)
+	}
+	if meta.Timings.CUDACheckpoint <= 0 || meta.Timings.Total < meta.Timings.CUDACheckpoint {
+		t.Errorf("manifest timings = %+v", meta.Timings)
+	}
+}
+
+func TestControllerCheckpointDumpFails(t *testing.T) {
+	c, sim, pid := newSimController(t)
+	c.dump = func(context.Context, *CheckpointRequest, string) error {
+		return errors.New("kubelet refused")
+	}
+
+	result := c.Checkpoint(context.Background(), &CheckpointRequest{Namespace: "ml", PodName: "trainer-0", ContainerName: "trainer", GPUProcessPID: pid})
+	if result.Error == nil {
+		t.Fatal("Checkpoint succeeded although the dump failed")
+	}
+	// The workload keeps running with its device memory
+	expectState(t, sim, pid, cuda.StateRunning)
+	if _, err := manifest.Read(result.CheckpointPath); !errors.Is(err, manifest.ErrNotFound) {
+		t.Errorf("manifest of a failed checkpoint: %v", err)
+	}
+}
+
+func TestControllerCheckpointCUDAFails(t *testing.T) {
+	c, sim, pid := newSimController(t)
+	dumped := false
+	c.dump = func(context.Context, *CheckpointRequest, string) error {
+		dumped = true
+		return nil
+	}
+	if err := sim.FailNext(cuda.SimOpCheckpoint, cuda.ErrCodeNotReady); err != nil {
+		t.Fatal(err)
+	}
+
+	result := c.Checkpoint(context.Background(), &CheckpointRequest{Namespace: "ml", PodName: "trainer-0", ContainerName: "trainer", GPUProcessPID: pid})
+	var cudaErr *cuda.CUDAError
+	if !errors.As(result.Error, &cudaErr) || cudaErr.Code != cuda.ErrCodeNotReady {
+		t.Fatalf("Checkpoint error = %v, want the injected CUDA error", result.Error)
+	}
+	if dumped {
+		t.Error("CRIU ran after the CUDA checkpoint failed")
+	}
+	expectState(t, sim, pid, cuda.StateRunning)
+}
+
+func TestControllerCheckpointWithoutGPU(t *testing.T) {
+	c, sim, pid := newSimController(t)
+	c.dump = func(context.Context, *CheckpointRequest, string) error { return nil }
+
+	result := c.Checkpoint(context.Background(), &CheckpointRequest{Namespace: "ml", PodName: "web-0", ContainerName: "web"})
+	if result.Error != nil {
+		t.Fatalf("Checkpoint: %v", result.Error)
+	}
+	if result.Manifest.GPU != nil {
+		t.Errorf("manifest GPU = %+v for a CPU-only checkpoint", result.Manifest.GPU)
+	}
+	// Other CUDA processes of the node are left alone
+	expectState(t, sim, pid, cuda.StateRunning)
+}
@@ -0,0 +1,234 @@
+package compat
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Level classifies how well a node matches the one a checkpoint was
+// taken on
+type Level int
+
+const (
+	// Compatible nodes restore the checkpoint as they would on its own
+	Compatible Level = iota
+	// Warning nodes differ in ways that usually do not matter
+	Warning
+	// Incompatible nodes cannot restore the GPU state of the checkpoint
+	Incompatible
+)
+
+func (l Level) String() string {
+	switch l {
+	case Compatible:
+		return "compatible"
+	case Warning:
+		return "warning"
+	case Incompatible:
+		return "incompatible"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// MarshalText writes the level by name
+func (l Level) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// Finding is one difference between the nodes
+type Finding struct {
+	Level Level `json:"level"`
+	// Component is what differs, e.g. nvidia-driver
+	Component string `json:"component"`
+	Message   string `json:"message"`
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %s: %s", f.Level, f.Component, f.Message)
+}
+
+// Report is the result of comparing two nodes
+type Report struct {
+	// Level is the highest level of the findings
+	Level    Level     `json:"level"`
+	Findings []Finding `json:"findings,omitempty"`
+}
+
+func (r *Report) add(level Level, component, format string, args ...any) {
+	r.Findings = append(r.Findings, Finding{Level: level, Component: component, Message: fmt.Sprintf(format, args...)})
+	if level > r.Level {
+		r.Level = level
+	}
+}
+
+// Summary describes the report on one line
+func (r *Report) Summary() string {
+	if len(r.Findings) == 0 {
+		return r.Level.String()
+	}
+	return fmt.Sprintf("%s (%s)", r.Level, r.messages())
+}
+
+func (r *Report) messages() string {
+	messages := make([]string, len(r.Findings))
+	for i, f := range r.Findings {
+		messages[i] = f.Component + ": " + f.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Compare checks whether target can restore a checkpoint taken on
+// recorded. gpuState tells whether the checkpoint holds GPU state; one
+// without only needs the GPU stack for the libraries it mounts, so a
+// different driver is then merely a warning. Anything recorded as
+// unknown is not compared.
+func Compare(recorded, target *Host, gpuState bool) *Report {
+	r := &Report{}
+	if recorded == nil {
+		return r
+	}
+	gpuLevel := Warning
+	if gpuState {
+		gpuLevel = Incompatible
+	}
+
+	switch {
+	case recorded.NVIDIADriver == "":
+	case target.NVIDIADriver == "":
+		r.add(gpuLevel, "nvidia-driver", "no driver loaded, checkpoint taken with %s", recorded.NVIDIADriver)
+	case branch(recorded.NVIDIADriver) != branch(target.NVIDIADriver):
+		r.add(gpuLevel, "nvidia-driver", "driver %s is not of the %s branch the checkpoint was taken with (%s)",
+			target.NVIDIADriver, branch(recorded.NVIDIADriver), recorded.NVIDIADriver)
+	case recorded.NVIDIADriver != target.NVIDIADriver:
+		r.add(Warning, "nvidia-driver", "driver %s, checkpoint taken with %s", target.NVIDIADriver, recorded.NVIDIADriver)
+	}
+
+	if recorded.CUDADriver != "" && target.CUDADriver != "" && compareVersions(target.CUDADriver, recorded.CUDADriver) < 0 {
+		r.add(gpuLevel, "cuda-driver", "CUDA %s is older than the CUDA %s the checkpoint was taken with",
+			target.CUDADriver, recorded.CUDADriver)
+	}
+
+	if gpuState {
+		compareGPUs(r, recorded.GPUs, target.GPUs)
+	}
+
+	if recorded.Kernel != "" && target.Kernel != "" && recorded.Kernel != target.Kernel {
+		r.add(Warning, "kernel", "kernel %s, checkpoint taken on %s", target.Kernel, recorded.Kernel)
+	}
+
+	switch {
+	case recorded.CRIU == "":
+	case target.CRIU == "":
+		r.add(Incompatible, "criu", "criu not found, checkpoint taken with %s", recorded.CRIU)
+	case compareVersions(target.CRIU, recorded.CRIU) < 0:
+		r.add(Warning, "criu", "criu %s is older than the %s the checkpoint was taken with", target.CRIU, recorded.CRIU)
+	}
+
+	compareLibraries(r, recorded.Libraries)
+	return r
+}
+
+// compareGPUs needs a target GPU of the same architecture for every GPU
+// the workload used. GPUs are matched by compute capability, or by name
+// where it is unknown.
+func compareGPUs(r *Report, recorded, target []GPU) {
+	if len(recorded) == 0 {
+		return
+	}
+	if len(target) < len(recorded) {
+		r.add(Incompatible, "gpu", "%d GPU(s) available, the checkpoint used %d", len(target), len(recorded))
+		return
+	}
+	used := make([]bool, len(target))
+	for _, want := range recorded {
+		match, exact := -1, false
+		for i, have := range target {
+			if used[i] || !sameArchitecture(want, have) {
+				continue
+			}
+			if match < 0 || (!exact && want.Name == have.Name) {
+				match, exact = i, want.Name == have.Name
+			}
+		}
+		if match < 0 {
+			r.add(Incompatible, "gpu", "no GPU like the %s the checkpoint used", describeGPU(want))
+			continue
+		}
+		used[match] = true
+		have := target[match]
+		switch {
+		case want.ComputeCapability == "" || have.ComputeCapability == "":
+			r.add(Warning, "gpu", "compute capability of %s unknown", have.Name)
+		case !exact:
+			r.add(Warning, "gpu", "%s in place of the %s the checkpoint used", describeGPU(have), describeGPU(want))
+		}
+	}
+}
+
+func sameArchitecture(a, b GPU) bool {
+	if a.ComputeCapability == "" || b.ComputeCapability == "" {
+		return a.Name == b.Name
+	}
+	return a.ComputeCapability == b.ComputeCapability
+}
+
+func describeGPU(g GPU) string {
+	if g.ComputeCapability == "" {
+		return g.Name
+	}
+	return fmt.Sprintf("%s (compute %s)", g.Name, g.ComputeCapability)
+}
+
+// compareLibraries checks that the libraries the container had mounted
+// are on this node. A library that changed is reported; whether it
+// matters depends on the driver findings.
+func compareLibraries(r *Report, libs []Library) {
+	var changed []string
+	for _, lib := range libs {
+		if _, err := os.Stat(lib.Source); err != nil {
+			r.add(Incompatible, "library", "%s is not on this node", lib.Source)
+			continue
+		}
+		sum, err := hashFile(lib.Source)
+		if err != nil {
+			r.add(Warning, "library", "%s cannot be read: %v", lib.Source, err)
+			continue
+		}
+		if sum != lib.SHA256 {
+			changed = append(changed, lib.Source)
+		}
+	}
+	if len(changed) > 0 {
+		r.add(Warning, "library", "changed since the checkpoint: %s", strings.Join(changed, ", "))
+	}
+}
+
+// branch returns the major version of a driver, e.g. 535 of 535.104.05
+func branch(version string) string {
+	major, _, _ := strings.Cut(version, ".")
+	return major
+}
+
+// compareVersions compares dotted versions numerically, treating a
+// missing or non-numeric part as zero
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,177 @@
+// Package compat records the GPU driver stack of the node a checkpoint
+// is taken on and checks whether another node can restore it. A CUDA
+// checkpoint holds driver state, and the container runs the driver
+// libraries of the node it was started on, so a different driver, GPU
+// architecture or CRIU may restore it badly or not at all.
+package compat
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+
+	"github.com/kybernate/kybernate/pkg/cuda"
+	"github.com/kybernate/kybernate/pkg/gpuenv"
+)
+
+// Host describes the GPU driver stack of a node
+type Host struct {
+	// NVIDIADriver is the version of the kernel driver, e.g. 535.104.05
+	NVIDIADriver string `json:"nvidiaDriver,omitempty"`
+	// CUDADriver is the CUDA driver API version, e.g. 12.8
+	CUDADriver string `json:"cudaDriver,omitempty"`
+	// GPUs are the GPUs the workload used, or that it can use on restore
+	GPUs   []GPU  `json:"gpus,omitempty"`
+	Kernel string `json:"kernel,omitempty"`
+	CRIU   string `json:"criu,omitempty"`
+	// Libraries are the NVIDIA libraries mounted into the container
+	Libraries []Library `json:"libraries,omitempty"`
+}
+
+// GPU is a GPU model
+type GPU struct {
+	UUID string `json:"uuid"`
+	Name string `json:"name,omitempty"`
+	// ComputeCapability is major.minor, e.g. 8.6
+	ComputeCapability string `json:"computeCapability,omitempty"`
+}
+
+// Library is a driver library bind-mounted into the container
+type Library struct {
+	// Path is the path in the container
+	Path string `json:"path"`
+	// Source is the path on the node
+	Source string `json:"source"`
+	SHA256 string `json:"sha256"`
+}
+
+// Probe describes this node with all of its GPUs. What cannot be
+// determined is left empty.
+func Probe() *Host {
+	h := &Host{
+		NVIDIADriver: gpuenv.DriverVersion(),
+		Kernel:       kernelRelease(),
+		CRIU:         criuVersion(),
+	}
+	if version := cuda.ProbeDriver().DriverVersion; version > 0 {
+		h.CUDADriver = cuda.FormatDriverVersion(version)
+	}
+	if devices, err := cuda.ListGPUs(); err == nil {
+		for _, dev := range devices {
+			h.GPUs = append(h.GPUs, GPU{UUID: dev.UUID, Name: dev.Name, ComputeCapability: dev.ComputeCapability})
+		}
+	}
+	return h
+}
+
+// Describe describes this node for a checkpoint: the GPUs with the given
+// UUIDs, which the workload used, and the libraries among the mounts of
+// env (nil if unknown)
+func Describe(env *gpuenv.Environment, uuids []string) *Host {
+	h := Probe().OnlyGPUs(uuids)
+	if env != nil {
+		h.Libraries = HashLibraries(env.Mounts)
+	}
+	return h
+}
+
+// ForProcess describes this node for a checkpoint of the container of
+// pid, whose workload used the GPUs with the given UUIDs
+func ForProcess(pid int, uuids []string) *Host {
+	rules, _ := gpuenv.RulesFromEnv(gpuenv.DefaultRules)
+	env, err := gpuenv.Capture(pid, rules)
+	if err != nil {
+		env = nil
+	}
+	return Describe(env, uuids)
+}
+
+// OnlyGPUs keeps the GPUs with the given UUIDs
+func (h *Host) OnlyGPUs(uuids []string) *Host {
+	var gpus []GPU
+	for _, gpu := range h.GPUs {
+		for _, uuid := range uuids {
+			if gpu.UUID == uuid {
+				gpus = append(gpus, gpu)
+				break
+			}
+		}
+	}
+	h.GPUs = gpus
+	return h
+}
+
+// MoveLibraries points the recorded libraries at the files that replace
+// them on this node, by recorded source
+func (h *Host) MoveLibraries(moved map[string]string) {
+	for i, lib := range h.Libraries {
+		if source, ok := moved[lib.Source]; ok {
+			h.Libraries[i].Source = source
+		}
+	}
+}
+
+// HashLibraries hashes the shared libraries bind-mounted by mounts
+func HashLibraries(mounts []specs.Mount) []Library {
+	var libs []Library
+	for _, m := range mounts {
+		if m.Type != "bind" || !isLibrary(m.Destination) {
+			continue
+		}
+		sum, err := hashFile(m.Source)
+		if err != nil {
+			continue
+		}
+		libs = append(libs, Library{Path: m.Destination, Source: m.Source, SHA256: sum})
+	}
+	return libs
+}
+
+func isLibrary(p string) bool {
+	ok, _ := path.Match("*.so*", path.Base(p))
+	return ok
+}
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func kernelRelease() string {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return ""
+	}
+	return unix.ByteSliceToString(uts.Release[:])
+}
+
+// criuVersion parses "Version: 3.19" from criu --version
+func criuVersion() string {
+	output, err := exec.Command("criu", "--version").Output()
+	if err != nil {
+		return ""
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "Version:"); ok {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,29 @@
+package compat
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kybernate/kybernate/pkg/cuda"
+)
+
+func TestProbeTakesGPUsFromDiscovery(t *testing.T) {
+	cuda.SetDiscoverer(&cuda.FixtureDiscoverer{Fixture: cuda.GPUFixture{
+		Devices: []cuda.GPUDevice{
+			{Index: 0, UUID: "GPU-00000000-0000-0000-0000-000000000001", Name: "NVIDIA A100", ComputeCapability: "8.0"},
+			{Index: 1, UUID: "GPU-00000000-0000-0000-0000-000000000002", Name: "Tesla T4"},
+		},
+	}})
+	t.Cleanup(func() { cuda.SetDiscoverer(nil) })
+
+	want := []GPU{
+		{UUID: "GPU-00000000-0000-0000-0000-000000000001", Name: "NVIDIA A100", ComputeCapability: "8.0"},
+		{UUID: "GPU-00000000-0000-0000-0000-000000000002", Name: "Tesla T4"},
+	}
+	if got := Probe().GPUs; !reflect.DeepEqual(got, want) {
+		t.Errorf("Probe().GPUs = %+v, want %+v", got, want)
+	}
+	if got := Probe().OnlyGPUs([]string{want[1].UUID}).GPUs; !reflect.DeepEqual(got, want[1:]) {
+		t.Errorf("OnlyGPUs() = %+v, want %+v", got, want[1:])
+	}
+}
@@ -0,0 +1,70 @@
+package compat
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Policy decides which restores a report refuses
+type Policy string
+
+const (
+	// PolicyWarn restores whatever the report says, logging the findings
+	PolicyWarn Policy = "warn"
+	// PolicyEnforce refuses incompatible nodes and warns otherwise
+	PolicyEnforce Policy = "enforce"
+	// PolicyStrict refuses any node that is not fully compatible
+	PolicyStrict Policy = "strict"
+)
+
+// Annotation and environment variable selecting the policy
+const (
+	PolicyAnnotation = "kybernate.io/compat-policy"
+	PolicyEnv        = "KYBERNATE_COMPAT_POLICY"
+)
+
+// DefaultPolicy refuses restores that could not work anyway
+const DefaultPolicy = PolicyEnforce
+
+// ParsePolicy parses "warn", "enforce" or "strict"; an empty string
+// yields def
+func ParsePolicy(s string, def Policy) (Policy, error) {
+	switch p := Policy(strings.ToLower(strings.TrimSpace(s))); p {
+	case "":
+		return def, nil
+	case PolicyWarn, PolicyEnforce, PolicyStrict:
+		return p, nil
+	}
+	return def, fmt.Errorf("invalid compat policy %q (expected %q, %q or %q)", s, PolicyWarn, PolicyEnforce, PolicyStrict)
+}
+
+// PolicyFromEnv returns def overridden by KYBERNATE_COMPAT_POLICY
+func PolicyFromEnv(def Policy) (Policy, error) {
+	return ParsePolicy(os.Getenv(PolicyEnv), def)
+}
+
+// PolicyFromAnnotations returns def overridden by the workload's
+// kybernate.io/compat-policy annotation
+func PolicyFromAnnotations(annotations map[string]string, def Policy) (Policy, error) {
+	return ParsePolicy(annotations[PolicyAnnotation], def)
+}
+
+// Refuses reports whether the policy refuses a restore at level
+func (p Policy) Refuses(level Level) bool {
+	switch p {
+	case PolicyWarn:
+		return false
+	case PolicyStrict:
+		return level >= Warning
+	}
+	return level >= Incompatible
+}
+
+// Check returns an error if policy refuses the restore r describes
+func (r *Report) Check(policy Policy) error {
+	if !policy.Refuses(r.Level) {
+		return nil
+	}
+	return fmt.Errorf("node is %s with the checkpoint under the %s compat policy: %s", r.Level, policy, r.messages())
+}
@@ -0,0 +1,337 @@
+// Package config is the host configuration shared by the shim,
+// kybernate-runtime and kybernate-ctl: where containerd and runc keep
+// their state, which runtimes to run, where kybernate keeps its own state
+// and logs, default timeouts and feature toggles.
+//
+// A configuration starts from the built-in profile of the distribution
+// (vanilla containerd, microk8s or k3s), detected unless the file names
+// one. A YAML file overrides the profile field by field; the shim also
+// reads the file named by ConfigPath in its containerd runtime options.
+// Environment variables such as KYBERNATE_LOG_LEVEL or
+// KYBERNATE_CUDA_*_TIMEOUT still override the configuration.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/kybernate/kybernate/pkg/cuda"
+	"github.com/kybernate/kybernate/pkg/export"
+	"github.com/kybernate/kybernate/pkg/logging"
+)
+
+const (
+	// DefaultPath is read if it exists and KYBERNATE_CONFIG names no file
+	DefaultPath = "/etc/kybernate/config.yaml"
+	// PathEnv names the configuration file
+	PathEnv = "KYBERNATE_CONFIG"
+	// ProfileEnv selects the profile of a configuration that names none
+	ProfileEnv = "KYBERNATE_PROFILE"
+)
+
+// Config is the configuration of a node
+type Config struct {
+	// Profile is the built-in profile the configuration starts from:
+	// containerd, microk8s, k3s, or auto to detect it
+	Profile    string     `yaml:"profile"`
+	Containerd Containerd `yaml:"containerd"`
+	Runtime    Runtime    `yaml:"runtime"`
+	Paths      Paths      `yaml:"paths"`
+	Kubelet    Kubelet    `yaml:"kubelet"`
+	// Timeouts bound the CUDA stages of workloads without annotations,
+	// e.g. checkpoint: 90s
+	Timeouts cuda.Timeouts `yaml:"timeouts"`
+	// Export hands checkpoints of workloads without annotation on, see
+	// package export
+	Export export.Spec `yaml:"export"`
+	// Exporters are the exporters workloads may select by name with the
+	// kybernate.io/checkpoint-export annotation, e.g. archive: tar:/mnt/archive
+	Exporters export.Exporters `yaml:"exporters"`
+	Log       Log              `yaml:"log"`
+	Features  Features         `yaml:"features"`
+	Debug     Debug            `yaml:"debug"`
+
+	// Source is the file or runtime option the configuration was read
+	// from, "" for a built-in profile
+	Source string `yaml:"-"`
+}
+
+// Containerd locates the state of containerd
+type Containerd struct {
+	// StateDir is containerd's state directory (its --state)
+	StateDir string `yaml:"state_dir"`
+	// Namespace is the containerd namespace of Kubernetes containers
+	Namespace string `yaml:"namespace"`
+	// Address is containerd's socket
+	Address string `yaml:"address"`
+	// Ctr is the ctr binary kybernate-ctl looks containers up with if
+	// crictl cannot; "" skips that lookup
+	Ctr string `yaml:"ctr"`
+}
+
+// Runtime names the OCI runtimes
+type Runtime struct {
+	// Runc is the runc binary the shim creates containers with and
+	// kybernate-ctl checkpoints them with
+	Runc string `yaml:"runc"`
+	// Root is runc's state root, without the namespace
+	Root string `yaml:"root"`
+	// SystemdCgroup makes runc manage cgroups through systemd
+	SystemdCgroup bool `yaml:"systemd_cgroup"`
+	// Nvidia is the runtime the shim creates GPU workloads with; ""
+	// creates them with runc
+	Nvidia string `yaml:"nvidia"`
+	// Delegates are the runtimes kybernate-runtime passes commands on to;
+	// the first one found is used
+	Delegates []string `yaml:"delegates"`
+}
+
+// Paths are where kybernate keeps its own files
+type Paths struct {
+	// StateDir holds the locks, the journal, suspend records and restore
+	// status of every tool
+	StateDir string `yaml:"state_dir"`
+	// CheckpointDir is where kybernate-ctl writes checkpoints
+	CheckpointDir string `yaml:"checkpoint_dir"`
+}
+
+// Kubelet is how the checkpoint controller reaches the kubelet's
+// checkpoint API
+type Kubelet struct {
+	Address string `yaml:"address"`
+	Cert    string `yaml:"cert"`
+	Key     string `yaml:"key"`
+}
+
+// Log selects the logging of every tool; empty fields keep the tool's
+// default
+type Log struct {
+	Level  string `yaml:"level"`
+	Output string `yaml:"output"`
+	Format string `yaml:"format"`
+	// Dir holds the log file of each tool, <dir>/<tool>.log
+	Dir        string `yaml:"dir"`
+	MaxSize    int64  `yaml:"max_size"`
+	MaxBackups int    `yaml:"max_backups"`
+}
+
+// Features turns behaviour of the shim on or off
+type Features struct {
+	// SuspendOnPause offloads VRAM when containerd pauses a task, unless
+	// a workload's annotation says otherwise
+	SuspendOnPause bool `yaml:"suspend_on_pause"`
+	// Reconcile closes operations left open by crashed tools when a shim
+	// or kybernate-ctl starts
+	Reconcile bool `yaml:"reconcile"`
+}
+
+// Debug makes the shim keep what it needs to reproduce a problem by hand
+type Debug struct {
+	// Enabled writes the config.json of every container the shim creates,
+	// and of a restored one once the NVIDIA environment is injected, to
+	// Dir. Specs may hold secrets, so this is off by default.
+	Enabled bool   `yaml:"enabled"`
+	Dir     string `yaml:"dir"`
+}
+
+// Load reads the configuration file at path, or the one KYBERNATE_CONFIG
+// names, or DefaultPath if it exists. Without a file the configuration is
+// the detected profile. On error, the profile is returned with it.
+func Load(path string) (*Config, error) {
+	if path == "" {
+		path = strings.TrimSpace(os.Getenv(PathEnv))
+	}
+	if path == "" {
+		if _, err := os.Stat(DefaultPath); err != nil {
+			return Detected(), nil
+		}
+		path = DefaultPath
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Detected(), err
+	}
+	cfg, err := Parse(data)
+	if err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	cfg.Source = path
+	return cfg, nil
+}
+
+// Parse decodes a YAML configuration on top of the profile it names, or
+// of the detected one
+func Parse(data []byte) (*Config, error) {
+	var head struct {
+		Profile string `yaml:"profile"`
+	}
+	if err := yaml.Unmarshal(data, &head); err != nil {
+		return Detected(), err
+	}
+	cfg, err := Profile(head.Profile)
+	if err != nil {
+		return Detected(), err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return Detected(), err
+	}
+	if err := cfg.Validate(); err != nil {
+		return Detected(), err
+	}
+	return cfg, nil
+}
+
+// Validate reports settings that cannot work
+func (c *Config) Validate() error {
+	var errs []string
+	for _, p := range []struct{ name, path string }{
+		{"containerd.state_dir", c.Containerd.StateDir},
+		{"containerd.address", c.Containerd.Address},
+		{"runtime.root", c.Runtime.Root},
+		{"paths.state_dir", c.Paths.StateDir},
+		{"paths.checkpoint_dir", c.Paths.CheckpointDir},
+		{"log.dir", c.Log.Dir},
+		{"debug.dir", c.Debug.Dir},
+	} {
+		if !filepath.IsAbs(p.path) {
+			errs = append(errs, fmt.Sprintf("%s must be an absolute path, not %q", p.name, p.path))
+		}
+	}
+	if c.Containerd.Namespace == "" {
+		errs = append(errs, "containerd.namespace is empty")
+	}
+	if c.Runtime.Runc == "" {
+		errs = append(errs, "runtime.runc is empty")
+	}
+	if c.Timeouts.Checkpoint <= 0 || c.Timeouts.Restore <= 0 {
+		errs = append(errs, "timeouts must be positive")
+	}
+	names := make([]string, 0, len(c.Exporters))
+	for name := range c.Exporters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !export.ValidName(name) {
+			errs = append(errs, fmt.Sprintf("exporters: invalid name %q (lowercase letters, digits and dashes, other than none)", name))
+		}
+	}
+	if _, err := c.Logging("", logging.Config{}); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// TaskDir is where containerd keeps the state of its shims' tasks,
+// <dir>/<id>/init.pid
+func (c *Config) TaskDir() string {
+	return filepath.Join(c.Containerd.StateDir, "io.containerd.runtime.v2.task", c.Containerd.Namespace)
+}
+
+// RuncRoot is runc's state root for the namespace, <root>/<id>/state.json
+func (c *Config) RuncRoot() string {
+	return filepath.Join(c.Runtime.Root, c.Containerd.Namespace)
+}
+
+// Delegate returns the first of the runtime's delegates found on the node
+func (c *Config) Delegate() (string, error) {
+	for _, name := range c.Runtime.Delegates {
+		if path, err := exec.LookPath(name); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("none of the OCI runtimes %s found", strings.Join(c.Runtime.Delegates, ", "))
+}
+
+// JournalDir holds the operation journals, see package journal
+func (c *Config) JournalDir() string {
+	return filepath.Join(c.Paths.StateDir, "journal")
+}
+
+// LockDir holds the container locks, see package oplock
+func (c *Config) LockDir() string {
+	return filepath.Join(c.Paths.StateDir, "locks")
+}
+
+// SuspendDir holds the records of suspended containers, see package suspend
+func (c *Config) SuspendDir() string {
+	return filepath.Join(c.Paths.StateDir, "suspended")
+}
+
+// RestoreDir holds the restore status of containers, see package readiness
+func (c *Config) RestoreDir() string {
+	return filepath.Join(c.Paths.StateDir, "restore")
+}
+
+// LogFile is the log file of tool
+func (c *Config) LogFile(tool string) string {
+	return filepath.Join(c.Log.Dir, tool+".log")
+}
+
+// FallbackLogFile is where tool logs if its log file cannot be written
+func FallbackLogFile(tool string) string {
+	return filepath.Join(os.TempDir(), tool+".log")
+}
+
+// Logging returns the logging configuration of tool: def, with the file
+// of tool and overridden by the configured fields
+func (c *Config) Logging(tool string, def logging.Config) (logging.Config, error) {
+	if tool != "" {
+		def.File = c.LogFile(tool)
+	}
+	cfg := def
+	level, err := logging.ParseLevel(c.Log.Level, def.Level)
+	if err != nil {
+		return def, fmt.Errorf("log.level: %w", err)
+	}
+	cfg.Level = level
+	switch o := logging.Output(c.Log.Output); o {
+	case "":
+	case logging.OutputFile, logging.OutputStderr, logging.OutputContainerd:
+		cfg.Output = o
+	default:
+		return def, fmt.Errorf("log.output: invalid output %q (expected file, stderr or containerd)", o)
+	}
+	switch f := logging.Format(c.Log.Format); f {
+	case "":
+	case logging.FormatText, logging.FormatJSON:
+		cfg.Format = f
+	default:
+		return def, fmt.Errorf("log.format: invalid format %q (expected text or json)", f)
+	}
+	if c.Log.MaxSize < 0 || c.Log.MaxBackups < 0 {
+		return def, errors.New("log.max_size and log.max_backups must not be negative")
+	}
+	if c.Log.MaxSize > 0 {
+		cfg.MaxSize = c.Log.MaxSize
+	}
+	if c.Log.MaxBackups > 0 {
+		cfg.MaxBackups = c.Log.MaxBackups
+	}
+	return cfg, nil
+}
+
+// Attrs describe the configuration in a log record
+func (c *Config) Attrs() []any {
+	source := c.Source
+	if source == "" {
+		source = "built-in"
+	}
+	return []any{"profile", c.Profile, "source", source}
+}
@@ -0,0 +1,230 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kybernate/kybernate/pkg/logging"
+)
+
+func TestProfiles(t *testing.T) {
+	for _, name := range []string{ProfileContainerd, ProfileMicroK8s, ProfileK3s} {
+		cfg, err := Profile(name)
+		if err != nil {
+			t.Fatalf("Profile(%s): %v", name, err)
+		}
+		if cfg.Profile != name {
+			t.Errorf("Profile(%s) is named %s", name, cfg.Profile)
+		}
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("built-in profile %s: %v", name, err)
+		}
+	}
+	if _, err := Profile("docker"); err == nil {
+		t.Error("unknown profile accepted")
+	}
+
+	t.Setenv(ProfileEnv, "K3S")
+	if cfg, err := Profile(""); err != nil || cfg.Profile != ProfileK3s {
+		t.Errorf("Profile from %s = %v, %v", ProfileEnv, cfg, err)
+	}
+}
+
+func TestParseOverlaysProfile(t *testing.T) {
+	cfg, err := Parse([]byte(`
+profile: microk8s
+containerd:
+  namespace: custom.io
+runtime:
+  delegates: [runc]
+timeouts:
+  checkpoint: 90s
+log:
+  level: debug
+features:
+  reconcile: false
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	microk8s, _ := Profile(ProfileMicroK8s)
+
+	// Set fields replace those of the profile
+	if cfg.Containerd.Namespace != "custom.io" || cfg.Timeouts.Checkpoint != 90*time.Second || cfg.Log.Level != "debug" || cfg.Features.Reconcile {
+		t.Errorf("overrides not applied: %+v", cfg)
+	}
+	if len(cfg.Runtime.Delegates) != 1 || cfg.Runtime.Delegates[0] != "runc" {
+		t.Errorf("delegates = %v, want [runc]", cfg.Runtime.Delegates)
+	}
+	// Others keep the profile's
+	if cfg.Profile != ProfileMicroK8s || cfg.Containerd.StateDir != microk8s.Containerd.StateDir || cfg.Runtime.Runc != microk8s.Runtime.Runc {
+		t.Errorf("profile settings lost: %+v", cfg)
+	}
+	if cfg.Containerd.Ctr != microk8s.Containerd.Ctr || cfg.Containerd.Address != microk8s.Containerd.Address {
+		t.Errorf("ctr = %s on %s, want the profile's", cfg.Containerd.Ctr, cfg.Containerd.Address)
+	}
+	if cfg.Timeouts.Restore != microk8s.Timeouts.Restore || !cfg.Features.SuspendOnPause {
+		t.Errorf("unset fields of a section lost: %+v", cfg)
+	}
+	if got := cfg.RuncRoot(); got != "/run/containerd/runc/custom.io" {
+		t.Errorf("RuncRoot = %s", got)
+	}
+	if got := cfg.TaskDir(); got != filepath.Join(microk8s.Containerd.StateDir, "io.containerd.runtime.v2.task", "custom.io") {
+		t.Errorf("TaskDir = %s", got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		// want is part of the error
+		want string
+	}{
+		{"unknown profile", "profile: docker", "unknown profile"},
+		{"unknown field", "profile: k3s\ncontainerd:\n  statedir: /run/k3s", "field statedir not found"},
+		{"unknown section", "profile: k3s\nruntimes: {}", "field runtimes not found"},
+		{"not YAML", "profile: [", "yaml"},
+		{"relative state dir", "profile: k3s\npaths:\n  state_dir: var/lib/kybernate", "paths.state_dir must be an absolute path"},
+		{"relative log dir", "profile: k3s\nlog:\n  dir: logs", "log.dir must be an absolute path"},
+		{"relative containerd address", "profile: k3s\ncontainerd:\n  address: containerd.sock", "containerd.address must be an absolute path"},
+		{"empty namespace", "profile: k3s\ncontainerd:\n  namespace: \"\"", "containerd.namespace is empty"},
+		{"empty runc", "profile: k3s\nruntime:\n  runc: \"\"", "runtime.runc is empty"},
+		{"zero timeout", "profile: k3s\ntimeouts:\n  restore: 0s", "timeouts must be positive"},
+		{"bad exporter name", "profile: k3s\nexporters:\n  Archive: tar:/mnt/archive", `invalid name "Archive"`},
+		{"bad log level", "profile: k3s\nlog:\n  level: loud", "log.level"},
+		{"bad log output", "profile: k3s\nlog:\n  output: syslog", "log.output"},
+		{"bad log format", "profile: k3s\nlog:\n  format: xml", "log.format"},
+		{"negative log size", "profile: k3s\nlog:\n  max_size: -1", "must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := Parse([]byte(tt.yaml))
+			if err == nil {
+				t.Fatalf("Parse accepted %q", tt.yaml)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %q does not mention %q", err, tt.want)
+			}
+			// The caller carries on with the detected profile
+			if cfg == nil || cfg.Validate() != nil {
+				t.Errorf("no usable configuration returned with the error: %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestValidateReportsEverything(t *testing.T) {
+	cfg, _ := Profile(ProfileContainerd)
+	cfg.Paths.StateDir = "state"
+	cfg.Runtime.Runc = ""
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "paths.state_dir") || !strings.Contains(err.Error(), "runtime.runc") {
+		t.Errorf("Validate = %v, want both problems", err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte("profile: k3s\nlog:\n  level: warn\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Source != path || cfg.Profile != ProfileK3s || cfg.Log.Level != "warn" {
+		t.Errorf("Load = %+v", cfg)
+	}
+
+	t.Setenv(PathEnv, path)
+	if cfg, err := Load(""); err != nil || cfg.Source != path {
+		t.Errorf("Load from %s = %+v, %v", PathEnv, cfg, err)
+	}
+
+	cfg, err = Load(filepath.Join(dir, "missing.yaml"))
+	if err == nil || cfg == nil || cfg.Source != "" {
+		t.Errorf("Load of a missing file = %+v, %v; want the profile and an error", cfg, err)
+	}
+}
+
+func TestLogging(t *testing.T) {
+	def := logging.Config{
+		Level:      slog.LevelInfo,
+		Output:     logging.OutputFile,
+		Format:     logging.FormatText,
+		MaxSize:    logging.DefaultMaxSize,
+		MaxBackups: logging.DefaultMaxBackups,
+	}
+	tests := []struct {
+		name    string
+		log     Log
+		want    logging.Config
+		wantErr string
+	}{
+		{
+			name: "empty keeps the defaults",
+			want: def,
+		},
+		{
+			name: "all set",
+			log:  Log{Level: "debug", Output: "stderr", Format: "json", MaxSize: 1 << 20, MaxBackups: 2},
+			want: logging.Config{Level: slog.LevelDebug, Output: logging.OutputStderr, Format: logging.FormatJSON, MaxSize: 1 << 20, MaxBackups: 2},
+		},
+		{
+			name: "level is case insensitive",
+			log:  Log{Level: " WARN "},
+			want: logging.Config{Level: slog.LevelWarn, Output: def.Output, Format: def.Format, MaxSize: def.MaxSize, MaxBackups: def.MaxBackups},
+		},
+		{
+			name: "containerd output",
+			log:  Log{Output: "containerd", Level: "error"},
+			want: logging.Config{Level: slog.LevelError, Output: logging.OutputContainerd, Format: def.Format, MaxSize: def.MaxSize, MaxBackups: def.MaxBackups},
+		},
+		{name: "bad level", log: Log{Level: "verbose"}, wantErr: "log.level"},
+		{name: "bad output", log: Log{Output: "journald"}, wantErr: "log.output"},
+		{name: "bad format", log: Log{Format: "logfmt"}, wantErr: "log.format"},
+		{name: "output is case sensitive", log: Log{Output: "Stderr"}, wantErr: "log.output"},
+		{name: "negative backups", log: Log{MaxBackups: -1}, wantErr: "must not be negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Log: tt.log}
+			cfg.Log.Dir = "/var/log/kybernate"
+			got, err := cfg.Logging("kybernate-ctl", def)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one about %s", err, tt.wantErr)
+				}
+				// The caller logs with the defaults
+				if want := withFile(def, "/var/log/kybernate/kybernate-ctl.log"); got != want {
+					t.Errorf("returned %+v with the error, want the defaults %+v", got, want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := withFile(tt.want, "/var/log/kybernate/kybernate-ctl.log"); got != want {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+
+	// Without a tool the file is left alone
+	got, err := (&Config{Log: Log{Dir: "/var/log/kybernate"}}).Logging("", withFile(def, "/tmp/x.log"))
+	if err != nil || got.File != "/tmp/x.log" {
+		t.Errorf("Logging without tool = %+v, %v", got, err)
+	}
+}
+
+func withFile(cfg logging.Config, file string) logging.Config {
+	cfg.File = file
+	return cfg
+}
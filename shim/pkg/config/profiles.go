@@ -0,0 +1,117 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kybernate/kybernate/pkg/cuda"
+	"github.com/kybernate/kybernate/pkg/export"
+)
+
+// Built-in profiles
+const (
+	ProfileContainerd = "containerd"
+	ProfileMicroK8s   = "microk8s"
+	ProfileK3s        = "k3s"
+	// ProfileAuto detects the profile of the node
+	ProfileAuto = "auto"
+)
+
+// Profile returns a copy of the named built-in profile. "" takes the name
+// from KYBERNATE_PROFILE; "" there and "auto" detect it.
+func Profile(name string) (*Config, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		name = strings.ToLower(strings.TrimSpace(os.Getenv(ProfileEnv)))
+	}
+	if name == "" || name == ProfileAuto {
+		name = Detect()
+	}
+
+	cfg := base()
+	cfg.Profile = name
+	switch name {
+	case ProfileContainerd:
+		cfg.Containerd.StateDir = "/run/containerd"
+		cfg.Containerd.Address = "/run/containerd/containerd.sock"
+		cfg.Containerd.Ctr = "ctr"
+		cfg.Runtime.Runc = "runc"
+		cfg.Log.Dir = "/var/log/kybernate"
+		// kubeadm's client certificate of the API server for the kubelet
+		cfg.Kubelet.Cert = "/etc/kubernetes/pki/apiserver-kubelet-client.crt"
+		cfg.Kubelet.Key = "/etc/kubernetes/pki/apiserver-kubelet-client.key"
+	case ProfileMicroK8s:
+		cfg.Containerd.StateDir = "/var/snap/microk8s/common/run/containerd"
+		cfg.Containerd.Address = "/var/snap/microk8s/common/run/containerd.sock"
+		cfg.Containerd.Ctr = "/snap/microk8s/current/bin/ctr"
+		cfg.Runtime.Runc = "/snap/microk8s/current/bin/runc"
+		cfg.Log.Dir = "/var/snap/microk8s/common/run"
+		cfg.Kubelet.Cert = "/var/snap/microk8s/current/certs/kubelet.crt"
+		cfg.Kubelet.Key = "/var/snap/microk8s/current/certs/kubelet.key"
+	case ProfileK3s:
+		cfg.Containerd.StateDir = "/run/k3s/containerd"
+		cfg.Containerd.Address = "/run/k3s/containerd/containerd.sock"
+		cfg.Containerd.Ctr = "/var/lib/rancher/k3s/data/current/bin/ctr"
+		cfg.Runtime.Runc = "/var/lib/rancher/k3s/data/current/bin/runc"
+		cfg.Log.Dir = "/var/log/kybernate"
+		cfg.Kubelet.Cert = "/var/lib/rancher/k3s/server/tls/client-kube-apiserver.crt"
+		cfg.Kubelet.Key = "/var/lib/rancher/k3s/server/tls/client-kube-apiserver.key"
+	default:
+		return nil, fmt.Errorf("unknown profile %q (expected containerd, microk8s, k3s or auto)", name)
+	}
+	return cfg, nil
+}
+
+// Detected returns the profile of the node
+func Detected() *Config {
+	cfg, _ := Profile(Detect())
+	return cfg
+}
+
+// base holds the settings every profile shares
+func base() *Config {
+	return &Config{
+		Containerd: Containerd{Namespace: "k8s.io"},
+		Runtime: Runtime{
+			Root:   "/run/containerd/runc",
+			Nvidia: "nvidia-container-runtime",
+			Delegates: []string{
+				"nvidia-container-runtime", "runc",
+				"/usr/bin/nvidia-container-runtime", "/usr/bin/runc", "/usr/sbin/runc",
+			},
+		},
+		Paths: Paths{
+			StateDir:      "/var/lib/kybernate",
+			CheckpointDir: "/var/lib/kybernate/checkpoints",
+		},
+		Kubelet:  Kubelet{Address: "https://localhost:10250"},
+		Timeouts: cuda.DefaultTimeouts,
+		Features: Features{SuspendOnPause: true, Reconcile: true},
+		Export:   export.None,
+		Debug:    Debug{Dir: "/var/lib/kybernate/debug"},
+	}
+}
+
+// Detect names the profile of the node: the distribution of the
+// containerd that started this process, else the one installed
+func Detect() string {
+	// containerd passes its TTRPC address to the shims it starts
+	addr := os.Getenv("TTRPC_ADDRESS")
+	switch {
+	case strings.Contains(addr, "microk8s"):
+		return ProfileMicroK8s
+	case strings.Contains(addr, "k3s"):
+		return ProfileK3s
+	}
+	for _, probe := range []struct{ path, profile string }{
+		{"/snap/microk8s/current", ProfileMicroK8s},
+		{"/run/k3s/containerd", ProfileK3s},
+		{"/var/lib/rancher/k3s", ProfileK3s},
+	} {
+		if _, err := os.Stat(probe.path); err == nil {
+			return probe.profile
+		}
+	}
+	return ProfileContainerd
+}
@@ -0,0 +1,93 @@
+package cuda
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MinCheckpointDriverVersion is the first CUDA driver API version (12.8)
+// that exports the cuCheckpointProcess* entry points.
+const MinCheckpointDriverVersion = 12080
+
+var (
+	// ErrDriverNotFound means libcuda could not be loaded (no NVIDIA driver installed)
+	ErrDriverNotFound = errors.New("CUDA driver library not found")
+
+	// ErrDriverTooOld means libcuda predates the checkpoint API
+	ErrDriverTooOld = errors.New("CUDA driver too old for checkpoint API")
+
+	// ErrCheckpointUnavailable means libcuda is recent enough but does not export the checkpoint API
+	ErrCheckpointUnavailable = errors.New("CUDA checkpoint API unavailable")
+)
+
+// Capabilities describes what the CUDA driver on this host supports
+type Capabilities struct {
+	// Loaded is true when libcuda could be opened
+	Loaded bool
+	// Library is the name libcuda was loaded as
+	Library string
+	// DriverVersion is the value of cuDriverGetVersion (e.g. 12080 for 12.8)
+	DriverVersion int
+	// CheckpointAPI is true when every checkpoint entry point was resolved
+	CheckpointAPI bool
+	// MissingSymbols lists driver entry points that could not be resolved
+	MissingSymbols []string
+}
+
+// DriverUnavailableError is returned by NewCheckpointer when the native
+// driver cannot provide the checkpoint API
+type DriverUnavailableError struct {
+	Err          error
+	Capabilities Capabilities
+}
+
+func (e *DriverUnavailableError) Error() string {
+	return fmt.Sprintf("%v (%s)", e.Err, e.Capabilities)
+}
+
+func (e *DriverUnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// Err returns a *DriverUnavailableError if the checkpoint API cannot be used
+func (c Capabilities) Err() error {
+	switch {
+	case !c.Loaded:
+		return &DriverUnavailableError{Err: ErrDriverNotFound, Capabilities: c}
+	case c.CheckpointAPI:
+		return nil
+	case c.DriverVersion > 0 && c.DriverVersion < MinCheckpointDriverVersion:
+		return &DriverUnavailableError{Err: ErrDriverTooOld, Capabilities: c}
+	default:
+		return &DriverUnavailableError{Err: ErrCheckpointUnavailable, Capabilities: c}
+	}
+}
+
+// String renders a one-line capability report
+func (c Capabilities) String() string {
+	if !c.Loaded {
+		return "libcuda: not loaded"
+	}
+	parts := []string{
+		"libcuda: " + c.Library,
+		"driver API: " + FormatDriverVersion(c.DriverVersion),
+	}
+	if c.CheckpointAPI {
+		parts = append(parts, "checkpoint API: available")
+	} else {
+		parts = append(parts, "checkpoint API: unavailable")
+	}
+	if len(c.MissingSymbols) > 0 {
+		parts = append(parts, "missing: "+strings.Join(c.MissingSymbols, ","))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// FormatDriverVersion formats a cuDriverGetVersion value as major.minor
+func FormatDriverVersion(version int) string {
+	if version <= 0 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%d.%d", version/1000, (version%1000)/10)
+}
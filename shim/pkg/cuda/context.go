@@ -0,0 +1,173 @@
+package cuda
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Phases of a checkpoint or restore, reported by PhaseError and GroupError
+const (
+	PhaseLock       = "lock"
+	PhaseCheckpoint = "checkpoint"
+	PhaseRestore    = "restore"
+	PhaseUnlock     = "unlock"
+)
+
+// StateUnknown is reported when the state of a process could not be read
+// back from the driver
+const StateUnknown ProcessState = -1
+
+// PhaseError reports the phase that was in progress when a checkpoint or
+// restore failed or its context expired, and the state the process was
+// left in after rolling back
+type PhaseError struct {
+	Phase string
+	PID   int
+	// Err is the context error if the deadline passed, else the driver error
+	Err   error
+	State ProcessState
+}
+
+func (e *PhaseError) Error() string {
+	return fmt.Sprintf("%s of PID %d: %v (process left %s)", e.Phase, e.PID, e.Err, e.State)
+}
+
+func (e *PhaseError) Unwrap() error {
+	return e.Err
+}
+
+// phaseErr prefers the context error over the driver error: a lock that
+// timed out because of the deadline is reported as the deadline.
+func phaseErr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// lockTimeout converts the context deadline into the lock timeout passed
+// to the driver, so a lock never outlives the context. Without a deadline
+// the lock waits indefinitely (0).
+func lockTimeout(ctx context.Context) uint {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	ms := time.Until(deadline).Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	return uint(ms)
+}
+
+// stateOf reads the state of pid, or StateUnknown
+func (c *Checkpointer) stateOf(pid int) ProcessState {
+	state, err := c.GetState(pid)
+	if err != nil {
+		return StateUnknown
+	}
+	return state
+}
+
+// CheckpointFullContext is CheckpointFull bounded by ctx. The lock timeout
+// is derived from the deadline and the context is checked between phases.
+// A driver call that is already running cannot be interrupted, so the
+// call returns once it completes. If the context expires or a phase
+// fails, the process is rolled back to running and a *PhaseError names
+// the phase.
+func (c *Checkpointer) CheckpointFullContext(ctx context.Context, pid int) error {
+	if err := ctx.Err(); err != nil {
+		return &PhaseError{Phase: PhaseLock, PID: pid, Err: err, State: c.stateOf(pid)}
+	}
+
+	if err := c.Lock(pid, lockTimeout(ctx)); err != nil {
+		return &PhaseError{Phase: PhaseLock, PID: pid, Err: phaseErr(ctx, err), State: c.rollbackToRunning(pid)}
+	}
+
+	err := ctx.Err()
+	if err == nil {
+		err = c.Checkpoint(pid)
+	}
+	if err == nil {
+		// Finishing after the deadline still counts as expired
+		err = ctx.Err()
+	}
+	if err != nil {
+		return &PhaseError{Phase: PhaseCheckpoint, PID: pid, Err: phaseErr(ctx, err), State: c.rollbackToRunning(pid)}
+	}
+	return nil
+}
+
+// RestoreFullContext is RestoreFull bounded by ctx. If the context expires
+// or a phase fails, the process is returned to checkpointed, so the
+// restore can be retried, and a *PhaseError names the phase.
+func (c *Checkpointer) RestoreFullContext(ctx context.Context, pid int) error {
+	return c.restoreContext(ctx, pid, c.Restore)
+}
+
+// restoreContext runs restore (checkpointed → locked) and unlock under ctx
+func (c *Checkpointer) restoreContext(ctx context.Context, pid int, restore func(pid int) error) error {
+	err := ctx.Err()
+	if err == nil {
+		err = restore(pid)
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return &PhaseError{Phase: PhaseRestore, PID: pid, Err: phaseErr(ctx, err), State: c.rollbackToCheckpointed(pid)}
+	}
+
+	if err := c.Unlock(pid); err != nil {
+		return &PhaseError{Phase: PhaseUnlock, PID: pid, Err: phaseErr(ctx, err), State: c.rollbackToCheckpointed(pid)}
+	}
+	return nil
+}
+
+// rollbackToRunning brings pid back to running from wherever a checkpoint
+// stopped and returns the resulting state
+func (c *Checkpointer) rollbackToRunning(pid int) ProcessState {
+	_ = c.toRunning(pid)
+	return c.stateOf(pid)
+}
+
+// rollbackToCheckpointed brings pid back to checkpointed from wherever a
+// restore stopped and returns the resulting state
+func (c *Checkpointer) rollbackToCheckpointed(pid int) ProcessState {
+	_ = c.toCheckpointed(pid)
+	return c.stateOf(pid)
+}
+
+// toRunning walks pid from its current state to running
+func (c *Checkpointer) toRunning(pid int) error {
+	state, err := c.GetState(pid)
+	if err == nil && state == StateCheckpointed {
+		err = c.Restore(pid)
+		state = StateLocked
+	}
+	if err == nil && state == StateLocked {
+		err = c.Unlock(pid)
+	}
+	return err
+}
+
+// toCheckpointed walks pid from its current state to checkpointed
+func (c *Checkpointer) toCheckpointed(pid int) error {
+	state, err := c.GetState(pid)
+	if err == nil && state == StateRunning {
+		err = c.Lock(pid, 0)
+		state = StateLocked
+	}
+	if err == nil && state == StateLocked {
+		err = c.Checkpoint(pid)
+	}
+	return err
+}
+
+// IsExpired reports whether err was caused by a context deadline or
+// cancellation
+func IsExpired(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
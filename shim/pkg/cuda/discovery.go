@@ -0,0 +1,309 @@
+package cuda
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// DiscoveryEnv selects the GPU discovery backend: "auto" (default,
+	// NVML with nvidia-smi fallback), "nvml" or "nvidia-smi"
+	DiscoveryEnv = "KYBERNATE_GPU_DISCOVERY"
+
+	// DiscoveryFixtureEnv points at a JSON fixture (see GPUFixture) that
+	// replaces the real discovery backend
+	DiscoveryFixtureEnv = "KYBERNATE_GPU_FIXTURE"
+)
+
+// Discoverer enumerates GPUs and the compute processes running on them
+type Discoverer interface {
+	// Name identifies the backend in logs
+	Name() string
+	// Devices returns all GPUs of this node in index order
+	Devices() ([]GPUDevice, error)
+	// ComputeProcesses returns one entry per process and GPU
+	ComputeProcesses() ([]GPUProcess, error)
+}
+
+var (
+	discoveryMu sync.Mutex
+	discoverer  Discoverer
+)
+
+// SetDiscoverer replaces the discovery backend used by FindGPUProcesses,
+// ListGPUs and HasGPU. Passing nil restores the default selection.
+func SetDiscoverer(d Discoverer) {
+	discoveryMu.Lock()
+	defer discoveryMu.Unlock()
+	discoverer = d
+}
+
+// discovery returns the active discovery backend
+func discovery() Discoverer {
+	discoveryMu.Lock()
+	defer discoveryMu.Unlock()
+	if discoverer == nil {
+		discoverer = DefaultDiscoverer()
+	}
+	return discoverer
+}
+
+// DefaultDiscoverer picks the discovery backend from the environment
+func DefaultDiscoverer() Discoverer {
+	if path := os.Getenv(DiscoveryFixtureEnv); path != "" {
+		return &FixtureDiscoverer{Path: path}
+	}
+	if SimulatorSelected() {
+		return simDiscoverer{}
+	}
+
+	switch os.Getenv(DiscoveryEnv) {
+	case "nvml":
+		return nvmlDiscoverer{}
+	case "nvidia-smi":
+		return smiDiscoverer{}
+	default:
+		return fallbackDiscoverer{primary: nvmlDiscoverer{}, fallback: smiDiscoverer{}}
+	}
+}
+
+// fallbackDiscoverer uses primary and switches to fallback when primary fails
+type fallbackDiscoverer struct {
+	primary  Discoverer
+	fallback Discoverer
+}
+
+func (f fallbackDiscoverer) Name() string {
+	return f.primary.Name() + "+" + f.fallback.Name()
+}
+
+func (f fallbackDiscoverer) Devices() ([]GPUDevice, error) {
+	devices, err := f.primary.Devices()
+	if err == nil {
+		return devices, nil
+	}
+	devices, fallbackErr := f.fallback.Devices()
+	if fallbackErr != nil {
+		return nil, fmt.Errorf("%s: %v; %s: %w", f.primary.Name(), err, f.fallback.Name(), fallbackErr)
+	}
+	return devices, nil
+}
+
+func (f fallbackDiscoverer) ComputeProcesses() ([]GPUProcess, error) {
+	processes, err := f.primary.ComputeProcesses()
+	if err == nil {
+		return processes, nil
+	}
+	processes, fallbackErr := f.fallback.ComputeProcesses()
+	if fallbackErr != nil {
+		return nil, fmt.Errorf("%s: %v; %s: %w", f.primary.Name(), err, f.fallback.Name(), fallbackErr)
+	}
+	return processes, nil
+}
+
+// smiDiscoverer parses the CSV output of nvidia-smi
+type smiDiscoverer struct{}
+
+func (smiDiscoverer) Name() string {
+	return "nvidia-smi"
+}
+
+func (smiDiscoverer) Devices() ([]GPUDevice, error) {
+	// Drivers before 510 reject the compute_cap field
+	output, err := exec.Command("nvidia-smi",
+		"--query-gpu=index,uuid,name,memory.total,compute_cap",
+		"--format=csv,noheader,nounits").Output()
+	if err != nil {
+		output, err = exec.Command("nvidia-smi",
+			"--query-gpu=index,uuid,name,memory.total",
+			"--format=csv,noheader,nounits").Output()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("nvidia-smi failed: %w", err)
+	}
+	return parseSMIDevices(string(output)), nil
+}
+
+// parseSMIDevices parses the CSV of nvidia-smi --query-gpu=index,uuid,
+// name,memory.total[,compute_cap]
+func parseSMIDevices(output string) []GPUDevice {
+	var devices []GPUDevice
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		parts := strings.Split(strings.TrimSpace(scanner.Text()), ", ")
+		if len(parts) < 4 {
+			continue
+		}
+
+		index, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			continue
+		}
+
+		// Memory is in MiB from nvidia-smi
+		memMiB, _ := strconv.ParseInt(strings.TrimSpace(parts[3]), 10, 64)
+
+		dev := GPUDevice{
+			Index:       index,
+			UUID:        strings.TrimSpace(parts[1]),
+			Name:        strings.TrimSpace(parts[2]),
+			MemoryTotal: memMiB * 1024 * 1024,
+		}
+		if len(parts) >= 5 {
+			if cc := strings.TrimSpace(parts[4]); !strings.HasPrefix(cc, "[") {
+				dev.ComputeCapability = cc
+			}
+		}
+		devices = append(devices, dev)
+	}
+
+	return devices
+}
+
+func (smiDiscoverer) ComputeProcesses() ([]GPUProcess, error) {
+	cmd := exec.Command("nvidia-smi",
+		"--query-compute-apps=pid,used_memory,process_name,gpu_uuid",
+		"--format=csv,noheader,nounits")
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("nvidia-smi failed: %w", err)
+	}
+
+	var processes []GPUProcess
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		parts := strings.Split(line, ", ")
+		if len(parts) < 2 {
+			continue
+		}
+
+		pid, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			continue
+		}
+
+		// Memory is in MiB from nvidia-smi
+		memMiB, _ := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+
+		name := ""
+		if len(parts) >= 3 {
+			name = strings.TrimSpace(parts[2])
+		}
+
+		gpuUUID := ""
+		if len(parts) >= 4 {
+			gpuUUID = strings.TrimSpace(parts[3])
+		}
+
+		processes = append(processes, GPUProcess{
+			PID:        pid,
+			UsedMemory: memMiB * 1024 * 1024, // Convert to bytes
+			Name:       name,
+			GPUUUID:    gpuUUID,
+		})
+	}
+
+	return processes, nil
+}
+
+// simDiscoverer reports the GPUs and processes of the simulated driver
+type simDiscoverer struct{}
+
+func (simDiscoverer) Name() string {
+	return "sim"
+}
+
+func (simDiscoverer) Devices() ([]GPUDevice, error) {
+	sim, err := OpenSimDriver(SimStatePath())
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []GPUDevice
+	for i, uuid := range sim.Devices() {
+		devices = append(devices, GPUDevice{Index: i, UUID: uuid, Name: "Simulated GPU"})
+	}
+	return devices, nil
+}
+
+func (simDiscoverer) ComputeProcesses() ([]GPUProcess, error) {
+	sim, err := OpenSimDriver(SimStatePath())
+	if err != nil {
+		return nil, err
+	}
+
+	// Like NVML, report one entry per process and GPU
+	var processes []GPUProcess
+	for _, p := range sim.Processes() {
+		for _, uuid := range p.Devices {
+			processes = append(processes, GPUProcess{
+				PID:        p.PID,
+				UsedMemory: p.VRAMBytes / int64(len(p.Devices)),
+				Name:       p.Name,
+				GPUUUID:    uuid,
+			})
+		}
+	}
+	return processes, nil
+}
+
+// GPUFixture is the JSON document read by FixtureDiscoverer
+type GPUFixture struct {
+	Devices   []GPUDevice  `json:"devices"`
+	Processes []GPUProcess `json:"processes"`
+}
+
+// FixtureDiscoverer serves GPUs and processes from a fixture instead of
+// the driver. Set Fixture directly, or Path to read a JSON GPUFixture on
+// every call so tests can change it between steps.
+type FixtureDiscoverer struct {
+	Path    string
+	Fixture GPUFixture
+}
+
+func (f *FixtureDiscoverer) Name() string {
+	return "fixture"
+}
+
+func (f *FixtureDiscoverer) load() (GPUFixture, error) {
+	if f.Path == "" {
+		return f.Fixture, nil
+	}
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return GPUFixture{}, err
+	}
+	var fixture GPUFixture
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return GPUFixture{}, fmt.Errorf("parse GPU fixture %s: %w", f.Path, err)
+	}
+	return fixture, nil
+}
+
+func (f *FixtureDiscoverer) Devices() ([]GPUDevice, error) {
+	fixture, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	return fixture.Devices, nil
+}
+
+func (f *FixtureDiscoverer) ComputeProcesses() ([]GPUProcess, error) {
+	fixture, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	return fixture.Processes, nil
+}
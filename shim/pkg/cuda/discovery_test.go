@@ -0,0 +1,251 @@
+package cuda
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const (
+	fixtureGPU0 = "GPU-00000000-0000-0000-0000-000000000001"
+	fixtureGPU1 = "GPU-00000000-0000-0000-0000-000000000002"
+)
+
+func testFixture() GPUFixture {
+	return GPUFixture{
+		Devices: []GPUDevice{
+			{Index: 0, UUID: fixtureGPU0, Name: "NVIDIA A100", MemoryTotal: 40 << 30, ComputeCapability: "8.0"},
+			{Index: 1, UUID: fixtureGPU1, Name: "NVIDIA L4", MemoryTotal: 24 << 30, ComputeCapability: "8.9"},
+		},
+		Processes: []GPUProcess{
+			{PID: 300, UsedMemory: 1 << 30, Name: "trainer", GPUUUID: fixtureGPU1},
+			{PID: 100, UsedMemory: 2 << 30, Name: "trainer", GPUUUID: fixtureGPU0},
+			{PID: 100, UsedMemory: 2 << 30, Name: "trainer", GPUUUID: fixtureGPU1},
+			{PID: 200, UsedMemory: 1 << 30, Name: "server", GPUUUID: fixtureGPU0},
+		},
+	}
+}
+
+// useDiscoverer makes d the discovery backend for the rest of the test
+func useDiscoverer(t *testing.T, d Discoverer) {
+	t.Helper()
+	SetDiscoverer(d)
+	t.Cleanup(func() { SetDiscoverer(nil) })
+}
+
+func TestFixtureDiscovery(t *testing.T) {
+	fixture := testFixture()
+	useDiscoverer(t, &FixtureDiscoverer{Fixture: fixture})
+
+	if name := DiscoveryName(); name != "fixture" {
+		t.Errorf("DiscoveryName() = %q, want fixture", name)
+	}
+	if !HasGPU() {
+		t.Error("HasGPU() = false with two fixture GPUs")
+	}
+
+	devices, err := ListGPUs()
+	if err != nil {
+		t.Fatalf("ListGPUs: %v", err)
+	}
+	if !reflect.DeepEqual(devices, fixture.Devices) {
+		t.Errorf("ListGPUs() = %+v, want %+v", devices, fixture.Devices)
+	}
+
+	processes, err := FindGPUProcesses()
+	if err != nil {
+		t.Fatalf("FindGPUProcesses: %v", err)
+	}
+	if len(processes) != len(fixture.Processes) {
+		t.Errorf("FindGPUProcesses() returned %d entries, want one per process and GPU (%d)", len(processes), len(fixture.Processes))
+	}
+}
+
+func TestProcessGPUs(t *testing.T) {
+	fixture := testFixture()
+	useDiscoverer(t, &FixtureDiscoverer{Fixture: fixture})
+
+	tests := []struct {
+		pid  int
+		want []GPUDevice
+	}{
+		{100, fixture.Devices},
+		{200, fixture.Devices[:1]},
+		{300, fixture.Devices[1:]},
+		{400, nil},
+	}
+	for _, tt := range tests {
+		got, err := ProcessGPUs(tt.pid)
+		if err != nil {
+			t.Fatalf("ProcessGPUs(%d): %v", tt.pid, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ProcessGPUs(%d) = %+v, want %+v", tt.pid, got, tt.want)
+		}
+	}
+}
+
+func TestFindGPUProcessesAmong(t *testing.T) {
+	useDiscoverer(t, &FixtureDiscoverer{Fixture: testFixture()})
+
+	tests := []struct {
+		name string
+		pids []int
+		want []int
+	}{
+		{"all", []int{300, 200, 100}, []int{100, 200, 300}},
+		{"some", []int{1, 300, 100, 2}, []int{100, 300}},
+		{"none", []int{1, 2}, nil},
+		{"empty", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FindGPUProcessesAmong(tt.pids)
+			if err != nil {
+				t.Fatalf("FindGPUProcessesAmong: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FindGPUProcessesAmong(%v) = %v, want %v", tt.pids, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFixtureDiscovererReloadsPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gpus.json")
+	write := func(fixture GPUFixture) {
+		t.Helper()
+		data, err := json.Marshal(fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	useDiscoverer(t, &FixtureDiscoverer{Path: path})
+
+	fixture := testFixture()
+	write(fixture)
+	if pids, err := FindGPUProcessesAmong([]int{100, 200, 300}); err != nil || len(pids) != 3 {
+		t.Fatalf("FindGPUProcessesAmong = %v, %v; want 3 processes", pids, err)
+	}
+
+	// The process exits between two steps of a test
+	fixture.Processes = fixture.Processes[:1]
+	write(fixture)
+	if pids, err := FindGPUProcessesAmong([]int{100, 200, 300}); err != nil || !reflect.DeepEqual(pids, []int{300}) {
+		t.Fatalf("FindGPUProcessesAmong = %v, %v; want [300]", pids, err)
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FindGPUProcessesAmong([]int{100}); err == nil {
+		t.Fatal("FindGPUProcessesAmong succeeded with a broken fixture")
+	}
+	if HasGPU() {
+		t.Error("HasGPU() = true with a broken fixture")
+	}
+}
+
+func TestDefaultDiscoverer(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		driver  string
+		backend string
+		want    string
+	}{
+		{"fixture", "/tmp/gpus.json", DriverSim, "nvml", "fixture"},
+		{"simulator", "", DriverSim, "nvml", "sim"},
+		{"nvml", "", "", "nvml", "nvml"},
+		{"nvidia-smi", "", "", "nvidia-smi", "nvidia-smi"},
+		{"auto", "", "", "", "nvml+nvidia-smi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(DiscoveryFixtureEnv, tt.fixture)
+			t.Setenv(DriverEnv, tt.driver)
+			t.Setenv(DiscoveryEnv, tt.backend)
+			if got := DefaultDiscoverer().Name(); got != tt.want {
+				t.Errorf("DefaultDiscoverer() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// failingDiscoverer fails every call
+type failingDiscoverer struct{}
+
+func (failingDiscoverer) Name() string { return "broken" }
+
+func (failingDiscoverer) Devices() ([]GPUDevice, error) {
+	return nil, errors.New("no driver")
+}
+
+func (failingDiscoverer) ComputeProcesses() ([]GPUProcess, error) {
+	return nil, errors.New("no driver")
+}
+
+func TestFallbackDiscoverer(t *testing.T) {
+	fixture := &FixtureDiscoverer{Fixture: testFixture()}
+
+	d := fallbackDiscoverer{primary: failingDiscoverer{}, fallback: fixture}
+	if devices, err := d.Devices(); err != nil || len(devices) != 2 {
+		t.Errorf("Devices() = %v, %v; want the fallback's GPUs", devices, err)
+	}
+	if processes, err := d.ComputeProcesses(); err != nil || len(processes) != 4 {
+		t.Errorf("ComputeProcesses() = %v, %v; want the fallback's processes", processes, err)
+	}
+
+	d = fallbackDiscoverer{primary: failingDiscoverer{}, fallback: failingDiscoverer{}}
+	if _, err := d.Devices(); err == nil {
+		t.Error("Devices() succeeded with both backends failing")
+	}
+	if _, err := d.ComputeProcesses(); err == nil {
+		t.Error("ComputeProcesses() succeeded with both backends failing")
+	}
+}
+
+func TestParseSMIDevices(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []GPUDevice
+	}{
+		{
+			name:   "compute capability",
+			output: "0, " + fixtureGPU0 + ", NVIDIA A100, 40960, 8.0\n1, " + fixtureGPU1 + ", NVIDIA L4, 23034, 8.9\n",
+			want: []GPUDevice{
+				{Index: 0, UUID: fixtureGPU0, Name: "NVIDIA A100", MemoryTotal: 40960 << 20, ComputeCapability: "8.0"},
+				{Index: 1, UUID: fixtureGPU1, Name: "NVIDIA L4", MemoryTotal: 23034 << 20, ComputeCapability: "8.9"},
+			},
+		},
+		{
+			name:   "old driver",
+			output: "0, " + fixtureGPU0 + ", Tesla T4, 15360\n",
+			want:   []GPUDevice{{Index: 0, UUID: fixtureGPU0, Name: "Tesla T4", MemoryTotal: 15360 << 20}},
+		},
+		{
+			name:   "not available",
+			output: "0, " + fixtureGPU0 + ", Tesla T4, 15360, [N/A]\n",
+			want:   []GPUDevice{{Index: 0, UUID: fixtureGPU0, Name: "Tesla T4", MemoryTotal: 15360 << 20}},
+		},
+		{
+			name:   "garbage",
+			output: "No devices were found\n\n",
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseSMIDevices(tt.output); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSMIDevices() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+//go:build cgo
+
+package cuda
+
+/*
+#cgo LDFLAGS: -ldl
+
+#include <dlfcn.h>
+#include <stddef.h>
+#include <stdlib.h>
+#include <string.h>
+
+// libcuda is loaded at runtime so that binaries start on nodes without the
+// NVIDIA driver. The types below mirror the declarations in cuda.h (12.8+).
+
+typedef int CUresult;
+typedef int CUdevice;
+typedef unsigned long long cuuint64_t;
+
+#define CUDA_SUCCESS 0
+#define CUDA_ERROR_OUT_OF_MEMORY 2
+#define CUDA_ERROR_NOT_INITIALIZED 3
+
+typedef struct { char bytes[16]; } CUuuid;
+
+typedef struct {
+    unsigned int timeoutMs;
+    unsigned int reserved0;
+    cuuint64_t reserved1[7];
+} CUcheckpointLockArgs;
+
+typedef struct {
+    cuuint64_t reserved[8];
+} CUcheckpointCheckpointArgs;
+
+typedef struct {
+    CUuuid oldUuid;
+    CUuuid newUuid;
+} CUcheckpointGpuPair;
+
+typedef struct {
+    CUcheckpointGpuPair* gpuPairs;
+    unsigned int gpuPairsCount;
+    char reserved[64 - sizeof(CUcheckpointGpuPair*) - sizeof(unsigned int)];
+    cuuint64_t reserved1;
+} CUcheckpointRestoreArgs;
+
+typedef struct {
+    cuuint64_t reserved[8];
+} CUcheckpointUnlockArgs;
+
+// The driver reads these structs by layout; a mismatch corrupts its
+// arguments, so the sizes of cuda.h are checked at compile time
+_Static_assert(sizeof(CUuuid) == 16, "CUuuid must be 16 bytes");
+_Static_assert(sizeof(CUcheckpointLockArgs) == 64, "CUcheckpointLockArgs must be 64 bytes");
+_Static_assert(sizeof(CUcheckpointCheckpointArgs) == 64, "CUcheckpointCheckpointArgs must be 64 bytes");
+_Static_assert(sizeof(CUcheckpointGpuPair) == 32, "CUcheckpointGpuPair must be 32 bytes");
+_Static_assert(sizeof(CUcheckpointRestoreArgs) == 72, "CUcheckpointRestoreArgs must be 72 bytes");
+_Static_assert(offsetof(CUcheckpointRestoreArgs, reserved1) == 64, "CUcheckpointRestoreArgs.reserved1 must be at offset 64");
+_Static_assert(sizeof(CUcheckpointUnlockArgs) == 64, "CUcheckpointUnlockArgs must be 64 bytes");
+
+static void* libcuda = NULL;
+
+static CUresult (*p_cuInit)(unsigned int);
+static CUresult (*p_cuDriverGetVersion)(int*);
+static CUresult (*p_cuDeviceGet)(CUdevice*, int);
+static CUresult (*p_cuDeviceGetCount)(int*);
+static CUresult (*p_cuDeviceGetUuid)(CUuuid*, CUdevice);
+static CUresult (*p_cuCheckpointProcessLock)(int, CUcheckpointLockArgs*);
+static CUresult (*p_cuCheckpointProcessCheckpoint)(int, CUcheckpointCheckpointArgs*);
+static CUresult (*p_cuCheckpointProcessRestore)(int, CUcheckpointRestoreArgs*);
+static CUresult (*p_cuCheckpointProcessUnlock)(int, CUcheckpointUnlockArgs*);
+static CUresult (*p_cuCheckpointProcessGetState)(int, int*);
+
+// Open libcuda; returns 0 on success
+static int cuda_load(const char* name) {
+    if (libcuda != NULL) return 0;
+    libcuda = dlopen(name, RTLD_NOW | RTLD_GLOBAL);
+    return libcuda == NULL ? -1 : 0;
+}
+
+static void* cuda_sym(const char* name) {
+    return libcuda == NULL ? NULL : dlsym(libcuda, name);
+}
+
+// Resolve all symbols; missing ones stay NULL. Returns a bitmask with
+// bit i set when symbol i (in the order of cudaSymbols in Go) resolved.
+static unsigned int cuda_resolve() {
+    p_cuInit = cuda_sym("cuInit");
+    p_cuDriverGetVersion = cuda_sym("cuDriverGetVersion");
+    p_cuDeviceGet = cuda_sym("cuDeviceGet");
+    p_cuDeviceGetCount = cuda_sym("cuDeviceGetCount");
+    p_cuDeviceGetUuid = cuda_sym("cuDeviceGetUuid_v2");
+    if (p_cuDeviceGetUuid == NULL) p_cuDeviceGetUuid = cuda_sym("cuDeviceGetUuid");
+    p_cuCheckpointProcessLock = cuda_sym("cuCheckpointProcessLock");
+    p_cuCheckpointProcessCheckpoint = cuda_sym("cuCheckpointProcessCheckpoint");
+    p_cuCheckpointProcessRestore = cuda_sym("cuCheckpointProcessRestore");
+    p_cuCheckpointProcessUnlock = cuda_sym("cuCheckpointProcessUnlock");
+    p_cuCheckpointProcessGetState = cuda_sym("cuCheckpointProcessGetState");
+
+    void* syms[] = {
+        (void*)p_cuInit, (void*)p_cuDriverGetVersion, (void*)p_cuDeviceGet,
+        (void*)p_cuDeviceGetCount, (void*)p_cuDeviceGetUuid,
+        (void*)p_cuCheckpointProcessLock, (void*)p_cuCheckpointProcessCheckpoint,
+        (void*)p_cuCheckpointProcessRestore, (void*)p_cuCheckpointProcessUnlock,
+        (void*)p_cuCheckpointProcessGetState,
+    };
+    unsigned int mask = 0;
+    for (unsigned int i = 0; i < sizeof(syms) / sizeof(syms[0]); i++) {
+        if (syms[i] != NULL) mask |= 1u << i;
+    }
+    return mask;
+}
+
+static CUresult cuda_init() {
+    if (p_cuInit == NULL) return CUDA_ERROR_NOT_INITIALIZED;
+    return p_cuInit(0);
+}
+
+static CUresult cuda_driver_version(int* version) {
+    if (p_cuDriverGetVersion == NULL) return CUDA_ERROR_NOT_INITIALIZED;
+    return p_cuDriverGetVersion(version);
+}
+
+static CUresult cuda_checkpoint_lock(int pid, unsigned int timeout_ms) {
+    CUcheckpointLockArgs args = {0};
+    args.timeoutMs = timeout_ms;
+    return p_cuCheckpointProcessLock(pid, &args);
+}
+
+static CUresult cuda_checkpoint_checkpoint(int pid) {
+    CUcheckpointCheckpointArgs args = {0};
+    return p_cuCheckpointProcessCheckpoint(pid, &args);
+}
+
+// Restore, optionally remapping GPUs. uuids holds count old/new pairs
+// laid out as old0 new0 old1 new1 ... (16 bytes each).
+static CUresult cuda_checkpoint_restore(int pid, char* uuids, unsigned int count) {
+    CUcheckpointRestoreArgs args = {0};
+    CUcheckpointGpuPair* pairs = NULL;
+
+    if (count > 0) {
+        pairs = calloc(count, sizeof(CUcheckpointGpuPair));
+        if (pairs == NULL) return CUDA_ERROR_OUT_OF_MEMORY;
+        for (unsigned int i = 0; i < count; i++) {
+            memcpy(pairs[i].oldUuid.bytes, uuids + (2 * i) * 16, 16);
+            memcpy(pairs[i].newUuid.bytes, uuids + (2 * i + 1) * 16, 16);
+        }
+    }
+
+    args.gpuPairsCount = count;
+    args.gpuPairs = pairs;
+    CUresult result = p_cuCheckpointProcessRestore(pid, &args);
+    free(pairs);
+    return result;
+}
+
+static CUresult cuda_checkpoint_unlock(int pid) {
+    CUcheckpointUnlockArgs args = {0};
+    return p_cuCheckpointProcessUnlock(pid, &args);
+}
+
+static CUresult cuda_checkpoint_get_state(int pid, int* state) {
+    return p_cuCheckpointProcessGetState(pid, state);
+}
+
+// Get device UUID
+static CUresult cuda_get_device_uuid(int device, char* uuid_out) {
+    CUdevice dev;
+    CUresult result = p_cuDeviceGet(&dev, device);
+    if (result != CUDA_SUCCESS) return result;
+
+    CUuuid uuid;
+    result = p_cuDeviceGetUuid(&uuid, dev);
+    if (result != CUDA_SUCCESS) return result;
+
+    memcpy(uuid_out, uuid.bytes, 16);
+    return CUDA_SUCCESS;
+}
+
+// Get device count
+static CUresult cuda_get_device_count(int* count) {
+    return p_cuDeviceGetCount(count);
+}
+*/
+import "C"
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// libcudaNames are tried in order when loading the driver library
+var libcudaNames = []string{"libcuda.so.1", "libcuda.so"}
+
+// cudaSymbols are the driver entry points resolved by cuda_resolve, in bit order
+var cudaSymbols = []string{
+	"cuInit",
+	"cuDriverGetVersion",
+	"cuDeviceGet",
+	"cuDeviceGetCount",
+	"cuDeviceGetUuid",
+	"cuCheckpointProcessLock",
+	"cuCheckpointProcessCheckpoint",
+	"cuCheckpointProcessRestore",
+	"cuCheckpointProcessUnlock",
+	"cuCheckpointProcessGetState",
+}
+
+var (
+	probeOnce sync.Once
+	probed    Capabilities
+)
+
+// ProbeDriver loads libcuda (once per process) and reports which parts of
+// the driver API are usable on this host.
+func ProbeDriver() Capabilities {
+	probeOnce.Do(func() {
+		for _, name := range libcudaNames {
+			cname := C.CString(name)
+			ok := C.cuda_load(cname) == 0
+			C.free(unsafe.Pointer(cname))
+			if ok {
+				probed.Loaded = true
+				probed.Library = name
+				break
+			}
+		}
+		if !probed.Loaded {
+			return
+		}
+
+		resolved := uint(C.cuda_resolve())
+		for i, name := range cudaSymbols {
+			if resolved&(1<<uint(i)) == 0 {
+				probed.MissingSymbols = append(probed.MissingSymbols, name)
+			}
+		}
+
+		var version C.int
+		if C.cuda_driver_version(&version) == C.CUDA_SUCCESS {
+			probed.DriverVersion = int(version)
+		}
+		probed.CheckpointAPI = len(probed.MissingSymbols) == 0
+	})
+	return probed
+}
+
+// cgoDriver calls the CUDA driver API through a dynamically loaded libcuda
+type cgoDriver struct{}
+
+func nativeDriver() (Driver, error) {
+	caps := ProbeDriver()
+	if err := caps.Err(); err != nil {
+		return nil, err
+	}
+	return cgoDriver{}, nil
+}
+
+func (cgoDriver) Init() error {
+	return cudaError(int(C.cuda_init()), "cuInit")
+}
+
+func (cgoDriver) ProcessGetState(pid int) (ProcessState, error) {
+	var state C.int
+	result := C.cuda_checkpoint_get_state(C.int(pid), &state)
+	if err := cudaError(int(result), "cuCheckpointProcessGetState"); err != nil {
+		return StateRunning, err
+	}
+	return ProcessState(state), nil
+}
+
+func (cgoDriver) ProcessLock(pid int, timeoutMs uint) error {
+	result := C.cuda_checkpoint_lock(C.int(pid), C.uint(timeoutMs))
+	return cudaError(int(result), "cuCheckpointProcessLock")
+}
+
+func (cgoDriver) ProcessCheckpoint(pid int) error {
+	result := C.cuda_checkpoint_checkpoint(C.int(pid))
+	return cudaError(int(result), "cuCheckpointProcessCheckpoint")
+}
+
+func (cgoDriver) ProcessRestore(pid int, pairs []GPUPair) error {
+	if len(pairs) == 0 {
+		result := C.cuda_checkpoint_restore(C.int(pid), nil, 0)
+		return cudaError(int(result), "cuCheckpointProcessRestore")
+	}
+
+	buf := make([]byte, 0, len(pairs)*32)
+	for _, p := range pairs {
+		buf = append(buf, p.Old[:]...)
+		buf = append(buf, p.New[:]...)
+	}
+	result := C.cuda_checkpoint_restore(C.int(pid), (*C.char)(unsafe.Pointer(&buf[0])), C.uint(len(pairs)))
+	return cudaError(int(result), "cuCheckpointProcessRestore (remap)")
+}
+
+func (cgoDriver) ProcessUnlock(pid int) error {
+	result := C.cuda_checkpoint_unlock(C.int(pid))
+	return cudaError(int(result), "cuCheckpointProcessUnlock")
+}
+
+func (cgoDriver) DeviceGetCount() (int, error) {
+	var count C.int
+	result := C.cuda_get_device_count(&count)
+	if err := cudaError(int(result), "cuDeviceGetCount"); err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+func (cgoDriver) DeviceGetUUID(device int) ([16]byte, error) {
+	var out [16]byte
+	var uuid [16]C.char
+	result := C.cuda_get_device_uuid(C.int(device), &uuid[0])
+	if err := cudaError(int(result), "cuDeviceGetUuid"); err != nil {
+		return out, err
+	}
+	for i := 0; i < 16; i++ {
+		out[i] = byte(uuid[i])
+	}
+	return out, nil
+}
@@ -0,0 +1,255 @@
+package cuda
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// GPUDevicesFile is written into the checkpoint directory and lists the
+// GPUs the checkpointed process was using
+const GPUDevicesFile = "gpu-devices.json"
+
+// GPUDevice describes a physical GPU
+type GPUDevice struct {
+	Index       int    `json:"index"`
+	UUID        string `json:"uuid"`
+	Name        string `json:"name,omitempty"`
+	MemoryTotal int64  `json:"memoryTotal,omitempty"` // in bytes
+	// ComputeCapability is major.minor, e.g. 8.6, if the backend reports it
+	ComputeCapability string `json:"computeCapability,omitempty"`
+}
+
+// ListGPUs returns all GPUs of this node
+func ListGPUs() ([]GPUDevice, error) {
+	return discovery().Devices()
+}
+
+// ProcessGPUs returns the GPUs a process has CUDA contexts on
+func ProcessGPUs(pid int) ([]GPUDevice, error) {
+	processes, err := FindGPUProcesses()
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := ListGPUs()
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []GPUDevice
+	for _, proc := range processes {
+		if proc.PID != pid || proc.GPUUUID == "" {
+			continue
+		}
+		if dev, ok := findGPU(all, proc.GPUUUID); ok && !containsGPU(devices, dev.UUID) {
+			devices = append(devices, dev)
+		}
+	}
+	return devices, nil
+}
+
+// VisibleGPUs returns the GPUs assigned to a container through
+// NVIDIA_VISIBLE_DEVICES in its environment (UUIDs, indices or "all")
+func VisibleGPUs(env []string, all []GPUDevice) []GPUDevice {
+	value := ""
+	for _, e := range env {
+		if strings.HasPrefix(e, "NVIDIA_VISIBLE_DEVICES=") {
+			value = strings.TrimPrefix(e, "NVIDIA_VISIBLE_DEVICES=")
+		}
+	}
+
+	switch value {
+	case "", "void", "none":
+		return nil
+	case "all":
+		return all
+	}
+
+	var devices []GPUDevice
+	for _, id := range strings.Split(value, ",") {
+		id = strings.TrimSpace(id)
+		if index, err := strconv.Atoi(id); err == nil {
+			for _, dev := range all {
+				if dev.Index == index {
+					devices = append(devices, dev)
+				}
+			}
+			continue
+		}
+		if dev, ok := findGPU(all, id); ok {
+			devices = append(devices, dev)
+		}
+	}
+	return devices
+}
+
+// PlanGPURemap compares the GPUs recorded at checkpoint time with the GPUs
+// available to the restored container. It returns nil if every source GPU
+// is still available, otherwise a plan that keeps unchanged GPUs in place
+// and moves the others onto free targets, preferring the same model.
+func PlanGPURemap(source, target []GPUDevice) (*MigrationPlan, error) {
+	if len(source) == 0 {
+		return nil, nil
+	}
+	if len(target) < len(source) {
+		return nil, fmt.Errorf("checkpoint used %d GPU(s) but only %d are available", len(source), len(target))
+	}
+
+	var missing []GPUDevice
+	taken := map[string]bool{}
+	for _, src := range source {
+		if _, ok := findGPU(target, src.UUID); ok {
+			taken[normalizeUUID(src.UUID)] = true
+		} else {
+			missing = append(missing, src)
+		}
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+
+	assigned := map[string]GPUDevice{}
+	// First pass: same model, second pass: any free GPU
+	for _, sameModel := range []bool{true, false} {
+		for _, src := range missing {
+			if _, done := assigned[src.UUID]; done {
+				continue
+			}
+			for _, dst := range target {
+				if taken[normalizeUUID(dst.UUID)] || (sameModel && dst.Name != src.Name) {
+					continue
+				}
+				assigned[src.UUID] = dst
+				taken[normalizeUUID(dst.UUID)] = true
+				break
+			}
+		}
+	}
+
+	plan := &MigrationPlan{}
+	for _, src := range source {
+		dst, ok := assigned[src.UUID]
+		if !ok {
+			if _, present := findGPU(target, src.UUID); !present {
+				return nil, fmt.Errorf("no free GPU to restore %s onto", src.UUID)
+			}
+			dst = src
+		}
+		mapping, err := newGPUMapping(src, dst)
+		if err != nil {
+			return nil, err
+		}
+		plan.Mappings = append(plan.Mappings, mapping)
+	}
+	return plan, nil
+}
+
+// WriteGPUDevices records the GPUs of a checkpointed process in dir
+func WriteGPUDevices(dir string, devices []GPUDevice) error {
+	data, err := json.MarshalIndent(devices, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, GPUDevicesFile), data, 0644)
+}
+
+// ReadGPUDevices reads the GPUs recorded in a checkpoint directory.
+// It returns nil without error for checkpoints that predate the file.
+func ReadGPUDevices(dir string) ([]GPUDevice, error) {
+	data, err := os.ReadFile(filepath.Join(dir, GPUDevicesFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var devices []GPUDevice
+	if err := json.Unmarshal(data, &devices); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", GPUDevicesFile, err)
+	}
+	return devices, nil
+}
+
+// GPUUUIDs returns the UUIDs of devices
+func GPUUUIDs(devices []GPUDevice) ([][16]byte, error) {
+	uuids := make([][16]byte, 0, len(devices))
+	for _, dev := range devices {
+		uuid, err := ParseUUID(dev.UUID)
+		if err != nil {
+			return nil, err
+		}
+		uuids = append(uuids, uuid)
+	}
+	return uuids, nil
+}
+
+func newGPUMapping(src, dst GPUDevice) (GPUMapping, error) {
+	srcUUID, err := ParseUUID(src.UUID)
+	if err != nil {
+		return GPUMapping{}, err
+	}
+	dstUUID, err := ParseUUID(dst.UUID)
+	if err != nil {
+		return GPUMapping{}, err
+	}
+	return GPUMapping{
+		Source: GPUInfo{Index: src.Index, UUID: srcUUID},
+		Target: GPUInfo{Index: dst.Index, UUID: dstUUID},
+	}, nil
+}
+
+// normalizeUUID makes UUIDs comparable regardless of dashes or case
+func normalizeUUID(uuid string) string {
+	if u, err := ParseUUID(uuid); err == nil {
+		return FormatUUID(u)
+	}
+	return strings.ToLower(uuid)
+}
+
+func findGPU(devices []GPUDevice, uuid string) (GPUDevice, bool) {
+	want := normalizeUUID(uuid)
+	for _, dev := range devices {
+		if normalizeUUID(dev.UUID) == want {
+			return dev, true
+		}
+	}
+	return GPUDevice{}, false
+}
+
+func containsGPU(devices []GPUDevice, uuid string) bool {
+	_, ok := findGPU(devices, uuid)
+	return ok
+}
+
+// RestoreOnto restores pid from the checkpoint in dir onto the target GPUs.
+// When the GPUs recorded at checkpoint time are not all among target, the
+// restore remaps them (see PlanGPURemap). It returns the applied plan, or
+// nil if the process was restored onto its original GPUs.
+func (c *Checkpointer) RestoreOnto(pid int, dir string, target []GPUDevice) (*MigrationPlan, error) {
+	source, err := ReadGPUDevices(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	plan, err := PlanGPURemap(source, target)
+	if err != nil {
+		return nil, err
+	}
+	if plan == nil {
+		return nil, c.RestoreFull(pid)
+	}
+
+	used, err := GPUUUIDs(source)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.RestoreWithMigration(pid, used, plan); err != nil {
+		return plan, fmt.Errorf("restore with GPU remap %s: %w", plan, err)
+	}
+	return plan, nil
+}
@@ -0,0 +1,463 @@
+package cuda
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kybernate/kybernate/pkg/cgroup"
+)
+
+// GPUProcessesFile is written into the checkpoint directory and lists
+// every CUDA process of the container together with the GPUs it used
+const GPUProcessesFile = "gpu-processes.json"
+
+// GroupError reports the process and phase that failed a group operation
+// and any processes that could not be rolled back afterwards
+type GroupError struct {
+	Phase string
+	PID   int
+	Err   error
+	// Rollback maps PIDs to the error that left them in a partial state
+	Rollback map[int]error
+}
+
+func (e *GroupError) Error() string {
+	msg := fmt.Sprintf("%s of PID %d: %v", e.Phase, e.PID, e.Err)
+	if len(e.Rollback) == 0 {
+		return msg
+	}
+	pids := make([]int, 0, len(e.Rollback))
+	for pid := range e.Rollback {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	parts := make([]string, 0, len(pids))
+	for _, pid := range pids {
+		parts = append(parts, fmt.Sprintf("PID %d: %v", pid, e.Rollback[pid]))
+	}
+	return fmt.Sprintf("%s (rollback incomplete: %s)", msg, strings.Join(parts, "; "))
+}
+
+func (e *GroupError) Unwrap() error {
+	return e.Err
+}
+
+// CheckpointGroup checkpoints all processes of a container as one unit:
+// every process is locked before any is checkpointed, so no process
+// observes a peer whose device memory is already gone. The locks share
+// the deadline of ctx, which is checked between steps (see
+// CheckpointFullContext). If any step fails or ctx expires, all
+// processes are returned to the running state and a *GroupError names
+// the phase that was in progress.
+func (c *Checkpointer) CheckpointGroup(ctx context.Context, pids []int) error {
+	if len(pids) == 0 {
+		return nil
+	}
+	for i, pid := range pids {
+		err := ctx.Err()
+		if err == nil {
+			err = c.Lock(pid, lockTimeout(ctx))
+		}
+		if err != nil {
+			return c.rollbackGroup(&GroupError{Phase: PhaseLock, PID: pid, Err: phaseErr(ctx, err)}, pids[:i+1], c.toRunning)
+		}
+	}
+
+	for _, pid := range pids {
+		err := ctx.Err()
+		if err == nil {
+			err = c.Checkpoint(pid)
+		}
+		if err != nil {
+			return c.rollbackGroup(&GroupError{Phase: PhaseCheckpoint, PID: pid, Err: phaseErr(ctx, err)}, pids, c.toRunning)
+		}
+	}
+
+	// Finishing after the deadline still counts as expired
+	if err := ctx.Err(); err != nil {
+		return c.rollbackGroup(&GroupError{Phase: PhaseCheckpoint, PID: pids[len(pids)-1], Err: err}, pids, c.toRunning)
+	}
+	return nil
+}
+
+// RestoreGroup restores all processes of a container as one unit. restore
+// brings one process from checkpointed to locked (plain restore or with a
+// GPU remap); the processes are only unlocked once all of them have their
+// device memory back. If any step fails or ctx expires, all processes are
+// returned to the checkpointed state and a *GroupError is returned.
+func (c *Checkpointer) RestoreGroup(ctx context.Context, pids []int, restore func(pid int) error) error {
+	if len(pids) == 0 {
+		return nil
+	}
+	if restore == nil {
+		restore = c.Restore
+	}
+
+	for _, pid := range pids {
+		err := ctx.Err()
+		if err == nil {
+			err = restore(pid)
+		}
+		if err != nil {
+			return c.rollbackGroup(&GroupError{Phase: PhaseRestore, PID: pid, Err: phaseErr(ctx, err)}, pids, c.toCheckpointed)
+		}
+	}
+
+	// Last chance to give up: after this point processes start running
+	if err := ctx.Err(); err != nil {
+		return c.rollbackGroup(&GroupError{Phase: PhaseRestore, PID: pids[len(pids)-1], Err: err}, pids, c.toCheckpointed)
+	}
+
+	for _, pid := range pids {
+		if err := c.Unlock(pid); err != nil {
+			return c.rollbackGroup(&GroupError{Phase: PhaseUnlock, PID: pid, Err: err}, pids, c.toCheckpointed)
+		}
+	}
+	return nil
+}
+
+// rollbackGroup walks every process back with step (toRunning or
+// toCheckpointed), in reverse order. The state of each process is read
+// back from the driver, so processes that never got past a step are left
+// alone.
+func (c *Checkpointer) rollbackGroup(gerr *GroupError, pids []int, step func(pid int) error) error {
+	for i := len(pids) - 1; i >= 0; i-- {
+		if err := step(pids[i]); err != nil {
+			gerr.addRollback(pids[i], err)
+		}
+	}
+	return gerr
+}
+
+func (e *GroupError) addRollback(pid int, err error) {
+	if e.Rollback == nil {
+		e.Rollback = map[int]error{}
+	}
+	e.Rollback[pid] = err
+}
+
+// ProcessesInState returns the PIDs among pids whose CUDA state is state.
+// Processes the driver does not know (no CUDA context) are skipped.
+func (c *Checkpointer) ProcessesInState(pids []int, state ProcessState) []int {
+	var out []int
+	for _, pid := range pids {
+		if s, err := c.GetState(pid); err == nil && s == state {
+			out = append(out, pid)
+		}
+	}
+	return out
+}
+
+// ReleasedProcess reports a process that Release found locked or
+// checkpointed
+type ReleasedProcess struct {
+	PID int
+	// From is the state the process was found in
+	From ProcessState
+	// Err is set if the process could not be brought back to running
+	Err error
+}
+
+// Release brings every locked or checkpointed process of pids back to
+// running (restore and unlock, or unlock), so that signals reach them and
+// teardown does not hang in the driver. Processes are handled one by one
+// and a failure does not stop the others. Once ctx expires, the remaining
+// processes are reported with its error.
+func (c *Checkpointer) Release(ctx context.Context, pids []int) []ReleasedProcess {
+	var released []ReleasedProcess
+	for _, pid := range pids {
+		state, err := c.GetState(pid)
+		if err != nil || state == StateRunning {
+			continue
+		}
+		r := ReleasedProcess{PID: pid, From: state}
+		if r.Err = ctx.Err(); r.Err == nil {
+			r.Err = c.toRunning(pid)
+		}
+		released = append(released, r)
+	}
+	return released
+}
+
+// TaskProcesses returns taskPID and all of its descendants
+func TaskProcesses(taskPID int) []int {
+	if taskPID <= 0 {
+		return nil
+	}
+	pids := []int{taskPID}
+	for i := 0; i < len(pids); i++ {
+		pids = append(pids, childPIDs(pids[i])...)
+	}
+	return pids
+}
+
+// childPIDs returns the direct children of pid across all of its threads
+func childPIDs(pid int) []int {
+	tasks, err := os.ReadDir(filepath.Join("/proc", strconv.Itoa(pid), "task"))
+	if err != nil {
+		return nil
+	}
+
+	var children []int
+	for _, t := range tasks {
+		data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "task", t.Name(), "children"))
+		if err != nil {
+			continue
+		}
+		for _, field := range strings.Fields(string(data)) {
+			if child, err := strconv.Atoi(field); err == nil && child > 0 {
+				children = append(children, child)
+			}
+		}
+	}
+	return children
+}
+
+// FindGPUProcessesForTask returns every GPU process in the process tree of
+// a containerd task, ordered by PID
+func FindGPUProcessesForTask(taskPID int) ([]int, error) {
+	return findGPUProcesses(func(pid int) bool { return isDescendant(pid, taskPID) })
+}
+
+// FindGPUProcessesForContainer returns every GPU process in the cgroup
+// of the container, ordered by PID
+func FindGPUProcessesForContainer(containerID string) ([]int, error) {
+	pids, err := cgroup.ContainerProcesses(containerID)
+	if err != nil {
+		return nil, err
+	}
+	return FindGPUProcessesAmong(pids)
+}
+
+// FindGPUProcessesAmong returns the GPU processes of pids, ordered by PID
+func FindGPUProcessesAmong(pids []int) ([]int, error) {
+	in := make(map[int]bool, len(pids))
+	for _, pid := range pids {
+		in[pid] = true
+	}
+	return findGPUProcesses(func(pid int) bool { return in[pid] })
+}
+
+// ContainerProcesses returns the processes of a container: those in its
+// cgroup, which includes processes that left the process tree, and the
+// process tree of its init process taskPID (0 if unknown), for runtimes
+// whose cgroup layout is not recognized. The result is ordered by PID.
+func ContainerProcesses(containerID string, taskPID int) []int {
+	seen := map[int]bool{}
+	var pids []int
+	procs, _ := cgroup.ContainerProcesses(containerID)
+	for _, pid := range append(procs, TaskProcesses(taskPID)...) {
+		if !seen[pid] {
+			seen[pid] = true
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+func findGPUProcesses(match func(pid int) bool) ([]int, error) {
+	processes, err := FindGPUProcesses()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[int]bool{}
+	var pids []int
+	for _, proc := range processes {
+		if proc.PID <= 0 || seen[proc.PID] {
+			continue
+		}
+		seen[proc.PID] = true
+		if match(proc.PID) {
+			pids = append(pids, proc.PID)
+		}
+	}
+	sort.Ints(pids)
+	return pids, nil
+}
+
+// CheckpointedProcess records one CUDA process of a checkpointed container
+type CheckpointedProcess struct {
+	PID int `json:"pid"`
+	// NSPID is the PID inside the container's PID namespace. CRIU restores
+	// it unchanged, so it identifies the process again after restore.
+	NSPID int         `json:"nsPid"`
+	Name  string      `json:"name,omitempty"`
+	GPUs  []GPUDevice `json:"gpus,omitempty"`
+}
+
+// DescribeProcesses collects the GPUs used by each of pids
+func DescribeProcesses(pids []int) ([]CheckpointedProcess, error) {
+	out := make([]CheckpointedProcess, 0, len(pids))
+	for _, pid := range pids {
+		gpus, err := ProcessGPUs(pid)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, CheckpointedProcess{
+			PID:   pid,
+			NSPID: namespacePID(pid),
+			Name:  processName(pid),
+			GPUs:  gpus,
+		})
+	}
+	return out, nil
+}
+
+// UnionGPUs returns the GPUs used by any of the processes, without duplicates
+func UnionGPUs(processes []CheckpointedProcess) []GPUDevice {
+	var devices []GPUDevice
+	for _, p := range processes {
+		for _, dev := range p.GPUs {
+			if !containsGPU(devices, dev.UUID) {
+				devices = append(devices, dev)
+			}
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Index < devices[j].Index })
+	return devices
+}
+
+// WriteGPUProcesses records the CUDA processes of a checkpoint in dir
+func WriteGPUProcesses(dir string, processes []CheckpointedProcess) error {
+	data, err := json.MarshalIndent(processes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, GPUProcessesFile), data, 0644)
+}
+
+// ReadGPUProcesses reads the CUDA processes recorded in a checkpoint
+// directory. It returns nil without error for checkpoints that predate
+// the file.
+func ReadGPUProcesses(dir string) ([]CheckpointedProcess, error) {
+	data, err := os.ReadFile(filepath.Join(dir, GPUProcessesFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var processes []CheckpointedProcess
+	if err := json.Unmarshal(data, &processes); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", GPUProcessesFile, err)
+	}
+	return processes, nil
+}
+
+// namespacePID returns the innermost namespace PID of pid from
+// /proc/<pid>/status, or pid itself if it cannot be read
+func namespacePID(pid int) int {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "status"))
+	if err != nil {
+		return pid
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "NSpid:") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "NSpid:"))
+		if len(fields) == 0 {
+			break
+		}
+		if nspid, err := strconv.Atoi(fields[len(fields)-1]); err == nil {
+			return nspid
+		}
+	}
+	return pid
+}
+
+// RestoreGroupOnto restores all checkpointed CUDA processes of a container
+// from the checkpoint in dir onto the target GPUs, remapping them as a
+// whole when the recorded GPUs are not all among target. It returns the
+// applied container-level plan, or nil if no remap was needed.
+func (c *Checkpointer) RestoreGroupOnto(ctx context.Context, pids []int, dir string, target []GPUDevice) (*MigrationPlan, error) {
+	recorded, err := ReadGPUProcesses(dir)
+	if err != nil {
+		return nil, err
+	}
+	source := UnionGPUs(recorded)
+	if len(source) == 0 {
+		// Checkpoints written before processes were recorded individually
+		if source, err = ReadGPUDevices(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	plan, err := PlanGPURemap(source, target)
+	if err != nil {
+		return nil, err
+	}
+	if plan == nil {
+		return nil, c.RestoreGroup(ctx, pids, nil)
+	}
+
+	used, err := GPUUUIDs(source)
+	if err != nil {
+		return nil, err
+	}
+	err = c.RestoreGroup(ctx, pids, func(pid int) error {
+		used, pairs, err := processPairs(plan, used, recorded, pid)
+		if err != nil {
+			return err
+		}
+		return c.RestoreWithGPUMap(pid, used, pairs)
+	})
+	if err != nil {
+		return plan, fmt.Errorf("restore with GPU remap %s: %w", plan, err)
+	}
+	return plan, nil
+}
+
+// processPairs narrows a container-level plan to the GPUs the process
+// with host PID pid used at checkpoint time, and returns those GPUs with
+// it. Processes without a record get the whole plan and used, the GPUs
+// of the container.
+func processPairs(plan *MigrationPlan, used [][16]byte, recorded []CheckpointedProcess, pid int) ([][16]byte, []GPUPair, error) {
+	nspid := namespacePID(pid)
+	for _, rec := range recorded {
+		if rec.NSPID != nspid || len(rec.GPUs) == 0 {
+			continue
+		}
+		own, err := GPUUUIDs(rec.GPUs)
+		if err != nil {
+			return nil, nil, err
+		}
+		var pairs []GPUPair
+		for _, pair := range plan.Pairs() {
+			for _, u := range own {
+				if u == pair.Old {
+					pairs = append(pairs, pair)
+				}
+			}
+		}
+		return own, pairs, nil
+	}
+	return used, plan.Pairs(), nil
+}
+
+// RecordProcesses writes the CUDA processes of a container and the union
+// of their GPUs into the checkpoint directory
+func RecordProcesses(dir string, pids []int) ([]CheckpointedProcess, error) {
+	processes, err := DescribeProcesses(pids)
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteGPUProcesses(dir, processes); err != nil {
+		return nil, err
+	}
+	if devices := UnionGPUs(processes); len(devices) > 0 {
+		if err := WriteGPUDevices(dir, devices); err != nil {
+			return nil, err
+		}
+	}
+	return processes, nil
+}
@@ -0,0 +1,243 @@
+package cuda
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kybernate/kybernate/pkg/cgroup"
+)
+
+// ErrInsufficientHostMemory is returned when the device memory of a
+// container would not fit into host memory during a CUDA checkpoint
+var ErrInsufficientHostMemory = errors.New("insufficient host memory for VRAM offload")
+
+// Headroom added to the VRAM estimate: a tenth of it, at least 64 MiB,
+// for the driver's staging buffers and allocations not reported per process
+const minOffloadHeadroom = 64 * 1024 * 1024
+
+func offloadNeed(bytes int64) int64 {
+	headroom := bytes / 10
+	if headroom < minOffloadHeadroom {
+		headroom = minOffloadHeadroom
+	}
+	return bytes + headroom
+}
+
+// OffloadOptions control PreflightOffload
+type OffloadOptions struct {
+	// RaiseLimit allows raising the memory limit of the container's own
+	// cgroup for the duration of the offload. Limits of enclosing cgroups
+	// (the pod) are never changed.
+	RaiseLimit bool
+}
+
+// OffloadReservation is the result of a successful preflight. If limits
+// were raised, Release puts them back once the offloaded memory is gone.
+// It can be persisted as JSON and released by another process.
+type OffloadReservation struct {
+	// Bytes is the VRAM that will be copied into host memory
+	Bytes int64 `json:"bytes"`
+	// Need is Bytes plus headroom
+	Need int64 `json:"need"`
+	// Available is the node's MemAvailable at preflight time
+	Available int64 `json:"available"`
+	// Limits lists the cgroup limits raised for the offload
+	Limits []LimitChange `json:"limits,omitempty"`
+}
+
+// LimitChange records a raised cgroup memory limit
+type LimitChange struct {
+	Cgroup   *cgroup.Cgroup `json:"cgroup"`
+	Original int64          `json:"original"`
+	Raised   int64          `json:"raised"`
+}
+
+// Raised reports whether any cgroup limit was raised
+func (r *OffloadReservation) Raised() bool {
+	return r != nil && len(r.Limits) > 0
+}
+
+func (r *OffloadReservation) String() string {
+	msg := fmt.Sprintf("VRAM offload of %s (need %s, node has %s available)",
+		cgroup.FormatBytes(r.Bytes), cgroup.FormatBytes(r.Need), cgroup.FormatBytes(r.Available))
+	for _, l := range r.Limits {
+		msg += fmt.Sprintf("; raised limit of %s from %s to %s",
+			l.Cgroup, cgroup.FormatBytes(l.Original), cgroup.FormatBytes(l.Raised))
+	}
+	return msg
+}
+
+// Release restores the limits raised by PreflightOffload. A limit is only
+// lowered once the cgroup's usage fits under it again; otherwise lowering
+// it would trigger the OOM killer, so it is left raised and an error is
+// returned. Cgroups that no longer exist are skipped.
+func (r *OffloadReservation) Release() error {
+	if r == nil {
+		return nil
+	}
+
+	var errs []string
+	var kept []LimitChange
+	for _, l := range r.Limits {
+		usage, err := l.Cgroup.MemoryUsage()
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil && l.Original != cgroup.Unlimited && usage > l.Original {
+			errs = append(errs, fmt.Sprintf("%s still uses %s, above its original limit %s; leaving it at %s",
+				l.Cgroup, cgroup.FormatBytes(usage), cgroup.FormatBytes(l.Original), cgroup.FormatBytes(l.Raised)))
+			kept = append(kept, l)
+			continue
+		}
+		if err := l.Cgroup.SetMemoryLimit(l.Original); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Sprintf("restore limit of %s: %v", l.Cgroup, err))
+			kept = append(kept, l)
+		}
+	}
+	r.Limits = kept
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// EstimateOffload returns the device memory in use by each of pids, which
+// is what a CUDA checkpoint copies into host memory
+func EstimateOffload(pids []int) (map[int]int64, error) {
+	processes, err := FindGPUProcesses()
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make(map[int]int64, len(pids))
+	for _, pid := range pids {
+		usage[pid] = 0
+	}
+	for _, proc := range processes {
+		if _, ok := usage[proc.PID]; ok {
+			usage[proc.PID] += proc.UsedMemory
+		}
+	}
+	return usage, nil
+}
+
+// PreflightOffload checks that the device memory of pids fits into host
+// memory before they are locked: into the node's MemAvailable and into
+// the memory limit of each process's cgroup and of every cgroup above it.
+// With opts.RaiseLimit the container's own limit is raised where needed.
+// If the offload cannot fit, the error wraps ErrInsufficientHostMemory.
+func PreflightOffload(pids []int, opts OffloadOptions) (*OffloadReservation, error) {
+	usage, err := EstimateOffload(pids)
+	if err != nil {
+		return nil, fmt.Errorf("estimate VRAM usage: %w", err)
+	}
+
+	res := &OffloadReservation{}
+	perCgroup := map[string]int64{}
+	cgroups := map[string]*cgroup.Cgroup{}
+	for _, pid := range pids {
+		res.Bytes += usage[pid]
+
+		cg, err := cgroup.ForPID(pid)
+		if err != nil {
+			// Not in a memory cgroup (or already gone): only the node limit applies
+			continue
+		}
+		perCgroup[cg.Path] += usage[pid]
+		cgroups[cg.Path] = cg
+	}
+	if res.Bytes == 0 {
+		return res, nil
+	}
+	res.Need = offloadNeed(res.Bytes)
+
+	if available, err := cgroup.MemAvailable(); err == nil {
+		res.Available = available
+		if res.Need > available {
+			return nil, fmt.Errorf("%w: offloading %s of VRAM needs %s but the node has only %s available",
+				ErrInsufficientHostMemory, cgroup.FormatBytes(res.Bytes), cgroup.FormatBytes(res.Need), cgroup.FormatBytes(available))
+		}
+	}
+
+	for path, bytes := range perCgroup {
+		if err := res.reserve(cgroups[path], offloadNeed(bytes), opts); err != nil {
+			_ = res.Release()
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// reserve makes room for need bytes in cg, checking every enclosing
+// cgroup as well
+func (r *OffloadReservation) reserve(cg *cgroup.Cgroup, need int64, opts OffloadOptions) error {
+	var raiseTo int64
+	for c := cg; c != nil; c = c.Parent() {
+		limit, err := c.MemoryLimit()
+		if err != nil || limit == cgroup.Unlimited {
+			continue
+		}
+		usage, err := c.MemoryUsage()
+		if err != nil || usage+need <= limit {
+			continue
+		}
+
+		if c == cg && opts.RaiseLimit {
+			raiseTo = usage + need
+			continue
+		}
+		msg := fmt.Sprintf("offloading VRAM needs %s in cgroup %s, which uses %s of its %s limit",
+			cgroup.FormatBytes(need), c, cgroup.FormatBytes(usage), cgroup.FormatBytes(limit))
+		if c == cg {
+			msg += " (allow raising the memory limit to offload anyway)"
+		}
+		return fmt.Errorf("%w: %s", ErrInsufficientHostMemory, msg)
+	}
+
+	if raiseTo == 0 {
+		return nil
+	}
+	original, err := cg.MemoryLimit()
+	if err != nil {
+		return err
+	}
+	if err := cg.SetMemoryLimit(raiseTo); err != nil {
+		return fmt.Errorf("raise memory limit of %s: %w", cg, err)
+	}
+	r.Limits = append(r.Limits, LimitChange{Cgroup: cg, Original: original, Raised: raiseTo})
+	return nil
+}
+
+// Annotation and environment variable that allow raising the container's
+// memory limit for a VRAM offload ("true"/"false")
+const (
+	RaiseMemoryLimitAnnotation = "kybernate.io/raise-memory-limit"
+	RaiseMemoryLimitEnv        = "KYBERNATE_RAISE_MEMORY_LIMIT"
+)
+
+// OffloadOptionsFromEnv returns defaults overridden by KYBERNATE_RAISE_MEMORY_LIMIT
+func OffloadOptionsFromEnv(defaults OffloadOptions) (OffloadOptions, error) {
+	return defaults.override(os.Getenv(RaiseMemoryLimitEnv), "environment")
+}
+
+// OffloadOptionsFromAnnotations returns defaults overridden by the
+// workload's kybernate.io/raise-memory-limit annotation
+func OffloadOptionsFromAnnotations(annotations map[string]string, defaults OffloadOptions) (OffloadOptions, error) {
+	return defaults.override(annotations[RaiseMemoryLimitAnnotation], "annotation")
+}
+
+func (o OffloadOptions) override(raise, source string) (OffloadOptions, error) {
+	if raise == "" {
+		return o, nil
+	}
+	v, err := strconv.ParseBool(raise)
+	if err != nil {
+		return o, fmt.Errorf("invalid raise-memory-limit %q in %s", raise, source)
+	}
+	o.RaiseLimit = v
+	return o, nil
+}
@@ -0,0 +1,257 @@
+//go:build cgo
+
+package cuda
+
+/*
+#cgo LDFLAGS: -ldl
+
+#include <dlfcn.h>
+#include <stdlib.h>
+
+// NVML is loaded at runtime like libcuda. The types below mirror nvml.h.
+
+typedef int nvmlReturn_t;
+typedef void* nvmlDevice_t;
+
+#define NVML_SUCCESS 0
+#define NVML_ERROR_UNINITIALIZED 1
+#define NVML_ERROR_NOT_SUPPORTED 3
+#define NVML_ERROR_INSUFFICIENT_SIZE 7
+#define NVML_ERROR_LIBRARY_NOT_FOUND 12
+#define NVML_ERROR_FUNCTION_NOT_FOUND 13
+
+#define NVML_BUFFER_SIZE 96
+
+typedef struct {
+    unsigned long long total;
+    unsigned long long free;
+    unsigned long long used;
+} nvmlMemory_t;
+
+typedef struct {
+    unsigned int pid;
+    unsigned long long usedGpuMemory;
+    unsigned int gpuInstanceId;
+    unsigned int computeInstanceId;
+} nvmlProcessInfo_t;
+
+// NVML fills these structs by layout; the sizes of nvml.h are checked at
+// compile time
+_Static_assert(sizeof(nvmlMemory_t) == 24, "nvmlMemory_t must be 24 bytes");
+_Static_assert(sizeof(nvmlProcessInfo_t) == 24, "nvmlProcessInfo_t must be 24 bytes");
+
+static void* libnvml = NULL;
+
+static nvmlReturn_t (*p_nvmlInit)(void);
+static nvmlReturn_t (*p_nvmlDeviceGetCount)(unsigned int*);
+static nvmlReturn_t (*p_nvmlDeviceGetHandleByIndex)(unsigned int, nvmlDevice_t*);
+static nvmlReturn_t (*p_nvmlDeviceGetUUID)(nvmlDevice_t, char*, unsigned int);
+static nvmlReturn_t (*p_nvmlDeviceGetName)(nvmlDevice_t, char*, unsigned int);
+static nvmlReturn_t (*p_nvmlDeviceGetMemoryInfo)(nvmlDevice_t, nvmlMemory_t*);
+static nvmlReturn_t (*p_nvmlDeviceGetComputeRunningProcesses)(nvmlDevice_t, unsigned int*, nvmlProcessInfo_t*);
+static nvmlReturn_t (*p_nvmlDeviceGetCudaComputeCapability)(nvmlDevice_t, int*, int*);
+
+// Load libnvidia-ml, resolve the symbols we need and call nvmlInit
+static nvmlReturn_t nvml_load(const char* name) {
+    if (libnvml != NULL) return NVML_SUCCESS;
+    void* lib = dlopen(name, RTLD_NOW | RTLD_GLOBAL);
+    if (lib == NULL) return NVML_ERROR_LIBRARY_NOT_FOUND;
+
+    p_nvmlInit = dlsym(lib, "nvmlInit_v2");
+    p_nvmlDeviceGetCount = dlsym(lib, "nvmlDeviceGetCount_v2");
+    p_nvmlDeviceGetHandleByIndex = dlsym(lib, "nvmlDeviceGetHandleByIndex_v2");
+    p_nvmlDeviceGetUUID = dlsym(lib, "nvmlDeviceGetUUID");
+    p_nvmlDeviceGetName = dlsym(lib, "nvmlDeviceGetName");
+    p_nvmlDeviceGetMemoryInfo = dlsym(lib, "nvmlDeviceGetMemoryInfo");
+    p_nvmlDeviceGetComputeRunningProcesses = dlsym(lib, "nvmlDeviceGetComputeRunningProcesses_v3");
+    if (p_nvmlDeviceGetComputeRunningProcesses == NULL)
+        p_nvmlDeviceGetComputeRunningProcesses = dlsym(lib, "nvmlDeviceGetComputeRunningProcesses_v2");
+    // Optional: drivers before 418 do not report the compute capability
+    p_nvmlDeviceGetCudaComputeCapability = dlsym(lib, "nvmlDeviceGetCudaComputeCapability");
+
+    if (p_nvmlInit == NULL || p_nvmlDeviceGetCount == NULL || p_nvmlDeviceGetHandleByIndex == NULL ||
+        p_nvmlDeviceGetUUID == NULL || p_nvmlDeviceGetName == NULL || p_nvmlDeviceGetMemoryInfo == NULL ||
+        p_nvmlDeviceGetComputeRunningProcesses == NULL) {
+        dlclose(lib);
+        return NVML_ERROR_FUNCTION_NOT_FOUND;
+    }
+
+    nvmlReturn_t ret = p_nvmlInit();
+    if (ret != NVML_SUCCESS) {
+        dlclose(lib);
+        return ret;
+    }
+    libnvml = lib;
+    return NVML_SUCCESS;
+}
+
+static nvmlReturn_t nvml_device_count(unsigned int* count) {
+    return p_nvmlDeviceGetCount(count);
+}
+
+// Fill in the UUID, name, total memory and compute capability of device
+// index. major and minor stay -1 if NVML cannot tell the capability.
+static nvmlReturn_t nvml_device_info(unsigned int index, char* uuid, char* name, unsigned long long* total, int* major, int* minor) {
+    nvmlDevice_t dev;
+    nvmlReturn_t ret = p_nvmlDeviceGetHandleByIndex(index, &dev);
+    if (ret != NVML_SUCCESS) return ret;
+
+    ret = p_nvmlDeviceGetUUID(dev, uuid, NVML_BUFFER_SIZE);
+    if (ret != NVML_SUCCESS) return ret;
+
+    ret = p_nvmlDeviceGetName(dev, name, NVML_BUFFER_SIZE);
+    if (ret != NVML_SUCCESS) return ret;
+
+    nvmlMemory_t mem;
+    ret = p_nvmlDeviceGetMemoryInfo(dev, &mem);
+    if (ret != NVML_SUCCESS) return ret;
+    *total = mem.total;
+
+    *major = -1;
+    *minor = -1;
+    if (p_nvmlDeviceGetCudaComputeCapability != NULL &&
+        p_nvmlDeviceGetCudaComputeCapability(dev, major, minor) != NVML_SUCCESS) {
+        *major = -1;
+        *minor = -1;
+    }
+    return NVML_SUCCESS;
+}
+
+// List compute processes of device index into infos (capacity *count).
+// On NVML_ERROR_INSUFFICIENT_SIZE *count holds the required capacity.
+static nvmlReturn_t nvml_device_processes(unsigned int index, unsigned int* count, nvmlProcessInfo_t* infos) {
+    nvmlDevice_t dev;
+    nvmlReturn_t ret = p_nvmlDeviceGetHandleByIndex(index, &dev);
+    if (ret != NVML_SUCCESS) return ret;
+    return p_nvmlDeviceGetComputeRunningProcesses(dev, count, infos);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+// libnvmlNames are tried in order when loading NVML
+var libnvmlNames = []string{"libnvidia-ml.so.1", "libnvidia-ml.so"}
+
+// nvmlValueNotAvailable is reported for usedGpuMemory when NVML cannot tell
+const nvmlValueNotAvailable = ^uint64(0)
+
+var (
+	nvmlOnce sync.Once
+	nvmlErr  error
+)
+
+// loadNVML opens and initializes NVML once per process
+func loadNVML() error {
+	nvmlOnce.Do(func() {
+		ret := C.int(C.NVML_ERROR_LIBRARY_NOT_FOUND)
+		for _, name := range libnvmlNames {
+			cname := C.CString(name)
+			ret = C.nvml_load(cname)
+			C.free(unsafe.Pointer(cname))
+			if ret != C.NVML_ERROR_LIBRARY_NOT_FOUND {
+				break
+			}
+		}
+		nvmlErr = nvmlError(int(ret), "nvmlInit")
+	})
+	return nvmlErr
+}
+
+func nvmlError(code int, operation string) error {
+	if code == 0 {
+		return nil
+	}
+	return fmt.Errorf("NVML error %d: %s failed", code, operation)
+}
+
+// nvmlDiscoverer queries NVML (libnvidia-ml) directly
+type nvmlDiscoverer struct{}
+
+func (nvmlDiscoverer) Name() string {
+	return "nvml"
+}
+
+func (nvmlDiscoverer) Devices() ([]GPUDevice, error) {
+	if err := loadNVML(); err != nil {
+		return nil, err
+	}
+
+	var count C.uint
+	if err := nvmlError(int(C.nvml_device_count(&count)), "nvmlDeviceGetCount"); err != nil {
+		return nil, err
+	}
+
+	devices := make([]GPUDevice, 0, int(count))
+	for i := 0; i < int(count); i++ {
+		var uuid, name [96]C.char
+		var total C.ulonglong
+		var major, minor C.int
+		ret := C.nvml_device_info(C.uint(i), &uuid[0], &name[0], &total, &major, &minor)
+		if err := nvmlError(int(ret), "nvmlDeviceGetUUID"); err != nil {
+			return nil, err
+		}
+		dev := GPUDevice{
+			Index:       i,
+			UUID:        C.GoString(&uuid[0]),
+			Name:        C.GoString(&name[0]),
+			MemoryTotal: int64(total),
+		}
+		if major >= 0 && minor >= 0 {
+			dev.ComputeCapability = fmt.Sprintf("%d.%d", int(major), int(minor))
+		}
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
+func (n nvmlDiscoverer) ComputeProcesses() ([]GPUProcess, error) {
+	devices, err := n.Devices()
+	if err != nil {
+		return nil, err
+	}
+
+	var processes []GPUProcess
+	for _, dev := range devices {
+		infos, err := nvmlDeviceProcesses(dev.Index)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			used := int64(0)
+			if uint64(info.usedGpuMemory) != nvmlValueNotAvailable {
+				used = int64(info.usedGpuMemory)
+			}
+			processes = append(processes, GPUProcess{
+				PID:        int(info.pid),
+				UsedMemory: used,
+				Name:       processName(int(info.pid)),
+				GPUUUID:    dev.UUID,
+			})
+		}
+	}
+	return processes, nil
+}
+
+// nvmlDeviceProcesses lists the compute processes of one device, growing
+// the buffer until NVML stops reporting an insufficient size
+func nvmlDeviceProcesses(index int) ([]C.nvmlProcessInfo_t, error) {
+	capacity := 16
+	for {
+		infos := make([]C.nvmlProcessInfo_t, capacity)
+		count := C.uint(capacity)
+		ret := C.nvml_device_processes(C.uint(index), &count, &infos[0])
+		if ret == C.NVML_ERROR_INSUFFICIENT_SIZE {
+			capacity = int(count) + 8
+			continue
+		}
+		if err := nvmlError(int(ret), "nvmlDeviceGetComputeRunningProcesses"); err != nil {
+			return nil, err
+		}
+		return infos[:int(count)], nil
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !cgo
+
+package cuda
+
+import (
+	"errors"
+)
+
+// nvmlDiscoverer is unavailable without cgo; discovery falls back to nvidia-smi
+type nvmlDiscoverer struct{}
+
+func (nvmlDiscoverer) Name() string {
+	return "nvml"
+}
+
+func (nvmlDiscoverer) Devices() ([]GPUDevice, error) {
+	return nil, errors.New("NVML requires cgo")
+}
+
+func (nvmlDiscoverer) ComputeProcesses() ([]GPUProcess, error) {
+	return nil, errors.New("NVML requires cgo")
+}
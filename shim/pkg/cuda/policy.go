@@ -0,0 +1,106 @@
+package cuda
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FailurePolicy decides what happens to a checkpoint or restore when the
+// CUDA stage fails
+type FailurePolicy string
+
+const (
+	// PolicyBestEffort carries on without the GPU state: the CRIU dump is
+	// taken anyway, and a restored container keeps running. Checkpoints
+	// taken this way are marked degraded.
+	PolicyBestEffort FailurePolicy = "best-effort"
+	// PolicyFailClosed aborts: the processes are unlocked and the
+	// checkpoint fails, or the restored container is killed
+	PolicyFailClosed FailurePolicy = "fail-closed"
+)
+
+// Annotation and environment variable selecting the failure policy
+const (
+	FailurePolicyAnnotation = "kybernate.io/cuda-failure-policy"
+	FailurePolicyEnv        = "KYBERNATE_CUDA_FAILURE_POLICY"
+)
+
+// DefaultFailurePolicy keeps the behaviour of earlier releases
+const DefaultFailurePolicy = PolicyBestEffort
+
+// ParseFailurePolicy parses "best-effort" or "fail-closed"; an empty
+// string yields def
+func ParseFailurePolicy(s string, def FailurePolicy) (FailurePolicy, error) {
+	switch FailurePolicy(strings.ToLower(strings.TrimSpace(s))) {
+	case "":
+		return def, nil
+	case PolicyBestEffort:
+		return PolicyBestEffort, nil
+	case PolicyFailClosed:
+		return PolicyFailClosed, nil
+	}
+	return def, fmt.Errorf("invalid failure policy %q (expected %q or %q)", s, PolicyBestEffort, PolicyFailClosed)
+}
+
+// FailurePolicyFromEnv returns def overridden by KYBERNATE_CUDA_FAILURE_POLICY
+func FailurePolicyFromEnv(def FailurePolicy) (FailurePolicy, error) {
+	return ParseFailurePolicy(os.Getenv(FailurePolicyEnv), def)
+}
+
+// FailurePolicyFromAnnotations returns def overridden by the workload's
+// kybernate.io/cuda-failure-policy annotation
+func FailurePolicyFromAnnotations(annotations map[string]string, def FailurePolicy) (FailurePolicy, error) {
+	return ParseFailurePolicy(annotations[FailurePolicyAnnotation], def)
+}
+
+// DegradedFile in a checkpoint directory marks a checkpoint whose GPU
+// state was not captured
+const DegradedFile = "cuda-degraded.json"
+
+// Degraded explains why a checkpoint lacks its GPU state
+type Degraded struct {
+	Phase string    `json:"phase"`
+	PIDs  []int     `json:"pids,omitempty"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// MarkDegraded records in dir that the CUDA stage of pids failed with err
+func MarkDegraded(dir string, pids []int, err error) error {
+	d := Degraded{Phase: PhaseCheckpoint, PIDs: pids, Error: err.Error(), Time: time.Now()}
+	var perr *PhaseError
+	var gerr *GroupError
+	switch {
+	case errors.As(err, &gerr):
+		d.Phase = gerr.Phase
+	case errors.As(err, &perr):
+		d.Phase = perr.Phase
+	}
+	data, merr := json.MarshalIndent(d, "", "  ")
+	if merr != nil {
+		return merr
+	}
+	return os.WriteFile(filepath.Join(dir, DegradedFile), data, 0644)
+}
+
+// ReadDegraded returns the degradation recorded in dir, or nil if the
+// checkpoint is complete
+func ReadDegraded(dir string) (*Degraded, error) {
+	data, err := os.ReadFile(filepath.Join(dir, DegradedFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var d Degraded
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", DegradedFile, err)
+	}
+	return &d, nil
+}
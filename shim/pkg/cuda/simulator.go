@@ -0,0 +1,460 @@
+package cuda
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+// Simulated driver operations, used as keys for fault injection
+const (
+	SimOpInit       = "init"
+	SimOpGetState   = "getstate"
+	SimOpLock       = "lock"
+	SimOpCheckpoint = "checkpoint"
+	SimOpRestore    = "restore"
+	SimOpUnlock     = "unlock"
+)
+
+// SimProcess is a CUDA process known to the simulated driver
+type SimProcess struct {
+	PID   int          `json:"pid"`
+	Name  string       `json:"name,omitempty"`
+	State ProcessState `json:"state"`
+	// Devices lists the UUIDs of the GPUs the process has contexts on
+	Devices []string `json:"devices"`
+	// VRAMBytes is the device memory in use while running
+	VRAMBytes int64 `json:"vramBytes"`
+	// HostBytes is the device memory parked in host RAM while checkpointed
+	HostBytes int64 `json:"hostBytes,omitempty"`
+}
+
+// simState is the persisted form of the simulator
+type simState struct {
+	Devices   []string            `json:"devices"`
+	Processes map[int]*SimProcess `json:"processes"`
+	// Faults maps an operation to a CUDA error code returned by its next call
+	Faults map[string]int `json:"faults,omitempty"`
+}
+
+// SimDriver is an in-memory CUDA driver for hosts without a GPU.
+// It enforces the running → locked → checkpointed state machine of the
+// checkpoint API, tracks device UUIDs per process and returns the same
+// error codes as libcuda. When opened with OpenSimDriver the state is
+// kept in a JSON file so separate processes share one simulated node;
+// every call holds an flock on <path>.lock while it reads, changes and
+// rewrites the file.
+type SimDriver struct {
+	mu          sync.Mutex
+	path        string
+	initialized bool
+	state       simState
+}
+
+// NewSimDriver creates an in-memory simulated driver with the given GPUs
+func NewSimDriver(devices ...[16]byte) *SimDriver {
+	s := &SimDriver{state: simState{Processes: map[int]*SimProcess{}}}
+	for _, d := range devices {
+		s.state.Devices = append(s.state.Devices, FormatUUID(d))
+	}
+	return s
+}
+
+// OpenSimDriver opens a simulated driver backed by the JSON file at path.
+// A missing file yields a node with no GPUs and no processes.
+func OpenSimDriver(path string) (*SimDriver, error) {
+	s := &SimDriver{path: path, state: simState{Processes: map[int]*SimProcess{}}}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SimDriver) load() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("read simulator state: %w", err)
+	}
+	var st simState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("parse simulator state %s: %w", s.path, err)
+	}
+	if st.Processes == nil {
+		st.Processes = map[int]*SimProcess{}
+	}
+	s.state = st
+	return nil
+}
+
+// lockState takes an flock on the lock file next to the state file,
+// shared to read the state and exclusive to change it. The state file
+// itself is replaced on every save, so it cannot carry the lock.
+func (s *SimDriver) lockState(how int) (unlock func(), err error) {
+	if s.path == "" {
+		return func() {}, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(s.path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open simulator lock: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock simulator state: %w", err)
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+func (s *SimDriver) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// update runs fn against freshly loaded state and persists the result
+// if fn changed it
+func (s *SimDriver) update(fn func(st *simState) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := s.lockState(syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	before, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+	opErr := fn(&s.state)
+	after, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+	if string(after) != string(before) {
+		if err := s.save(); err != nil {
+			return err
+		}
+	}
+	return opErr
+}
+
+// view runs fn against freshly loaded state without writing it back
+func (s *SimDriver) view(fn func(st *simState)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// A reader that cannot take the lock, e.g. on a read-only mount,
+	// still sees the last complete save
+	if unlock, err := s.lockState(syscall.LOCK_SH); err == nil {
+		defer unlock()
+	}
+
+	_ = s.load()
+	fn(&s.state)
+}
+
+// fault consumes an injected fault for op, if any
+func (st *simState) fault(op, name string) error {
+	code, ok := st.Faults[op]
+	if !ok {
+		return nil
+	}
+	delete(st.Faults, op)
+	return cudaError(code, name)
+}
+
+// AddDevice registers a GPU with the simulated node
+func (s *SimDriver) AddDevice(uuid [16]byte) error {
+	return s.update(func(st *simState) error {
+		st.Devices = append(st.Devices, FormatUUID(uuid))
+		return nil
+	})
+}
+
+// AddProcess registers a running CUDA process using the given GPUs
+func (s *SimDriver) AddProcess(pid int, name string, vramBytes int64, devices ...[16]byte) error {
+	return s.update(func(st *simState) error {
+		p := &SimProcess{PID: pid, Name: name, State: StateRunning, VRAMBytes: vramBytes}
+		for _, d := range devices {
+			u := FormatUUID(d)
+			if !st.hasDevice(u) {
+				return fmt.Errorf("simulated device %s does not exist", u)
+			}
+			p.Devices = append(p.Devices, u)
+		}
+		st.Processes[pid] = p
+		return nil
+	})
+}
+
+// RemoveProcess forgets a simulated process, as if it had exited
+func (s *SimDriver) RemoveProcess(pid int) error {
+	return s.update(func(st *simState) error {
+		delete(st.Processes, pid)
+		return nil
+	})
+}
+
+// Process returns a copy of the simulated process with the given PID
+func (s *SimDriver) Process(pid int) (SimProcess, bool) {
+	var cp SimProcess
+	var ok bool
+	s.view(func(st *simState) {
+		var p *SimProcess
+		if p, ok = st.Processes[pid]; ok {
+			cp = *p
+			cp.Devices = append([]string(nil), p.Devices...)
+		}
+	})
+	return cp, ok
+}
+
+// Processes returns copies of all simulated processes ordered by PID
+func (s *SimDriver) Processes() []SimProcess {
+	var out []SimProcess
+	s.view(func(st *simState) {
+		out = make([]SimProcess, 0, len(st.Processes))
+		for _, p := range st.Processes {
+			cp := *p
+			cp.Devices = append([]string(nil), p.Devices...)
+			out = append(out, cp)
+		}
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].PID < out[j].PID })
+	return out
+}
+
+// Devices returns the UUIDs of the simulated GPUs in device index order
+func (s *SimDriver) Devices() []string {
+	var devices []string
+	s.view(func(st *simState) {
+		devices = append([]string(nil), st.Devices...)
+	})
+	return devices
+}
+
+// FailNext makes the next call of op fail with the given CUDA error code
+func (s *SimDriver) FailNext(op string, code int) error {
+	return s.update(func(st *simState) error {
+		if st.Faults == nil {
+			st.Faults = map[string]int{}
+		}
+		st.Faults[op] = code
+		return nil
+	})
+}
+
+func (st *simState) hasDevice(uuid string) bool {
+	for _, d := range st.Devices {
+		if d == uuid {
+			return true
+		}
+	}
+	return false
+}
+
+// process looks up pid for an API call, mirroring the driver's errors
+func (s *SimDriver) process(st *simState, pid int, name string) (*SimProcess, error) {
+	if !s.initialized {
+		return nil, cudaError(ErrCodeNotInitialized, name)
+	}
+	p, ok := st.Processes[pid]
+	if !ok {
+		return nil, cudaError(ErrCodeInvalidValue, name)
+	}
+	return p, nil
+}
+
+func (s *SimDriver) Init() error {
+	return s.update(func(st *simState) error {
+		if err := st.fault(SimOpInit, "cuInit"); err != nil {
+			return err
+		}
+		if len(st.Devices) == 0 {
+			return cudaError(ErrCodeNoDevice, "cuInit")
+		}
+		s.initialized = true
+		return nil
+	})
+}
+
+func (s *SimDriver) ProcessGetState(pid int) (ProcessState, error) {
+	state := StateRunning
+	err := s.update(func(st *simState) error {
+		const name = "cuCheckpointProcessGetState"
+		if err := st.fault(SimOpGetState, name); err != nil {
+			return err
+		}
+		p, err := s.process(st, pid, name)
+		if err != nil {
+			return err
+		}
+		state = p.State
+		return nil
+	})
+	return state, err
+}
+
+func (s *SimDriver) ProcessLock(pid int, timeoutMs uint) error {
+	return s.update(func(st *simState) error {
+		const name = "cuCheckpointProcessLock"
+		if err := st.fault(SimOpLock, name); err != nil {
+			return err
+		}
+		p, err := s.process(st, pid, name)
+		if err != nil {
+			return err
+		}
+		if p.State != StateRunning {
+			return cudaError(ErrCodeIllegalState, name)
+		}
+		p.State = StateLocked
+		return nil
+	})
+}
+
+func (s *SimDriver) ProcessCheckpoint(pid int) error {
+	return s.update(func(st *simState) error {
+		const name = "cuCheckpointProcessCheckpoint"
+		if err := st.fault(SimOpCheckpoint, name); err != nil {
+			return err
+		}
+		p, err := s.process(st, pid, name)
+		if err != nil {
+			return err
+		}
+		if p.State != StateLocked {
+			return cudaError(ErrCodeIllegalState, name)
+		}
+		p.State = StateCheckpointed
+		p.HostBytes = p.VRAMBytes
+		p.VRAMBytes = 0
+		return nil
+	})
+}
+
+func (s *SimDriver) ProcessRestore(pid int, pairs []GPUPair) error {
+	return s.update(func(st *simState) error {
+		const name = "cuCheckpointProcessRestore"
+		if err := st.fault(SimOpRestore, name); err != nil {
+			return err
+		}
+		p, err := s.process(st, pid, name)
+		if err != nil {
+			return err
+		}
+		if p.State != StateCheckpointed {
+			return cudaError(ErrCodeIllegalState, name)
+		}
+
+		// A remap must name every device of the process exactly once
+		if len(pairs) > 0 && len(pairs) != len(p.Devices) {
+			return cudaError(ErrCodeInvalidValue, name)
+		}
+		devices := append([]string(nil), p.Devices...)
+		targets := map[string]bool{}
+		for _, pair := range pairs {
+			oldUUID, newUUID := FormatUUID(pair.Old), FormatUUID(pair.New)
+			if !st.hasDevice(newUUID) || targets[newUUID] {
+				return cudaError(ErrCodeInvalidValue, name)
+			}
+			targets[newUUID] = true
+			found := false
+			for i, d := range p.Devices {
+				if d == oldUUID {
+					devices[i] = newUUID
+					found = true
+				}
+			}
+			if !found {
+				return cudaError(ErrCodeInvalidValue, name)
+			}
+		}
+
+		p.Devices = devices
+		p.State = StateLocked
+		p.VRAMBytes = p.HostBytes
+		p.HostBytes = 0
+		return nil
+	})
+}
+
+func (s *SimDriver) ProcessUnlock(pid int) error {
+	return s.update(func(st *simState) error {
+		const name = "cuCheckpointProcessUnlock"
+		if err := st.fault(SimOpUnlock, name); err != nil {
+			return err
+		}
+		p, err := s.process(st, pid, name)
+		if err != nil {
+			return err
+		}
+		if p.State != StateLocked {
+			return cudaError(ErrCodeIllegalState, name)
+		}
+		p.State = StateRunning
+		return nil
+	})
+}
+
+func (s *SimDriver) DeviceGetCount() (int, error) {
+	count := 0
+	err := s.update(func(st *simState) error {
+		if !s.initialized {
+			return cudaError(ErrCodeNotInitialized, "cuDeviceGetCount")
+		}
+		count = len(st.Devices)
+		return nil
+	})
+	return count, err
+}
+
+func (s *SimDriver) DeviceGetUUID(device int) ([16]byte, error) {
+	var uuid [16]byte
+	err := s.update(func(st *simState) error {
+		const name = "cuDeviceGetUuid"
+		if !s.initialized {
+			return cudaError(ErrCodeNotInitialized, name)
+		}
+		if device < 0 || device >= len(st.Devices) {
+			return cudaError(ErrCodeInvalidDevice, name)
+		}
+		u, err := ParseUUID(st.Devices[device])
+		if err != nil {
+			return err
+		}
+		uuid = u
+		return nil
+	})
+	return uuid, err
+}
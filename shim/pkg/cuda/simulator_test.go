@@ -0,0 +1,278 @@
+package cuda
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+var (
+	simGPU0 = [16]byte{0x01, 0x02, 0x03, 0x04, 15: 0x10}
+	simGPU1 = [16]byte{0x0a, 0x0b, 0x0c, 0x0d, 15: 0x20}
+)
+
+func newSimCheckpointer(t *testing.T, pid int, vram int64) (*Checkpointer, *SimDriver) {
+	t.Helper()
+	sim := NewSimDriver(simGPU0, simGPU1)
+	if err := sim.AddProcess(pid, "worker", vram, simGPU0); err != nil {
+		t.Fatalf("AddProcess: %v", err)
+	}
+	c, err := NewCheckpointerWithDriver(sim)
+	if err != nil {
+		t.Fatalf("NewCheckpointerWithDriver: %v", err)
+	}
+	return c, sim
+}
+
+func expectState(t *testing.T, c *Checkpointer, pid int, want ProcessState) {
+	t.Helper()
+	got, err := c.GetState(pid)
+	if err != nil {
+		t.Fatalf("GetState: %v", err)
+	}
+	if got != want {
+		t.Fatalf("state = %s, want %s", got, want)
+	}
+}
+
+func TestSimulatorLifecycle(t *testing.T) {
+	const pid, vram = 4242, 1 << 30
+	c, sim := newSimCheckpointer(t, pid, vram)
+	expectState(t, c, pid, StateRunning)
+
+	if err := c.Lock(pid, 1000); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	expectState(t, c, pid, StateLocked)
+
+	if err := c.Checkpoint(pid); err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+	expectState(t, c, pid, StateCheckpointed)
+	p, _ := sim.Process(pid)
+	if p.VRAMBytes != 0 || p.HostBytes != vram {
+		t.Fatalf("checkpointed process holds %d bytes of VRAM and %d of host memory, want 0 and %d", p.VRAMBytes, p.HostBytes, int64(vram))
+	}
+
+	if err := c.Restore(pid); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	expectState(t, c, pid, StateLocked)
+
+	if err := c.Unlock(pid); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	expectState(t, c, pid, StateRunning)
+	p, _ = sim.Process(pid)
+	if p.VRAMBytes != vram || p.HostBytes != 0 {
+		t.Fatalf("restored process holds %d bytes of VRAM and %d of host memory, want %d and 0", p.VRAMBytes, p.HostBytes, int64(vram))
+	}
+	if len(p.Devices) != 1 || p.Devices[0] != FormatUUID(simGPU0) {
+		t.Fatalf("restored process is on %v, want [%s]", p.Devices, FormatUUID(simGPU0))
+	}
+}
+
+func TestSimulatorIllegalTransitions(t *testing.T) {
+	const pid = 7
+	tests := []struct {
+		name string
+		prep func(c *Checkpointer) error
+		op   func(c *Checkpointer) error
+	}{
+		{"checkpoint running", nil, func(c *Checkpointer) error { return c.Checkpoint(pid) }},
+		{"restore running", nil, func(c *Checkpointer) error { return c.Restore(pid) }},
+		{"unlock running", nil, func(c *Checkpointer) error { return c.Unlock(pid) }},
+		{"lock locked", func(c *Checkpointer) error { return c.Lock(pid, 0) }, func(c *Checkpointer) error { return c.Lock(pid, 0) }},
+		{"unlock checkpointed", func(c *Checkpointer) error { return c.CheckpointFull(pid, 0) }, func(c *Checkpointer) error { return c.Unlock(pid) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newSimCheckpointer(t, pid, 1024)
+			if tt.prep != nil {
+				if err := tt.prep(c); err != nil {
+					t.Fatalf("prepare: %v", err)
+				}
+			}
+			var cerr *CUDAError
+			if err := tt.op(c); !errors.As(err, &cerr) || cerr.Code != ErrCodeIllegalState {
+				t.Fatalf("got %v, want CUDA error %d", err, ErrCodeIllegalState)
+			}
+		})
+	}
+}
+
+func TestSimulatorFaultRollsBackLock(t *testing.T) {
+	const pid = 9
+	c, sim := newSimCheckpointer(t, pid, 1024)
+	if err := sim.FailNext(SimOpCheckpoint, ErrCodeNotReady); err != nil {
+		t.Fatalf("FailNext: %v", err)
+	}
+	if err := c.CheckpointFull(pid, 0); err == nil {
+		t.Fatal("CheckpointFull succeeded despite the injected fault")
+	}
+	expectState(t, c, pid, StateRunning)
+
+	// The fault is consumed by the call it was injected for
+	if err := c.CheckpointFull(pid, 0); err != nil {
+		t.Fatalf("CheckpointFull: %v", err)
+	}
+	if err := c.RestoreFull(pid); err != nil {
+		t.Fatalf("RestoreFull: %v", err)
+	}
+	expectState(t, c, pid, StateRunning)
+}
+
+func TestSimulatorRestoreWithRemap(t *testing.T) {
+	const pid = 11
+	c, sim := newSimCheckpointer(t, pid, 1024)
+	if err := c.CheckpointFull(pid, 0); err != nil {
+		t.Fatalf("CheckpointFull: %v", err)
+	}
+	if err := c.RestoreWithRemap(pid, simGPU0, simGPU1); err != nil {
+		t.Fatalf("RestoreWithRemap: %v", err)
+	}
+	expectState(t, c, pid, StateLocked)
+	if err := c.Unlock(pid); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	p, _ := sim.Process(pid)
+	if len(p.Devices) != 1 || p.Devices[0] != FormatUUID(simGPU1) {
+		t.Fatalf("remapped process is on %v, want [%s]", p.Devices, FormatUUID(simGPU1))
+	}
+}
+
+func TestSimulatorSharedState(t *testing.T) {
+	const pid = 13
+	path := filepath.Join(t.TempDir(), "sim.json")
+	first, err := OpenSimDriver(path)
+	if err != nil {
+		t.Fatalf("OpenSimDriver: %v", err)
+	}
+	if err := first.AddDevice(simGPU0); err != nil {
+		t.Fatalf("AddDevice: %v", err)
+	}
+	if err := first.AddProcess(pid, "worker", 1024, simGPU0); err != nil {
+		t.Fatalf("AddProcess: %v", err)
+	}
+	c, err := NewCheckpointerWithDriver(first)
+	if err != nil {
+		t.Fatalf("NewCheckpointerWithDriver: %v", err)
+	}
+	if err := c.CheckpointFull(pid, 0); err != nil {
+		t.Fatalf("CheckpointFull: %v", err)
+	}
+
+	// A second process opening the same file sees the checkpoint
+	second, err := OpenSimDriver(path)
+	if err != nil {
+		t.Fatalf("OpenSimDriver: %v", err)
+	}
+	c2, err := NewCheckpointerWithDriver(second)
+	if err != nil {
+		t.Fatalf("NewCheckpointerWithDriver: %v", err)
+	}
+	expectState(t, c2, pid, StateCheckpointed)
+	if err := c2.RestoreFull(pid); err != nil {
+		t.Fatalf("RestoreFull: %v", err)
+	}
+	expectState(t, c, pid, StateRunning)
+}
+
+func TestSimulatorConcurrentUpdates(t *testing.T) {
+	// Each driver stands for a separate process: its own mutex and its
+	// own descriptor of the lock file
+	path := filepath.Join(t.TempDir(), "sim.json")
+	setup, err := OpenSimDriver(path)
+	if err != nil {
+		t.Fatalf("OpenSimDriver: %v", err)
+	}
+	if err := setup.AddDevice(simGPU0); err != nil {
+		t.Fatalf("AddDevice: %v", err)
+	}
+
+	const writers, perWriter = 8, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			sim, err := OpenSimDriver(path)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for i := 0; i < perWriter; i++ {
+				if err := sim.AddProcess(1000*(w+1)+i, "worker", 1024, simGPU0); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("AddProcess: %v", err)
+	}
+
+	if got := len(setup.Processes()); got != writers*perWriter {
+		t.Fatalf("simulator holds %d processes, want %d: updates were lost", got, writers*perWriter)
+	}
+}
+
+func TestSimulatorReadsDoNotWrite(t *testing.T) {
+	const pid = 21
+	path := filepath.Join(t.TempDir(), "sim.json")
+	sim, err := OpenSimDriver(path)
+	if err != nil {
+		t.Fatalf("OpenSimDriver: %v", err)
+	}
+	if err := sim.AddDevice(simGPU0); err != nil {
+		t.Fatalf("AddDevice: %v", err)
+	}
+	if err := sim.AddProcess(pid, "worker", 1024, simGPU0); err != nil {
+		t.Fatalf("AddProcess: %v", err)
+	}
+	c, err := NewCheckpointerWithDriver(sim)
+	if err != nil {
+		t.Fatalf("NewCheckpointerWithDriver: %v", err)
+	}
+
+	// save indents the state, so a rewrite changes the compact form
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, compact.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectState(t, c, pid, StateRunning)
+	sim.Process(pid)
+	sim.Processes()
+	sim.Devices()
+	if _, err := sim.DeviceGetCount(); err != nil {
+		t.Fatalf("DeviceGetCount: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || !bytes.Equal(data, compact.Bytes()) {
+		t.Fatalf("a read rewrote the simulator state (%v)", err)
+	}
+
+	// A consumed fault is a change and is saved
+	if err := sim.FailNext(SimOpGetState, ErrCodeNotReady); err != nil {
+		t.Fatalf("FailNext: %v", err)
+	}
+	if _, err := c.GetState(pid); err == nil {
+		t.Fatal("GetState ignored the injected fault")
+	}
+	// The next call loads the state again and finds the fault gone
+	expectState(t, c, pid, StateRunning)
+}
@@ -0,0 +1,62 @@
+package cuda
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Annotations and environment variables that set the CUDA timeouts of a
+// workload. Values use Go duration syntax, e.g. "90s" or "5m".
+const (
+	CheckpointTimeoutAnnotation = "kybernate.io/cuda-checkpoint-timeout"
+	RestoreTimeoutAnnotation    = "kybernate.io/cuda-restore-timeout"
+	CheckpointTimeoutEnv        = "KYBERNATE_CUDA_CHECKPOINT_TIMEOUT"
+	RestoreTimeoutEnv           = "KYBERNATE_CUDA_RESTORE_TIMEOUT"
+)
+
+// Timeouts bound the CUDA part of a checkpoint (lock + checkpoint of all
+// processes) and of a restore (restore + unlock of all processes)
+type Timeouts struct {
+	Checkpoint time.Duration
+	Restore    time.Duration
+}
+
+// DefaultTimeouts apply when neither the workload nor the environment
+// sets a timeout. Large models need tens of seconds to copy VRAM.
+var DefaultTimeouts = Timeouts{
+	Checkpoint: 60 * time.Second,
+	Restore:    60 * time.Second,
+}
+
+// TimeoutsFromEnv returns defaults overridden by KYBERNATE_CUDA_*_TIMEOUT
+func TimeoutsFromEnv(defaults Timeouts) (Timeouts, error) {
+	return defaults.override(os.Getenv(CheckpointTimeoutEnv), os.Getenv(RestoreTimeoutEnv), "environment")
+}
+
+// TimeoutsFromAnnotations returns defaults overridden by the workload's
+// kybernate.io/cuda-*-timeout annotations
+func TimeoutsFromAnnotations(annotations map[string]string, defaults Timeouts) (Timeouts, error) {
+	return defaults.override(annotations[CheckpointTimeoutAnnotation], annotations[RestoreTimeoutAnnotation], "annotation")
+}
+
+func (t Timeouts) override(checkpoint, restore, source string) (Timeouts, error) {
+	for _, v := range []struct {
+		value  string
+		target *time.Duration
+		name   string
+	}{
+		{checkpoint, &t.Checkpoint, "checkpoint"},
+		{restore, &t.Restore, "restore"},
+	} {
+		if v.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v.value)
+		if err != nil || d <= 0 {
+			return t, fmt.Errorf("invalid %s timeout %q in %s", v.name, v.value, source)
+		}
+		*v.target = d
+	}
+	return t, nil
+}
@@ -0,0 +1,213 @@
+// Package export hands a checkpoint on once it is written: copied,
+// hard-linked or archived into a directory, or passed to a command that
+// moves it to another storage tier. The checkpoint itself stays where the
+// runtime wrote it, for containerd.
+package export
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kybernate/kybernate/pkg/manifest"
+)
+
+// Kind names an exporter
+type Kind string
+
+const (
+	// KindNone leaves the checkpoint alone
+	KindNone Kind = "none"
+	// KindCopy copies the checkpoint into a directory
+	KindCopy Kind = "copy"
+	// KindHardLink links the files of the checkpoint into a directory on
+	// the same filesystem, without copying them
+	KindHardLink Kind = "hardlink"
+	// KindTar writes the checkpoint into a gzip-compressed tar archive in
+	// a directory
+	KindTar Kind = "tar"
+	// KindTier runs a command that takes the checkpoint to another
+	// storage tier
+	KindTier Kind = "tier"
+)
+
+const (
+	// Annotation selects the exporter of a workload by the name the node's
+	// configuration gives it, or "none". A workload never names a
+	// directory or command itself: the shim runs exporters as root on the
+	// node.
+	Annotation = "kybernate.io/checkpoint-export"
+	// Env sets the exporter of workloads without annotation, as
+	// "<kind>:<target>", e.g. "tar:/mnt/archive", or "none"
+	Env = "KYBERNATE_CHECKPOINT_EXPORT"
+)
+
+// Spec selects an exporter and its target: the directory of copy,
+// hardlink and tar, the command of tier
+type Spec struct {
+	Kind   Kind
+	Target string
+}
+
+// None exports nothing
+var None = Spec{Kind: KindNone}
+
+func (s Spec) String() string {
+	if s.Kind == "" || s.Kind == KindNone {
+		return string(KindNone)
+	}
+	return string(s.Kind) + ":" + s.Target
+}
+
+// ParseSpec parses "none" or "<kind>:<target>"; an empty string yields
+// def
+func ParseSpec(s string, def Spec) (Spec, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return def, nil
+	}
+	kind, target, _ := strings.Cut(s, ":")
+	spec := Spec{Kind: Kind(strings.ToLower(strings.TrimSpace(kind))), Target: strings.TrimSpace(target)}
+	switch spec.Kind {
+	case KindNone:
+		return None, nil
+	case KindCopy, KindHardLink, KindTar, KindTier:
+		if !filepath.IsAbs(spec.Target) {
+			return def, fmt.Errorf("invalid checkpoint export %q (the target of %s must be an absolute path)", s, spec.Kind)
+		}
+		return spec, nil
+	}
+	return def, fmt.Errorf("invalid checkpoint export %q (expected none, copy:<dir>, hardlink:<dir>, tar:<dir> or tier:<command>)", s)
+}
+
+// SpecFromEnv returns def overridden by KYBERNATE_CHECKPOINT_EXPORT
+func SpecFromEnv(def Spec) (Spec, error) {
+	return ParseSpec(os.Getenv(Env), def)
+}
+
+// Exporters are the exporters configured on a node, by name
+type Exporters map[string]Spec
+
+// ValidName reports whether name can name a configured exporter:
+// lowercase letters, digits and dashes, other than "none"
+func ValidName(name string) bool {
+	if name == "" || name == string(KindNone) {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// Lookup returns the exporter configured as name; "none" selects None
+func (e Exporters) Lookup(name string) (Spec, error) {
+	if name == string(KindNone) {
+		return None, nil
+	}
+	if spec, ok := e[name]; ok {
+		return spec, nil
+	}
+	if len(e) == 0 {
+		return Spec{}, fmt.Errorf("unknown checkpoint exporter %q (the node configures none)", name)
+	}
+	names := make([]string, 0, len(e))
+	for n := range e {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return Spec{}, fmt.Errorf("unknown checkpoint exporter %q (expected none or one of %s)", name, strings.Join(names, ", "))
+}
+
+// SpecFromAnnotations returns def overridden by the exporter that the
+// workload's kybernate.io/checkpoint-export annotation selects among
+// exporters
+func SpecFromAnnotations(annotations map[string]string, exporters Exporters, def Spec) (Spec, error) {
+	name := strings.TrimSpace(annotations[Annotation])
+	if name == "" {
+		return def, nil
+	}
+	spec, err := exporters.Lookup(name)
+	if err != nil {
+		return def, fmt.Errorf("invalid %s: %w", Annotation, err)
+	}
+	return spec, nil
+}
+
+// UnmarshalText parses a spec in a configuration file
+func (s *Spec) UnmarshalText(text []byte) error {
+	spec, err := ParseSpec(string(text), None)
+	if err != nil {
+		return err
+	}
+	*s = spec
+	return nil
+}
+
+// MarshalText is the inverse of UnmarshalText
+func (s Spec) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Exporter hands a checkpoint on
+type Exporter interface {
+	// Export hands on the checkpoint in dir, taken of workload, and
+	// returns where it went, or "" if nowhere
+	Export(ctx context.Context, dir string, workload manifest.Workload) (string, error)
+}
+
+// New returns the exporter of spec
+func New(spec Spec) Exporter {
+	switch spec.Kind {
+	case KindCopy:
+		return Copy{Dir: spec.Target}
+	case KindHardLink:
+		return HardLink{Dir: spec.Target}
+	case KindTar:
+		return Tar{Dir: spec.Target}
+	case KindTier:
+		return Tier{Command: spec.Target}
+	}
+	return noop{}
+}
+
+type noop struct{}
+
+func (noop) Export(context.Context, string, manifest.Workload) (string, error) { return "", nil }
+
+// destination names the export of a checkpoint of workload taken at t
+// below dir: <dir>/<namespace>/<pod>/<container>/<time>, or
+// <dir>/<container-id>/<time> outside Kubernetes
+func destination(dir string, workload manifest.Workload, t time.Time) string {
+	stamp := t.UTC().Format("20060102T150405Z")
+	if workload.Pod == "" {
+		return filepath.Join(dir, workload.ContainerID, stamp)
+	}
+	return filepath.Join(dir, workload.Namespace, workload.Pod, workload.Container, stamp)
+}
+
+// publish writes an export through write into a temporary name next to
+// dest and renames it to dest once complete, so a partial export is never
+// mistaken for a checkpoint
+func publish(dest string, write func(tmp string) error) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp := dest + ".partial"
+	os.RemoveAll(tmp)
+	if err := write(tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return nil
+}
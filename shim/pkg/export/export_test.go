@@ -0,0 +1,62 @@
+package export
+
+import "testing"
+
+func TestSpecFromAnnotations(t *testing.T) {
+	exporters := Exporters{
+		"archive":   {Kind: KindTar, Target: "/mnt/archive"},
+		"cold-tier": {Kind: KindTier, Target: "/usr/local/bin/to-s3"},
+	}
+	def := Spec{Kind: KindCopy, Target: "/var/lib/kybernate/exports"}
+
+	tests := []struct {
+		name       string
+		annotation string
+		exporters  Exporters
+		want       Spec
+		wantErr    bool
+	}{
+		{"no annotation", "", exporters, def, false},
+		{"configured", "archive", exporters, exporters["archive"], false},
+		{"configured command", " cold-tier ", exporters, exporters["cold-tier"], false},
+		{"none", "none", exporters, None, false},
+		{"none without exporters", "none", nil, None, false},
+		{"unknown", "scratch", exporters, def, true},
+		{"no exporters", "archive", nil, def, true},
+		// A workload must not pick the directory or command
+		{"directory", "tar:/etc", exporters, def, true},
+		{"command", "tier:/bin/sh", exporters, def, true},
+		{"kind of a configured exporter", "tar:/mnt/archive", exporters, def, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{}
+			if tt.annotation != "" {
+				annotations[Annotation] = tt.annotation
+			}
+			got, err := SpecFromAnnotations(annotations, tt.exporters, def)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SpecFromAnnotations(%q) error = %v, want error %v", tt.annotation, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("SpecFromAnnotations(%q) = %s, want %s", tt.annotation, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"archive":     true,
+		"cold-tier-2": true,
+		"":            false,
+		"none":        false,
+		"Archive":     false,
+		"tar:/mnt":    false,
+		"a/b":         false,
+	} {
+		if got := ValidName(name); got != want {
+			t.Errorf("ValidName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
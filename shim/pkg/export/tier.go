@@ -0,0 +1,56 @@
+package export
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/kybernate/kybernate/pkg/manifest"
+)
+
+// Environment of a tier command, naming the checkpoint and its workload
+const (
+	EnvCheckpoint  = "KYBERNATE_CHECKPOINT"
+	EnvNamespace   = "KYBERNATE_NAMESPACE"
+	EnvPod         = "KYBERNATE_POD"
+	EnvContainer   = "KYBERNATE_CONTAINER"
+	EnvContainerID = "KYBERNATE_CONTAINER_ID"
+)
+
+// Tier runs Command to take a checkpoint to another storage tier, such as
+// an object store or a slower disk. The command gets the checkpoint
+// directory as its argument and in KYBERNATE_CHECKPOINT, and the workload
+// in KYBERNATE_NAMESPACE, KYBERNATE_POD, KYBERNATE_CONTAINER and
+// KYBERNATE_CONTAINER_ID. It must be done with the directory when it
+// exits; the last line it prints names where the checkpoint went.
+type Tier struct {
+	Command string
+}
+
+func (t Tier) Export(ctx context.Context, dir string, workload manifest.Workload) (string, error) {
+	cmd := exec.CommandContext(ctx, t.Command, dir)
+	cmd.Env = append(os.Environ(),
+		EnvCheckpoint+"="+dir,
+		EnvNamespace+"="+workload.Namespace,
+		EnvPod+"="+workload.Pod,
+		EnvContainer+"="+workload.Container,
+		EnvContainerID+"="+workload.ContainerID,
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("tier command %s: %v: %s", t.Command, err, msg)
+		}
+		return "", fmt.Errorf("tier command %s: %w", t.Command, err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if location := strings.TrimSpace(lines[len(lines)-1]); location != "" {
+		return location, nil
+	}
+	return t.Command, nil
+}
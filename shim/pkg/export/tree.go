@@ -0,0 +1,103 @@
+package export
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/kybernate/kybernate/pkg/manifest"
+)
+
+// Copy copies a checkpoint into Dir
+type Copy struct {
+	Dir string
+}
+
+func (c Copy) Export(ctx context.Context, dir string, workload manifest.Workload) (string, error) {
+	dest := destination(c.Dir, workload, time.Now())
+	err := publish(dest, func(tmp string) error {
+		return walkTree(ctx, dir, tmp, copyFile)
+	})
+	if err != nil {
+		return "", fmt.Errorf("copy checkpoint to %s: %w", dest, err)
+	}
+	return dest, nil
+}
+
+// HardLink links the files of a checkpoint into Dir, which must be on the
+// same filesystem. The export shares the files' data with the checkpoint
+// and costs no space until one of them is removed.
+type HardLink struct {
+	Dir string
+}
+
+func (h HardLink) Export(ctx context.Context, dir string, workload manifest.Workload) (string, error) {
+	dest := destination(h.Dir, workload, time.Now())
+	err := publish(dest, func(tmp string) error {
+		return walkTree(ctx, dir, tmp, func(src, dst string, _ fs.FileInfo) error {
+			return os.Link(src, dst)
+		})
+	})
+	if errors.Is(err, syscall.EXDEV) {
+		return "", fmt.Errorf("hard-link checkpoint to %s: not on the filesystem of %s", dest, dir)
+	}
+	if err != nil {
+		return "", fmt.Errorf("hard-link checkpoint to %s: %w", dest, err)
+	}
+	return dest, nil
+}
+
+// walkTree recreates the directories and symlinks of src below dst and
+// hands each regular file to file
+func walkTree(ctx context.Context, src, dst string, file func(src, dst string, info fs.FileInfo) error) error {
+	return filepath.Walk(src, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return file(path, target, info)
+		}
+		// Sockets, pipes and devices are not part of a checkpoint
+		return nil
+	})
+}
+
+func copyFile(src, dst string, info fs.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
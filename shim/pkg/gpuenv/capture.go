@@ -0,0 +1,228 @@
+package gpuenv
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+
+	"github.com/kybernate/kybernate/pkg/cgroup"
+	"github.com/kybernate/kybernate/pkg/mountinfo"
+)
+
+// Capture records the NVIDIA environment of the container whose init
+// process is pid: the mounts rules select, resolved against the mounts
+// of the calling process, the NVIDIA device nodes and the device rules
+// of its cgroup
+func Capture(pid int, rules Rules) (*Environment, error) {
+	container, err := mountinfo.ForPID(pid)
+	if err != nil {
+		return nil, err
+	}
+	host, err := mountinfo.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+
+	env := &Environment{DriverVersion: DriverVersion()}
+	env.Mounts, env.Skipped = Mounts(container, host, rules)
+	env.Sonames = Sonames(env.Mounts)
+	env.Devices, err = Devices(fmt.Sprintf("/proc/%d/root", pid))
+	if err != nil {
+		return nil, err
+	}
+	env.DeviceRules = DeviceRules(pid, env.Devices)
+	return env, nil
+}
+
+// Mounts turns the container mounts that rules select into OCI mounts.
+// A bind mount gets the host path of what it mounts, found through the
+// host mount of the same filesystem; a tmpfs that is not on the host is
+// mounted afresh. Mounts that cannot be recreated are returned as
+// skipped, with the reason.
+func Mounts(container, host []mountinfo.Mount, rules Rules) (mounts []specs.Mount, skipped []string) {
+	for _, m := range container {
+		if !rules.Match(m) {
+			continue
+		}
+		if source, ok := hostPath(m, host); ok {
+			mounts = append(mounts, specs.Mount{
+				Destination: m.MountPoint,
+				Type:        "bind",
+				Source:      source,
+				Options:     append([]string{"bind"}, append(mountFlags(m.Options), m.Propagation())...),
+			})
+			continue
+		}
+		if m.FSType == "tmpfs" && m.Root == "/" {
+			options := mountFlags(m.Options)
+			for _, o := range m.SuperOptions {
+				if o != "rw" && o != "ro" {
+					options = append(options, o)
+				}
+			}
+			mounts = append(mounts, specs.Mount{Destination: m.MountPoint, Type: "tmpfs", Source: "tmpfs", Options: options})
+			continue
+		}
+		skipped = append(skipped, fmt.Sprintf("%s: %s %s of %s is not mounted on the host", m.MountPoint, m.FSType, m.Root, m.Device()))
+	}
+	return mounts, skipped
+}
+
+// Sonames reads the soname of each library that mounts bind-mount, by
+// destination
+func Sonames(mounts []specs.Mount) map[string]string {
+	sonames := map[string]string{}
+	for _, m := range mounts {
+		if m.Type != "bind" || !isLibrary(m.Destination) {
+			continue
+		}
+		if soname, err := Soname(m.Source); err == nil {
+			sonames[m.Destination] = soname
+		}
+	}
+	return sonames
+}
+
+// hostPath returns the path on the host of the root of m: below the host
+// mount of the same filesystem whose root is the longest parent of it
+func hostPath(m mountinfo.Mount, host []mountinfo.Mount) (string, bool) {
+	var best *mountinfo.Mount
+	for i := range host {
+		h := &host[i]
+		if h.Major != m.Major || h.Minor != m.Minor || !within(m.Root, h.Root) {
+			continue
+		}
+		if best == nil || len(h.Root) > len(best.Root) {
+			best = h
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	rel := strings.TrimPrefix(m.Root, best.Root)
+	return path.Join(best.MountPoint, rel), true
+}
+
+// within reports whether p is dir or below it
+func within(p, dir string) bool {
+	return dir == "/" || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// bindFlags are the per-mount options that the runtime applies to a bind
+// mount
+var bindFlags = map[string]bool{
+	"ro": true, "rw": true, "nosuid": true, "nodev": true, "noexec": true,
+	"noatime": true, "relatime": true, "strictatime": true, "nodiratime": true,
+}
+
+func mountFlags(options []string) []string {
+	var flags []string
+	for _, o := range options {
+		if bindFlags[o] {
+			flags = append(flags, o)
+		}
+	}
+	return flags
+}
+
+// deviceGlobs name the NVIDIA device nodes below the root of a container
+var deviceGlobs = []string{"/dev/nvidia*", "/dev/nvidia-caps/*"}
+
+// Devices returns the NVIDIA character devices in the filesystem at root
+func Devices(root string) ([]specs.LinuxDevice, error) {
+	var devices []specs.LinuxDevice
+	for _, glob := range deviceGlobs {
+		matches, err := filepath.Glob(filepath.Join(root, glob))
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range matches {
+			var st unix.Stat_t
+			if err := unix.Lstat(p, &st); err != nil || st.Mode&unix.S_IFMT != unix.S_IFCHR {
+				continue
+			}
+			mode := os.FileMode(st.Mode & 0777)
+			uid, gid := st.Uid, st.Gid
+			devices = append(devices, specs.LinuxDevice{
+				Path:     "/" + strings.TrimPrefix(strings.TrimPrefix(p, root), "/"),
+				Type:     "c",
+				Major:    int64(unix.Major(uint64(st.Rdev))),
+				Minor:    int64(unix.Minor(uint64(st.Rdev))),
+				FileMode: &mode,
+				UID:      &uid,
+				GID:      &gid,
+			})
+		}
+	}
+	return devices, nil
+}
+
+// DeviceRules returns the rules of the device cgroup of pid that grant
+// access to devices. Under cgroup v2 the rules are an eBPF program that
+// cannot be read back, so access to each of devices is granted instead.
+func DeviceRules(pid int, devices []specs.LinuxDevice) []specs.LinuxDeviceCgroup {
+	if cg, err := cgroup.ForController(pid, "devices"); err == nil && !cg.V2 {
+		if rules, err := readDevicesList(filepath.Join(cg.Path, "devices.list"), devices); err == nil {
+			return rules
+		}
+	}
+	var rules []specs.LinuxDeviceCgroup
+	for _, d := range devices {
+		major, minor := d.Major, d.Minor
+		rules = append(rules, specs.LinuxDeviceCgroup{Allow: true, Type: "c", Major: &major, Minor: &minor, Access: "rwm"})
+	}
+	return rules
+}
+
+// readDevicesList reads the v1 whitelist, lines like "c 195:* rwm", and
+// keeps the entries that cover one of devices
+func readDevicesList(path string, devices []specs.LinuxDevice) ([]specs.LinuxDeviceCgroup, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	majors := map[int64]bool{}
+	for _, d := range devices {
+		majors[d.Major] = true
+	}
+	var rules []specs.LinuxDeviceCgroup
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		majorStr, minorStr, ok := strings.Cut(fields[1], ":")
+		if !ok {
+			continue
+		}
+		rule := specs.LinuxDeviceCgroup{Allow: true, Type: fields[0], Access: fields[2]}
+		if majorStr != "*" {
+			major, err := strconv.ParseInt(majorStr, 10, 64)
+			if err != nil {
+				continue
+			}
+			rule.Major = &major
+		}
+		if minorStr != "*" {
+			minor, err := strconv.ParseInt(minorStr, 10, 64)
+			if err != nil {
+				continue
+			}
+			rule.Minor = &minor
+		}
+		if rule.Type == "a" || (rule.Type == "c" && (rule.Major == nil || majors[*rule.Major])) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, scanner.Err()
+}
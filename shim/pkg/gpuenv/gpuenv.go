@@ -0,0 +1,248 @@
+// Package gpuenv captures the NVIDIA environment of a container at
+// checkpoint time and recreates it on restore. The NVIDIA container
+// toolkit mounts driver files into the container, creates /dev/nvidia*
+// device nodes and grants access to them in the device cgroup, none of
+// which is in the spec of the container. A restored container is not run
+// through the toolkit, so the shim adds all of it to the spec instead;
+// CRIU needs the mounts to match the checkpoint.
+package gpuenv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// FileName is written into the checkpoint directory
+const FileName = "nvidia-env.json"
+
+// legacyMountsFile is the list of mounts written by earlier releases
+const legacyMountsFile = "nvidia-mounts.json"
+
+// Environment is the NVIDIA environment of a container
+type Environment struct {
+	Mounts  []specs.Mount       `json:"mounts,omitempty"`
+	Devices []specs.LinuxDevice `json:"devices,omitempty"`
+	// DeviceRules grant access to Devices in the device cgroup
+	DeviceRules []specs.LinuxDeviceCgroup `json:"deviceRules,omitempty"`
+	// Skipped lists the NVIDIA mounts that cannot be recreated
+	Skipped []string `json:"skipped,omitempty"`
+	// DriverVersion is the NVIDIA driver the mounts belong to
+	DriverVersion string `json:"driverVersion,omitempty"`
+	// Sonames holds the soname of each mounted library by destination, to
+	// find its counterpart under another driver version
+	Sonames map[string]string `json:"sonames,omitempty"`
+}
+
+// Empty reports whether the container had no NVIDIA environment
+func (e *Environment) Empty() bool {
+	return len(e.Mounts) == 0 && len(e.Devices) == 0
+}
+
+// Write stores the environment in the checkpoint directory dir
+func (e *Environment) Write(dir string) error {
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, FileName), data, 0644)
+}
+
+// Read returns the environment stored in the checkpoint directory dir, or
+// nil if there is none. Checkpoints of earlier releases only hold mounts.
+func Read(dir string) (*Environment, error) {
+	data, err := os.ReadFile(filepath.Join(dir, FileName))
+	if err == nil {
+		env := &Environment{}
+		if err := json.Unmarshal(data, env); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", FileName, err)
+		}
+		return env, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	data, err = os.ReadFile(filepath.Join(dir, legacyMountsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	// The keys of the legacy file differ from the spec's only in case
+	env := &Environment{}
+	if err := json.Unmarshal(data, &env.Mounts); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", legacyMountsFile, err)
+	}
+	return env, nil
+}
+
+// Applied counts what Apply added to a spec
+type Applied struct {
+	Mounts      int
+	Devices     int
+	DeviceRules int
+}
+
+func (a Applied) String() string {
+	return fmt.Sprintf("%d mounts, %d devices, %d device rules", a.Mounts, a.Devices, a.DeviceRules)
+}
+
+// Apply adds the environment to spec. Mounts and devices the spec already
+// has at the same path are kept as they are.
+func (e *Environment) Apply(spec *specs.Spec) Applied {
+	var applied Applied
+	for _, m := range e.Mounts {
+		if !hasMount(spec.Mounts, m.Destination) {
+			spec.Mounts = append(spec.Mounts, m)
+			applied.Mounts++
+		}
+	}
+	if len(e.Devices) == 0 && len(e.DeviceRules) == 0 {
+		return applied
+	}
+
+	if spec.Linux == nil {
+		spec.Linux = &specs.Linux{}
+	}
+	for _, d := range e.Devices {
+		if !hasDevice(spec.Linux.Devices, d.Path) {
+			spec.Linux.Devices = append(spec.Linux.Devices, d)
+			applied.Devices++
+		}
+	}
+	if spec.Linux.Resources == nil {
+		spec.Linux.Resources = &specs.LinuxResources{}
+	}
+	// Rules are applied in order, so these follow the spec's deny-all
+	for _, r := range e.DeviceRules {
+		if !hasRule(spec.Linux.Resources.Devices, r) {
+			spec.Linux.Resources.Devices = append(spec.Linux.Resources.Devices, r)
+			applied.DeviceRules++
+		}
+	}
+	return applied
+}
+
+func hasMount(mounts []specs.Mount, destination string) bool {
+	for _, m := range mounts {
+		if filepath.Clean(m.Destination) == filepath.Clean(destination) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasDevice(devices []specs.LinuxDevice, path string) bool {
+	for _, d := range devices {
+		if d.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+func hasRule(rules []specs.LinuxDeviceCgroup, r specs.LinuxDeviceCgroup) bool {
+	for _, existing := range rules {
+		if existing.Allow == r.Allow && existing.Type == r.Type && existing.Access == r.Access &&
+			equalID(existing.Major, r.Major) && equalID(existing.Minor, r.Minor) {
+			return true
+		}
+	}
+	return false
+}
+
+func equalID(a, b *int64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// PrepareRootfs creates the targets of the mounts in the container root
+// filesystem at rootfs: a directory for a tmpfs or a directory source,
+// an empty file for a file source. Paths are resolved inside rootfs, so
+// symlinks in the image cannot point them elsewhere. A mount whose
+// source does not exist is reported and left alone.
+func (e *Environment) PrepareRootfs(rootfs string) error {
+	root, err := unix.Open(rootfs, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", rootfs, err)
+	}
+	defer unix.Close(root)
+
+	var errs []error
+	for _, m := range e.Mounts {
+		dir := m.Type == "tmpfs"
+		if !dir {
+			fi, err := os.Stat(m.Source)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("source of %s: %w", m.Destination, err))
+				continue
+			}
+			dir = fi.IsDir()
+		}
+		if err := createTarget(root, m.Destination, dir); err != nil {
+			errs = append(errs, fmt.Errorf("target %s: %w", m.Destination, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resolve confines path resolution to the root filesystem
+const resolve = unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS
+
+// createTarget creates path below root, as a directory or an empty file
+func createTarget(root int, path string, dir bool) error {
+	parts := strings.Split(strings.Trim(filepath.Clean("/"+path), "/"), "/")
+	last := len(parts)
+	if !dir {
+		last--
+	}
+	for i := 1; i <= last; i++ {
+		if err := mkdirIn(root, strings.Join(parts[:i], "/")); err != nil {
+			return err
+		}
+	}
+	if dir {
+		return nil
+	}
+
+	fd, err := unix.Openat2(root, strings.Join(parts, "/"), &unix.OpenHow{
+		Flags:   unix.O_RDONLY | unix.O_CREAT | unix.O_CLOEXEC,
+		Mode:    0644,
+		Resolve: resolve,
+	})
+	if err != nil {
+		return err
+	}
+	return unix.Close(fd)
+}
+
+// mkdirIn creates the directory path below root unless it exists
+func mkdirIn(root int, path string) error {
+	fd, err := unix.Openat2(root, path, &unix.OpenHow{Flags: unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC, Resolve: resolve})
+	if err == nil {
+		return unix.Close(fd)
+	}
+	if !errors.Is(err, unix.ENOENT) {
+		return err
+	}
+	parent, name := filepath.Split(path)
+	pfd, err := unix.Openat2(root, "/"+parent, &unix.OpenHow{Flags: unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC, Resolve: resolve})
+	if err != nil {
+		return err
+	}
+	defer unix.Close(pfd)
+	if err := unix.Mkdirat(pfd, name, 0755); err != nil && !errors.Is(err, unix.EEXIST) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package gpuenv
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/kybernate/kybernate/pkg/mountinfo"
+)
+
+// Rule selects mounts of a container. Every list that is set must have
+// an entry that matches the mount.
+type Rule struct {
+	// Paths are globs (path.Match) matched against the mount point and
+	// the root of the mount. A glob that matches a parent directory
+	// matches everything below it.
+	Paths []string `json:"paths,omitempty"`
+	// Names are globs matched against the base name of the mount point
+	Names []string `json:"names,omitempty"`
+	// FSTypes are filesystem types, e.g. tmpfs
+	FSTypes []string `json:"fsTypes,omitempty"`
+	// Exclude drops the mounts the rule matches
+	Exclude bool `json:"exclude,omitempty"`
+}
+
+// Rules decide which mounts belong to the NVIDIA environment. The first
+// rule that matches a mount decides; a mount no rule matches is left out.
+type Rules []Rule
+
+// DefaultRules select what the NVIDIA container toolkit mounts into a
+// container: driver libraries, binaries, firmware, IPC sockets, config
+// files and the mounts of its hooks
+var DefaultRules = Rules{
+	// Pseudo and image filesystems are set up by the runtime on restore
+	{FSTypes: []string{"proc", "sysfs", "cgroup", "cgroup2", "devtmpfs", "devpts", "mqueue", "overlay"}, Exclude: true},
+	// runc refuses mounts inside /proc, e.g. /proc/driver/nvidia/params
+	{Paths: []string{"/proc"}, Exclude: true},
+	{Names: []string{
+		"libcuda.so*", "libcudadebugger.so*", "libnvidia-*.so*", "libnvcuvid.so*", "libnvoptix.so*",
+		"libGLX_nvidia.so*", "libEGL_nvidia.so*", "libGLESv1_CM_nvidia.so*", "libGLESv2_nvidia.so*", "libvdpau_nvidia.so*",
+		"nvidia-smi", "nvidia-debugdump", "nvidia-persistenced", "nvidia-cuda-mps-control", "nvidia-cuda-mps-server",
+		"gsp_*.bin", "nvidia_icd.json", "nvidia_layers.json", "10_nvidia.json", "nvidia-application-profiles-*",
+	}},
+	{Paths: []string{
+		"/run/nvidia-persistenced", "/run/nvidia-fabricmanager", "/run/nvidia-ctk-hook*",
+		"/lib/firmware/nvidia", "/usr/lib/firmware/nvidia", "/usr/share/nvidia", "/etc/nvidia",
+		"/usr/local/nvidia", "/usr/lib/nvidia", "/usr/lib64/nvidia",
+	}},
+}
+
+// RulesEnv names a JSON file with a list of rules that are tried before
+// the built-in ones
+const RulesEnv = "KYBERNATE_NVIDIA_RULES"
+
+// RulesFromEnv returns defaults preceded by the rules in the file named
+// by KYBERNATE_NVIDIA_RULES
+func RulesFromEnv(defaults Rules) (Rules, error) {
+	file := strings.TrimSpace(os.Getenv(RulesEnv))
+	if file == "" {
+		return defaults, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return defaults, fmt.Errorf("%s: %w", RulesEnv, err)
+	}
+	var custom Rules
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return defaults, fmt.Errorf("%s: parse %s: %w", RulesEnv, file, err)
+	}
+	if err := custom.Validate(); err != nil {
+		return defaults, fmt.Errorf("%s: %w", RulesEnv, err)
+	}
+	return append(custom, defaults...), nil
+}
+
+// Validate rejects rules that match every mount or have malformed globs
+func (r Rules) Validate() error {
+	for i, rule := range r {
+		if len(rule.Paths) == 0 && len(rule.Names) == 0 && len(rule.FSTypes) == 0 {
+			return fmt.Errorf("rule %d matches every mount", i)
+		}
+		for _, glob := range append(append([]string{}, rule.Paths...), rule.Names...) {
+			if _, err := path.Match(glob, ""); err != nil {
+				return fmt.Errorf("rule %d: glob %q: %w", i, glob, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Match reports whether m belongs to the NVIDIA environment
+func (r Rules) Match(m mountinfo.Mount) bool {
+	for _, rule := range r {
+		if rule.matches(m) {
+			return !rule.Exclude
+		}
+	}
+	return false
+}
+
+func (r Rule) matches(m mountinfo.Mount) bool {
+	if len(r.FSTypes) > 0 && !contains(r.FSTypes, m.FSType) {
+		return false
+	}
+	if len(r.Names) > 0 && !matchAny(r.Names, path.Base(m.MountPoint)) {
+		return false
+	}
+	if len(r.Paths) > 0 && !matchTree(r.Paths, m.MountPoint) && !matchTree(r.Paths, m.Root) {
+		return false
+	}
+	return true
+}
+
+// matchTree reports whether a glob matches p or one of its parents
+func matchTree(globs []string, p string) bool {
+	for p = path.Clean(p); ; p = path.Dir(p) {
+		if matchAny(globs, p) {
+			return true
+		}
+		if p == "/" || p == "." {
+			return false
+		}
+	}
+}
+
+func matchAny(globs []string, s string) bool {
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
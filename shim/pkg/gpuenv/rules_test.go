@@ -0,0 +1,126 @@
+package gpuenv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kybernate/kybernate/pkg/mountinfo"
+)
+
+func bind(target, fsType string) mountinfo.Mount {
+	return mountinfo.Mount{Root: target, MountPoint: target, FSType: fsType}
+}
+
+func TestDefaultRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		mount mountinfo.Mount
+		want  bool
+	}{
+		{"driver library", bind("/usr/lib/x86_64-linux-gnu/libcuda.so.550.54.15", "ext4"), true},
+		{"versioned NVIDIA library", bind("/usr/lib64/libnvidia-ml.so.550.54.15", "xfs"), true},
+		{"binary", bind("/usr/bin/nvidia-smi", "ext4"), true},
+		{"firmware", bind("/lib/firmware/nvidia/550.54.15/gsp_ga10x.bin", "ext4"), true},
+		{"persistenced socket", bind("/run/nvidia-persistenced/socket", "tmpfs"), true},
+		{"vulkan ICD", bind("/etc/vulkan/icd.d/nvidia_icd.json", "ext4"), true},
+		{"below a listed tree", bind("/usr/local/nvidia/lib64/libfoo.so", "ext4"), true},
+		{"bind of a subdirectory", mountinfo.Mount{Root: "/etc/nvidia/profiles", MountPoint: "/opt/profiles", FSType: "ext4"}, true},
+		{"driver params in /proc", bind("/proc/driver/nvidia/params", "ext4"), false},
+		{"overlay named like a library", bind("/libcuda.so.1", "overlay"), false},
+		{"proc", bind("/proc", "proc"), false},
+		{"application data", bind("/data", "ext4"), false},
+		{"CUDA toolkit library", bind("/usr/local/cuda/lib64/libcudart.so.12", "ext4"), false},
+		{"similar prefix", bind("/etc/nvidia-other/config", "ext4"), false},
+	}
+	for _, tt := range tests {
+		if got := DefaultRules.Match(tt.mount); got != tt.want {
+			t.Errorf("%s: Match(%s) = %v, want %v", tt.name, tt.mount.MountPoint, got, tt.want)
+		}
+	}
+}
+
+func TestRulesFirstMatchDecides(t *testing.T) {
+	rules := Rules{
+		{Names: []string{"libnvidia-ml.so*"}, Exclude: true},
+		{Paths: []string{"/opt/vendor/*"}, FSTypes: []string{"ext4"}},
+	}
+	rules = append(rules, DefaultRules...)
+
+	tests := []struct {
+		mount mountinfo.Mount
+		want  bool
+	}{
+		{bind("/usr/lib64/libnvidia-ml.so.1", "ext4"), false},
+		{bind("/usr/lib64/libcuda.so.1", "ext4"), true},
+		{bind("/opt/vendor/lib/libgpu.so", "ext4"), true},
+		// Every list of a rule must match
+		{bind("/opt/vendor/lib/libgpu.so", "tmpfs"), false},
+	}
+	for _, tt := range tests {
+		if got := rules.Match(tt.mount); got != tt.want {
+			t.Errorf("Match(%s on %s) = %v, want %v", tt.mount.MountPoint, tt.mount.FSType, got, tt.want)
+		}
+	}
+}
+
+func TestRulesValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   Rules
+		wantErr bool
+	}{
+		{"defaults", DefaultRules, false},
+		{"names only", Rules{{Names: []string{"lib*.so"}}}, false},
+		{"matches everything", Rules{{Exclude: true}}, true},
+		{"bad path glob", Rules{{Paths: []string{"/usr/[lib"}}}, true},
+		{"bad name glob", Rules{{Names: []string{"lib\\"}}}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.rules.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRulesFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	t.Setenv(RulesEnv, "")
+	if rules, err := RulesFromEnv(DefaultRules); err != nil || len(rules) != len(DefaultRules) {
+		t.Errorf("without %s: %d rules, %v", RulesEnv, len(rules), err)
+	}
+
+	t.Setenv(RulesEnv, write("custom.json", `[{"paths": ["/opt/vendor"]}, {"names": ["libcuda.so*"], "exclude": true}]`))
+	rules, err := RulesFromEnv(DefaultRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != len(DefaultRules)+2 {
+		t.Fatalf("%d rules, want the custom ones before the defaults", len(rules))
+	}
+	if !rules.Match(bind("/opt/vendor/bin/tool", "ext4")) || rules.Match(bind("/usr/lib64/libcuda.so.1", "ext4")) {
+		t.Error("custom rules were not tried first")
+	}
+
+	for name, content := range map[string]string{
+		"broken.json":   `[{"paths": `,
+		"matchall.json": `[{"exclude": true}]`,
+	} {
+		t.Setenv(RulesEnv, write(name, content))
+		if rules, err := RulesFromEnv(DefaultRules); err == nil || len(rules) != len(DefaultRules) {
+			t.Errorf("%s: %d rules, %v; want the defaults and an error", name, len(rules), err)
+		}
+	}
+	t.Setenv(RulesEnv, filepath.Join(dir, "missing.json"))
+	if _, err := RulesFromEnv(DefaultRules); err == nil {
+		t.Error("missing rules file accepted")
+	}
+}
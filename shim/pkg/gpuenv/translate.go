@@ -0,0 +1,324 @@
+package gpuenv
+
+import (
+	"bufio"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// DriverVersion returns the version of the loaded NVIDIA kernel driver,
+// e.g. 535.104.05, or "" if none is loaded
+func DriverVersion() string {
+	if data, err := os.ReadFile("/sys/module/nvidia/version"); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	data, err := os.ReadFile("/proc/driver/nvidia/version")
+	if err != nil {
+		return ""
+	}
+	// NVRM version: NVIDIA UNIX x86_64 Kernel Module  535.104.05  Sat Aug 19 ...
+	_, rest, ok := strings.Cut(string(data), "Kernel Module")
+	if !ok {
+		return ""
+	}
+	for _, field := range strings.Fields(rest) {
+		if field != "" && field[0] >= '0' && field[0] <= '9' {
+			return field
+		}
+	}
+	return ""
+}
+
+// Soname returns the DT_SONAME of the shared library at p
+func Soname(p string) (string, error) {
+	f, err := elf.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	names, err := f.DynString(elf.DT_SONAME)
+	if err != nil {
+		return "", err
+	}
+	if len(names) == 0 {
+		return "", fmt.Errorf("%s has no soname", p)
+	}
+	return names[0], nil
+}
+
+func hasSoname(p, soname string) bool {
+	s, err := Soname(p)
+	return err == nil && s == soname
+}
+
+// HostLibraries lists the driver libraries installed on this node, as the
+// NVIDIA container toolkit finds them. It is empty without the toolkit.
+func HostLibraries() []string {
+	output, err := exec.Command("nvidia-container-cli", "list", "--libraries").Output()
+	if err != nil {
+		return nil
+	}
+	var libs []string
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			libs = append(libs, line)
+		}
+	}
+	return libs
+}
+
+// Translator resolves the bind mounts of an environment recorded under
+// another driver installation against the one on this node
+type Translator struct {
+	// DriverVersion is the driver of this node, "" if unknown
+	DriverVersion string
+	// Libraries are the driver libraries installed on this node
+	Libraries []string
+}
+
+// NewTranslator describes the driver installation of this node
+func NewTranslator() *Translator {
+	return &Translator{DriverVersion: DriverVersion(), Libraries: HostLibraries()}
+}
+
+// How a recorded mount source was resolved
+const (
+	// MethodUnchanged keeps a source that exists on this node
+	MethodUnchanged = "unchanged"
+	// MethodDriverVersion replaces the recorded driver version in the path
+	MethodDriverVersion = "driver-version"
+	// MethodSoname picks the library of this node with the same soname
+	MethodSoname = "soname"
+	// MethodName picks the library of this node with the same name up to
+	// its version suffix, for environments that recorded no soname
+	MethodName = "name"
+)
+
+// Mapping is the resolution of one bind mount
+type Mapping struct {
+	Destination string `json:"destination"`
+	// Recorded is the source at checkpoint time
+	Recorded string `json:"recorded"`
+	// Source is the source on this node, "" if there is none
+	Source string `json:"source,omitempty"`
+	Method string `json:"method,omitempty"`
+	// Reason explains a missing counterpart
+	Reason string `json:"reason,omitempty"`
+}
+
+func (m Mapping) String() string {
+	switch {
+	case m.Source == "":
+		return fmt.Sprintf("%s: %s has no counterpart: %s", m.Destination, m.Recorded, m.Reason)
+	case m.Method == MethodUnchanged:
+		return fmt.Sprintf("%s: %s", m.Destination, m.Source)
+	}
+	return fmt.Sprintf("%s: %s -> %s (%s)", m.Destination, m.Recorded, m.Source, m.Method)
+}
+
+// Translation reports how the bind mounts of an environment map onto
+// this node
+type Translation struct {
+	// From and To are the recorded driver version and that of this node
+	From     string    `json:"from,omitempty"`
+	To       string    `json:"to,omitempty"`
+	Mappings []Mapping `json:"mappings"`
+}
+
+// Err lists the mounts that have no counterpart on this node
+func (t *Translation) Err() error {
+	var errs []error
+	for _, m := range t.Mappings {
+		if m.Source == "" {
+			errs = append(errs, errors.New(m.String()))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("NVIDIA environment of driver %s cannot be recreated with driver %s: %w",
+		orUnknown(t.From), orUnknown(t.To), errors.Join(errs...))
+}
+
+// Moved maps the recorded sources that changed to their new source
+func (t *Translation) Moved() map[string]string {
+	moved := map[string]string{}
+	for _, m := range t.Mappings {
+		if m.Source != "" && m.Source != m.Recorded {
+			moved[m.Recorded] = m.Source
+		}
+	}
+	return moved
+}
+
+func orUnknown(version string) string {
+	if version == "" {
+		return "unknown"
+	}
+	return version
+}
+
+// Translate returns a copy of env whose bind mounts point at their
+// counterparts on this node and reports how each was resolved; env itself
+// keeps the mounts recorded at checkpoint. A source that exists is kept.
+// Otherwise the recorded driver version in its path is replaced by this
+// node's, and a library is looked up by its soname among the libraries
+// of this node and the files next to the recorded source. Mounts without
+// a counterpart are left as they are; Err on the result lists them.
+func (t *Translator) Translate(env *Environment) (*Environment, *Translation) {
+	translated := *env
+	translated.Mounts = append([]specs.Mount(nil), env.Mounts...)
+	tr := &Translation{From: env.DriverVersion, To: t.DriverVersion}
+	for i := range translated.Mounts {
+		m := &translated.Mounts[i]
+		if m.Type != "bind" {
+			continue
+		}
+		mapping := t.resolve(env, m.Destination, m.Source)
+		if mapping.Source != "" {
+			m.Source = mapping.Source
+		}
+		tr.Mappings = append(tr.Mappings, mapping)
+	}
+	return &translated, tr
+}
+
+func (t *Translator) resolve(env *Environment, destination, recorded string) Mapping {
+	mapping := Mapping{Destination: destination, Recorded: recorded}
+	if exists(recorded) {
+		mapping.Source, mapping.Method = recorded, MethodUnchanged
+		return mapping
+	}
+	soname := env.Sonames[destination]
+	if env.DriverVersion != "" && t.DriverVersion != "" && strings.Contains(recorded, env.DriverVersion) {
+		p := strings.ReplaceAll(recorded, env.DriverVersion, t.DriverVersion)
+		if exists(p) && (soname == "" || hasSoname(p, soname)) {
+			mapping.Source, mapping.Method = p, MethodDriverVersion
+			return mapping
+		}
+	}
+	if !isLibrary(recorded) {
+		mapping.Reason = "not on this node"
+		return mapping
+	}
+
+	candidates := t.candidates(recorded)
+	var matches []string
+	for _, c := range candidates {
+		if soname == "" || hasSoname(c, soname) {
+			matches = append(matches, c)
+		}
+	}
+	if len(matches) == 0 {
+		if soname != "" {
+			mapping.Reason = fmt.Sprintf("no library with soname %s among %d candidates", soname, len(candidates))
+		} else {
+			mapping.Reason = fmt.Sprintf("no library named %s* among %d candidates", libraryStem(path.Base(recorded)), len(candidates))
+		}
+		return mapping
+	}
+	mapping.Source = t.pick(matches)
+	mapping.Method = MethodSoname
+	if soname == "" {
+		mapping.Method = MethodName
+	}
+	return mapping
+}
+
+// candidates returns the real files of the libraries of this node and of
+// the files next to recorded that share its name up to the version
+func (t *Translator) candidates(recorded string) []string {
+	stem := libraryStem(filepath.Base(recorded))
+	paths := append([]string{}, t.Libraries...)
+	if matches, err := filepath.Glob(filepath.Join(filepath.Dir(recorded), globEscape(stem)+"*")); err == nil {
+		paths = append(paths, matches...)
+	}
+
+	seen := map[string]bool{}
+	var files []string
+	for _, p := range paths {
+		if libraryStem(filepath.Base(p)) != stem {
+			continue
+		}
+		real, err := filepath.EvalSymlinks(p)
+		if err != nil || seen[real] {
+			continue
+		}
+		if fi, err := os.Stat(real); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		seen[real] = true
+		files = append(files, real)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// pick prefers the library built for the driver of this node
+func (t *Translator) pick(matches []string) string {
+	if t.DriverVersion != "" {
+		for _, m := range matches {
+			if strings.Contains(filepath.Base(m), t.DriverVersion) {
+				return m
+			}
+		}
+	}
+	return matches[len(matches)-1]
+}
+
+// libraryStem returns the name of a library up to its version suffix,
+// libcuda.so of libcuda.so.535.104.05
+func libraryStem(name string) string {
+	if stem, ok := splitLibrary(name); ok {
+		return stem
+	}
+	return name
+}
+
+func isLibrary(p string) bool {
+	_, ok := splitLibrary(path.Base(p))
+	return ok
+}
+
+// splitLibrary finds the ".so" of a library name, which is followed by
+// nothing or a version
+func splitLibrary(name string) (string, bool) {
+	for i := strings.Index(name, ".so"); i >= 0; {
+		end := i + len(".so")
+		if end == len(name) || name[end] == '.' {
+			return name[:end], true
+		}
+		next := strings.Index(name[end:], ".so")
+		if next < 0 {
+			break
+		}
+		i = end + next
+	}
+	return "", false
+}
+
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func exists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
@@ -0,0 +1,228 @@
+package gpuenv
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// elfWithSoname returns a shared library of this host and its soname, to
+// stand in for a driver library whose soname is checked
+func elfWithSoname(t *testing.T, candidates ...string) (string, string) {
+	t.Helper()
+	for _, p := range candidates {
+		if soname, err := Soname(p); err == nil {
+			return p, soname
+		}
+	}
+	t.Skipf("no shared library with a soname among %v", candidates)
+	return "", ""
+}
+
+// mkLibs creates the files of a fake driver installation below root. A
+// file is a copy of the host library elfs maps it to, else a few bytes that
+// are no ELF object; links map a symlink to its target.
+func mkLibs(t *testing.T, root string, files []string, elfs map[string]string, links map[string]string) {
+	t.Helper()
+	for _, f := range files {
+		p := filepath.Join(root, f)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		data := []byte("not an ELF object")
+		if src, ok := elfs[f]; ok {
+			var err error
+			if data, err = os.ReadFile(src); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	libc, libcSoname := elfWithSoname(t, "/lib/x86_64-linux-gnu/libc.so.6", "/lib64/libc.so.6", "/usr/lib/libc.so.6")
+	libm, libmSoname := elfWithSoname(t, "/lib/x86_64-linux-gnu/libm.so.6", "/lib64/libm.so.6", "/usr/lib/libm.so.6")
+
+	const old, cur = "535.104.05", "550.54.15"
+	tests := []struct {
+		name string
+		// files are created below the temp root, see mkLibs
+		files     []string
+		elfs      map[string]string
+		links     map[string]string
+		libraries []string
+		// recorded is the source at checkpoint, below the temp root
+		recorded string
+		soname   string
+		// want is the resolved source below the temp root, "" for none
+		want   string
+		method string
+	}{
+		{
+			name:     "source still exists",
+			files:    []string{"lib/libcuda.so." + old},
+			recorded: "lib/libcuda.so." + old,
+			want:     "lib/libcuda.so." + old,
+			method:   MethodUnchanged,
+		},
+		{
+			name:     "driver version in the path",
+			files:    []string{"firmware/nvidia/" + cur + "/gsp_ga10x.bin"},
+			recorded: "firmware/nvidia/" + old + "/gsp_ga10x.bin",
+			want:     "firmware/nvidia/" + cur + "/gsp_ga10x.bin",
+			method:   MethodDriverVersion,
+		},
+		{
+			name:     "driver version with matching soname",
+			files:    []string{"lib/libcuda.so." + cur},
+			elfs:     map[string]string{"lib/libcuda.so." + cur: libc},
+			recorded: "lib/libcuda.so." + old,
+			soname:   libcSoname,
+			want:     "lib/libcuda.so." + cur,
+			method:   MethodDriverVersion,
+		},
+		{
+			name: "soname among the files next to the source",
+			// The renamed file has the driver version but not the soname
+			files:    []string{"lib/libcuda.so." + cur, "lib/libcuda.so.1.1"},
+			elfs:     map[string]string{"lib/libcuda.so." + cur: libm, "lib/libcuda.so.1.1": libc},
+			recorded: "lib/libcuda.so." + old,
+			soname:   libcSoname,
+			want:     "lib/libcuda.so.1.1",
+			method:   MethodSoname,
+		},
+		{
+			name:      "soname among the host libraries",
+			files:     []string{"usr/lib64/libnvidia-ml.so.2.0", "usr/lib64/libnvidia-ml.so.3.0"},
+			elfs:      map[string]string{"usr/lib64/libnvidia-ml.so.2.0": libm, "usr/lib64/libnvidia-ml.so.3.0": libc},
+			links:     map[string]string{"usr/lib64/libnvidia-ml.so.1": "libnvidia-ml.so.2.0"},
+			libraries: []string{"usr/lib64/libnvidia-ml.so.1", "usr/lib64/libnvidia-ml.so.3.0", "usr/lib64/libcuda.so.1"},
+			recorded:  "usr/lib/x86_64-linux-gnu/libnvidia-ml.so." + old,
+			soname:    libmSoname,
+			want:      "usr/lib64/libnvidia-ml.so.2.0",
+			method:    MethodSoname,
+		},
+		{
+			name:     "name only prefers the node's driver version",
+			files:    []string{"lib/libnvidia-ptxjitcompiler.so." + cur, "lib/libnvidia-ptxjitcompiler.so.999.0"},
+			recorded: "lib/libnvidia-ptxjitcompiler.so.1",
+			want:     "lib/libnvidia-ptxjitcompiler.so." + cur,
+			method:   MethodName,
+		},
+		{
+			name:     "name only takes the last candidate",
+			files:    []string{"lib/libnvidia-tls.so.1.0", "lib/libnvidia-tls.so.2.0"},
+			recorded: "lib/libnvidia-tls.so.0.9",
+			want:     "lib/libnvidia-tls.so.2.0",
+			method:   MethodName,
+		},
+		{
+			name:     "no library with the soname",
+			files:    []string{"lib/libcuda.so.1.1"},
+			elfs:     map[string]string{"lib/libcuda.so.1.1": libm},
+			recorded: "lib/libcuda.so." + old,
+			soname:   libcSoname,
+		},
+		{
+			name:     "no library of that name",
+			files:    []string{"lib/libcudadebugger.so.1"},
+			recorded: "lib/libcuda.so." + old,
+		},
+		{
+			name:     "not a library",
+			recorded: "bin/nvidia-smi",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			mkLibs(t, root, tt.files, tt.elfs, tt.links)
+			tr := &Translator{DriverVersion: cur}
+			for _, l := range tt.libraries {
+				tr.Libraries = append(tr.Libraries, filepath.Join(root, l))
+			}
+
+			recorded := filepath.Join(root, tt.recorded)
+			dest := "/usr/lib/x86_64-linux-gnu/" + filepath.Base(tt.recorded)
+			env := &Environment{
+				DriverVersion: old,
+				Mounts: []specs.Mount{
+					{Destination: dest, Source: recorded, Type: "bind", Options: []string{"ro", "rbind"}},
+					{Destination: "/dev/shm", Source: "shm", Type: "tmpfs"},
+				},
+			}
+			if tt.soname != "" {
+				env.Sonames = map[string]string{dest: tt.soname}
+			}
+			recordedMounts := append([]specs.Mount(nil), env.Mounts...)
+
+			translated, translation := tr.Translate(env)
+			if !reflect.DeepEqual(env.Mounts, recordedMounts) {
+				t.Errorf("Translate changed the recorded mounts: %+v", env.Mounts)
+			}
+			if translation.From != old || translation.To != cur || len(translation.Mappings) != 1 {
+				t.Fatalf("translation = %+v, want one mapping from %s to %s", translation, old, cur)
+			}
+			m := translation.Mappings[0]
+			if m.Recorded != recorded || m.Destination != dest {
+				t.Errorf("mapping = %+v", m)
+			}
+
+			if tt.want == "" {
+				if m.Source != "" || m.Reason == "" {
+					t.Errorf("mapping = %+v, want no counterpart with a reason", m)
+				}
+				if translation.Err() == nil {
+					t.Error("Err is nil with an unresolved mount")
+				}
+				if translated.Mounts[0].Source != recorded {
+					t.Errorf("unresolved mount points at %s", translated.Mounts[0].Source)
+				}
+				return
+			}
+			want := filepath.Join(root, tt.want)
+			if m.Source != want || m.Method != tt.method {
+				t.Errorf("resolved to %s by %s, want %s by %s (%s)", m.Source, m.Method, want, tt.method, m.Reason)
+			}
+			if err := translation.Err(); err != nil {
+				t.Errorf("Err = %v", err)
+			}
+			if translated.Mounts[0].Source != want || translated.Mounts[1].Source != "shm" {
+				t.Errorf("translated mounts = %+v", translated.Mounts)
+			}
+			moved := translation.Moved()
+			if (tt.method == MethodUnchanged) != (len(moved) == 0) || (len(moved) > 0 && moved[recorded] != want) {
+				t.Errorf("Moved = %v", moved)
+			}
+		})
+	}
+}
+
+func TestSplitLibrary(t *testing.T) {
+	tests := map[string]string{
+		"libcuda.so":                "libcuda.so",
+		"libcuda.so.1":              "libcuda.so",
+		"libcuda.so.535.104.05":     "libcuda.so",
+		"libnvidia-ml.so.1":         "libnvidia-ml.so",
+		"libfoo.sock.so.2":          "libfoo.sock.so",
+		"libnvidia-something.sox.1": "",
+		"nvidia-smi":                "",
+	}
+	for name, want := range tests {
+		stem, ok := splitLibrary(name)
+		if stem != want || ok != (want != "") {
+			t.Errorf("splitLibrary(%s) = %q, %v; want %q", name, stem, ok, want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Package initpid finds the init process of a container. The runtime
+// does not always report it, for example when runc restores a container
+// from a checkpoint, so a Resolver tries an ordered chain of strategies,
+// from reading a PID file to scanning cgroups, until one finds it or a
+// common deadline passes. Every strategy reads the host through
+// configurable procfs and cgroupfs roots, so it can run against a fake
+// tree.
+package initpid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned by a strategy that did not find the process,
+// and wrapped by a Resolver that gave up
+var ErrNotFound = errors.New("init PID not found")
+
+// Request names the container to resolve
+type Request struct {
+	// IDs are the names the container may be known by to the runtime, in
+	// order of preference: the task ID, the bundle name, the sandbox ID or
+	// prefixes of them
+	IDs []string
+	// Bundle is the bundle directory of the task, if known
+	Bundle string
+}
+
+// ids drops empty IDs, which would match anything
+func (r Request) ids() []string {
+	ids := make([]string, 0, len(r.IDs))
+	for _, id := range r.IDs {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Strategy is one way of finding the init process
+type Strategy interface {
+	Name() string
+	// Resolve returns the PID, or an error wrapping ErrNotFound if this
+	// strategy cannot find it (yet)
+	Resolve(ctx context.Context, req Request) (int, error)
+}
+
+// Step is a strategy in a chain. A step with a Delay is only tried once
+// that much time has passed since the resolve began, which keeps
+// expensive strategies out of the way of cheap ones that usually win.
+type Step struct {
+	Strategy Strategy
+	Delay    time.Duration
+}
+
+// Resolver runs a chain of strategies in rounds
+type Resolver struct {
+	Steps []Step
+	// Interval is the pause between rounds
+	Interval time.Duration
+}
+
+// Result reports how the init process was found
+type Result struct {
+	PID      int
+	Strategy string
+	// Rounds is the number of rounds it took, starting at 1
+	Rounds  int
+	Elapsed time.Duration
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("PID %d via %s after %d round(s) in %s", r.PID, r.Strategy, r.Rounds, r.Elapsed.Round(time.Millisecond))
+}
+
+// StrategyError is the last failure of a strategy
+type StrategyError struct {
+	Strategy string
+	Err      error
+}
+
+// ResolveError is returned when no strategy found the process
+type ResolveError struct {
+	Rounds  int
+	Elapsed time.Duration
+	// Errors holds the last failure of each strategy that was tried
+	Errors []StrategyError
+	// Err is the context error if the deadline passed
+	Err error
+}
+
+func (e *ResolveError) Error() string {
+	parts := make([]string, 0, len(e.Errors))
+	for _, se := range e.Errors {
+		parts = append(parts, fmt.Sprintf("%s: %v", se.Strategy, se.Err))
+	}
+	msg := fmt.Sprintf("%v after %d round(s) in %s", ErrNotFound, e.Rounds, e.Elapsed.Round(time.Millisecond))
+	if e.Err != nil {
+		msg += fmt.Sprintf(" (%v)", e.Err)
+	}
+	if len(parts) > 0 {
+		msg += ": " + strings.Join(parts, "; ")
+	}
+	return msg
+}
+
+func (e *ResolveError) Unwrap() error {
+	return ErrNotFound
+}
+
+// Resolve runs the chain in rounds until a strategy finds the process or
+// ctx is done. The deadline of ctx bounds all strategies together.
+func (r *Resolver) Resolve(ctx context.Context, req Request) (Result, error) {
+	start := time.Now()
+	failures := map[string]error{}
+	for round := 1; ; round++ {
+		elapsed := time.Since(start)
+		for _, step := range r.Steps {
+			if step.Delay > elapsed {
+				continue
+			}
+			if pid, ok := r.try(ctx, step.Strategy, req, failures); ok {
+				return Result{PID: pid, Strategy: step.Strategy.Name(), Rounds: round, Elapsed: time.Since(start)}, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return Result{}, r.failure(round, start, failures, ctx.Err())
+		case <-time.After(r.Interval):
+		}
+	}
+}
+
+// Once runs a single round of the steps without a delay, for tasks that
+// are known to be running
+func (r *Resolver) Once(ctx context.Context, req Request) (Result, error) {
+	start := time.Now()
+	failures := map[string]error{}
+	for _, step := range r.Steps {
+		if step.Delay > 0 {
+			continue
+		}
+		if pid, ok := r.try(ctx, step.Strategy, req, failures); ok {
+			return Result{PID: pid, Strategy: step.Strategy.Name(), Rounds: 1, Elapsed: time.Since(start)}, nil
+		}
+	}
+	return Result{}, r.failure(1, start, failures, nil)
+}
+
+func (r *Resolver) try(ctx context.Context, s Strategy, req Request, failures map[string]error) (int, bool) {
+	if ctx.Err() != nil {
+		return 0, false
+	}
+	pid, err := s.Resolve(ctx, req)
+	if err == nil && pid > 0 {
+		return pid, true
+	}
+	if err == nil {
+		err = ErrNotFound
+	}
+	failures[s.Name()] = err
+	return 0, false
+}
+
+func (r *Resolver) failure(rounds int, start time.Time, failures map[string]error, cause error) error {
+	e := &ResolveError{Rounds: rounds, Elapsed: time.Since(start), Err: cause}
+	for _, step := range r.Steps {
+		if err, ok := failures[step.Strategy.Name()]; ok {
+			e.Errors = append(e.Errors, StrategyError{Strategy: step.Strategy.Name(), Err: err})
+		}
+	}
+	return e
+}
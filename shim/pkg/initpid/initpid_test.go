@@ -0,0 +1,312 @@
+package initpid
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStrategy finds pid from its found-th call on, or fails with err
+type fakeStrategy struct {
+	name  string
+	pid   int
+	found int
+	err   error
+	// block waits for the context instead of returning
+	block bool
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (f *fakeStrategy) Name() string { return f.name }
+
+func (f *fakeStrategy) Resolve(ctx context.Context, req Request) (int, error) {
+	f.mu.Lock()
+	f.calls++
+	calls := f.calls
+	f.mu.Unlock()
+
+	if f.block {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+	if f.pid > 0 && calls >= f.found {
+		return f.pid, nil
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	return 0, ErrNotFound
+}
+
+func (f *fakeStrategy) Calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+func TestResolverOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		strategies []*fakeStrategy
+		want       Result
+		// calls is the number of calls of each strategy
+		calls []int
+	}{
+		{
+			name: "first wins",
+			strategies: []*fakeStrategy{
+				{name: "a", pid: 10, found: 1},
+				{name: "b", pid: 20, found: 1},
+			},
+			want:  Result{PID: 10, Strategy: "a", Rounds: 1},
+			calls: []int{1, 0},
+		},
+		{
+			name: "falls through",
+			strategies: []*fakeStrategy{
+				{name: "a"},
+				{name: "b", err: errors.New("permission denied")},
+				{name: "c", pid: 30, found: 1},
+				{name: "d", pid: 40, found: 1},
+			},
+			want:  Result{PID: 30, Strategy: "c", Rounds: 1},
+			calls: []int{1, 1, 1, 0},
+		},
+		{
+			name: "later round",
+			strategies: []*fakeStrategy{
+				{name: "a", pid: 10, found: 3},
+				{name: "b", pid: 20, found: 2},
+			},
+			want:  Result{PID: 20, Strategy: "b", Rounds: 2},
+			calls: []int{2, 2},
+		},
+		{
+			name: "earlier strategy wins a round",
+			strategies: []*fakeStrategy{
+				{name: "a", pid: 10, found: 2},
+				{name: "b", pid: 20, found: 2},
+			},
+			want:  Result{PID: 10, Strategy: "a", Rounds: 2},
+			calls: []int{2, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Resolver{Interval: time.Millisecond}
+			for _, s := range tt.strategies {
+				r.Steps = append(r.Steps, Step{Strategy: s})
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			got, err := r.Resolve(ctx, Request{IDs: []string{"id"}})
+			if err != nil {
+				t.Fatalf("Resolve: %v", err)
+			}
+			got.Elapsed = 0
+			if got != tt.want {
+				t.Errorf("Resolve() = %+v, want %+v", got, tt.want)
+			}
+			for i, s := range tt.strategies {
+				if s.Calls() != tt.calls[i] {
+					t.Errorf("strategy %s ran %d times, want %d", s.name, s.Calls(), tt.calls[i])
+				}
+			}
+		})
+	}
+}
+
+func TestResolverDelay(t *testing.T) {
+	cheap := &fakeStrategy{name: "cheap"}
+	scan := &fakeStrategy{name: "scan", pid: 50, found: 1}
+	r := &Resolver{
+		Interval: 5 * time.Millisecond,
+		Steps: []Step{
+			{Strategy: cheap},
+			{Strategy: scan, Delay: 40 * time.Millisecond},
+		},
+	}
+
+	got, err := r.Resolve(context.Background(), Request{IDs: []string{"id"}})
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if got.PID != 50 || got.Strategy != "scan" {
+		t.Errorf("Resolve() = %s, want PID 50 via scan", got)
+	}
+	if got.Elapsed < 40*time.Millisecond || got.Rounds < 2 {
+		t.Errorf("the delayed strategy won after %s in round %d, before its delay of 40ms", got.Elapsed, got.Rounds)
+	}
+	if scan.Calls() != 1 {
+		t.Errorf("the delayed strategy ran %d times, want once", scan.Calls())
+	}
+	if cheap.Calls() != got.Rounds {
+		t.Errorf("the cheap strategy ran %d times in %d rounds", cheap.Calls(), got.Rounds)
+	}
+
+	// Once skips delayed steps altogether
+	_, err = r.Once(context.Background(), Request{IDs: []string{"id"}})
+	var rerr *ResolveError
+	if !errors.As(err, &rerr) || rerr.Rounds != 1 {
+		t.Fatalf("Once() = %v, want a ResolveError after one round", err)
+	}
+	if scan.Calls() != 1 {
+		t.Error("Once ran a delayed strategy")
+	}
+}
+
+func TestResolverDeadline(t *testing.T) {
+	denied := errors.New("permission denied")
+	a := &fakeStrategy{name: "a"}
+	b := &fakeStrategy{name: "b", err: denied}
+	late := &fakeStrategy{name: "late", pid: 60, found: 1}
+	r := &Resolver{
+		Interval: 5 * time.Millisecond,
+		Steps: []Step{
+			{Strategy: a},
+			{Strategy: b},
+			{Strategy: late, Delay: time.Hour},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := r.Resolve(ctx, Request{IDs: []string{"id"}})
+
+	var rerr *ResolveError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("Resolve() = %v, want a ResolveError", err)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		t.Error("ResolveError does not wrap ErrNotFound")
+	}
+	if !errors.Is(rerr.Err, context.DeadlineExceeded) {
+		t.Errorf("ResolveError.Err = %v, want the deadline", rerr.Err)
+	}
+	if rerr.Elapsed < 50*time.Millisecond || rerr.Elapsed > time.Second {
+		t.Errorf("gave up after %s, want the deadline of 50ms", rerr.Elapsed)
+	}
+	// The deadline may cut the last round short before its first strategy
+	if rerr.Rounds < 2 || a.Calls() < rerr.Rounds-1 || a.Calls() > rerr.Rounds {
+		t.Errorf("ran %d round(s), strategy a %d times", rerr.Rounds, a.Calls())
+	}
+	if late.Calls() != 0 {
+		t.Error("ran a strategy before its delay")
+	}
+
+	// The last failure of each strategy tried, in chain order
+	names := make([]string, 0, len(rerr.Errors))
+	for _, se := range rerr.Errors {
+		names = append(names, se.Strategy)
+	}
+	if !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("ResolveError.Errors names %v, want [a b]", names)
+	}
+	if len(rerr.Errors) == 2 && !errors.Is(rerr.Errors[1].Err, denied) {
+		t.Errorf("failure of b = %v, want %v", rerr.Errors[1].Err, denied)
+	}
+}
+
+func TestResolverSharedDeadline(t *testing.T) {
+	// A strategy that takes up the whole deadline leaves none for the rest
+	slow := &fakeStrategy{name: "slow", block: true}
+	next := &fakeStrategy{name: "next", pid: 70, found: 1}
+	r := &Resolver{
+		Interval: time.Millisecond,
+		Steps:    []Step{{Strategy: slow}, {Strategy: next}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, err := r.Resolve(ctx, Request{IDs: []string{"id"}})
+
+	var rerr *ResolveError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("Resolve() = %v, want a ResolveError", err)
+	}
+	if rerr.Rounds != 1 || slow.Calls() != 1 {
+		t.Errorf("ran %d round(s) and the slow strategy %d times, want one", rerr.Rounds, slow.Calls())
+	}
+	if next.Calls() != 0 {
+		t.Error("ran a strategy after the deadline passed")
+	}
+}
+
+func TestNewResolver(t *testing.T) {
+	h := podHost(t, false)
+	taskDir := filepath.Join(h.proc, "..", "tasks")
+	h.write(filepath.Join(taskDir, sidecarID, "init.pid"), "2004")
+	bundle := filepath.Join(h.proc, "..", "bundle")
+	h.write(filepath.Join(bundle, "init.pid"), "2001")
+
+	cfg := Config{
+		ProcRoot:        h.proc,
+		CgroupRoot:      h.cgroup,
+		TaskDirs:        []string{taskDir},
+		RuntimeRoots:    []string{"/nonexistent"},
+		RuntimeBinaries: []string{filepath.Join(h.proc, "..", "no-runc")},
+		ShimPID:         shimPID,
+		Interval:        5 * time.Millisecond,
+		ScanDelay:       20 * time.Millisecond,
+	}
+	tests := []struct {
+		name     string
+		req      Request
+		strategy string
+		want     int
+		rounds   int
+	}{
+		{"bundle file", Request{IDs: []string{podID}, Bundle: bundle}, "bundle-file", 2001, 1},
+		{"task state file", Request{IDs: []string{sidecarID}}, "task-state-file", 2004, 1},
+		// The restored init is no longer listed anywhere, the scans find it
+		{"shim child", Request{IDs: []string{appID}}, "shim-child", 2002, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			got, err := NewResolver(cfg).Resolve(ctx, tt.req)
+			if err != nil {
+				t.Fatalf("Resolve: %v", err)
+			}
+			if got.PID != tt.want || got.Strategy != tt.strategy || got.Rounds < tt.rounds {
+				t.Errorf("Resolve() = %s, want PID %d via %s after at least %d round(s)", got, tt.want, tt.strategy, tt.rounds)
+			}
+		})
+	}
+
+	t.Run("cgroup", func(t *testing.T) {
+		// Another shim: only the cgroup scan finds the container
+		cfg := cfg
+		cfg.ShimPID = 2001
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		got, err := NewResolver(cfg).Resolve(ctx, Request{IDs: []string{appID}})
+		if err != nil {
+			t.Fatalf("Resolve: %v", err)
+		}
+		if got.PID != 2002 || got.Strategy != "cgroup" {
+			t.Errorf("Resolve() = %s, want PID 2002 via cgroup", got)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Millisecond)
+		defer cancel()
+		_, err := NewResolver(cfg).Resolve(ctx, Request{IDs: []string{"dddd"}})
+		var rerr *ResolveError
+		if !errors.As(err, &rerr) {
+			t.Fatalf("Resolve() = %v, want a ResolveError", err)
+		}
+		if len(rerr.Errors) != len(NewResolver(cfg).Steps) {
+			t.Errorf("ResolveError lists %d strategies, want every one of the chain: %v", len(rerr.Errors), err)
+		}
+	})
+}
@@ -0,0 +1,318 @@
+package initpid
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kybernate/kybernate/pkg/cgroup"
+)
+
+// Config is the host layout the default chain reads. Zero values select
+// the host defaults.
+type Config struct {
+	// ProcRoot is the procfs mount
+	ProcRoot string
+	// CgroupRoot is the cgroupfs mount
+	CgroupRoot string
+	// TaskDirs hold the containerd task state, <dir>/<id>/init.pid
+	TaskDirs []string
+	// RuntimeRoots and RuntimeBinaries are combined to query `<bin> --root
+	// <root> state <id>`
+	RuntimeRoots    []string
+	RuntimeBinaries []string
+	// ShimPID is the shim process that reaps the container init; it
+	// defaults to the calling process
+	ShimPID int
+	// Interval is the pause between rounds
+	Interval time.Duration
+	// ScanDelay holds back the shim and cgroup scans
+	ScanDelay time.Duration
+}
+
+// Host defaults, including the paths of a microk8s installation
+var (
+	DefaultTaskDirs = []string{
+		"/run/containerd/io.containerd.runtime.v2.task/k8s.io",
+		"/var/snap/microk8s/common/run/containerd/io.containerd.runtime.v2.task/k8s.io",
+	}
+	DefaultRuntimeRoots = []string{
+		"/run/containerd/runc/k8s.io",
+		"/var/snap/microk8s/common/run/containerd/runc/k8s.io",
+	}
+	DefaultRuntimeBinaries = []string{"runc", "nvidia-container-runtime", "/snap/microk8s/current/bin/runc"}
+)
+
+func (c Config) withDefaults() Config {
+	if c.ProcRoot == "" {
+		c.ProcRoot = "/proc"
+	}
+	if c.CgroupRoot == "" {
+		c.CgroupRoot = "/sys/fs/cgroup"
+	}
+	if c.TaskDirs == nil {
+		c.TaskDirs = DefaultTaskDirs
+	}
+	if c.RuntimeRoots == nil {
+		c.RuntimeRoots = DefaultRuntimeRoots
+	}
+	if c.RuntimeBinaries == nil {
+		c.RuntimeBinaries = DefaultRuntimeBinaries
+	}
+	if c.ShimPID == 0 {
+		c.ShimPID = os.Getpid()
+	}
+	if c.Interval == 0 {
+		c.Interval = 200 * time.Millisecond
+	}
+	if c.ScanDelay == 0 {
+		c.ScanDelay = time.Second
+	}
+	return c
+}
+
+// NewResolver returns the default chain: the PID files the runtime
+// writes, the runtime's own state, then the children of the shim and the
+// processes of the container's cgroup
+func NewResolver(cfg Config) *Resolver {
+	cfg = cfg.withDefaults()
+	return &Resolver{
+		Interval: cfg.Interval,
+		Steps: []Step{
+			{Strategy: BundleFile{}},
+			{Strategy: TaskStateFile{Dirs: cfg.TaskDirs}},
+			{Strategy: RuntimeState{Roots: cfg.RuntimeRoots, Binaries: cfg.RuntimeBinaries}},
+			{Strategy: ShimChild{ProcRoot: cfg.ProcRoot, ShimPID: cfg.ShimPID}, Delay: cfg.ScanDelay},
+			{Strategy: Cgroup{ProcRoot: cfg.ProcRoot, CgroupRoot: cfg.CgroupRoot}, Delay: cfg.ScanDelay},
+		},
+	}
+}
+
+// BundleFile reads init.pid in the bundle directory, written by the
+// runtime once the task is created or restored
+type BundleFile struct{}
+
+func (BundleFile) Name() string { return "bundle-file" }
+
+func (BundleFile) Resolve(ctx context.Context, req Request) (int, error) {
+	if req.Bundle == "" {
+		return 0, fmt.Errorf("%w: no bundle", ErrNotFound)
+	}
+	return readPIDFile(filepath.Join(req.Bundle, "init.pid"))
+}
+
+// TaskStateFile reads init.pid in the containerd task state of each ID
+type TaskStateFile struct {
+	Dirs []string
+}
+
+func (TaskStateFile) Name() string { return "task-state-file" }
+
+func (t TaskStateFile) Resolve(ctx context.Context, req Request) (int, error) {
+	for _, id := range req.ids() {
+		for _, dir := range t.Dirs {
+			if pid, err := readPIDFile(filepath.Join(dir, id, "init.pid")); err == nil {
+				return pid, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("%w: no init.pid for %v", ErrNotFound, req.IDs)
+}
+
+// RunFunc runs a command and returns its standard output
+type RunFunc func(ctx context.Context, name string, args ...string) ([]byte, error)
+
+// RuntimeState asks the OCI runtime for the state of each ID
+type RuntimeState struct {
+	Roots    []string
+	Binaries []string
+	// Run defaults to executing the binary
+	Run RunFunc
+}
+
+func (RuntimeState) Name() string { return "runtime-state" }
+
+func (r RuntimeState) Resolve(ctx context.Context, req Request) (int, error) {
+	run := r.Run
+	if run == nil {
+		run = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+			return exec.CommandContext(ctx, name, args...).Output()
+		}
+	}
+	for _, id := range req.ids() {
+		for _, root := range r.Roots {
+			for _, bin := range r.Binaries {
+				output, err := run(ctx, bin, "--root", root, "state", id)
+				if err != nil {
+					continue
+				}
+				var state struct {
+					InitProcessPID int `json:"init_process_pid"`
+				}
+				if err := json.Unmarshal(output, &state); err == nil && state.InitProcessPID > 0 {
+					return state.InitProcessPID, nil
+				}
+			}
+		}
+	}
+	return 0, fmt.Errorf("%w: no runtime knows %v", ErrNotFound, req.IDs)
+}
+
+// ShimChild looks for the child of the shim that runs in the cgroup of
+// the container. The shim reaps the container init, so a restored init
+// is its child once the runtime exits.
+type ShimChild struct {
+	ProcRoot string
+	ShimPID  int
+}
+
+func (ShimChild) Name() string { return "shim-child" }
+
+func (s ShimChild) Resolve(ctx context.Context, req Request) (int, error) {
+	children, err := childrenOf(s.ProcRoot, s.ShimPID)
+	if err != nil {
+		return 0, err
+	}
+	// One shim serves all containers of a pod; tell them apart by cgroup
+	groups := make(map[int][]string, len(children))
+	for _, pid := range children {
+		groups[pid] = cgroupPaths(s.ProcRoot, pid)
+	}
+	for _, id := range req.ids() {
+		for _, pid := range children {
+			for _, path := range groups[pid] {
+				if cgroup.NamesContainer(path, id) {
+					return pid, nil
+				}
+			}
+		}
+	}
+	return 0, fmt.Errorf("%w: none of the %d children of shim %d is in a cgroup of %v", ErrNotFound, len(children), s.ShimPID, req.IDs)
+}
+
+// cgroupPaths returns the cgroup paths of pid, one per hierarchy
+func cgroupPaths(procRoot string, pid int) []string {
+	data, err := os.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return nil
+	}
+	var paths []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		// Format: hierarchy-ID:controller-list:path
+		if parts := strings.SplitN(line, ":", 3); len(parts) == 3 {
+			paths = append(paths, parts[2])
+		}
+	}
+	return paths
+}
+
+// childrenOf returns the children of pid, which the kernel lists per
+// thread that forked them
+func childrenOf(procRoot string, pid int) ([]int, error) {
+	taskDir := filepath.Join(procRoot, strconv.Itoa(pid), "task")
+	tasks, err := os.ReadDir(taskDir)
+	if err != nil {
+		return nil, fmt.Errorf("list threads of shim %d: %w", pid, err)
+	}
+	var children []int
+	for _, t := range tasks {
+		data, err := os.ReadFile(filepath.Join(taskDir, t.Name(), "children"))
+		if err != nil {
+			continue
+		}
+		for _, f := range strings.Fields(string(data)) {
+			if child, err := strconv.Atoi(f); err == nil && child > 0 {
+				children = append(children, child)
+			}
+		}
+	}
+	sort.Ints(children)
+	return children, nil
+}
+
+// Cgroup finds the cgroup of the container in cgroupfs and returns the
+// process in it whose parent is outside of it. Only a full ID names a
+// cgroup, so prefixes among the IDs do not match.
+type Cgroup struct {
+	ProcRoot   string
+	CgroupRoot string
+}
+
+func (Cgroup) Name() string { return "cgroup" }
+
+func (c Cgroup) Resolve(ctx context.Context, req Request) (int, error) {
+	ids := req.ids()
+	cg, err := cgroup.FindContainerIn(c.CgroupRoot, ids...)
+	if err != nil {
+		if errors.Is(err, cgroup.ErrNotFound) {
+			return 0, fmt.Errorf("%w: %v", ErrNotFound, err)
+		}
+		return 0, err
+	}
+	procs, err := cg.Procs()
+	if err != nil {
+		return 0, err
+	}
+	if pid := c.topmost(procs); pid > 0 {
+		return pid, nil
+	}
+	return 0, fmt.Errorf("%w: cgroup %s is empty", ErrNotFound, cg)
+}
+
+// topmost returns the lowest PID of procs whose parent is not in procs
+func (c Cgroup) topmost(procs []int) int {
+	in := make(map[int]bool, len(procs))
+	for _, pid := range procs {
+		in[pid] = true
+	}
+	sort.Ints(procs)
+	for _, pid := range procs {
+		ppid, err := parentOf(c.ProcRoot, pid)
+		if err == nil && !in[ppid] {
+			return pid
+		}
+	}
+	return 0
+}
+
+// parentOf reads the parent PID from /proc/<pid>/stat. The command name
+// in parentheses may contain spaces, so fields are counted from its end.
+func parentOf(procRoot string, pid int) (int, error) {
+	data, err := os.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, err
+	}
+	s := string(data)
+	i := strings.LastIndexByte(s, ')')
+	if i < 0 {
+		return 0, fmt.Errorf("malformed stat of %d", pid)
+	}
+	fields := strings.Fields(s[i+1:])
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("malformed stat of %d", pid)
+	}
+	return strconv.Atoi(fields[1])
+}
+
+func readPIDFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, fmt.Errorf("%w: %s does not exist", ErrNotFound, path)
+		}
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("%w: %s holds no PID", ErrNotFound, path)
+	}
+	return pid, nil
+}
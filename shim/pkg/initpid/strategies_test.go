@@ -0,0 +1,303 @@
+package initpid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// fakeHost is a procfs and cgroupfs in a temporary directory
+type fakeHost struct {
+	t      *testing.T
+	proc   string
+	cgroup string
+	// v1 puts processes into the pids hierarchy instead of the unified one
+	v1 bool
+}
+
+func newFakeHost(t *testing.T, v1 bool) *fakeHost {
+	t.Helper()
+	root := t.TempDir()
+	h := &fakeHost{t: t, proc: filepath.Join(root, "proc"), cgroup: filepath.Join(root, "cgroup"), v1: v1}
+	if v1 {
+		h.mkdir(filepath.Join(h.cgroup, "pids"))
+	} else {
+		h.write(filepath.Join(h.cgroup, "cgroup.controllers"), "cpu memory pids")
+	}
+	return h
+}
+
+func (h *fakeHost) mkdir(dir string) {
+	h.t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+func (h *fakeHost) write(path, data string) {
+	h.t.Helper()
+	h.mkdir(filepath.Dir(path))
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+func (h *fakeHost) append(path, line string) {
+	h.t.Helper()
+	h.mkdir(filepath.Dir(path))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// process adds pid with parent ppid in the cgroup at path ("" for none)
+func (h *fakeHost) process(pid, ppid int, comm, path string) {
+	h.t.Helper()
+	dir := filepath.Join(h.proc, strconv.Itoa(pid))
+	h.write(filepath.Join(dir, "stat"), fmt.Sprintf("%d (%s) S %d %d %d 0 -1\n", pid, comm, ppid, pid, pid))
+	h.mkdir(filepath.Join(dir, "task", strconv.Itoa(pid)))
+	if path == "" {
+		return
+	}
+	hierarchy := h.cgroup
+	if h.v1 {
+		hierarchy = filepath.Join(h.cgroup, "pids")
+		h.write(filepath.Join(dir, "cgroup"), fmt.Sprintf("12:pids:%s\n0::/\n", path))
+	} else {
+		h.write(filepath.Join(dir, "cgroup"), fmt.Sprintf("0::%s\n", path))
+	}
+	h.append(filepath.Join(hierarchy, path, "cgroup.procs"), strconv.Itoa(pid))
+}
+
+// children lists the children of pid as forked by its thread tid
+func (h *fakeHost) children(pid, tid int, children ...int) {
+	h.t.Helper()
+	line := ""
+	for _, c := range children {
+		line += strconv.Itoa(c) + " "
+	}
+	h.write(filepath.Join(h.proc, strconv.Itoa(pid), "task", strconv.Itoa(tid), "children"), line)
+}
+
+const (
+	shimPID   = 1000
+	podID     = "aaaa0000aaaa0000aaaa0000aaaa0000aaaa0000aaaa0000aaaa0000aaaa0000"
+	appID     = "bbbb1111bbbb1111bbbb1111bbbb1111bbbb1111bbbb1111bbbb1111bbbb1111"
+	sidecarID = "cccc2222cccc2222cccc2222cccc2222cccc2222cccc2222cccc2222cccc2222"
+	podCgroup = "/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod1234.slice"
+)
+
+// podHost is a shim serving the pause container and two application
+// containers of one pod, with the systemd cgroup driver
+func podHost(t *testing.T, v1 bool) *fakeHost {
+	h := newFakeHost(t, v1)
+	h.process(shimPID, 1, "containerd-shim", "/system.slice/containerd.service")
+	h.process(2001, shimPID, "pause", podCgroup+"/cri-containerd-"+podID+".scope")
+	h.process(2002, shimPID, "python3", podCgroup+"/cri-containerd-"+appID+".scope")
+	h.process(2003, 2002, "worker (gpu)", podCgroup+"/cri-containerd-"+appID+".scope")
+	h.process(2004, shimPID, "envoy", podCgroup+"/cri-containerd-"+sidecarID+".scope")
+	h.children(shimPID, shimPID, 2001, 2002)
+	// The shim is multi-threaded; another thread forked the sidecar
+	h.children(shimPID, shimPID+1, 2004)
+	h.children(2002, 2002, 2003)
+	return h
+}
+
+func TestBundleFile(t *testing.T) {
+	h := newFakeHost(t, false)
+	bundle := filepath.Join(h.proc, "..", "bundle")
+	h.write(filepath.Join(bundle, "init.pid"), "4242")
+	garbage := filepath.Join(h.proc, "..", "garbage")
+	h.write(filepath.Join(garbage, "init.pid"), "not a pid\n")
+
+	tests := []struct {
+		name     string
+		bundle   string
+		want     int
+		notFound bool
+	}{
+		{"pid file", bundle, 4242, false},
+		{"no bundle", "", 0, true},
+		{"not written yet", filepath.Join(h.proc, "..", "missing"), 0, true},
+		{"garbage", garbage, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pid, err := BundleFile{}.Resolve(context.Background(), Request{IDs: []string{appID}, Bundle: tt.bundle})
+			checkResolve(t, pid, err, tt.want, tt.notFound)
+		})
+	}
+}
+
+func TestTaskStateFile(t *testing.T) {
+	h := newFakeHost(t, false)
+	containerd := filepath.Join(h.proc, "..", "containerd", "k8s.io")
+	microk8s := filepath.Join(h.proc, "..", "microk8s", "k8s.io")
+	h.write(filepath.Join(microk8s, appID, "init.pid"), "2002\n")
+	h.write(filepath.Join(containerd, sidecarID, "init.pid"), "2004\n")
+	dirs := []string{containerd, microk8s}
+
+	tests := []struct {
+		name     string
+		ids      []string
+		want     int
+		notFound bool
+	}{
+		{"second directory", []string{appID}, 2002, false},
+		{"first ID wins", []string{sidecarID, appID}, 2004, false},
+		{"later ID", []string{podID, "", appID}, 2002, false},
+		{"unknown", []string{podID}, 0, true},
+		{"no IDs", []string{""}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pid, err := TaskStateFile{Dirs: dirs}.Resolve(context.Background(), Request{IDs: tt.ids})
+			checkResolve(t, pid, err, tt.want, tt.notFound)
+		})
+	}
+}
+
+func TestRuntimeState(t *testing.T) {
+	// Only nvidia-container-runtime with the microk8s root knows appID
+	var calls []string
+	run := func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		calls = append(calls, name+" "+args[1]+" "+args[3])
+		if name == "nvidia-container-runtime" && args[1] == "/microk8s" && args[3] == appID {
+			return []byte(`{"id": "` + appID + `", "init_process_pid": 2002, "status": "running"}`), nil
+		}
+		if name == "runc" && args[3] == sidecarID {
+			// A stopped container reports no init process
+			return []byte(`{"id": "` + sidecarID + `", "init_process_pid": 0, "status": "stopped"}`), nil
+		}
+		return nil, errors.New("container does not exist")
+	}
+	r := RuntimeState{Roots: []string{"/containerd", "/microk8s"}, Binaries: []string{"runc", "nvidia-container-runtime"}, Run: run}
+
+	tests := []struct {
+		name     string
+		ids      []string
+		want     int
+		notFound bool
+		calls    int
+	}{
+		{"found", []string{appID}, 2002, false, 4},
+		{"stopped", []string{sidecarID}, 0, true, 4},
+		{"unknown", []string{podID}, 0, true, 4},
+		{"second ID", []string{podID, appID}, 2002, false, 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls = nil
+			pid, err := r.Resolve(context.Background(), Request{IDs: tt.ids})
+			checkResolve(t, pid, err, tt.want, tt.notFound)
+			if len(calls) != tt.calls {
+				t.Errorf("ran the runtime %d times, want %d: %v", len(calls), tt.calls, calls)
+			}
+		})
+	}
+}
+
+func TestShimChild(t *testing.T) {
+	for _, v1 := range []bool{false, true} {
+		h := podHost(t, v1)
+		tests := []struct {
+			name     string
+			shim     int
+			ids      []string
+			want     int
+			notFound bool
+		}{
+			{"container", shimPID, []string{appID}, 2002, false},
+			{"pause container", shimPID, []string{podID}, 2001, false},
+			{"child of another thread", shimPID, []string{sidecarID}, 2004, false},
+			{"first ID wins", shimPID, []string{sidecarID, appID}, 2004, false},
+			{"prefix names no cgroup", shimPID, []string{appID[:12]}, 0, true},
+			{"shim without children", 2001, []string{podID}, 0, true},
+		}
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s/v1=%v", tt.name, v1), func(t *testing.T) {
+				s := ShimChild{ProcRoot: h.proc, ShimPID: tt.shim}
+				pid, err := s.Resolve(context.Background(), Request{IDs: tt.ids})
+				checkResolve(t, pid, err, tt.want, tt.notFound)
+			})
+		}
+	}
+
+	t.Run("shim gone", func(t *testing.T) {
+		h := newFakeHost(t, false)
+		_, err := ShimChild{ProcRoot: h.proc, ShimPID: shimPID}.Resolve(context.Background(), Request{IDs: []string{appID}})
+		if err == nil {
+			t.Fatal("resolved a container of a shim without /proc entry")
+		}
+	})
+}
+
+func TestCgroup(t *testing.T) {
+	for _, v1 := range []bool{false, true} {
+		h := podHost(t, v1)
+		// A container whose init exited leaves an empty cgroup behind
+		hierarchy := h.cgroup
+		if v1 {
+			hierarchy = filepath.Join(h.cgroup, "pids")
+		}
+		h.write(filepath.Join(hierarchy, podCgroup, "cri-containerd-dddd.scope", "cgroup.procs"), "")
+
+		tests := []struct {
+			name     string
+			ids      []string
+			want     int
+			notFound bool
+		}{
+			{"init, not its child", []string{appID}, 2002, false},
+			{"pause container", []string{podID}, 2001, false},
+			{"first ID with a cgroup", []string{"eeee", sidecarID, appID}, 2004, false},
+			{"prefix names no cgroup", []string{appID[:12]}, 0, true},
+			{"empty cgroup", []string{"dddd"}, 0, true},
+		}
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s/v1=%v", tt.name, v1), func(t *testing.T) {
+				c := Cgroup{ProcRoot: h.proc, CgroupRoot: h.cgroup}
+				pid, err := c.Resolve(context.Background(), Request{IDs: tt.ids})
+				checkResolve(t, pid, err, tt.want, tt.notFound)
+			})
+		}
+	}
+}
+
+func TestParentOf(t *testing.T) {
+	h := newFakeHost(t, false)
+	h.process(2003, 2002, "worker (gpu) 1", "")
+	h.write(filepath.Join(h.proc, "7", "stat"), "7 (broken")
+
+	if ppid, err := parentOf(h.proc, 2003); err != nil || ppid != 2002 {
+		t.Errorf("parentOf(2003) = %d, %v; want 2002", ppid, err)
+	}
+	if _, err := parentOf(h.proc, 7); err == nil {
+		t.Error("parentOf accepted a stat without the end of the command name")
+	}
+	if _, err := parentOf(h.proc, 8); err == nil {
+		t.Error("parentOf succeeded for a process without /proc entry")
+	}
+}
+
+func checkResolve(t *testing.T, pid int, err error, want int, notFound bool) {
+	t.Helper()
+	if notFound {
+		if !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Resolve() = %d, %v; want ErrNotFound", pid, err)
+		}
+		return
+	}
+	if err != nil || pid != want {
+		t.Fatalf("Resolve() = %d, %v; want %d", pid, err, want)
+	}
+}
@@ -0,0 +1,289 @@
+// Package journal records the progress of two-stage (CUDA, then CRIU)
+// checkpoints per container, so an operation interrupted by a crash of
+// the shim, kybernate-runtime or kybernate-ctl can be detected and its
+// processes brought back to running on the next start.
+//
+// Each container has one append-only file of JSON lines under the journal
+// directory. Starting an operation truncates it, so it only ever holds
+// the latest operation.
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultDir holds one journal per container
+const DefaultDir = "/var/lib/kybernate/journal"
+
+// Stage is a step of a checkpoint operation
+type Stage string
+
+const (
+	// StageLocked is written before the CUDA processes are locked, so a
+	// crash during the lock is covered as well
+	StageLocked Stage = "locked"
+	// StageCUDACheckpointed means the device memory is in host memory
+	StageCUDACheckpointed Stage = "cuda-checkpointed"
+	// StageCRIUDone means the CRIU dump completed
+	StageCRIUDone Stage = "criu-done"
+	// StageResumed means no process of the operation is left locked or
+	// checkpointed after a completed checkpoint
+	StageResumed Stage = "resumed"
+	// StageRolledBack means the operation was abandoned and its processes
+	// brought back to running
+	StageRolledBack Stage = "rolled-back"
+)
+
+// Terminal reports whether an operation ends with this stage
+func (s Stage) Terminal() bool {
+	return s == StageResumed || s == StageRolledBack
+}
+
+// Entry is one line of a journal
+type Entry struct {
+	Time        time.Time `json:"time"`
+	ContainerID string    `json:"containerID"`
+	Stage       Stage     `json:"stage"`
+	// Tool and Owner identify the process running the operation
+	Tool  string `json:"tool"`
+	Owner int    `json:"owner"`
+	// OwnerStart is the start time of Owner in clock ticks since boot, so
+	// that another process reusing its PID is not taken for it
+	OwnerStart uint64 `json:"ownerStart,omitempty"`
+	PIDs       []int  `json:"pids,omitempty"`
+	// Path is the checkpoint directory, if known
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Latency is set on StageResumed: the time the processes spent
+	// checkpointed, from the end of the CUDA checkpoint to the resume
+	Latency time.Duration `json:"latency,omitempty"`
+}
+
+// Journal is a directory of per-container journals
+type Journal struct {
+	Dir string
+}
+
+// New returns the journal in dir, or DefaultDir if dir is empty
+func New(dir string) *Journal {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return &Journal{Dir: dir}
+}
+
+func (j *Journal) path(containerID string) string {
+	return filepath.Join(j.Dir, containerID+".jsonl")
+}
+
+// Operation appends the stages of one operation to a container's journal.
+// A nil *Operation records nothing, so callers can carry on when the
+// journal cannot be written.
+type Operation struct {
+	journal     *Journal
+	ContainerID string
+	Tool        string
+	PIDs        []int
+	Path        string
+
+	checkpointedAt time.Time
+}
+
+// Begin starts a new operation on a container run by tool on pids,
+// discarding the previous one
+func (j *Journal) Begin(containerID, tool string, pids []int, path string) (*Operation, error) {
+	if err := os.MkdirAll(j.Dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Truncate(j.path(containerID), 0); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return &Operation{journal: j, ContainerID: containerID, Tool: tool, PIDs: pids, Path: path}, nil
+}
+
+// Record appends stage, with cause if it is set, and syncs the journal
+func (o *Operation) Record(stage Stage, cause error) error {
+	if o == nil {
+		return nil
+	}
+	now := time.Now()
+	if stage == StageCUDACheckpointed {
+		o.checkpointedAt = now
+	}
+	owner := os.Getpid()
+	e := Entry{
+		Time:        now,
+		ContainerID: o.ContainerID,
+		Stage:       stage,
+		Tool:        o.Tool,
+		Owner:       owner,
+		OwnerStart:  startTime(owner),
+		PIDs:        o.PIDs,
+		Path:        o.Path,
+	}
+	if cause != nil {
+		e.Error = cause.Error()
+	}
+	if stage == StageResumed {
+		e.Latency = o.SinceCheckpoint()
+	}
+	return o.journal.append(e)
+}
+
+// SinceCheckpoint returns the time since StageCUDACheckpointed was
+// recorded, or zero if it was not
+func (o *Operation) SinceCheckpoint() time.Duration {
+	if o == nil || o.checkpointedAt.IsZero() {
+		return 0
+	}
+	return time.Since(o.checkpointedAt)
+}
+
+func (j *Journal) append(e Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.path(e.ContainerID), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	// A line cut short by a crash must not swallow this entry
+	if fi, err := f.Stat(); err == nil && fi.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, fi.Size()-1); err == nil && last[0] != '\n' {
+			data = append([]byte{'\n'}, data...)
+		}
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	// The entry must survive the crash it is meant to detect
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Entries returns the journal of a container, oldest first. A line cut
+// short by a crash is skipped.
+func (j *Journal) Entries(containerID string) ([]Entry, error) {
+	f, err := os.Open(j.path(containerID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// Last returns the latest entry of a container, or nil if there is none
+func (j *Journal) Last(containerID string) (*Entry, error) {
+	entries, err := j.Entries(containerID)
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	return &entries[len(entries)-1], nil
+}
+
+// Remove deletes the journal of a container
+func (j *Journal) Remove(containerID string) error {
+	err := os.Remove(j.path(containerID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Interrupted returns the last entry of every operation that did not
+// reach a terminal stage and whose owner is no longer running
+func (j *Journal) Interrupted() ([]Entry, error) {
+	files, err := os.ReadDir(j.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var interrupted []Entry
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".jsonl") {
+			continue
+		}
+		last, err := j.Last(strings.TrimSuffix(f.Name(), ".jsonl"))
+		if err != nil || last == nil {
+			continue
+		}
+		if !last.Stage.Terminal() && !last.ownerRunning() {
+			interrupted = append(interrupted, *last)
+		}
+	}
+	return interrupted, nil
+}
+
+// ownerRunning reports whether the process that wrote e still runs. A
+// process with the same PID but a different start time is another one.
+func (e Entry) ownerRunning() bool {
+	if !alive(e.Owner) {
+		return false
+	}
+	return e.OwnerStart == 0 || startTime(e.Owner) == e.OwnerStart
+}
+
+// alive reports whether a process with this PID exists
+func alive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// startTime returns the start time of a process in clock ticks since
+// boot, field 22 of /proc/<pid>/stat, or 0 if it cannot be read
+func startTime(pid int) uint64 {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0
+	}
+	// The command name in field 2 may contain spaces and parentheses
+	end := strings.LastIndexByte(string(data), ')')
+	if end < 0 {
+		return 0
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	// fields[0] is field 3, the state
+	if len(fields) < 20 {
+		return 0
+	}
+	start, _ := strconv.ParseUint(fields[19], 10, 64)
+	return start
+}
+
+func (e Entry) String() string {
+	return fmt.Sprintf("%s of %s by %s (PID %d) at %s", e.Stage, e.ContainerID, e.Tool, e.Owner, e.Time.Format(time.RFC3339))
+}
@@ -0,0 +1,229 @@
+package journal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/kybernate/kybernate/pkg/cuda"
+)
+
+// deadPID returns the PID of a process that has exited
+func deadPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("cannot run true: %v", err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestBeginRecord(t *testing.T) {
+	j := New(t.TempDir())
+	op, err := j.Begin("abc", "test", []int{42}, "/ckpt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stage := range []Stage{StageLocked, StageCUDACheckpointed, StageCRIUDone, StageResumed} {
+		if err := op.Record(stage, nil); err != nil {
+			t.Fatalf("Record %s: %v", stage, err)
+		}
+	}
+	if err := op.Record(StageRolledBack, errors.New("boom")); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := j.Entries("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 5 {
+		t.Fatalf("%d entries, want 5", len(entries))
+	}
+	e := entries[3]
+	if e.Stage != StageResumed || e.Tool != "test" || e.Path != "/ckpt" || len(e.PIDs) != 1 || e.PIDs[0] != 42 {
+		t.Errorf("entry = %+v", e)
+	}
+	if e.Owner != os.Getpid() || e.OwnerStart == 0 || e.OwnerStart != startTime(os.Getpid()) {
+		t.Errorf("owner = %d started at %d, want this process", e.Owner, e.OwnerStart)
+	}
+	if e.Latency <= 0 {
+		t.Errorf("resumed without latency")
+	}
+	if entries[4].Error != "boom" {
+		t.Errorf("error = %q, want boom", entries[4].Error)
+	}
+
+	// A new operation discards the previous one
+	if _, err := j.Begin("abc", "test", nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if last, err := j.Last("abc"); err != nil || last != nil {
+		t.Errorf("Last after Begin = %+v, %v; want none", last, err)
+	}
+}
+
+func TestEntriesSkipTornLine(t *testing.T) {
+	j := New(t.TempDir())
+	op, err := j.Begin("abc", "test", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := op.Record(StageLocked, nil); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(j.path("abc"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"stage":"cuda-check`)
+	f.Close()
+	if err := op.Record(StageCUDACheckpointed, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := j.Entries("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].Stage != StageCUDACheckpointed {
+		t.Errorf("entries = %+v, want locked and cuda-checkpointed", entries)
+	}
+}
+
+func TestInterrupted(t *testing.T) {
+	self := os.Getpid()
+	dead := deadPID(t)
+	tests := []struct {
+		name        string
+		entry       Entry
+		interrupted bool
+	}{
+		{"owner running", Entry{Stage: StageCUDACheckpointed, Owner: self, OwnerStart: startTime(self)}, false},
+		{"owner without start time", Entry{Stage: StageCUDACheckpointed, Owner: self}, false},
+		{"owner dead", Entry{Stage: StageCUDACheckpointed, Owner: dead, OwnerStart: 1}, true},
+		{"PID reused", Entry{Stage: StageLocked, Owner: self, OwnerStart: startTime(self) + 1}, true},
+		{"finished", Entry{Stage: StageResumed, Owner: dead}, false},
+		{"rolled back", Entry{Stage: StageRolledBack, Owner: dead}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := New(t.TempDir())
+			tt.entry.ContainerID = "abc"
+			if err := j.append(tt.entry); err != nil {
+				t.Fatal(err)
+			}
+			got, err := j.Interrupted()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (len(got) == 1) != tt.interrupted {
+				t.Errorf("Interrupted = %+v, want interrupted %v", got, tt.interrupted)
+			}
+		})
+	}
+}
+
+func TestInterruptedMissingDir(t *testing.T) {
+	got, err := New(t.TempDir() + "/missing").Interrupted()
+	if err != nil || got != nil {
+		t.Errorf("Interrupted = %v, %v; want nothing", got, err)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	uuid, _ := cuda.ParseUUID("GPU-00000000-0000-0000-0000-000000000001")
+	tests := []struct {
+		name  string
+		stage Stage
+		state cuda.ProcessState
+		// fault makes the release fail
+		fault string
+		want  Stage
+	}{
+		{"interrupted while locked", StageLocked, cuda.StateLocked, "", StageRolledBack},
+		{"interrupted before CRIU", StageCUDACheckpointed, cuda.StateCheckpointed, "", StageRolledBack},
+		{"interrupted after CRIU", StageCRIUDone, cuda.StateCheckpointed, "", StageResumed},
+		{"release fails", StageCUDACheckpointed, cuda.StateCheckpointed, cuda.SimOpRestore, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sim := cuda.NewSimDriver(uuid)
+			if err := sim.AddProcess(100, "trainer", 1<<20, uuid); err != nil {
+				t.Fatal(err)
+			}
+			ckpt, err := cuda.NewCheckpointerWithDriver(sim)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sim.ProcessLock(100, 0); err != nil {
+				t.Fatal(err)
+			}
+			if tt.state == cuda.StateCheckpointed {
+				if err := sim.ProcessCheckpoint(100); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.fault != "" {
+				if err := sim.FailNext(tt.fault, cuda.ErrCodeNotReady); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			j := New(t.TempDir())
+			// PID 101 is gone and skipped
+			if err := j.append(Entry{ContainerID: "abc", Stage: tt.stage, Owner: deadPID(t), PIDs: []int{100, 101}}); err != nil {
+				t.Fatal(err)
+			}
+			results, err := Reconcile(context.Background(), ckpt, j, "reconciler")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != 1 {
+				t.Fatalf("%d results, want 1", len(results))
+			}
+			r := results[0]
+			last, err := j.Last("abc")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.want == "" {
+				if r.Err == nil {
+					t.Error("release failure not reported")
+				}
+				if last.Stage != tt.stage {
+					t.Errorf("journal at %s, want it left open at %s", last.Stage, tt.stage)
+				}
+				return
+			}
+			if r.Err != nil || r.Stage != tt.want {
+				t.Fatalf("result = %s", r)
+			}
+			if last.Stage != tt.want || last.Tool != "reconciler" {
+				t.Errorf("journal at %s by %s, want %s by reconciler", last.Stage, last.Tool, tt.want)
+			}
+			if p, _ := sim.Process(100); p.State != cuda.StateRunning {
+				t.Errorf("process left %s", p.State)
+			}
+			// A reconciled operation is not reconciled again
+			if again, _ := j.Interrupted(); len(again) != 0 {
+				t.Errorf("still interrupted: %+v", again)
+			}
+		})
+	}
+}
+
+func TestSinceCheckpoint(t *testing.T) {
+	var nilOp *Operation
+	if nilOp.SinceCheckpoint() != 0 || nilOp.Record(StageLocked, nil) != nil {
+		t.Error("nil operation recorded something")
+	}
+	op := &Operation{checkpointedAt: time.Now().Add(-time.Second)}
+	if op.SinceCheckpoint() < time.Second {
+		t.Errorf("SinceCheckpoint = %s", op.SinceCheckpoint())
+	}
+}
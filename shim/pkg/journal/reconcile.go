@@ -0,0 +1,76 @@
+package journal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/kybernate/kybernate/pkg/cuda"
+)
+
+// Result describes how an interrupted operation was reconciled
+type Result struct {
+	// Entry is the last stage the operation reached
+	Entry Entry
+	// Stage is the terminal stage recorded by the reconcile
+	Stage    Stage
+	Released []cuda.ReleasedProcess
+	// Err is set if a process could not be released; the operation stays
+	// open and is retried by the next reconcile
+	Err error
+}
+
+func (r Result) String() string {
+	pids := make([]string, 0, len(r.Released))
+	for _, p := range r.Released {
+		pids = append(pids, fmt.Sprintf("%d (%s)", p.PID, p.From))
+	}
+	msg := fmt.Sprintf("operation interrupted after %s", r.Entry)
+	if len(pids) > 0 {
+		msg += ", released " + strings.Join(pids, ", ")
+	}
+	if r.Err != nil {
+		return msg + ": " + r.Err.Error()
+	}
+	return msg + ", marked " + string(r.Stage)
+}
+
+// Reconcile closes every interrupted operation in the journal. A
+// checkpoint whose CRIU dump completed is finished: processes that kept
+// running are resumed. Any other operation is rolled back. In both cases
+// every process of the operation left locked or checkpointed is brought
+// back to running; processes that are gone are skipped.
+func Reconcile(ctx context.Context, ckpt *cuda.Checkpointer, j *Journal, tool string) ([]Result, error) {
+	interrupted, err := j.Interrupted()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Result
+	for _, e := range interrupted {
+		r := Result{Entry: e, Stage: StageRolledBack}
+		if e.Stage == StageCRIUDone {
+			r.Stage = StageResumed
+		}
+
+		r.Released = ckpt.Release(ctx, e.PIDs)
+		var failed []string
+		for _, p := range r.Released {
+			if p.Err != nil {
+				failed = append(failed, fmt.Sprintf("PID %d: %v", p.PID, p.Err))
+			}
+		}
+		if len(failed) > 0 {
+			r.Err = fmt.Errorf("release %s", strings.Join(failed, "; "))
+			results = append(results, r)
+			continue
+		}
+
+		op := &Operation{journal: j, ContainerID: e.ContainerID, Tool: tool, PIDs: e.PIDs, Path: e.Path}
+		if err := op.Record(r.Stage, nil); err != nil {
+			r.Err = err
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
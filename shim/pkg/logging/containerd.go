@@ -0,0 +1,96 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/containerd/containerd/log"
+)
+
+// containerdStream reports whether this process runs as a containerd shim,
+// whose standard logger writes to the log stream containerd opened for it
+func containerdStream() bool {
+	return os.Getenv("TTRPC_ADDRESS") != "" || os.Getenv("NAMESPACE") != ""
+}
+
+// containerdHandler hands records to containerd's logger
+type containerdHandler struct {
+	level slog.Leveler
+	attrs []slog.Attr
+	group string
+}
+
+func newContainerdHandler(level slog.Leveler) *containerdHandler {
+	return &containerdHandler{level: level}
+}
+
+func (h *containerdHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *containerdHandler) Handle(_ context.Context, r slog.Record) error {
+	fields := log.Fields{}
+	add := func(a slog.Attr) bool {
+		key := a.Key
+		if h.group != "" {
+			key = h.group + "." + key
+		}
+		fields[key] = fieldValue(a.Value.Resolve())
+		return true
+	}
+	for _, a := range h.attrs {
+		add(a)
+	}
+	r.Attrs(add)
+
+	entry := log.L.WithFields(fields)
+	if !r.Time.IsZero() {
+		entry = entry.WithTime(r.Time)
+	}
+	switch {
+	case r.Level >= slog.LevelError:
+		entry.Error(r.Message)
+	case r.Level >= slog.LevelWarn:
+		entry.Warn(r.Message)
+	case r.Level >= slog.LevelInfo:
+		entry.Info(r.Message)
+	default:
+		entry.Debug(r.Message)
+	}
+	return nil
+}
+
+func fieldValue(v slog.Value) any {
+	switch v.Kind() {
+	case slog.KindDuration:
+		return v.Duration().String()
+	case slog.KindTime:
+		return v.Time().Format(time.RFC3339Nano)
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return err.Error()
+		}
+		return v.Any()
+	case slog.KindGroup:
+		return fmt.Sprint(v.Group())
+	}
+	return v.Any()
+}
+
+func (h *containerdHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &clone
+}
+
+func (h *containerdHandler) WithGroup(name string) slog.Handler {
+	clone := *h
+	if clone.group != "" {
+		name = clone.group + "." + name
+	}
+	clone.group = name
+	return &clone
+}
@@ -0,0 +1,53 @@
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"strings"
+	"time"
+)
+
+// A correlation ID names one operation, e.g. a checkpoint and the restore
+// of it, in the logs of every tool that takes part. kybernate-ctl passes
+// it to the commands it runs in the environment; it is recorded in the
+// checkpoint manifest and in the container lock, and a restored
+// container takes it from its annotation or from the manifest.
+const (
+	CorrelationEnv        = "KYBERNATE_CORRELATION_ID"
+	CorrelationAnnotation = "kybernate.io/correlation-id"
+)
+
+// randRead fills correlation IDs; tests replace it to make it fail
+var randRead = rand.Read
+
+// NewCorrelationID returns a random ID. If no random bytes can be read,
+// the ID is made of the time and the PID instead, which still tells the
+// operations of a node apart.
+func NewCorrelationID() string {
+	b := make([]byte, 8)
+	if _, err := randRead(b); err != nil {
+		binary.BigEndian.PutUint64(b, uint64(time.Now().UnixNano())^uint64(os.Getpid())<<48)
+	}
+	return hex.EncodeToString(b)
+}
+
+// CorrelationFromEnv returns the ID in KYBERNATE_CORRELATION_ID, or a new
+// one
+func CorrelationFromEnv() string {
+	if id := strings.TrimSpace(os.Getenv(CorrelationEnv)); id != "" {
+		return id
+	}
+	return NewCorrelationID()
+}
+
+// FirstCorrelation returns the first of ids that is set, or a new ID
+func FirstCorrelation(ids ...string) string {
+	for _, id := range ids {
+		if id = strings.TrimSpace(id); id != "" {
+			return id
+		}
+	}
+	return NewCorrelationID()
+}
@@ -0,0 +1,41 @@
+package logging
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNewCorrelationID(t *testing.T) {
+	a, b := NewCorrelationID(), NewCorrelationID()
+	if len(a) != 16 || a == b {
+		t.Errorf("IDs %q and %q, want two distinct 16 digit IDs", a, b)
+	}
+}
+
+func TestNewCorrelationIDWithoutRandomness(t *testing.T) {
+	defer func(read func([]byte) (int, error)) { randRead = read }(randRead)
+	randRead = func(b []byte) (int, error) { return 0, errors.New("no entropy") }
+
+	id := NewCorrelationID()
+	if len(id) != 16 || id == "0000000000000000" {
+		t.Errorf("fallback ID %q", id)
+	}
+}
+
+func TestFirstCorrelation(t *testing.T) {
+	if id := FirstCorrelation("", "  ", " ckpt-1 ", "ckpt-2"); id != "ckpt-1" {
+		t.Errorf("FirstCorrelation = %q, want ckpt-1", id)
+	}
+	if id := FirstCorrelation("", ""); len(id) != 16 {
+		t.Errorf("FirstCorrelation without IDs = %q, want a new one", id)
+	}
+
+	t.Setenv(CorrelationEnv, " restore-1 ")
+	if id := CorrelationFromEnv(); id != "restore-1" {
+		t.Errorf("CorrelationFromEnv = %q", id)
+	}
+	t.Setenv(CorrelationEnv, "")
+	if id := CorrelationFromEnv(); len(id) != 16 {
+		t.Errorf("CorrelationFromEnv without %s = %q", CorrelationEnv, id)
+	}
+}
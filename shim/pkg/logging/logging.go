@@ -0,0 +1,195 @@
+// Package logging sets up the structured, leveled logger shared by the
+// shim, kybernate-runtime and kybernate-ctl. Records carry fields such as
+// the container ID, PID, stage and duration, and a correlation ID that
+// follows one operation across the tools. The destination is a file with
+// size-based rotation, stderr, or, in the shim, the log stream containerd
+// reads from the shim.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Keys of the fields the tools attach to records
+const (
+	KeyComponent   = "component"
+	KeyCorrelation = "correlation"
+	KeyContainer   = "container"
+	KeyPID         = "pid"
+	KeyPIDs        = "pids"
+	KeyStage       = "stage"
+	KeyDuration    = "duration"
+	KeyError       = "error"
+)
+
+// Output is where records go
+type Output string
+
+const (
+	// OutputFile appends to Config.File, rotating it by size
+	OutputFile Output = "file"
+	// OutputStderr writes to standard error
+	OutputStderr Output = "stderr"
+	// OutputContainerd writes to the log stream of a containerd shim,
+	// which containerd merges into its own log. Outside a shim it is the
+	// same as stderr.
+	OutputContainerd Output = "containerd"
+)
+
+// Format is the encoding of records written to a file or stderr
+type Format string
+
+const (
+	FormatText Format = "text"
+	FormatJSON Format = "json"
+)
+
+// Config selects the level, destination and encoding of a logger
+type Config struct {
+	Level  slog.Level
+	Output Output
+	Format Format
+	// File is the log file of OutputFile
+	File string
+	// MaxSize rotates the file once it grows past this many bytes; 0
+	// never rotates
+	MaxSize int64
+	// MaxBackups is how many rotated files are kept
+	MaxBackups int
+}
+
+// DefaultMaxSize and DefaultMaxBackups bound a log file to about 60 MiB
+const (
+	DefaultMaxSize    = 10 << 20
+	DefaultMaxBackups = 5
+)
+
+// Environment variables overriding the configuration of every tool
+const (
+	LevelEnv      = "KYBERNATE_LOG_LEVEL"
+	OutputEnv     = "KYBERNATE_LOG_OUTPUT"
+	FormatEnv     = "KYBERNATE_LOG_FORMAT"
+	FileEnv       = "KYBERNATE_LOG_FILE"
+	MaxSizeEnv    = "KYBERNATE_LOG_MAX_SIZE"
+	MaxBackupsEnv = "KYBERNATE_LOG_MAX_BACKUPS"
+)
+
+// ParseLevel parses debug, info, warn or error; an empty string yields def
+func ParseLevel(s string, def slog.Level) (slog.Level, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return def, nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return def, fmt.Errorf("invalid log level %q (expected debug, info, warn or error)", s)
+	}
+	return level, nil
+}
+
+// ConfigFromEnv returns def overridden by the KYBERNATE_LOG_* variables.
+// Invalid values are reported and leave the default in place.
+func ConfigFromEnv(def Config) (Config, error) {
+	cfg := def
+	var errs []string
+	if level, err := ParseLevel(os.Getenv(LevelEnv), def.Level); err != nil {
+		errs = append(errs, fmt.Sprintf("%s: %v", LevelEnv, err))
+	} else {
+		cfg.Level = level
+	}
+	switch o := Output(strings.ToLower(strings.TrimSpace(os.Getenv(OutputEnv)))); o {
+	case "":
+	case OutputFile, OutputStderr, OutputContainerd:
+		cfg.Output = o
+	default:
+		errs = append(errs, fmt.Sprintf("%s: invalid output %q (expected file, stderr or containerd)", OutputEnv, o))
+	}
+	switch f := Format(strings.ToLower(strings.TrimSpace(os.Getenv(FormatEnv)))); f {
+	case "":
+	case FormatText, FormatJSON:
+		cfg.Format = f
+	default:
+		errs = append(errs, fmt.Sprintf("%s: invalid format %q (expected text or json)", FormatEnv, f))
+	}
+	if file := strings.TrimSpace(os.Getenv(FileEnv)); file != "" {
+		cfg.File = file
+		if cfg.Output == "" {
+			cfg.Output = OutputFile
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv(MaxSizeEnv)); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err != nil || n < 0 {
+			errs = append(errs, fmt.Sprintf("%s: invalid size %q", MaxSizeEnv, v))
+		} else {
+			cfg.MaxSize = n
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv(MaxBackupsEnv)); v != "" {
+		if n, err := strconv.Atoi(v); err != nil || n < 0 {
+			errs = append(errs, fmt.Sprintf("%s: invalid count %q", MaxBackupsEnv, v))
+		} else {
+			cfg.MaxBackups = n
+		}
+	}
+	if len(errs) > 0 {
+		return cfg, fmt.Errorf("ignoring log settings: %s", strings.Join(errs, "; "))
+	}
+	return cfg, nil
+}
+
+// New returns a logger for component as configured, and the closer of its
+// destination. If a log file cannot be opened, fallbacks are tried in
+// order before stderr.
+func New(cfg Config, component string, fallbacks ...string) (*slog.Logger, io.Closer, error) {
+	var (
+		w      io.Writer = os.Stderr
+		closer io.Closer = nopCloser{}
+		err    error
+	)
+	switch cfg.Output {
+	case OutputContainerd:
+		if containerdStream() {
+			logger := slog.New(newContainerdHandler(cfg.Level)).With(KeyComponent, component)
+			return logger, closer, nil
+		}
+	case OutputFile, "":
+		var f *RotatingFile
+		for _, path := range append([]string{cfg.File}, fallbacks...) {
+			if path == "" {
+				continue
+			}
+			if f, err = OpenRotating(path, cfg.MaxSize, cfg.MaxBackups); err == nil {
+				break
+			}
+		}
+		if f != nil {
+			w, closer, err = f, f, nil
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: cfg.Level}
+	var h slog.Handler
+	if cfg.Format == FormatJSON {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(h).With(KeyComponent, component), closer, err
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// Discard drops every record, for use before a logger is configured
+var Discard = slog.New(slog.DiscardHandler)
+
+// Err is the field of an error
+func Err(err error) slog.Attr {
+	return slog.Any(KeyError, err)
+}
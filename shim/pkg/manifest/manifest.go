@@ -0,0 +1,362 @@
+// Package manifest defines kybernate-metadata.json, the description of a
+// checkpoint that every checkpoint path (the shim, kybernate-runtime,
+// kybernate-ctl and the CheckpointController) writes into the checkpoint
+// directory. The manifest is versioned: Read validates it and migrates
+// manifests written by older releases to the current version.
+package manifest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+
+	"github.com/kybernate/kybernate/pkg/compat"
+	"github.com/kybernate/kybernate/pkg/cuda"
+)
+
+// FileName is the manifest inside a checkpoint directory
+const FileName = "kybernate-metadata.json"
+
+// Version is the schema version written by this release. Version 1 is
+// the untyped map written by earlier releases of kybernate-ctl, which had
+// no version field.
+const Version = 2
+
+var (
+	// ErrNotFound means the checkpoint directory has no manifest
+	ErrNotFound = errors.New("checkpoint has no manifest")
+	// ErrInvalid is wrapped by validation errors
+	ErrInvalid = errors.New("invalid checkpoint manifest")
+	// ErrUnsupportedVersion means the manifest was written by a newer release
+	ErrUnsupportedVersion = errors.New("unsupported checkpoint manifest version")
+)
+
+// ToolVersion is the version recorded in manifests. Release builds set it
+// with -ldflags "-X github.com/kybernate/kybernate/pkg/manifest.ToolVersion=...";
+// otherwise the VCS revision of the build is used.
+var ToolVersion = ""
+
+// Manifest describes a checkpoint
+type Manifest struct {
+	Version int `json:"version"`
+	// Tool is the entry point that took the checkpoint
+	Tool        string    `json:"tool"`
+	ToolVersion string    `json:"toolVersion,omitempty"`
+	Node        string    `json:"node,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// Path is the checkpoint directory at the time it was written
+	Path string `json:"path,omitempty"`
+	// CorrelationID names the checkpoint in the logs of every tool; a
+	// restore of it logs under the same ID
+	CorrelationID string `json:"correlationID,omitempty"`
+
+	Workload Workload `json:"workload"`
+	// GPU is nil for CPU-only checkpoints
+	GPU     *GPU    `json:"gpu,omitempty"`
+	Timings Timings `json:"timings"`
+	Sizes   Sizes   `json:"sizes"`
+	// Degraded is set if the GPU state was not captured
+	Degraded *cuda.Degraded `json:"degraded,omitempty"`
+	// Host is the driver stack of the node, which a restore is checked
+	// against. Manifests of earlier releases lack it.
+	Host *compat.Host `json:"host,omitempty"`
+}
+
+// Workload identifies the checkpointed container
+type Workload struct {
+	Namespace   string `json:"namespace,omitempty"`
+	Pod         string `json:"pod,omitempty"`
+	Container   string `json:"container,omitempty"`
+	ContainerID string `json:"containerID,omitempty"`
+	Image       string `json:"image,omitempty"`
+}
+
+func (w Workload) String() string {
+	if w.Pod == "" {
+		return w.ContainerID
+	}
+	return fmt.Sprintf("%s/%s/%s", w.Namespace, w.Pod, w.Container)
+}
+
+// CRI annotations naming the pod, container and image of a container
+const (
+	annotationNamespace = "io.kubernetes.cri.sandbox-namespace"
+	annotationPod       = "io.kubernetes.cri.sandbox-name"
+	annotationContainer = "io.kubernetes.cri.container-name"
+	annotationImage     = "io.kubernetes.cri.image-name"
+)
+
+// WorkloadFromAnnotations identifies container id from the CRI
+// annotations of its spec
+func WorkloadFromAnnotations(id string, annotations map[string]string) Workload {
+	return Workload{
+		Namespace:   annotations[annotationNamespace],
+		Pod:         annotations[annotationPod],
+		Container:   annotations[annotationContainer],
+		ContainerID: id,
+		Image:       annotations[annotationImage],
+	}
+}
+
+// GPU describes the GPU state of a checkpoint
+type GPU struct {
+	PIDs  []int    `json:"pids"`
+	UUIDs []string `json:"uuids,omitempty"`
+	// DriverVersion is the CUDA driver API version, e.g. "12.8"
+	DriverVersion string `json:"driverVersion,omitempty"`
+	// Processes holds the CUDA state of each process after the CUDA stage
+	Processes []Process `json:"processes,omitempty"`
+}
+
+// Process is the CUDA state of one process
+type Process struct {
+	PID   int    `json:"pid"`
+	State string `json:"state"`
+}
+
+// Timings are the durations of the stages of a checkpoint
+type Timings struct {
+	CUDACheckpoint time.Duration `json:"cudaCheckpoint,omitempty"`
+	CRIUDump       time.Duration `json:"criuDump,omitempty"`
+	// SnapshotToResume is the time the processes spent without their
+	// device memory, if they were resumed after the dump
+	SnapshotToResume time.Duration `json:"snapshotToResume,omitempty"`
+	Total            time.Duration `json:"total,omitempty"`
+}
+
+// Sizes are in bytes
+type Sizes struct {
+	// Checkpoint is the size of the checkpoint directory
+	Checkpoint int64 `json:"checkpoint"`
+	// VRAM is the device memory copied into host memory
+	VRAM int64 `json:"vram,omitempty"`
+}
+
+// New returns a manifest of the current version for a checkpoint taken by
+// tool into path
+func New(tool, path string) *Manifest {
+	node, _ := os.Hostname()
+	return &Manifest{
+		Version:     Version,
+		Tool:        tool,
+		ToolVersion: toolVersion(),
+		Node:        node,
+		CreatedAt:   time.Now(),
+		Path:        path,
+	}
+}
+
+func toolVersion() string {
+	if ToolVersion != "" {
+		return ToolVersion
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, s := range info.Settings {
+		if s.Key == "vcs.revision" {
+			return s.Value
+		}
+	}
+	if info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return ""
+}
+
+// DescribeGPU records the GPU state of pids: their GPUs from processes
+// (as returned by cuda.RecordProcesses), the driver version and the CUDA
+// state of each process as reported by ckpt
+func DescribeGPU(ckpt *cuda.Checkpointer, pids []int, processes []cuda.CheckpointedProcess) *GPU {
+	if len(pids) == 0 {
+		return nil
+	}
+	gpu := &GPU{PIDs: pids}
+	for _, dev := range cuda.UnionGPUs(processes) {
+		gpu.UUIDs = append(gpu.UUIDs, dev.UUID)
+	}
+	if version := cuda.ProbeDriver().DriverVersion; version > 0 {
+		gpu.DriverVersion = cuda.FormatDriverVersion(version)
+	}
+	if ckpt != nil {
+		for _, pid := range pids {
+			p := Process{PID: pid, State: "unknown"}
+			if state, err := ckpt.GetState(pid); err == nil {
+				p.State = state.String()
+			}
+			gpu.Processes = append(gpu.Processes, p)
+		}
+	}
+	return gpu
+}
+
+// Validate checks the manifest for the fields every reader relies on
+func (m *Manifest) Validate() error {
+	switch {
+	case m.Version < 1:
+		return fmt.Errorf("%w: version %d", ErrInvalid, m.Version)
+	case m.Version > Version:
+		return fmt.Errorf("%w %d (this release reads up to %d)", ErrUnsupportedVersion, m.Version, Version)
+	case m.Tool == "":
+		return fmt.Errorf("%w: no tool", ErrInvalid)
+	case m.CreatedAt.IsZero():
+		return fmt.Errorf("%w: no creation time", ErrInvalid)
+	case m.Workload.ContainerID == "" && m.Workload.Pod == "":
+		return fmt.Errorf("%w: neither container ID nor pod", ErrInvalid)
+	case m.GPU != nil && len(m.GPU.PIDs) == 0:
+		return fmt.Errorf("%w: GPU state without processes", ErrInvalid)
+	}
+	return nil
+}
+
+// Write validates the manifest and writes it into dir. The checkpoint
+// size is measured and a degradation recorded in dir is picked up, so it
+// should be called once the checkpoint is complete.
+func (m *Manifest) Write(dir string) error {
+	if m.Degraded == nil {
+		degraded, err := cuda.ReadDegraded(dir)
+		if err != nil {
+			return err
+		}
+		m.Degraded = degraded
+	}
+	size, err := dirSize(dir)
+	if err != nil {
+		return err
+	}
+	m.Sizes.Checkpoint = size
+
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, "."+FileName+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, FileName))
+}
+
+// Read reads, migrates and validates the manifest in dir. It returns an
+// error wrapping ErrNotFound if there is none.
+func Read(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, FileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: %w", dir, ErrNotFound)
+		}
+		return nil, err
+	}
+
+	var probe struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", FileName, err)
+	}
+
+	var m *Manifest
+	switch probe.Version {
+	case 0, 1:
+		m, err = migrateV1(dir, data)
+	default:
+		m = &Manifest{}
+		err = json.Unmarshal(data, m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", FileName, err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// v1 is the manifest written by kybernate-ctl before versioning
+type v1 struct {
+	Namespace   string `json:"namespace"`
+	Pod         string `json:"pod"`
+	Container   string `json:"container"`
+	ContainerID string `json:"containerID"`
+	GPUPIDs     []int  `json:"gpuPIDs"`
+	// GPUPID predates the recording of all GPU processes
+	GPUPID         int    `json:"gpuPID"`
+	Timestamp      string `json:"timestamp"`
+	CheckpointPath string `json:"checkpointPath"`
+}
+
+// migrateV1 converts a version 1 manifest, filling in what the files
+// written next to it still tell
+func migrateV1(dir string, data []byte) (*Manifest, error) {
+	var old v1
+	if err := json.Unmarshal(data, &old); err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{
+		Version: Version,
+		Tool:    "kybernate-ctl",
+		Path:    old.CheckpointPath,
+		Workload: Workload{
+			Namespace:   old.Namespace,
+			Pod:         old.Pod,
+			Container:   old.Container,
+			ContainerID: old.ContainerID,
+		},
+	}
+	if t, err := time.ParseInLocation("20060102-150405", old.Timestamp, time.Local); err == nil {
+		m.CreatedAt = t
+	} else if fi, err := os.Stat(filepath.Join(dir, FileName)); err == nil {
+		m.CreatedAt = fi.ModTime()
+	}
+
+	pids := old.GPUPIDs
+	if len(pids) == 0 && old.GPUPID > 0 {
+		pids = []int{old.GPUPID}
+	}
+	if len(pids) > 0 {
+		m.GPU = &GPU{PIDs: pids}
+		if devices, err := cuda.ReadGPUDevices(dir); err == nil {
+			for _, dev := range devices {
+				m.GPU.UUIDs = append(m.GPU.UUIDs, dev.UUID)
+			}
+		}
+	}
+	if degraded, err := cuda.ReadDegraded(dir); err == nil {
+		m.Degraded = degraded
+	}
+	if size, err := dirSize(dir); err == nil {
+		m.Sizes.Checkpoint = size
+	}
+	return m, nil
+}
+
+// dirSize returns the size of the regular files below dir, without the
+// manifest itself
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || filepath.Base(path) == FileName {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
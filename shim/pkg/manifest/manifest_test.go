@@ -0,0 +1,254 @@
+package manifest
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kybernate/kybernate/pkg/cuda"
+)
+
+// checkpointDir returns a checkpoint directory holding manifest, if it is
+// set, and a 4 KiB image, and the size of its files
+func checkpointDir(t *testing.T, manifest []byte) (string, int64) {
+	t.Helper()
+	dir := t.TempDir()
+	if manifest != nil {
+		if err := os.WriteFile(filepath.Join(dir, FileName), manifest, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "pages-1.img"), make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, 4096
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func TestReadMigratesV1(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/v1/" + FileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, size := checkpointDir(t, fixture)
+	devices := []cuda.GPUDevice{{Index: 0, UUID: "GPU-00000000-0000-0000-0000-000000000001", Name: "Simulated GPU"}}
+	if err := cuda.WriteGPUDevices(dir, devices); err != nil {
+		t.Fatal(err)
+	}
+	size += fileSize(t, filepath.Join(dir, cuda.GPUDevicesFile))
+
+	m, err := Read(dir)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if m.Version != Version || m.Tool != "kybernate-ctl" {
+		t.Errorf("version %d by %s, want %d by kybernate-ctl", m.Version, m.Tool, Version)
+	}
+	want := Workload{
+		Namespace:   "ml",
+		Pod:         "trainer-0",
+		Container:   "trainer",
+		ContainerID: "4f3c2b1a09e8d7c6b5a4f3e2d1c0b9a8f7e6d5c4b3a2918070605040302010ff",
+	}
+	if m.Workload != want {
+		t.Errorf("workload = %+v, want %+v", m.Workload, want)
+	}
+	if m.Path != "/var/lib/kybernate/checkpoints/ml/trainer-0/trainer/20240315-142530" {
+		t.Errorf("path = %s", m.Path)
+	}
+	if created := time.Date(2024, 3, 15, 14, 25, 30, 0, time.Local); !m.CreatedAt.Equal(created) {
+		t.Errorf("created at %s, want %s", m.CreatedAt, created)
+	}
+	// Version 1 recorded no timings and no VRAM size
+	if m.Timings != (Timings{}) {
+		t.Errorf("timings = %+v, want none", m.Timings)
+	}
+	if m.Sizes != (Sizes{Checkpoint: size}) {
+		t.Errorf("sizes = %+v, want a checkpoint of %d bytes", m.Sizes, size)
+	}
+	if m.GPU == nil || !reflect.DeepEqual(m.GPU.PIDs, []int{4242}) || !reflect.DeepEqual(m.GPU.UUIDs, []string{devices[0].UUID}) {
+		t.Errorf("GPU = %+v, want PID 4242 on the recorded device", m.GPU)
+	}
+	if m.Degraded != nil || m.Host != nil {
+		t.Errorf("degraded %+v, host %+v; want neither", m.Degraded, m.Host)
+	}
+}
+
+func TestMigrateV1Variants(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		degraded bool
+		pids     []int
+		// fromFile takes the creation time from the manifest file
+		fromFile bool
+	}{
+		{
+			name:     "all GPU processes",
+			manifest: `{"pod": "p", "namespace": "n", "container": "c", "gpuPIDs": [10, 11], "gpuPID": 10, "timestamp": "20240101-000000"}`,
+			pids:     []int{10, 11},
+		},
+		{
+			name:     "CPU only",
+			manifest: `{"pod": "p", "namespace": "n", "container": "c", "gpuPID": 0, "timestamp": "20240101-000000"}`,
+		},
+		{
+			name:     "degraded",
+			manifest: `{"containerID": "abc", "gpuPID": 10, "timestamp": "20240101-000000"}`,
+			degraded: true,
+			pids:     []int{10},
+		},
+		{
+			name:     "no timestamp",
+			manifest: `{"containerID": "abc"}`,
+			fromFile: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, size := checkpointDir(t, []byte(tt.manifest))
+			if tt.degraded {
+				if err := cuda.MarkDegraded(dir, []int{10}, errors.New("lock timed out")); err != nil {
+					t.Fatal(err)
+				}
+				size += fileSize(t, filepath.Join(dir, cuda.DegradedFile))
+			}
+
+			m, err := Read(dir)
+			if err != nil {
+				t.Fatalf("Read: %v", err)
+			}
+			if tt.pids == nil && m.GPU != nil || tt.pids != nil && (m.GPU == nil || !reflect.DeepEqual(m.GPU.PIDs, tt.pids)) {
+				t.Errorf("GPU = %+v, want PIDs %v", m.GPU, tt.pids)
+			}
+			if (m.Degraded != nil) != tt.degraded {
+				t.Errorf("degraded = %+v", m.Degraded)
+			}
+			if m.Sizes.Checkpoint != size {
+				t.Errorf("checkpoint size %d, want %d", m.Sizes.Checkpoint, size)
+			}
+			if fi, _ := os.Stat(filepath.Join(dir, FileName)); tt.fromFile != m.CreatedAt.Equal(fi.ModTime()) {
+				t.Errorf("created at %s, manifest written at %s", m.CreatedAt, fi.ModTime())
+			}
+		})
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		want     error
+	}{
+		{"newer version", `{"version": 3, "tool": "shim", "createdAt": "2024-01-01T00:00:00Z", "workload": {"containerID": "abc"}}`, ErrUnsupportedVersion},
+		{"no tool", `{"version": 2, "createdAt": "2024-01-01T00:00:00Z", "workload": {"containerID": "abc"}}`, ErrInvalid},
+		{"v1 without workload", `{"gpuPID": 10, "timestamp": "20240101-000000"}`, ErrInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, _ := checkpointDir(t, []byte(tt.manifest))
+			if _, err := Read(dir); !errors.Is(err, tt.want) {
+				t.Errorf("Read = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := Read(t.TempDir()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Read without manifest = %v, want ErrNotFound", err)
+	}
+	dir, _ := checkpointDir(t, []byte(`{"version": `))
+	if _, err := Read(dir); err == nil {
+		t.Error("Read accepted a truncated manifest")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *Manifest {
+		m := New("shim", "/ckpt")
+		m.Workload.ContainerID = "abc"
+		return m
+	}
+	tests := []struct {
+		name   string
+		modify func(m *Manifest)
+		want   error
+	}{
+		{"valid", func(m *Manifest) {}, nil},
+		{"pod without container ID", func(m *Manifest) { m.Workload = Workload{Namespace: "n", Pod: "p"} }, nil},
+		{"CPU only", func(m *Manifest) { m.GPU = nil }, nil},
+		{"no version", func(m *Manifest) { m.Version = 0 }, ErrInvalid},
+		{"newer version", func(m *Manifest) { m.Version = Version + 1 }, ErrUnsupportedVersion},
+		{"no tool", func(m *Manifest) { m.Tool = "" }, ErrInvalid},
+		{"no creation time", func(m *Manifest) { m.CreatedAt = time.Time{} }, ErrInvalid},
+		{"no workload", func(m *Manifest) { m.Workload = Workload{Image: "img"} }, ErrInvalid},
+		{"GPU without processes", func(m *Manifest) { m.GPU = &GPU{UUIDs: []string{"GPU-1"}} }, ErrInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := valid()
+			tt.modify(m)
+			err := m.Validate()
+			if tt.want == nil && err != nil || tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("Validate = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	dir, size := checkpointDir(t, nil)
+	if err := cuda.MarkDegraded(dir, []int{10}, errors.New("lock timed out")); err != nil {
+		t.Fatal(err)
+	}
+	size += fileSize(t, filepath.Join(dir, cuda.DegradedFile))
+
+	m := New("kybernate-runtime", dir)
+	m.Workload = WorkloadFromAnnotations("abc", map[string]string{
+		"io.kubernetes.cri.sandbox-namespace": "ml",
+		"io.kubernetes.cri.sandbox-name":      "trainer-0",
+		"io.kubernetes.cri.container-name":    "trainer",
+		"io.kubernetes.cri.image-name":        "registry/trainer:1",
+	})
+	m.GPU = &GPU{PIDs: []int{10}, UUIDs: []string{"GPU-1"}, Processes: []Process{{PID: 10, State: "running"}}}
+	m.Timings = Timings{CUDACheckpoint: time.Second, CRIUDump: 2 * time.Second, Total: 3 * time.Second}
+	m.Sizes.VRAM = 1 << 30
+	if err := m.Write(dir); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	got, err := Read(dir)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if got.Sizes != (Sizes{Checkpoint: size, VRAM: 1 << 30}) {
+		t.Errorf("sizes = %+v, want a checkpoint of %d bytes", got.Sizes, size)
+	}
+	if got.Degraded == nil {
+		t.Error("degradation recorded in the directory not picked up")
+	}
+	if got.Workload.String() != "ml/trainer-0/trainer" || got.Workload.Image != "registry/trainer:1" {
+		t.Errorf("workload = %+v", got.Workload)
+	}
+	if got.Timings != m.Timings || !got.CreatedAt.Equal(m.CreatedAt) || !reflect.DeepEqual(got.GPU, m.GPU) {
+		t.Errorf("read back %+v, wrote %+v", got, m)
+	}
+
+	invalid := New("", dir)
+	if err := invalid.Write(dir); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Write of an invalid manifest = %v", err)
+	}
+	if again, _ := Read(dir); again == nil || again.Tool != "kybernate-runtime" {
+		t.Error("invalid manifest replaced the valid one")
+	}
+}
@@ -0,0 +1,160 @@
+// Package mountinfo parses /proc/<pid>/mountinfo (see proc(5)).
+package mountinfo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Mount is one line of mountinfo
+type Mount struct {
+	ID       int
+	ParentID int
+	// Major and Minor identify the filesystem (st_dev of its files)
+	Major int
+	Minor int
+	// Root is the directory of the filesystem that is mounted: "/" for a
+	// mount of the whole filesystem, a subdirectory or file for a bind mount
+	Root string
+	// MountPoint is relative to the root of the reading process
+	MountPoint string
+	// Options are the per-mount options, e.g. ro, nosuid
+	Options []string
+	// Optional holds the tagged fields, e.g. shared:1 or master:2
+	Optional []string
+	FSType   string
+	// Source is filesystem specific, e.g. /dev/sda1 or tmpfs
+	Source string
+	// SuperOptions are the per-superblock options
+	SuperOptions []string
+}
+
+// Propagation returns the propagation type of the mount as the OCI
+// mount option that recreates it: shared, slave or private, and
+// unbindable for an unbindable mount
+func (m Mount) Propagation() string {
+	propagation := "private"
+	for _, f := range m.Optional {
+		switch {
+		case strings.HasPrefix(f, "shared:"):
+			propagation = "shared"
+		case strings.HasPrefix(f, "master:") && propagation != "shared":
+			propagation = "slave"
+		case f == "unbindable":
+			return "unbindable"
+		}
+	}
+	return propagation
+}
+
+// Device returns major:minor
+func (m Mount) Device() string {
+	return fmt.Sprintf("%d:%d", m.Major, m.Minor)
+}
+
+// ParseLine parses one line of mountinfo:
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+//
+// There may be any number of optional fields before the separator. Paths
+// and sources are unescaped.
+func ParseLine(line string) (Mount, error) {
+	fields := strings.Split(line, " ")
+	sep := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			sep = i
+			break
+		}
+	}
+	if len(fields) < 7 || sep < 0 || len(fields) < sep+4 {
+		return Mount{}, fmt.Errorf("malformed mountinfo line %q", line)
+	}
+
+	var m Mount
+	var err error
+	if m.ID, err = strconv.Atoi(fields[0]); err != nil {
+		return Mount{}, fmt.Errorf("mount ID in %q: %w", line, err)
+	}
+	if m.ParentID, err = strconv.Atoi(fields[1]); err != nil {
+		return Mount{}, fmt.Errorf("parent ID in %q: %w", line, err)
+	}
+	major, minor, ok := strings.Cut(fields[2], ":")
+	if !ok {
+		return Mount{}, fmt.Errorf("device in %q is not major:minor", line)
+	}
+	if m.Major, err = strconv.Atoi(major); err != nil {
+		return Mount{}, fmt.Errorf("major in %q: %w", line, err)
+	}
+	if m.Minor, err = strconv.Atoi(minor); err != nil {
+		return Mount{}, fmt.Errorf("minor in %q: %w", line, err)
+	}
+	m.Root = Unescape(fields[3])
+	m.MountPoint = Unescape(fields[4])
+	m.Options = strings.Split(fields[5], ",")
+	m.Optional = fields[6:sep]
+	m.FSType = fields[sep+1]
+	m.Source = Unescape(fields[sep+2])
+	m.SuperOptions = strings.Split(strings.Join(fields[sep+3:], " "), ",")
+	return m, nil
+}
+
+// Parse reads mountinfo from r
+func Parse(r io.Reader) ([]Mount, error) {
+	var mounts []Mount
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		m, err := ParseLine(line)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, scanner.Err()
+}
+
+// ReadFile parses the mountinfo file at path
+func ReadFile(path string) ([]Mount, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// ForPID returns the mounts in the mount namespace of pid, as seen from
+// its root
+func ForPID(pid int) ([]Mount, error) {
+	return ReadFile(fmt.Sprintf("/proc/%d/mountinfo", pid))
+}
+
+// Unescape decodes the octal escapes the kernel writes for space, tab,
+// newline and backslash (\040, \011, \012, \134)
+func Unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isOctal(s[i+1]) && isOctal(s[i+2]) && isOctal(s[i+3]) {
+			b.WriteByte((s[i+1]-'0')<<6 | (s[i+2]-'0')<<3 | (s[i+3] - '0'))
+			i += 3
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
@@ -0,0 +1,143 @@
+package mountinfo
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    Mount
+		wantErr bool
+	}{
+		{
+			name: "proc(5) example",
+			line: "36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue",
+			want: Mount{
+				ID: 36, ParentID: 35, Major: 98, Minor: 0, Root: "/mnt1", MountPoint: "/mnt2",
+				Options: []string{"rw", "noatime"}, Optional: []string{"master:1"},
+				FSType: "ext3", Source: "/dev/root", SuperOptions: []string{"rw", "errors=continue"},
+			},
+		},
+		{
+			name: "no optional fields",
+			line: "25 1 0:22 / /dev/shm rw,nosuid,nodev - tmpfs tmpfs rw",
+			want: Mount{
+				ID: 25, ParentID: 1, Major: 0, Minor: 22, Root: "/", MountPoint: "/dev/shm",
+				Options: []string{"rw", "nosuid", "nodev"}, Optional: []string{},
+				FSType: "tmpfs", Source: "tmpfs", SuperOptions: []string{"rw"},
+			},
+		},
+		{
+			name: "several optional fields",
+			line: "812 790 259:1 /usr/lib/x86_64-linux-gnu/libcuda.so.550.54.15 /usr/lib/x86_64-linux-gnu/libcuda.so.550.54.15 ro,nosuid,nodev,relatime shared:5 master:1 unbindable - ext4 /dev/nvme0n1p1 rw",
+			want: Mount{
+				ID: 812, ParentID: 790, Major: 259, Minor: 1,
+				Root: "/usr/lib/x86_64-linux-gnu/libcuda.so.550.54.15", MountPoint: "/usr/lib/x86_64-linux-gnu/libcuda.so.550.54.15",
+				Options: []string{"ro", "nosuid", "nodev", "relatime"}, Optional: []string{"shared:5", "master:1", "unbindable"},
+				FSType: "ext4", Source: "/dev/nvme0n1p1", SuperOptions: []string{"rw"},
+			},
+		},
+		{
+			name: "octal escapes",
+			line: `40 25 0:40 /my\040dir /mnt/a\011b\134c rw - fuse.sshfs user@host:/a\040b rw`,
+			want: Mount{
+				ID: 40, ParentID: 25, Major: 0, Minor: 40, Root: "/my dir", MountPoint: "/mnt/a\tb\\c",
+				Options: []string{"rw"}, Optional: []string{},
+				FSType: "fuse.sshfs", Source: "user@host:/a b", SuperOptions: []string{"rw"},
+			},
+		},
+		{
+			name: "dash as mount point is not the separator",
+			line: "41 25 0:41 / - rw - tmpfs tmpfs rw",
+			want: Mount{
+				ID: 41, ParentID: 25, Major: 0, Minor: 41, Root: "/", MountPoint: "-",
+				Options: []string{"rw"}, Optional: []string{},
+				FSType: "tmpfs", Source: "tmpfs", SuperOptions: []string{"rw"},
+			},
+		},
+		{name: "no separator", line: "36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 ext3 /dev/root rw", wantErr: true},
+		{name: "separator without source", line: "36 35 98:0 /mnt1 /mnt2 rw - ext3", wantErr: true},
+		{name: "too short", line: "36 35 98:0 /", wantErr: true},
+		{name: "bad ID", line: "x 35 98:0 / / rw - ext3 /dev/root rw", wantErr: true},
+		{name: "bad device", line: "36 35 98 / / rw - ext3 /dev/root rw", wantErr: true},
+		{name: "bad minor", line: "36 35 98:x / / rw - ext3 /dev/root rw", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLine(tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parsed %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnescape(t *testing.T) {
+	tests := map[string]string{
+		`/plain`:          "/plain",
+		`/a\040b`:         "/a b",
+		`\040`:            " ",
+		`/a\012b\134`:     "/a\nb\\",
+		`/not\08escape`:   `/not\08escape`,
+		`/short\04`:       `/short\04`,
+		`/trailing\`:      `/trailing\`,
+		`/two\040\040end`: "/two  end",
+	}
+	for in, want := range tests {
+		if got := Unescape(in); got != want {
+			t.Errorf("Unescape(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	tests := []struct {
+		optional []string
+		want     string
+	}{
+		{nil, "private"},
+		{[]string{"shared:1"}, "shared"},
+		{[]string{"master:2"}, "slave"},
+		{[]string{"shared:1", "master:2"}, "shared"},
+		{[]string{"master:2", "shared:1"}, "shared"},
+		{[]string{"shared:1", "unbindable"}, "unbindable"},
+		{[]string{"propagate_from:3", "master:2"}, "slave"},
+	}
+	for _, tt := range tests {
+		if got := (Mount{Optional: tt.optional}).Propagation(); got != tt.want {
+			t.Errorf("Propagation(%v) = %s, want %s", tt.optional, got, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	input := strings.Join([]string{
+		"22 1 259:1 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p1 rw",
+		"",
+		"23 22 0:21 / /proc rw,nosuid shared:12 - proc proc rw",
+	}, "\n")
+	mounts, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 2 || mounts[1].MountPoint != "/proc" || mounts[0].Device() != "259:1" {
+		t.Errorf("mounts = %+v", mounts)
+	}
+
+	if _, err := Parse(strings.NewReader(input + "\ngarbage")); err == nil {
+		t.Error("Parse accepted a malformed line")
+	}
+}
@@ -0,0 +1,225 @@
+// Package oplock serializes GPU checkpoint operations on a container
+// across the shim, kybernate-runtime and kybernate-ctl. Each container
+// has a lock file under a node-local state directory; holding an
+// exclusive flock on it makes a process the owner of the container's GPU
+// state until it releases the lock or exits. The file names the owner so
+// that others can report who holds it.
+package oplock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultDir holds one lock file per container
+const DefaultDir = "/var/lib/kybernate/locks"
+
+// pollInterval is how often a waiting caller retries the lock
+const pollInterval = 100 * time.Millisecond
+
+// ErrBusy is wrapped by the error returned when another process holds the
+// lock of a container
+var ErrBusy = errors.New("container is locked by another operation")
+
+// Mode decides what a caller does when the lock is held
+type Mode string
+
+const (
+	// ModeSkip returns at once with a *BusyError. Callers skip the CUDA
+	// stage if the owner already moved the VRAM and fail otherwise. This is
+	// the mode to use when the tools are stacked (shim → kybernate-runtime),
+	// where waiting would deadlock.
+	ModeSkip Mode = "skip"
+	// ModeWait retries until the lock is free or the context expires
+	ModeWait Mode = "wait"
+)
+
+// ParseMode parses "skip" or "wait"; an empty string yields def
+func ParseMode(s string, def Mode) (Mode, error) {
+	switch Mode(strings.ToLower(strings.TrimSpace(s))) {
+	case "":
+		return def, nil
+	case ModeSkip:
+		return ModeSkip, nil
+	case ModeWait:
+		return ModeWait, nil
+	}
+	return def, fmt.Errorf("invalid lock mode %q (expected %q or %q)", s, ModeSkip, ModeWait)
+}
+
+// Owner identifies the holder of a lock
+type Owner struct {
+	Tool string `json:"tool"`
+	PID  int    `json:"pid"`
+	// Op names the operation, e.g. "checkpoint" or "suspend"
+	Op    string    `json:"op"`
+	Since time.Time `json:"since"`
+	// Correlation is the correlation ID of the operation, see package logging
+	Correlation string `json:"correlation,omitempty"`
+}
+
+func (o *Owner) String() string {
+	if o == nil {
+		return "unknown owner"
+	}
+	s := fmt.Sprintf("%s of %s (PID %d) since %s", o.Op, o.Tool, o.PID, o.Since.Format(time.RFC3339))
+	if o.Correlation != "" {
+		s += fmt.Sprintf(" [correlation %s]", o.Correlation)
+	}
+	return s
+}
+
+// BusyError reports a lock held by someone else
+type BusyError struct {
+	ContainerID string
+	// Holder is nil if the owner could not be read
+	Holder *Owner
+	// Err is set if the caller gave up waiting
+	Err error
+}
+
+func (e *BusyError) Error() string {
+	msg := fmt.Sprintf("%s: %v: %s", e.ContainerID, ErrBusy, e.Holder)
+	if e.Err != nil {
+		msg += fmt.Sprintf(" (gave up waiting: %v)", e.Err)
+	}
+	return msg
+}
+
+func (e *BusyError) Unwrap() error {
+	return ErrBusy
+}
+
+// Lock is a held container lock
+type Lock struct {
+	f *os.File
+}
+
+func path(dir, containerID string) string {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return filepath.Join(dir, containerID+".lock")
+}
+
+// Acquire takes the lock of a container in dir (DefaultDir if empty) for
+// owner. The lock is released by Release or when the process exits.
+func Acquire(ctx context.Context, dir, containerID string, owner Owner, mode Mode) (*Lock, error) {
+	p := path(dir, containerID)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("lock %s: %w", p, err)
+		}
+		if mode != ModeWait {
+			f.Close()
+			return nil, &BusyError{ContainerID: containerID, Holder: readOwner(p)}
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, &BusyError{ContainerID: containerID, Holder: readOwner(p), Err: ctx.Err()}
+		case <-time.After(pollInterval):
+		}
+	}
+
+	if owner.PID == 0 {
+		owner.PID = os.Getpid()
+	}
+	if owner.Since.IsZero() {
+		owner.Since = time.Now()
+	}
+	data, _ := json.Marshal(owner)
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt(data, 0)
+	}
+	return &Lock{f: f}, nil
+}
+
+// Release gives up the lock; it is a no-op on a nil *Lock
+func (l *Lock) Release() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	_ = l.f.Truncate(0)
+	err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
+
+// Holder returns the owner of a container's lock, or nil if it is free
+func Holder(dir, containerID string) (*Owner, error) {
+	p := path(dir, containerID)
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == nil {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		return nil, nil
+	}
+	if !errors.Is(err, syscall.EWOULDBLOCK) {
+		return nil, err
+	}
+	if owner := readOwner(p); owner != nil {
+		return owner, nil
+	}
+	return &Owner{}, nil
+}
+
+func readOwner(p string) *Owner {
+	data, err := os.ReadFile(p)
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	var owner Owner
+	if err := json.Unmarshal(data, &owner); err != nil {
+		return nil
+	}
+	return &owner
+}
+
+// Annotation and environment variable selecting the lock mode
+const (
+	ModeAnnotation = "kybernate.io/lock-mode"
+	ModeEnv        = "KYBERNATE_LOCK_MODE"
+)
+
+// ModeFromEnv returns def overridden by KYBERNATE_LOCK_MODE
+func ModeFromEnv(def Mode) (Mode, error) {
+	return ParseMode(os.Getenv(ModeEnv), def)
+}
+
+// ModeFromAnnotations returns def overridden by the workload's
+// kybernate.io/lock-mode annotation
+func ModeFromAnnotations(annotations map[string]string, def Mode) (Mode, error) {
+	return ParseMode(annotations[ModeAnnotation], def)
+}
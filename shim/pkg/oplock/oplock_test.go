@@ -0,0 +1,247 @@
+package oplock
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+)
+
+// helperEnv makes the test binary hold a lock in a child process, see
+// TestHelperProcess
+const helperEnv = "OPLOCK_TEST_HELPER_DIR"
+
+// TestHelperProcess is not a test: run with helperEnv set, it takes the
+// lock of container "abc", reports "locked" and holds the lock until its
+// stdin is closed
+func TestHelperProcess(t *testing.T) {
+	dir := os.Getenv(helperEnv)
+	if dir == "" {
+		return
+	}
+	lock, err := Acquire(context.Background(), dir, "abc", Owner{Tool: "helper", Op: "checkpoint", Correlation: "ckpt-1"}, ModeSkip)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("locked")
+	bufio.NewReader(os.Stdin).ReadString('\n')
+	lock.Release()
+	os.Exit(0)
+}
+
+// holdInChild locks container "abc" in dir from another process and
+// returns the child and the function that makes it release the lock
+func holdInChild(t *testing.T, dir string) (*exec.Cmd, func()) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+	cmd.Env = append(os.Environ(), helperEnv+"="+dir)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			stdin.Close()
+			cmd.Wait()
+		})
+	}
+	t.Cleanup(release)
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != "locked\n" {
+		t.Fatalf("helper did not lock: %q, %v", line, err)
+	}
+	return cmd, release
+}
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Mode
+		wantErr bool
+	}{
+		{"", ModeWait, false},
+		{"skip", ModeSkip, false},
+		{" WAIT ", ModeWait, false},
+		{"block", ModeWait, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMode(tt.in, ModeWait)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseMode(%q) = %s, %v; want %s, error %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestAcquireRelease(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := Acquire(context.Background(), dir, "abc", Owner{Tool: "shim", Op: "checkpoint"}, ModeSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner, err := Holder(dir, "abc")
+	if err != nil || owner == nil {
+		t.Fatalf("Holder = %v, %v; want the shim", owner, err)
+	}
+	if owner.Tool != "shim" || owner.PID != os.Getpid() || owner.Since.IsZero() {
+		t.Errorf("owner = %+v", owner)
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if owner, err := Holder(dir, "abc"); err != nil || owner != nil {
+		t.Errorf("Holder after Release = %v, %v; want free", owner, err)
+	}
+	if err := lock.Release(); err != nil {
+		t.Errorf("second Release: %v", err)
+	}
+	var none *Lock
+	if err := none.Release(); err != nil {
+		t.Errorf("Release of nil lock: %v", err)
+	}
+	if owner, err := Holder(dir, "unknown"); err != nil || owner != nil {
+		t.Errorf("Holder of an unlocked container = %v, %v", owner, err)
+	}
+}
+
+func TestAcquireSkip(t *testing.T) {
+	dir := t.TempDir()
+	// Each Acquire opens its own file description, so the flocks conflict
+	// within one process as they do across processes
+	held, err := Acquire(context.Background(), dir, "abc", Owner{Tool: "kybernate-ctl", Op: "suspend", Correlation: "sus-1"}, ModeSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Release()
+
+	start := time.Now()
+	_, err = Acquire(context.Background(), dir, "abc", Owner{Tool: "shim", Op: "checkpoint"}, ModeSkip)
+	if time.Since(start) >= pollInterval {
+		t.Errorf("skip mode waited %s", time.Since(start))
+	}
+	var busy *BusyError
+	if !errors.As(err, &busy) || !errors.Is(err, ErrBusy) {
+		t.Fatalf("Acquire = %v, want a BusyError", err)
+	}
+	if busy.ContainerID != "abc" || busy.Err != nil {
+		t.Errorf("BusyError = %+v", busy)
+	}
+	if busy.Holder == nil || busy.Holder.Tool != "kybernate-ctl" || busy.Holder.Op != "suspend" || busy.Holder.Correlation != "sus-1" {
+		t.Errorf("holder = %v, want the suspend of kybernate-ctl", busy.Holder)
+	}
+
+	// Other containers are not affected
+	other, err := Acquire(context.Background(), dir, "def", Owner{Tool: "shim"}, ModeSkip)
+	if err != nil {
+		t.Fatalf("Acquire of another container: %v", err)
+	}
+	other.Release()
+}
+
+func TestAcquireWait(t *testing.T) {
+	dir := t.TempDir()
+	held, err := Acquire(context.Background(), dir, "abc", Owner{Tool: "kybernate-ctl"}, ModeSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(3 * pollInterval)
+		held.Release()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	lock, err := Acquire(ctx, dir, "abc", Owner{Tool: "shim"}, ModeWait)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer lock.Release()
+	if time.Since(start) < 2*pollInterval {
+		t.Errorf("acquired after %s, before the holder released", time.Since(start))
+	}
+	if owner, _ := Holder(dir, "abc"); owner == nil || owner.Tool != "shim" {
+		t.Errorf("holder = %v, want the shim", owner)
+	}
+}
+
+func TestAcquireWaitExpires(t *testing.T) {
+	dir := t.TempDir()
+	held, err := Acquire(context.Background(), dir, "abc", Owner{Tool: "kybernate-runtime", Op: "checkpoint"}, ModeSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*pollInterval)
+	defer cancel()
+	_, err = Acquire(ctx, dir, "abc", Owner{Tool: "shim"}, ModeWait)
+	var busy *BusyError
+	if !errors.As(err, &busy) {
+		t.Fatalf("Acquire = %v, want a BusyError", err)
+	}
+	if !errors.Is(busy.Err, context.DeadlineExceeded) {
+		t.Errorf("gave up with %v, want the deadline", busy.Err)
+	}
+	if busy.Holder == nil || busy.Holder.Tool != "kybernate-runtime" {
+		t.Errorf("holder = %v", busy.Holder)
+	}
+}
+
+func TestAcquireAcrossProcesses(t *testing.T) {
+	dir := t.TempDir()
+	child, release := holdInChild(t, dir)
+
+	_, err := Acquire(context.Background(), dir, "abc", Owner{Tool: "shim"}, ModeSkip)
+	var busy *BusyError
+	if !errors.As(err, &busy) {
+		t.Fatalf("Acquire = %v, want a BusyError", err)
+	}
+	if busy.Holder == nil || busy.Holder.PID != child.Process.Pid || busy.Holder.Correlation != "ckpt-1" {
+		t.Errorf("holder = %v, want the helper (PID %d)", busy.Holder, child.Process.Pid)
+	}
+	if owner, err := Holder(dir, "abc"); err != nil || owner == nil || owner.PID != child.Process.Pid {
+		t.Errorf("Holder = %v, %v", owner, err)
+	}
+
+	// The waiter gets the lock once the other process lets go
+	go func() {
+		time.Sleep(2 * pollInterval)
+		release()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	lock, err := Acquire(ctx, dir, "abc", Owner{Tool: "shim"}, ModeWait)
+	if err != nil {
+		t.Fatalf("Acquire after the helper released: %v", err)
+	}
+	lock.Release()
+}
+
+func TestModeOverrides(t *testing.T) {
+	t.Setenv(ModeEnv, "wait")
+	if m, err := ModeFromEnv(ModeSkip); err != nil || m != ModeWait {
+		t.Errorf("ModeFromEnv = %s, %v", m, err)
+	}
+	if m, err := ModeFromAnnotations(map[string]string{ModeAnnotation: "skip"}, ModeWait); err != nil || m != ModeSkip {
+		t.Errorf("ModeFromAnnotations = %s, %v", m, err)
+	}
+	if m, err := ModeFromAnnotations(nil, ModeWait); err != nil || m != ModeWait {
+		t.Errorf("ModeFromAnnotations without annotation = %s, %v", m, err)
+	}
+}
@@ -0,0 +1,215 @@
+// Package readiness reports the progress of the CUDA restore of a
+// container restored from a checkpoint. The shim restores the GPU state
+// in the background once the task has started, so the container runs
+// before its device memory is back. Its progress is kept in a status file
+// per container on the node and, if the workload asks for it, signalled
+// inside the container by a marker file that a readiness probe can test.
+package readiness
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultDir holds one status file per restored container
+const DefaultDir = "/var/lib/kybernate/restore"
+
+// State is the progress of a GPU restore
+type State string
+
+const (
+	// StatePending means the container was created from a checkpoint and
+	// its task has not started yet
+	StatePending State = "pending"
+	// StateRestoring means the CUDA restore is running
+	StateRestoring State = "restoring"
+	// StateReady means the GPU state is back, or there was none to restore
+	StateReady State = "ready"
+	// StateFailed means the CUDA restore failed
+	StateFailed State = "failed"
+)
+
+// Terminal reports whether the restore is over
+func (s State) Terminal() bool {
+	return s == StateReady || s == StateFailed
+}
+
+// Status describes the GPU restore of a container
+type Status struct {
+	ContainerID string `json:"containerID"`
+	State       State  `json:"state"`
+	Checkpoint  string `json:"checkpoint,omitempty"`
+	PIDs        []int  `json:"pids,omitempty"`
+	Error       string `json:"error,omitempty"`
+	// Killed is set if the task was killed because the restore failed
+	Killed bool `json:"killed,omitempty"`
+	// Duration is the time the CUDA restore took once the task was found
+	Duration  time.Duration `json:"duration,omitempty"`
+	CreatedAt time.Time     `json:"createdAt"`
+	UpdatedAt time.Time     `json:"updatedAt"`
+}
+
+func (s *Status) String() string {
+	msg := fmt.Sprintf("%s since %s", s.State, s.UpdatedAt.Format(time.RFC3339))
+	if s.Error != "" {
+		msg += ": " + s.Error
+	}
+	if s.Killed {
+		msg += " (task killed)"
+	}
+	return msg
+}
+
+// Store persists statuses as <dir>/<container-id>.json
+type Store struct {
+	Dir string
+}
+
+// NewStore returns a store in dir, or DefaultDir if dir is empty
+func NewStore(dir string) *Store {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return &Store{Dir: dir}
+}
+
+func (s *Store) path(containerID string) string {
+	return filepath.Join(s.Dir, containerID+".json")
+}
+
+// Save writes st atomically and stamps its update time
+func (s *Store) Save(st *Status) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	st.UpdatedAt = time.Now()
+	if st.CreatedAt.IsZero() {
+		st.CreatedAt = st.UpdatedAt
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path(st.ContainerID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(st.ContainerID))
+}
+
+// Load returns the status of a container, or nil if it was not restored
+func (s *Store) Load(containerID string) (*Status, error) {
+	data, err := os.ReadFile(s.path(containerID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var st Status
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("parse restore status of %s: %w", containerID, err)
+	}
+	return &st, nil
+}
+
+// Remove deletes the status of a container
+func (s *Store) Remove(containerID string) error {
+	err := os.Remove(s.path(containerID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// MarkerAnnotation names a file inside the container that is created
+// once its GPU state is restored, e.g. for an exec readiness probe
+// running `test -f <path>`
+const MarkerAnnotation = "kybernate.io/restore-ready-file"
+
+// resolve confines path resolution to the container's root: the
+// container owns the path and could point it anywhere on the node with
+// a symlink
+const resolve = unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS
+
+// WriteMarker creates the marker at path inside the root of process pid.
+// The parent directory must exist in the container.
+func WriteMarker(pid int, path string) error {
+	root, err := openRoot(pid)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(root)
+
+	fd, err := unix.Openat2(root, path, &unix.OpenHow{
+		Flags:   unix.O_WRONLY | unix.O_CREAT | unix.O_TRUNC | unix.O_NOFOLLOW | unix.O_CLOEXEC,
+		Mode:    0644,
+		Resolve: resolve,
+	})
+	if err != nil {
+		return fmt.Errorf("create marker %s: %w", path, err)
+	}
+	_, err = unix.Write(fd, []byte(time.Now().Format(time.RFC3339)+"\n"))
+	if cerr := unix.Close(fd); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// RemoveMarker deletes the marker at path inside the root of process pid.
+// A checkpoint taken after the marker was written carries it along, so it
+// has to go before the GPU state of the restored container is restored.
+func RemoveMarker(pid int, path string) error {
+	root, err := openRoot(pid)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(root)
+
+	dir, name := filepath.Split(filepath.Clean("/" + path))
+	parent, err := unix.Openat2(root, dir, &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		Resolve: resolve,
+	})
+	if err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return nil
+		}
+		return fmt.Errorf("open %s: %w", dir, err)
+	}
+	defer unix.Close(parent)
+
+	if err := unix.Unlinkat(parent, name, 0); err != nil && !errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("remove marker %s: %w", path, err)
+	}
+	return nil
+}
+
+func openRoot(pid int) (int, error) {
+	root := fmt.Sprintf("/proc/%d/root", pid)
+	fd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("open %s: %w", root, err)
+	}
+	return fd, nil
+}
+
+// MarkerFromAnnotations returns the marker path requested by a workload,
+// or "" if it did not ask for one
+func MarkerFromAnnotations(annotations map[string]string) (string, error) {
+	path := strings.TrimSpace(annotations[MarkerAnnotation])
+	if path == "" {
+		return "", nil
+	}
+	if !filepath.IsAbs(path) || filepath.Clean(path) == "/" {
+		return "", fmt.Errorf("invalid %s %q: must be an absolute file path", MarkerAnnotation, path)
+	}
+	return filepath.Clean(path), nil
+}
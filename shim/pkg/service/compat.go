@@ -0,0 +1,58 @@
+package service
+
+import (
+	"log/slog"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+
+	"github.com/kybernate/kybernate/pkg/compat"
+	"github.com/kybernate/kybernate/pkg/cuda"
+	"github.com/kybernate/kybernate/pkg/gpuenv"
+	"github.com/kybernate/kybernate/pkg/manifest"
+)
+
+// checkCompat compares this node with the one the checkpoint described by
+// meta (nil if it has no manifest) was taken on and returns an error if
+// policy refuses to restore it here. The GPUs the restored container gets
+// are those its spec makes visible, the libraries those that translation
+// (nil if none) mounts in their place.
+func checkCompat(log *slog.Logger, meta *manifest.Manifest, spec *specs.Spec, translation *gpuenv.Translation, policy compat.Policy) error {
+	if meta == nil {
+		return nil
+	}
+	if meta.Host == nil {
+		log.Info("Checkpoint records no node, skipping compatibility check")
+		return nil
+	}
+
+	if translation != nil {
+		meta.Host.MoveLibraries(translation.Moved())
+	}
+
+	target := compat.Probe()
+	if spec != nil && spec.Process != nil {
+		if all, err := cuda.ListGPUs(); err == nil {
+			if visible := cuda.VisibleGPUs(spec.Process.Env, all); visible != nil {
+				uuids := make([]string, len(visible))
+				for i, dev := range visible {
+					uuids[i] = dev.UUID
+				}
+				target.OnlyGPUs(uuids)
+			}
+		}
+	}
+
+	report := compat.Compare(meta.Host, target, meta.GPU != nil && meta.Degraded == nil)
+	for _, f := range report.Findings {
+		switch f.Level {
+		case compat.Incompatible:
+			log.Error("Node compatibility", "check", f.Component, "level", f.Level.String(), "finding", f.Message)
+		case compat.Warning:
+			log.Warn("Node compatibility", "check", f.Component, "level", f.Level.String(), "finding", f.Message)
+		default:
+			log.Debug("Node compatibility", "check", f.Component, "finding", f.Message)
+		}
+	}
+	log.Info("Node compatibility checked", "level", report.Level.String(), "policy", string(policy))
+	return report.Check(policy)
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"fmt"
+	"log/slog"
+
+	runcoptions "github.com/containerd/containerd/api/types/runc/options"
+	runtimeoptions "github.com/containerd/containerd/pkg/runtimeoptions/v1"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/kybernate/kybernate/pkg/config"
+	"github.com/kybernate/kybernate/pkg/initpid"
+	"github.com/kybernate/kybernate/pkg/journal"
+	"github.com/kybernate/kybernate/pkg/logging"
+	"github.com/kybernate/kybernate/pkg/readiness"
+	"github.com/kybernate/kybernate/pkg/suspend"
+)
+
+// applyConfig points the shim's stores, lookups and defaults at the
+// paths and settings of conf
+func (s *Service) applyConfig(conf *config.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conf = conf
+	s.suspended = suspend.NewStore(conf.SuspendDir())
+	s.journal = journal.New(conf.JournalDir())
+	s.readiness = readiness.NewStore(conf.RestoreDir())
+	s.initPIDs = initpid.NewResolver(initPIDConfig(conf))
+	s.defaults = defaultWorkloadConfig(conf)
+}
+
+// initPIDConfig looks for init PIDs where conf's containerd and runc keep
+// their state, before the built-in locations
+func initPIDConfig(conf *config.Config) initpid.Config {
+	cfg := initpid.Config{
+		TaskDirs:        append([]string{conf.TaskDir()}, initpid.DefaultTaskDirs...),
+		RuntimeRoots:    append([]string{conf.RuncRoot()}, initpid.DefaultRuntimeRoots...),
+		RuntimeBinaries: []string{conf.Runtime.Runc},
+	}
+	if conf.Runtime.Nvidia != "" {
+		cfg.RuntimeBinaries = append(cfg.RuntimeBinaries, conf.Runtime.Nvidia)
+	}
+	cfg.RuntimeBinaries = uniq(append(cfg.RuntimeBinaries, initpid.DefaultRuntimeBinaries...))
+	cfg.TaskDirs = uniq(cfg.TaskDirs)
+	cfg.RuntimeRoots = uniq(cfg.RuntimeRoots)
+	return cfg
+}
+
+// uniq drops repeated strings, keeping the first of each
+func uniq(list []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, v := range list {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// config returns the shim's configuration
+func (s *Service) config() *config.Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conf
+}
+
+// runtimeOptions reads the runtime options containerd passes to Create.
+// CRI hands the options table of a runtime other than runc over as
+// runtimeoptions.Options; its ConfigPath names the shim's configuration
+// file, which is loaded for the first container. The options are
+// returned as runc options for the runc shim, with the runc binary and
+// root of the configuration unless they set their own.
+func (s *Service) runtimeOptions(log *slog.Logger, opts *anypb.Any) (*runcoptions.Options, error) {
+	s.configureOnce.Do(func() {
+		path := ""
+		if opts != nil {
+			if v, err := opts.UnmarshalNew(); err == nil {
+				if o, ok := v.(*runtimeoptions.Options); ok {
+					path = o.ConfigPath
+					if path == "" && len(o.ConfigBody) > 0 {
+						log.Warn("Ignoring inline runtime options, set ConfigPath to the configuration file")
+					}
+				}
+			}
+		}
+		s.configPath = path
+		if path != "" && path != s.config().Source {
+			conf, err := config.Load(path)
+			if err != nil {
+				log.Error("Invalid configuration, keeping the current one", logging.Err(err))
+			} else {
+				s.applyConfig(conf)
+				setupLogging(conf)
+				logger.Info("Configuration loaded from runtime options", conf.Attrs()...)
+			}
+		}
+		if s.cudaCheckpointer != nil && s.config().Features.Reconcile {
+			go s.reconcile()
+		}
+	})
+
+	conf := s.config()
+	runc := &runcoptions.Options{}
+	if opts != nil {
+		v, err := opts.UnmarshalNew()
+		if err != nil {
+			return nil, fmt.Errorf("invalid runtime options: %w", err)
+		}
+		switch o := v.(type) {
+		case *runcoptions.Options:
+			runc = o
+		case *runtimeoptions.Options:
+			if o.ConfigPath != s.configPath {
+				log.Warn("Ignoring configuration of a later container, the shim keeps the one of its first", "config", o.ConfigPath, "current", s.configPath)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported runtime options %s", opts.GetTypeUrl())
+		}
+	}
+	if runc.BinaryName == "" {
+		runc.BinaryName = conf.Runtime.Runc
+	}
+	if runc.Root == "" {
+		runc.Root = conf.Runtime.Root
+	}
+	if conf.Runtime.SystemdCgroup {
+		runc.SystemdCgroup = true
+	}
+	return runc, nil
+}
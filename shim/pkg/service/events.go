@@ -0,0 +1,50 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/containerd/typeurl/v2"
+
+	"github.com/kybernate/kybernate/pkg/logging"
+)
+
+// Topics of the GPU events published through containerd
+const (
+	TopicGPUSuspended     = "/kybernate/gpu/suspended"
+	TopicGPUResumed       = "/kybernate/gpu/resumed"
+	TopicGPUSuspendFailed = "/kybernate/gpu/suspend-failed"
+	TopicGPUResumeFailed  = "/kybernate/gpu/resume-failed"
+	// TopicGPURestored and TopicGPURestoreFailed report the end of the
+	// background GPU restore of a container created from a checkpoint
+	TopicGPURestored      = "/kybernate/gpu/restored"
+	TopicGPURestoreFailed = "/kybernate/gpu/restore-failed"
+	// TopicGPUCleanup reports locked or checkpointed CUDA processes that
+	// were released before teardown
+	TopicGPUCleanup = "/kybernate/gpu/cleanup"
+)
+
+// GPUEvent reports a change of the GPU state of a container. It is
+// encoded as JSON in the event envelope.
+type GPUEvent struct {
+	ContainerID string        `json:"containerID"`
+	Reason      string        `json:"reason,omitempty"`
+	PIDs        []int         `json:"pids,omitempty"`
+	VRAMBytes   int64         `json:"vramBytes,omitempty"`
+	Duration    time.Duration `json:"duration,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+func init() {
+	typeurl.Register(&GPUEvent{}, "kybernate.io", "events", "GPUEvent")
+}
+
+// publish sends a GPU event to containerd; failures are only logged
+func (s *Service) publish(ctx context.Context, topic string, event *GPUEvent) {
+	if s.publisher == nil {
+		return
+	}
+	if err := s.publisher.Publish(ctx, topic, event); err != nil {
+		s.logFor(event.ContainerID).Warn("Failed to publish event", "topic", topic, logging.Err(err))
+	}
+}
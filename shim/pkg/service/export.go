@@ -0,0 +1,46 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kybernate/kybernate/pkg/export"
+	"github.com/kybernate/kybernate/pkg/logging"
+)
+
+// exportCheckpoint hands the checkpoint in dir on as the workload's
+// exporter says. A failed export is only logged; the checkpoint stands.
+func (s *Service) exportCheckpoint(ctx context.Context, log *slog.Logger, dir string, workload workloadConfig) {
+	if workload.export.Kind == export.KindNone {
+		return
+	}
+	start := time.Now()
+	dest, err := export.New(workload.export).Export(ctx, dir, workload.identity)
+	if err != nil {
+		log.Error("Checkpoint export failed", "export", workload.export.String(), logging.Err(err))
+		return
+	}
+	log.Info("Checkpoint exported", "export", workload.export.String(), "destination", dest, logging.KeyDuration, time.Since(start))
+}
+
+// debugDump keeps data as <dir>/<id>-<name> in the debug directory, if
+// debugging is enabled
+func (s *Service) debugDump(log *slog.Logger, id, name string, data []byte) {
+	debug := s.config().Debug
+	if !debug.Enabled {
+		return
+	}
+	path := filepath.Join(debug.Dir, id+"-"+name)
+	err := os.MkdirAll(debug.Dir, 0700)
+	if err == nil {
+		err = os.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		log.Warn("Failed to write debug copy", "file", path, logging.Err(err))
+		return
+	}
+	log.Debug("Wrote debug copy", "file", path)
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/kybernate/kybernate/pkg/journal"
+	"github.com/kybernate/kybernate/pkg/logging"
+)
+
+// reconcile closes checkpoints left open by a crashed shim, runtime
+// wrapper or kybernate-ctl: their processes are brought back to running
+func (s *Service) reconcile() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.defaults.timeouts.Restore)
+	defer cancel()
+
+	results, err := journal.Reconcile(ctx, s.cudaCheckpointer, s.journal, "shim")
+	if err != nil {
+		logger.Error("Journal reconcile failed", logging.Err(err))
+		return
+	}
+	for _, r := range results {
+		logger.Info("Journal reconcile", "result", r.String())
+	}
+}
+
+// record appends stage to the journal of op; failures are only logged
+func (s *Service) record(op *journal.Operation, stage journal.Stage, cause error) {
+	if err := op.Record(stage, cause); err != nil {
+		s.logFor(op.ContainerID).Warn("Failed to journal stage", logging.KeyStage, stage, logging.Err(err))
+	}
+}
+
+// rollback brings pids of container id back to running after a failed
+// stage and journals it in op. If a process cannot be released, the
+// operation stays open for the next reconcile.
+func (s *Service) rollback(id string, pids []int, op *journal.Operation, cause error) {
+	if s.releaseAll(id, pids) == nil {
+		s.record(op, journal.StageRolledBack, cause)
+	}
+}
+
+// resumeSource gives the processes of op their device memory back after
+// a dump that left the container running, and returns how long they were
+// checkpointed, or zero if they could not be resumed
+func (s *Service) resumeSource(ctx context.Context, id string, op *journal.Operation) time.Duration {
+	if err := s.releaseAll(id, op.PIDs); err != nil {
+		s.logFor(id).Error("Failed to resume GPU processes after checkpoint", logging.KeyPIDs, op.PIDs, logging.Err(err))
+		s.publish(ctx, TopicGPUResumeFailed, &GPUEvent{ContainerID: id, Reason: "checkpoint", PIDs: op.PIDs, Error: err.Error()})
+		return 0
+	}
+
+	latency := op.SinceCheckpoint()
+	s.record(op, journal.StageResumed, nil)
+	s.logFor(id).Info("Resumed GPU processes after checkpoint", logging.KeyPIDs, op.PIDs, "snapshotToResume", latency)
+	s.publish(ctx, TopicGPUResumed, &GPUEvent{ContainerID: id, Reason: "checkpoint", PIDs: op.PIDs, Duration: latency})
+	return latency
+}
+
+// releaseAll brings the locked or checkpointed processes among pids of
+// container id back to running
+func (s *Service) releaseAll(id string, pids []int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.workloadFor(id).timeouts.Restore)
+	defer cancel()
+
+	log := s.logFor(id)
+	var failed []string
+	for _, r := range s.cudaCheckpointer.Release(ctx, pids) {
+		if r.Err != nil {
+			log.Error("Failed to restore CUDA process", logging.KeyPID, r.PID, "state", r.From, logging.Err(r.Err))
+			failed = append(failed, fmt.Sprintf("PID %d: %v", r.PID, r.Err))
+			continue
+		}
+		log.Info("Restored CUDA process", logging.KeyPID, r.PID, "state", r.From)
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
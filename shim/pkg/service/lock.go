@@ -0,0 +1,26 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"github.com/kybernate/kybernate/pkg/cuda"
+	"github.com/kybernate/kybernate/pkg/oplock"
+)
+
+// acquire takes the node-wide lock of container id for op, recording its
+// correlation ID. In wait mode it waits at most the workload's checkpoint
+// timeout.
+func (s *Service) acquire(ctx context.Context, id, op, correlation string, workload workloadConfig) (*oplock.Lock, error) {
+	ctx, cancel := context.WithTimeout(ctx, workload.timeouts.Checkpoint)
+	defer cancel()
+	return oplock.Acquire(ctx, s.config().LockDir(), id, oplock.Owner{Tool: "shim", Op: op, Correlation: correlation}, workload.lockMode)
+}
+
+// vramMoved reports whether a busy lock can be skipped: in skip mode,
+// when the owner already moved the VRAM of pids, i.e. none of them is
+// still running
+func (s *Service) vramMoved(err error, workload workloadConfig, pids []int) bool {
+	return workload.lockMode == oplock.ModeSkip && errors.Is(err, oplock.ErrBusy) &&
+		len(s.cudaCheckpointer.ProcessesInState(pids, cuda.StateRunning)) == 0
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"log/slog"
+
+	"github.com/kybernate/kybernate/pkg/config"
+	"github.com/kybernate/kybernate/pkg/logging"
+)
+
+// tool names the shim's log file
+const tool = "kybernate-shim"
+
+// logger is the shim's logger; New configures it from the configuration
+// and the environment
+var logger = logging.Discard
+
+// setupLogging configures logger from conf and the KYBERNATE_LOG_*
+// variables
+func setupLogging(conf *config.Config) {
+	def, confErr := conf.Logging(tool, logging.Config{
+		Level:      slog.LevelInfo,
+		Output:     logging.OutputFile,
+		Format:     logging.FormatText,
+		MaxSize:    logging.DefaultMaxSize,
+		MaxBackups: logging.DefaultMaxBackups,
+	})
+	cfg, cfgErr := logging.ConfigFromEnv(def)
+	l, _, err := logging.New(cfg, "shim", config.FallbackLogFile(tool))
+	logger = l
+	if confErr != nil {
+		logger.Warn("Invalid log configuration", logging.Err(confErr))
+	}
+	if cfgErr != nil {
+		logger.Warn("Invalid log configuration", logging.Err(cfgErr))
+	}
+	if err != nil {
+		logger.Warn("Cannot open log file, logging to stderr", logging.Err(err))
+	}
+}
+
+// correlation returns the correlation ID of container id, or a new one
+// for a container this shim did not create
+func (s *Service) correlation(id string) string {
+	s.mu.Lock()
+	cfg, ok := s.workloads[id]
+	s.mu.Unlock()
+	if ok && cfg.correlation != "" {
+		return cfg.correlation
+	}
+	return logging.NewCorrelationID()
+}
+
+// logFor returns the logger for container id
+func (s *Service) logFor(id string) *slog.Logger {
+	return containerLogger(id, s.correlation(id))
+}
+
+// containerLogger returns the logger for an operation on container id
+func containerLogger(id, correlation string) *slog.Logger {
+	return logger.With(logging.KeyContainer, id, logging.KeyCorrelation, correlation)
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+
+	"github.com/kybernate/kybernate/pkg/gpuenv"
+	"github.com/kybernate/kybernate/pkg/logging"
+)
+
+// captureNvidiaEnv records the NVIDIA mounts, devices and device rules of
+// the container whose init process is pid in the checkpoint directory
+// and returns them, or nil if they could not be captured
+func (s *Service) captureNvidiaEnv(log *slog.Logger, pid int, dir string) *gpuenv.Environment {
+	env, err := gpuenv.Capture(pid, s.nvidiaRules)
+	if err != nil {
+		log.Warn("Failed to capture NVIDIA environment", logging.KeyPID, pid, logging.Err(err))
+		return nil
+	}
+	for _, skipped := range env.Skipped {
+		log.Debug("NVIDIA mount not recorded", "mount", skipped)
+	}
+	if env.Empty() {
+		return env
+	}
+	log.Info("Found NVIDIA environment", "mounts", len(env.Mounts), "devices", len(env.Devices))
+	if err := env.Write(dir); err != nil {
+		log.Warn("Failed to write NVIDIA environment", "file", gpuenv.FileName, logging.Err(err))
+	}
+	return env
+}
+
+// restoreNvidiaEnv adds the NVIDIA environment recorded in checkpoint to
+// spec, writes it back to the bundle and creates the mount targets in the
+// root filesystem. Mounts are first translated to the driver installation
+// of this node; if one has no counterpart, the spec is left alone and the
+// restore fails before CRIU runs into the missing file.
+func (s *Service) restoreNvidiaEnv(log *slog.Logger, bundle string, spec *specs.Spec, checkpoint string) (*gpuenv.Translation, error) {
+	env, err := gpuenv.Read(checkpoint)
+	if err != nil {
+		log.Warn("Failed to read NVIDIA environment of checkpoint", logging.Err(err))
+		return nil, nil
+	}
+	if env == nil {
+		return nil, nil
+	}
+
+	translated, translation := gpuenv.NewTranslator().Translate(env)
+	if translation.From != translation.To {
+		log.Info("Translating NVIDIA mounts to the driver of this node", "from", translation.From, "to", translation.To)
+	}
+	for _, m := range translation.Mappings {
+		switch {
+		case m.Source == "":
+			log.Error("NVIDIA mount", "mapping", m.String())
+		case m.Method == gpuenv.MethodUnchanged:
+			log.Debug("NVIDIA mount", "mapping", m.String())
+		default:
+			log.Info("NVIDIA mount", "mapping", m.String())
+		}
+	}
+	if err := translation.Err(); err != nil {
+		return translation, err
+	}
+
+	applied := translated.Apply(spec)
+	log.Info("Injected NVIDIA environment from checkpoint", "applied", applied.String())
+
+	configPath := filepath.Join(bundle, "config.json")
+	newData, err := json.Marshal(spec)
+	if err != nil {
+		log.Error("Failed to marshal config.json", logging.Err(err))
+		return translation, nil
+	}
+	if err := os.WriteFile(configPath, newData, 0644); err != nil {
+		log.Error("Failed to write updated config.json", logging.Err(err))
+		return translation, nil
+	}
+	log.Debug("Updated config.json with the NVIDIA environment")
+	s.debugDump(log, filepath.Base(bundle), "restore-config.json", newData)
+
+	if err := translated.PrepareRootfs(filepath.Join(bundle, "rootfs")); err != nil {
+		log.Warn("Failed to prepare NVIDIA mount targets", logging.Err(err))
+	}
+	return translation, nil
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	task "github.com/containerd/containerd/api/runtime/task/v2"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/kybernate/kybernate/pkg/cgroup"
+	"github.com/kybernate/kybernate/pkg/cuda"
+	"github.com/kybernate/kybernate/pkg/logging"
+	"github.com/kybernate/kybernate/pkg/suspend"
+)
+
+// Pause suspends the GPU state of the task before runc freezes it, so a
+// paused GPU container no longer holds device memory. The CUDA processes
+// are checkpointed in place while still running, because locking waits
+// for their outstanding GPU work.
+func (s *Service) Pause(ctx context.Context, req *task.PauseRequest) (*emptypb.Empty, error) {
+	s.logFor(req.ID).Debug("Pause called")
+
+	suspended := s.suspendGPU(ctx, req.ID)
+
+	resp, err := s.Shim.Pause(ctx, req)
+	if err != nil && suspended {
+		// The task keeps running, so it needs its device memory back
+		s.logFor(req.ID).Error("Pause failed, resuming GPU state", logging.Err(err))
+		s.resumeGPU(ctx, req.ID)
+	}
+	return resp, err
+}
+
+// Resume thaws the task and restores its GPU state. The processes stay
+// locked until their device memory is back, so the workload cannot issue
+// GPU work before that even though its threads already run. If the
+// restore fails, the task is paused again.
+func (s *Service) Resume(ctx context.Context, req *task.ResumeRequest) (*emptypb.Empty, error) {
+	s.logFor(req.ID).Debug("Resume called")
+
+	resp, err := s.Shim.Resume(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+
+	if err := s.resumeGPU(ctx, req.ID); err != nil {
+		if _, perr := s.Shim.Pause(ctx, &task.PauseRequest{ID: req.ID}); perr != nil {
+			s.logFor(req.ID).Error("Failed to pause again after failed GPU resume", logging.Err(perr))
+		}
+		return nil, fmt.Errorf("resume GPU state of %s: %w", req.ID, err)
+	}
+	return resp, nil
+}
+
+// suspendGPU checkpoints the CUDA processes of container id in place and
+// reports whether it did. Failures leave the processes running and do not
+// prevent the pause.
+func (s *Service) suspendGPU(ctx context.Context, id string) bool {
+	if s.cudaCheckpointer == nil {
+		return false
+	}
+	log := s.logFor(id)
+	workload := s.workloadFor(id)
+	if !workload.suspendOnPause {
+		log.Debug("GPU suspend on pause disabled")
+		return false
+	}
+
+	taskPID := s.getTaskPID(id)
+	if taskPID <= 0 {
+		return false
+	}
+	pids, err := cuda.FindGPUProcessesAmong(cuda.ContainerProcesses(id, taskPID))
+	if err != nil {
+		log.Warn("GPU process discovery failed", logging.Err(err))
+	}
+	pids = s.cudaCheckpointer.ProcessesInState(pids, cuda.StateRunning)
+	if len(pids) == 0 {
+		return false
+	}
+
+	lock, err := s.acquire(ctx, id, "suspend", s.correlation(id), workload)
+	if err != nil {
+		log.Warn("Not suspending GPU state, pausing with VRAM allocated", logging.Err(err))
+		return false
+	}
+	defer lock.Release()
+
+	log.Info("Suspending GPU processes (VRAM → RAM)", logging.KeyPIDs, pids)
+	start := time.Now()
+	rec := &suspend.Record{ContainerID: id, Source: "shim"}
+	opts := suspend.Options{Offload: workload.offload, Timeouts: workload.timeouts}
+	err = suspend.Suspend(ctx, s.cudaCheckpointer, s.suspended, rec, pids, opts)
+	if err != nil {
+		if errors.Is(err, suspend.ErrAlreadySuspended) {
+			log.Info("GPU state is already suspended")
+			return false
+		}
+		log.Error("GPU suspend failed, pausing with VRAM allocated", logging.KeyPIDs, pids, logging.Err(err))
+		s.publish(ctx, TopicGPUSuspendFailed, &GPUEvent{ContainerID: id, PIDs: pids, Error: err.Error()})
+		return false
+	}
+
+	elapsed := time.Since(start)
+	log.Info("GPU suspend successful", logging.KeyPIDs, pids, logging.KeyDuration, elapsed, "vramFreed", cgroup.FormatBytes(rec.VRAMBytes))
+	s.publish(ctx, TopicGPUSuspended, &GPUEvent{ContainerID: id, PIDs: pids, VRAMBytes: rec.VRAMBytes, Duration: elapsed})
+	return true
+}
+
+// resumeGPU restores the GPU state of container id if it was suspended
+func (s *Service) resumeGPU(ctx context.Context, id string) error {
+	if s.cudaCheckpointer == nil {
+		return nil
+	}
+
+	if rec, err := s.suspended.Load(id); err == nil && rec == nil {
+		return nil
+	}
+
+	log := s.logFor(id)
+	workload := s.workloadFor(id)
+	lock, err := s.acquire(ctx, id, "resume", s.correlation(id), workload)
+	if err != nil {
+		log.Error("Cannot resume GPU state", logging.Err(err))
+		return err
+	}
+	defer lock.Release()
+
+	start := time.Now()
+	rec, err := suspend.Resume(ctx, s.cudaCheckpointer, s.suspended, id, suspend.Options{Timeouts: workload.timeouts})
+	if errors.Is(err, suspend.ErrNotSuspended) {
+		return nil
+	}
+	if err != nil {
+		log.Error("GPU resume failed, processes left checkpointed", logging.Err(err))
+		event := &GPUEvent{ContainerID: id, Error: err.Error()}
+		if rec != nil {
+			event.PIDs = rec.PIDs
+		}
+		s.publish(ctx, TopicGPUResumeFailed, event)
+		return err
+	}
+
+	elapsed := time.Since(start)
+	if rec.ReleaseError != "" {
+		log.Warn("Memory limit not restored", logging.KeyError, rec.ReleaseError)
+	}
+	log.Info("GPU resume successful, VRAM restored", logging.KeyPIDs, rec.PIDs, logging.KeyDuration, elapsed)
+	s.publish(ctx, TopicGPUResumed, &GPUEvent{ContainerID: id, PIDs: rec.PIDs, VRAMBytes: rec.VRAMBytes, Duration: elapsed})
+	return nil
+}
@@ -0,0 +1,253 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"syscall"
+	"time"
+
+	task "github.com/containerd/containerd/api/runtime/task/v2"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+
+	"github.com/kybernate/kybernate/pkg/cuda"
+	"github.com/kybernate/kybernate/pkg/initpid"
+	"github.com/kybernate/kybernate/pkg/logging"
+	"github.com/kybernate/kybernate/pkg/readiness"
+)
+
+// errInitPIDNotFound is the failure of a restore whose task never showed up
+var errInitPIDNotFound = errors.New("init PID of the restored task not found")
+
+// initPIDTimeout bounds the search for the init process of a restored task
+const initPIDTimeout = 15 * time.Second
+
+// restoreJob is the CUDA restore of a container created from a
+// checkpoint. It is queued by Create and runs in the background once
+// Start has brought the task up.
+type restoreJob struct {
+	id         string
+	checkpoint string
+	bundle     string
+	spec       *specs.Spec
+	// candidates are the IDs the task may be known by to the runtime
+	candidates []string
+	status     *readiness.Status
+	log        *slog.Logger
+
+	cancel context.CancelFunc
+	// done is closed when the worker exits; nil until it started
+	done chan struct{}
+}
+
+// Start starts the task. For a container created from a checkpoint, runc
+// restores the process here, so this is where the restore of its GPU
+// state begins. It runs in the background: the task is reported started
+// while its device memory is still coming back.
+func (s *Service) Start(ctx context.Context, req *task.StartRequest) (*task.StartResponse, error) {
+	resp, err := s.Shim.Start(ctx, req)
+	if req.ExecID != "" {
+		return resp, err
+	}
+	if err != nil {
+		s.abandonRestore(req.ID, err)
+		return resp, err
+	}
+	s.startRestore(req.ID, int(resp.Pid))
+	return resp, nil
+}
+
+// queueRestore records that the GPU state of container id has to be
+// restored from checkpoint once its task starts
+func (s *Service) queueRestore(id, checkpoint, bundle string, candidates []string, spec *specs.Spec) {
+	job := &restoreJob{
+		id:         id,
+		checkpoint: checkpoint,
+		bundle:     bundle,
+		spec:       spec,
+		candidates: candidates,
+		status:     &readiness.Status{ContainerID: id, State: readiness.StatePending, Checkpoint: checkpoint},
+		log:        s.logFor(id),
+	}
+	s.mu.Lock()
+	s.restores[id] = job
+	s.mu.Unlock()
+	s.saveStatus(job.status)
+}
+
+// startRestore runs the queued restore of container id, whose init
+// process is pid (0 if unknown). A restore that already runs is left alone.
+func (s *Service) startRestore(id string, pid int) {
+	s.mu.Lock()
+	job := s.restores[id]
+	if job == nil || job.done != nil {
+		s.mu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	job.cancel = cancel
+	job.done = make(chan struct{})
+	s.mu.Unlock()
+
+	go s.runRestore(ctx, job, pid)
+}
+
+// abandonRestore marks the queued restore of a task that failed to start
+func (s *Service) abandonRestore(id string, cause error) {
+	s.mu.Lock()
+	job := s.restores[id]
+	started := job != nil && job.done != nil
+	s.mu.Unlock()
+	if job == nil || started {
+		return
+	}
+	job.status.State = readiness.StateFailed
+	job.status.Error = fmt.Sprintf("task failed to start: %v", cause)
+	s.saveStatus(job.status)
+}
+
+// stopRestore cancels the restore of container id and waits for the
+// worker to exit, at most until ctx expires
+func (s *Service) stopRestore(ctx context.Context, id string) {
+	s.mu.Lock()
+	var cancel context.CancelFunc
+	var done chan struct{}
+	if job := s.restores[id]; job != nil {
+		cancel, done = job.cancel, job.done
+	}
+	s.mu.Unlock()
+	if done == nil {
+		return
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.logFor(id).Warn("Gave up waiting for the GPU restore to stop", logging.Err(ctx.Err()))
+	}
+}
+
+// runRestore restores the checkpointed CUDA processes of a started task.
+// A restore that fails under the fail-closed policy kills the task.
+func (s *Service) runRestore(ctx context.Context, job *restoreJob, pid int) {
+	defer close(job.done)
+	workload := s.workloadFor(job.id)
+
+	job.status.State = readiness.StateRestoring
+	s.saveStatus(job.status)
+	job.log.Info("Checking for GPU processes to restore", "checkpoint", job.checkpoint)
+
+	if pid <= 0 {
+		pid = s.resolveInitPID(ctx, job)
+	}
+	if pid <= 0 {
+		if ctx.Err() != nil {
+			s.cancelRestore(job)
+			return
+		}
+		s.failRestore(job, nil, errInitPIDNotFound, workload.failurePolicy)
+		return
+	}
+
+	// A marker carried along by the checkpoint is stale until the restore is done
+	if workload.restoreMarker != "" {
+		if err := readiness.RemoveMarker(pid, workload.restoreMarker); err != nil {
+			job.log.Warn("Failed to remove readiness marker", logging.Err(err))
+		}
+	}
+
+	// Checkpointed processes hold no device memory, so discovery does not
+	// list them; ask the driver about every process of the container instead
+	pids := s.cudaCheckpointer.ProcessesInState(cuda.ContainerProcesses(job.id, pid), cuda.StateCheckpointed)
+	if len(pids) == 0 {
+		job.log.Info("No checkpointed CUDA process found", logging.KeyPID, pid)
+		s.readyRestore(job, pid, workload)
+		return
+	}
+	job.status.PIDs = pids
+
+	job.log.Info("Found checkpointed processes, performing CUDA restore", logging.KeyPIDs, pids)
+	restoreCtx, cancel := context.WithTimeout(ctx, workload.timeouts.Restore)
+	start := time.Now()
+	err := s.restoreGPUProcesses(restoreCtx, job.log, pids, job.checkpoint, job.spec)
+	cancel()
+	job.status.Duration = time.Since(start)
+	switch {
+	case err != nil && ctx.Err() != nil:
+		// Torn down meanwhile; Kill and Delete release what is left
+		s.cancelRestore(job)
+	case err != nil:
+		s.failRestore(job, pids, err, workload.failurePolicy)
+	default:
+		job.log.Info("CUDA restore successful, VRAM restored", logging.KeyStage, "cuda-restore", logging.KeyPIDs, pids, logging.KeyDuration, job.status.Duration)
+		s.readyRestore(job, pid, workload)
+	}
+}
+
+// readyRestore reports the GPU state of a restored task as back
+func (s *Service) readyRestore(job *restoreJob, pid int, workload workloadConfig) {
+	job.status.State = readiness.StateReady
+	s.saveStatus(job.status)
+	if workload.restoreMarker != "" {
+		if err := readiness.WriteMarker(pid, workload.restoreMarker); err != nil {
+			job.log.Warn("Failed to write readiness marker", logging.Err(err))
+		}
+	}
+	s.publish(context.Background(), TopicGPURestored, &GPUEvent{ContainerID: job.id, Reason: "restore", PIDs: job.status.PIDs, Duration: job.status.Duration})
+}
+
+// failRestore reports a failed restore. Under the fail-closed policy the
+// task is killed, as it cannot run without its GPU state; otherwise its
+// processes are left checkpointed.
+func (s *Service) failRestore(job *restoreJob, pids []int, cause error, policy cuda.FailurePolicy) {
+	ctx := context.Background()
+	job.status.State = readiness.StateFailed
+	job.status.Error = cause.Error()
+
+	if policy == cuda.PolicyFailClosed {
+		job.log.Error("CUDA restore failed, killing container", logging.KeyStage, "cuda-restore", logging.KeyPIDs, pids, "policy", policy, logging.Err(cause))
+		// The processes must be unlocked before they can exit
+		s.releaseGPU(ctx, job.id, "", "restore")
+		if _, err := s.Shim.Kill(ctx, &task.KillRequest{ID: job.id, Signal: uint32(syscall.SIGKILL), All: true}); err != nil {
+			job.log.Error("Failed to kill container", logging.Err(err))
+		} else {
+			job.status.Killed = true
+		}
+	} else {
+		job.log.Error("CUDA restore failed, all processes left checkpointed", logging.KeyStage, "cuda-restore", logging.KeyPIDs, pids, logging.Err(cause))
+	}
+
+	s.saveStatus(job.status)
+	s.publish(ctx, TopicGPURestoreFailed, &GPUEvent{ContainerID: job.id, Reason: "restore", PIDs: pids, Error: cause.Error()})
+}
+
+// cancelRestore records a restore stopped by the teardown of its task
+func (s *Service) cancelRestore(job *restoreJob) {
+	job.log.Info("GPU restore cancelled")
+	job.status.State = readiness.StateFailed
+	job.status.Error = "cancelled by task teardown"
+	s.saveStatus(job.status)
+}
+
+func (s *Service) saveStatus(st *readiness.Status) {
+	if err := s.readiness.Save(st); err != nil {
+		s.logFor(st.ContainerID).Warn("Failed to save restore status", logging.Err(err))
+	}
+}
+
+// resolveInitPID finds the init process of a restored task that Start
+// did not report, for up to initPIDTimeout or until ctx is done
+func (s *Service) resolveInitPID(ctx context.Context, job *restoreJob) int {
+	job.log.Info("Init PID unknown, resolving it", "bundle", job.bundle)
+
+	ctx, cancel := context.WithTimeout(ctx, initPIDTimeout)
+	defer cancel()
+	res, err := s.initPIDs.Resolve(ctx, initpid.Request{IDs: job.candidates, Bundle: job.bundle})
+	if err != nil {
+		job.log.Error("Failed to resolve init PID", logging.Err(err))
+		return 0
+	}
+	job.log.Info("Resolved init PID", logging.KeyPID, res.PID, "resolution", res.String())
+	return res.PID
+}
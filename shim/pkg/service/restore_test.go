@@ -0,0 +1,155 @@
+package service
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	task "github.com/containerd/containerd/api/runtime/task/v2"
+
+	"github.com/kybernate/kybernate/pkg/cuda"
+	"github.com/kybernate/kybernate/pkg/initpid"
+	"github.com/kybernate/kybernate/pkg/readiness"
+)
+
+// gatedPID resolves the init PID of a restored task only once released,
+// holding its restore in the restoring state until then
+type gatedPID struct {
+	pid     int
+	reached chan struct{}
+	release chan struct{}
+}
+
+func (g *gatedPID) Name() string { return "gated" }
+
+func (g *gatedPID) Resolve(ctx context.Context, req initpid.Request) (int, error) {
+	close(g.reached)
+	select {
+	case <-g.release:
+		return g.pid, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (n *simNode) readiness(id string) *readiness.Status {
+	n.t.Helper()
+	st, err := n.svc.readiness.Load(id)
+	if err != nil {
+		n.t.Fatalf("readiness of %s: %v", id, err)
+	}
+	return st
+}
+
+// waitRestore waits for the restore worker of container id to exit
+func (n *simNode) waitRestore(id string) {
+	n.t.Helper()
+	n.svc.mu.Lock()
+	job := n.svc.restores[id]
+	n.svc.mu.Unlock()
+	if job == nil || job.done == nil {
+		n.t.Fatalf("no restore started for %s", id)
+	}
+	select {
+	case <-job.done:
+	case <-time.After(10 * time.Second):
+		n.t.Fatal("restore did not finish")
+	}
+}
+
+func TestRestoreReadiness(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     cuda.FailurePolicy
+		failCUDA   bool
+		want       readiness.State
+		wantKilled bool
+		wantSim    cuda.ProcessState
+	}{
+		{
+			name:    "restored",
+			policy:  cuda.PolicyBestEffort,
+			want:    readiness.StateReady,
+			wantSim: cuda.StateRunning,
+		},
+		{
+			name:       "fail-closed kills the task",
+			policy:     cuda.PolicyFailClosed,
+			failCUDA:   true,
+			want:       readiness.StateFailed,
+			wantKilled: true,
+			// Released before the kill, so the process can exit
+			wantSim: cuda.StateRunning,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newSimNode(t)
+			n.create(testContainer, nil)
+			dir, err := n.checkpoint(testContainer, true)
+			if err != nil {
+				t.Fatalf("Checkpoint: %v", err)
+			}
+			n.expectState(cuda.StateCheckpointed)
+
+			// The runtime reports no PID, the restore has to resolve it
+			n.runtime.pid = 0
+			gate := &gatedPID{pid: n.pid, reached: make(chan struct{}), release: make(chan struct{})}
+			n.svc.initPIDs = &initpid.Resolver{Steps: []initpid.Step{{Strategy: gate}}}
+
+			n.create(testRestored, map[string]string{
+				"kybernate.io/restore-from":  dir,
+				cuda.FailurePolicyAnnotation: string(tt.policy),
+			})
+			if st := n.readiness(testRestored); st.State != readiness.StatePending || st.Checkpoint != dir {
+				t.Fatalf("after Create: %s, want pending from %s", st, dir)
+			}
+
+			if _, err := n.svc.Start(context.Background(), &task.StartRequest{ID: testRestored}); err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			select {
+			case <-gate.reached:
+			case <-time.After(10 * time.Second):
+				t.Fatal("restore never looked for the init PID")
+			}
+			if st := n.readiness(testRestored); st.State != readiness.StateRestoring {
+				t.Fatalf("while running: %s, want restoring", st)
+			}
+
+			if tt.failCUDA {
+				if err := n.sim.FailNext(cuda.SimOpRestore, cuda.ErrCodeNotReady); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// The task is up by now, the runtime knows its PID
+			n.runtime.pid = n.pid
+			close(gate.release)
+			n.waitRestore(testRestored)
+
+			st := n.readiness(testRestored)
+			if st.State != tt.want || st.Killed != tt.wantKilled {
+				t.Fatalf("after restore: %s, want %s with killed %v", st, tt.want, tt.wantKilled)
+			}
+			if len(st.PIDs) != 1 || st.PIDs[0] != n.pid {
+				t.Errorf("restored PIDs = %v, want [%d]", st.PIDs, n.pid)
+			}
+			if tt.want == readiness.StateFailed && st.Error == "" {
+				t.Error("failed restore without an error")
+			}
+			n.expectState(tt.wantSim)
+
+			kills := n.runtime.Kills()
+			if !tt.wantKilled {
+				if len(kills) != 0 {
+					t.Errorf("task killed %d time(s) after a restore", len(kills))
+				}
+				return
+			}
+			if len(kills) != 1 || kills[0].ID != testRestored || kills[0].Signal != uint32(syscall.SIGKILL) || !kills[0].All {
+				t.Errorf("kills = %v, want one SIGKILL of every process of %s", kills, testRestored)
+			}
+		})
+	}
+}
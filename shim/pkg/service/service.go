@@ -1,18 +1,20 @@
 package service
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	task "github.com/containerd/containerd/api/runtime/task/v2"
+	"github.com/containerd/containerd/errdefs"
 	// Import runc options to register the protobuf type
 	runcoptions "github.com/containerd/containerd/api/types/runc/options"
 	runc "github.com/containerd/containerd/runtime/v2/runc/v2"
@@ -21,7 +23,16 @@ import (
 	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/emptypb"
 
+	"github.com/kybernate/kybernate/pkg/compat"
+	"github.com/kybernate/kybernate/pkg/config"
 	"github.com/kybernate/kybernate/pkg/cuda"
+	"github.com/kybernate/kybernate/pkg/gpuenv"
+	"github.com/kybernate/kybernate/pkg/initpid"
+	"github.com/kybernate/kybernate/pkg/journal"
+	"github.com/kybernate/kybernate/pkg/logging"
+	"github.com/kybernate/kybernate/pkg/manifest"
+	"github.com/kybernate/kybernate/pkg/readiness"
+	"github.com/kybernate/kybernate/pkg/suspend"
 )
 
 // Service wraps the runc shim to add checkpoint/restore capabilities.
@@ -34,11 +45,43 @@ type Service struct {
 	shim.Shim
 	cudaCheckpointer *cuda.Checkpointer
 	gpuAvailable     bool
+	publisher        shim.Publisher
+	// suspended records containers whose GPU state was suspended on pause
+	suspended *suspend.Store
+	// journal records the stages of each checkpoint for crash recovery
+	journal *journal.Journal
+	// readiness reports the progress of the GPU restore of restored containers
+	readiness *readiness.Store
+
+	// defaults apply to workloads without annotations; the effective
+	// settings are recorded per container at Create
+	defaults  workloadConfig
+	mu        sync.Mutex
+	workloads map[string]workloadConfig
+	// restores tracks the GPU restore of containers created from a checkpoint
+	restores map[string]*restoreJob
+	// initPIDs finds the init process of tasks the runtime did not report
+	initPIDs *initpid.Resolver
+	// nvidiaRules select the NVIDIA mounts recorded at checkpoint
+	nvidiaRules gpuenv.Rules
+
+	// conf holds the host paths and defaults; the runtime options of the
+	// first container may replace the one loaded at start
+	conf          *config.Config
+	configureOnce sync.Once
+	// configPath is the configuration file named by the first container
+	configPath string
 }
 
 // New initializes the shim by delegating to the default runc shim.
 func New(ctx context.Context, id string, publisher shim.Publisher, shutdown func()) (shim.Shim, error) {
-	debugLog("Kybernate shim starting")
+	conf, confErr := config.Load("")
+	setupLogging(conf)
+	logger.Info("Kybernate shim starting", "id", id)
+	if confErr != nil {
+		logger.Warn("Invalid configuration, using the built-in profile", logging.Err(confErr))
+	}
+	logger.Info("Configuration", conf.Attrs()...)
 
 	runcShim, err := runc.New(ctx, id, publisher, shutdown)
 	if err != nil {
@@ -48,19 +91,27 @@ func New(ctx context.Context, id string, publisher shim.Publisher, shutdown func
 	svc := &Service{
 		Shim:         runcShim,
 		gpuAvailable: cuda.HasGPU(),
+		publisher:    publisher,
+		workloads:    map[string]workloadConfig{},
+		restores:     map[string]*restoreJob{},
+	}
+	svc.applyConfig(conf)
+	if svc.nvidiaRules, err = gpuenv.RulesFromEnv(gpuenv.DefaultRules); err != nil {
+		logger.Warn("Ignoring NVIDIA mount rules", logging.Err(err))
 	}
+	logger.Info("GPU discovery backend", "backend", cuda.DiscoveryName())
 
 	// Initialize CUDA checkpointer if GPU is available
 	if svc.gpuAvailable {
 		checkpointer, err := cuda.NewCheckpointer()
 		if err != nil {
-			debugLog(fmt.Sprintf("CUDA checkpointer init failed (GPU checkpoint disabled): %v", err))
+			logger.Warn("CUDA checkpointer init failed, GPU checkpoint disabled", logging.Err(err))
 		} else {
 			svc.cudaCheckpointer = checkpointer
-			debugLog("CUDA checkpointer initialized - GPU checkpoint enabled")
+			logger.Info("CUDA checkpointer initialized, GPU checkpoint enabled")
 		}
 	} else {
-		debugLog("No GPU detected - GPU checkpoint disabled")
+		logger.Info("No GPU detected, GPU checkpoint disabled")
 	}
 
 	return svc, nil
@@ -105,18 +156,12 @@ func hasGPUResources(spec *specs.Spec) bool {
 	return false
 }
 
-// ensureNvidiaRuntime writes options.json to use nvidia-container-runtime if GPU is requested
-func ensureNvidiaRuntime(bundlePath string, spec *specs.Spec) error {
+// ensureNvidiaRuntime writes options.json to use the NVIDIA runtime if GPU is requested
+func ensureNvidiaRuntime(log *slog.Logger, runtime, bundlePath string, spec *specs.Spec) error {
 	if !hasGPUResources(spec) {
 		return nil
 	}
 
-	// Check if nvidia-container-runtime is available
-	if _, err := exec.LookPath("nvidia-container-runtime"); err != nil {
-		debugLog("nvidia-container-runtime not found, using default runtime")
-		return nil
-	}
-
 	optionsPath := filepath.Join(bundlePath, "options.json")
 
 	// Check if options.json already exists
@@ -124,15 +169,15 @@ func ensureNvidiaRuntime(bundlePath string, spec *specs.Spec) error {
 		var opts Options
 		if err := json.Unmarshal(data, &opts); err == nil {
 			if opts.BinaryName != "" {
-				debugLog(fmt.Sprintf("options.json already has BinaryName: %s", opts.BinaryName))
+				log.Debug("options.json already has a runtime binary", "binary", opts.BinaryName)
 				return nil
 			}
 		}
 	}
 
-	// Write options.json with nvidia-container-runtime
+	// Write options.json with the NVIDIA runtime
 	opts := Options{
-		BinaryName: "nvidia-container-runtime",
+		BinaryName: runtime,
 	}
 	data, err := json.Marshal(opts)
 	if err != nil {
@@ -143,13 +188,23 @@ func ensureNvidiaRuntime(bundlePath string, spec *specs.Spec) error {
 		return err
 	}
 
-	debugLog("Wrote options.json with nvidia-container-runtime for GPU workload")
+	log.Info("Wrote options.json with the NVIDIA runtime for GPU workload", "runtime", runtime)
 	return nil
 }
 
 // Create intercepts the container creation to check for restore annotations.
 func (s *Service) Create(ctx context.Context, req *task.CreateTaskRequest) (*task.CreateTaskResponse, error) {
-	debugLog(fmt.Sprintf("Create called. Bundle: %s", req.Bundle))
+	// The correlation ID is only known once the spec was read
+	log := logger.With(logging.KeyContainer, req.ID)
+	log.Debug("Create called", "bundle", req.Bundle)
+
+	// Pick up the configuration before anything depends on it
+	runcOpts, err := s.runtimeOptions(log, req.Options)
+	if err != nil {
+		log.Error("Refusing create", logging.Err(err))
+		return nil, errdefs.ToGRPCf(errdefs.ErrInvalidArgument, "create %s: %v", req.ID, err)
+	}
+	conf := s.config()
 
 	isRestore := false
 	checkpointPath := ""
@@ -159,14 +214,11 @@ func (s *Service) Create(ctx context.Context, req *task.CreateTaskRequest) (*tas
 	if req.Bundle != "" {
 		configPath := filepath.Join(req.Bundle, "config.json")
 
-		// Debug: Copy config.json for manual reproduction
-		if data, err := os.ReadFile(configPath); err == nil {
-			os.WriteFile("/tmp/last-config.json", data, 0644)
-			debugLog("Copied config.json to /tmp/last-config.json")
-		}
-
 		data, err := os.ReadFile(configPath)
 		if err == nil {
+			// Keep config.json for manual reproduction
+			s.debugDump(log, req.ID, "config.json", data)
+
 			spec = &specs.Spec{}
 			if err := json.Unmarshal(data, spec); err == nil {
 				// Check for restore annotation
@@ -174,7 +226,7 @@ func (s *Service) Create(ctx context.Context, req *task.CreateTaskRequest) (*tas
 					req.Checkpoint = cp
 					checkpointPath = cp
 					isRestore = true
-					debugLog(fmt.Sprintf("Restoring container from checkpoint (Annotation): %s", cp))
+					log.Info("Restoring container from checkpoint", "checkpoint", cp, "source", "annotation")
 				}
 
 				// Check for restore ENV var
@@ -185,7 +237,7 @@ func (s *Service) Create(ctx context.Context, req *task.CreateTaskRequest) (*tas
 							req.Checkpoint = cp
 							checkpointPath = cp
 							isRestore = true
-							debugLog(fmt.Sprintf("Restoring container from checkpoint (ENV): %s", cp))
+							log.Info("Restoring container from checkpoint", "checkpoint", cp, "source", "env")
 							break
 						}
 					}
@@ -197,119 +249,16 @@ func (s *Service) Create(ctx context.Context, req *task.CreateTaskRequest) (*tas
 				// UPDATE: For restore, we manually inject mounts from the checkpoint.
 				// Using nvidia-container-runtime might cause conflicts or double injection.
 				// So we ONLY use it for non-restore workloads.
-				if hasGPUResources(spec) && !isRestore {
-					// Try to modify req.Options (protobuf)
-					if req.Options != nil {
-						v, err := req.Options.UnmarshalNew()
-						if err == nil {
-							if opts, ok := v.(*runcoptions.Options); ok {
-								opts.BinaryName = "nvidia-container-runtime"
-								newOpts, err := anypb.New(opts)
-								if err == nil {
-									req.Options = newOpts
-									debugLog("Switched runtime binary to nvidia-container-runtime via protobuf")
-								} else {
-									debugLog(fmt.Sprintf("Failed to marshal new options: %v", err))
-								}
-							}
-						} else {
-							debugLog(fmt.Sprintf("Failed to unmarshal options: %v", err))
-						}
+				if nvidia := conf.Runtime.Nvidia; nvidia != "" && hasGPUResources(spec) && !isRestore {
+					if _, err := exec.LookPath(nvidia); err != nil {
+						log.Info("NVIDIA runtime not found, using runc", "runtime", nvidia)
 					} else {
-						// Create new options if nil
-						opts := &runcoptions.Options{
-							BinaryName: "nvidia-container-runtime",
-						}
-						newOpts, err := anypb.New(opts)
-						if err == nil {
-							req.Options = newOpts
-							debugLog("Created new options with nvidia-container-runtime")
-						} else {
-							debugLog(fmt.Sprintf("Failed to marshal new options (from nil): %v", err))
-						}
-					}
-
-					// Also try the options.json method as fallback/complement
-					if err := ensureNvidiaRuntime(req.Bundle, spec); err != nil {
-						debugLog(fmt.Sprintf("Failed to set nvidia-container-runtime via options.json: %v", err))
-					}
-				}
+						runcOpts.BinaryName = nvidia
+						log.Info("Switched runtime binary to the NVIDIA runtime", "runtime", nvidia)
 
-				// If restoring, check for saved NVIDIA mounts and inject them
-				if isRestore && checkpointPath != "" {
-					mountsFile := filepath.Join(checkpointPath, "nvidia-mounts.json")
-					if data, err := os.ReadFile(mountsFile); err == nil {
-						var nvidiaMounts []cuda.MountInfo
-						if err := json.Unmarshal(data, &nvidiaMounts); err == nil {
-							debugLog(fmt.Sprintf("Injecting %d NVIDIA mounts from checkpoint", len(nvidiaMounts)))
-
-							// Add to spec.Mounts
-							for _, m := range nvidiaMounts {
-								// Check if already exists (to avoid duplicates)
-								exists := false
-								for _, existing := range spec.Mounts {
-									if existing.Destination == m.Destination {
-										exists = true
-										break
-									}
-								}
-
-								if !exists {
-									spec.Mounts = append(spec.Mounts, specs.Mount{
-										Source:      m.Source,
-										Destination: m.Destination,
-										Type:        m.Type,
-										Options:     m.Options,
-									})
-									debugLog(fmt.Sprintf("Injected mount: %s -> %s", m.Source, m.Destination))
-								}
-							}
-
-							// Write updated spec back to config.json
-							if newData, err := json.Marshal(spec); err == nil {
-								if err := os.WriteFile(configPath, newData, 0644); err != nil {
-									debugLog(fmt.Sprintf("Failed to write updated config.json: %v", err))
-								} else {
-									debugLog("Updated config.json with injected mounts")
-									// Save a copy for debugging in a shared directory
-									debugPath := "/var/snap/microk8s/common/run/debug-config.json"
-									os.WriteFile(debugPath, newData, 0644)
-									debugLog(fmt.Sprintf("Wrote debug config to %s", debugPath))
-								}
-							}
-							// Also ensure directories/files exist for these mounts
-							rootfs := filepath.Join(req.Bundle, "rootfs")
-							for _, m := range nvidiaMounts {
-								relPath := strings.TrimPrefix(m.Destination, "/")
-								fullPath := filepath.Join(rootfs, relPath)
-
-								// Check source on host to determine if dir or file
-								fi, err := os.Stat(m.Source)
-								if err == nil {
-									if fi.IsDir() {
-										os.MkdirAll(fullPath, 0755)
-									} else {
-										// Ensure parent dir exists
-										os.MkdirAll(filepath.Dir(fullPath), 0755)
-										// Create empty file if not exists
-										f, err := os.OpenFile(fullPath, os.O_RDONLY|os.O_CREATE, 0644)
-										if err == nil {
-											f.Close()
-										}
-									}
-								} else {
-									// Fallback: assume directory if no extension?
-									if strings.Contains(filepath.Base(m.Destination), ".") {
-										os.MkdirAll(filepath.Dir(fullPath), 0755)
-										f, err := os.OpenFile(fullPath, os.O_RDONLY|os.O_CREATE, 0644)
-										if err == nil {
-											f.Close()
-										}
-									} else {
-										os.MkdirAll(fullPath, 0755)
-									}
-								}
-							}
+						// Also try the options.json method as fallback/complement
+						if err := ensureNvidiaRuntime(log, nvidia, req.Bundle, spec); err != nil {
+							log.Warn("Failed to set the NVIDIA runtime via options.json", logging.Err(err))
 						}
 					}
 				}
@@ -317,9 +266,50 @@ func (s *Service) Create(ctx context.Context, req *task.CreateTaskRequest) (*tas
 		}
 	}
 
+	// A restore logs under the correlation ID of its checkpoint, unless
+	// the container is given one
+	var meta *manifest.Manifest
+	inherited := ""
+	if isRestore {
+		var err error
+		if meta, err = manifest.Read(checkpointPath); err == nil {
+			inherited = meta.CorrelationID
+		} else if !errors.Is(err, manifest.ErrNotFound) {
+			log.Warn("Ignoring checkpoint manifest", logging.Err(err))
+		}
+	}
+	cfg := s.setWorkload(req.ID, spec, inherited)
+	log = containerLogger(req.ID, cfg.correlation)
+
+	if isRestore && checkpointPath != "" {
+		if meta != nil {
+			log.Info("Checkpoint taken", "workload", meta.Workload.String(), "tool", meta.Tool, "version", meta.ToolVersion, "created", meta.CreatedAt.Format(time.RFC3339))
+			if meta.Degraded != nil {
+				log.Warn("Checkpoint is degraded, GPU state was not captured", "phase", meta.Degraded.Phase, logging.KeyError, meta.Degraded.Error)
+			}
+		}
+
+		// Recreate the NVIDIA environment of the checkpoint
+		translation, err := s.restoreNvidiaEnv(log, req.Bundle, spec, checkpointPath)
+		if err != nil {
+			log.Error("Refusing restore", logging.Err(err))
+			return nil, errdefs.ToGRPCf(errdefs.ErrFailedPrecondition, "restore %s: %v", req.ID, err)
+		}
+
+		// Refuse a restore this node cannot do before the runtime tries it
+		if err := checkCompat(log, meta, spec, translation, cfg.compatPolicy); err != nil {
+			log.Error("Refusing restore", logging.Err(err))
+			return nil, errdefs.ToGRPCf(errdefs.ErrFailedPrecondition, "restore %s: %v", req.ID, err)
+		}
+	}
+
 	// Call the underlying shim to create/restore the container
+	if req.Options, err = anypb.New(runcOpts); err != nil {
+		return nil, errdefs.ToGRPCf(errdefs.ErrInternal, "create %s: runtime options: %v", req.ID, err)
+	}
 	resp, err := s.Shim.Create(ctx, req)
 	if err != nil {
+		log.Error("Create failed", logging.Err(err))
 		return resp, err
 	}
 
@@ -335,352 +325,224 @@ func (s *Service) Create(ctx context.Context, req *task.CreateTaskRequest) (*tas
 		}
 	}
 
-	candidateIDs = expandCandidatePrefixes(candidateIDs)
-
-	// If this was a restore and we have GPU support, perform CUDA restore
+	// The task of a restored container only runs after Start, the GPU
+	// state is restored from there in the background
 	if isRestore && s.cudaCheckpointer != nil {
-		debugLog(fmt.Sprintf("Checking for GPU process to restore (checkpoint: %s)", checkpointPath))
-
-		// Wait a moment for the process to start
-		time.Sleep(500 * time.Millisecond)
-
-		restored := false
-		initPID := int(resp.Pid)
-
-		// If resp.Pid is 0 (which happens with some runtimes/restore flows), try to resolve it from the bundle
-		if initPID <= 0 {
-			debugLog(fmt.Sprintf("resp.Pid was %d, trying to resolve from bundle: %s", initPID, req.Bundle))
-
-			for i := 0; i < 75; i++ { // Retry for up to ~15 seconds
-				// 1. Try init.pid in the bundle directory (most reliable)
-				pidPath := filepath.Join(req.Bundle, "init.pid")
-				data, err := os.ReadFile(pidPath)
-				if err == nil {
-					pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
-					if err == nil && pid > 0 {
-						initPID = pid
-						debugLog(fmt.Sprintf("Resolved PID %d from %s after retry %d", initPID, pidPath, i))
-						break
-					}
-				} else {
-					if i%10 == 0 {
-						debugLog(fmt.Sprintf("Failed to read %s: %v", pidPath, err))
-						// List directory contents to debug
-						entries, _ := os.ReadDir(req.Bundle)
-						var names []string
-						for _, e := range entries {
-							names = append(names, e.Name())
-						}
-						debugLog(fmt.Sprintf("Bundle contents: %v", names))
-					}
-				}
-
-				// 2. Fallback: Try getTaskPID which checks standard locations
-				if pid := s.getTaskPID(candidateIDs...); pid > 0 {
-					initPID = pid
-					debugLog(fmt.Sprintf("Resolved PID %d from getTaskPID after retry %d", initPID, i))
-					break
-				}
-
-				// 3. Deep Fallback: Scan cgroups (expensive but necessary for some runtimes)
-				if i > 5 { // Only try this after a few quick failures
-					debugLog(fmt.Sprintf("Running cgroup scan with candidates: %v", candidateIDs))
-					if pid := s.findPIDFromCgroup(candidateIDs); pid > 0 {
-						initPID = pid
-						debugLog(fmt.Sprintf("Resolved PID %d from cgroup scan after retry %d", initPID, i))
-						break
-					}
-
-					// 4. Shim parent: if we can find the shim for this container, use its child as init PID
-					debugLog(fmt.Sprintf("Running shim-child scan with candidates: %v", candidateIDs))
-					if pid := s.findPIDFromShim(candidateIDs); pid > 0 {
-						initPID = pid
-						debugLog(fmt.Sprintf("Resolved PID %d from shim child after retry %d", initPID, i))
-						break
-					}
-				}
-
-				time.Sleep(200 * time.Millisecond)
-			}
-		}
-
-		// Try to check the init process directly first (nvidia-smi might not show it if VRAM is 0)
-		if initPID > 0 {
-			state, err := s.cudaCheckpointer.GetState(initPID)
-			if err == nil && state == cuda.StateCheckpointed {
-				debugLog(fmt.Sprintf("Found checkpointed process %d (init), performing CUDA restore", initPID))
-				if err := s.cudaCheckpointer.RestoreFull(initPID); err != nil {
-					debugLog(fmt.Sprintf("CUDA restore failed for PID %d: %v", initPID, err))
-				} else {
-					debugLog(fmt.Sprintf("CUDA restore successful for PID %d - VRAM restored", initPID))
-					restored = true
-				}
-			} else {
-				debugLog(fmt.Sprintf("Init process %d state: %s (err: %v)", initPID, state, err))
-			}
-		} else {
-			// Do not fail container startup if we cannot resolve the PID yet.
-			// This avoids breaking restore when the runtime hasn't written init.pid but
-			// the process may still come up; we can rely on later detection/logging.
-			debugLog("Could not resolve init PID – skipping CUDA restore but allowing container startup")
-			return resp, nil
+		s.queueRestore(req.ID, checkpointPath, req.Bundle, candidateIDs, spec)
+		if resp.Pid > 0 {
+			// The runtime restored the process at create already
+			s.startRestore(req.ID, int(resp.Pid))
 		}
+	}
 
-		if !restored {
-			// Fallback: Find GPU process in the restored container via nvidia-smi
-			// Use initPID if available, otherwise 0 (which might fail)
-			searchPID := initPID
-			if searchPID == 0 {
-				searchPID = int(resp.Pid)
-			}
+	return resp, nil
+}
 
-			if gpuPID, hasGPU := cuda.FindAnyGPUProcessForTask(searchPID); hasGPU {
-				debugLog(fmt.Sprintf("Found GPU process %d via nvidia-smi, performing CUDA restore", gpuPID))
+// restoreGPUProcesses restores all checkpointed CUDA processes of a
+// container together: either every process gets its device memory back
+// and is unlocked, or all of them stay checkpointed. If the restored
+// container was given other GPUs than the checkpointed one used, the
+// device memory is remapped onto the new GPUs.
+func (s *Service) restoreGPUProcesses(ctx context.Context, log *slog.Logger, pids []int, checkpointPath string, spec *specs.Spec) error {
+	all, err := cuda.ListGPUs()
+	if err != nil {
+		log.Warn("Failed to list GPUs, restoring without remap", logging.Err(err))
+		return s.cudaCheckpointer.RestoreGroup(ctx, pids, nil)
+	}
 
-				// Check if process is in checkpointed state
-				state, err := s.cudaCheckpointer.GetState(gpuPID)
-				if err != nil {
-					debugLog(fmt.Sprintf("Failed to get CUDA state for PID %d: %v", gpuPID, err))
-				} else if state == cuda.StateCheckpointed {
-					// Perform CUDA restore: Host RAM → VRAM
-					if err := s.cudaCheckpointer.RestoreFull(gpuPID); err != nil {
-						debugLog(fmt.Sprintf("CUDA restore failed for PID %d: %v", gpuPID, err))
-					} else {
-						debugLog(fmt.Sprintf("CUDA restore successful for PID %d - VRAM restored", gpuPID))
-					}
-				} else {
-					debugLog(fmt.Sprintf("GPU process %d not in checkpointed state (state=%s), skipping CUDA restore", gpuPID, state))
-				}
-			} else {
-				debugLog("No GPU process found in restored container")
-			}
-		}
+	var target []cuda.GPUDevice
+	if spec != nil && spec.Process != nil {
+		target = cuda.VisibleGPUs(spec.Process.Env, all)
+	}
+	if len(target) == 0 {
+		// No explicit assignment, the container can see every GPU
+		target = all
 	}
 
-	return resp, nil
+	plan, err := s.cudaCheckpointer.RestoreGroupOnto(ctx, pids, checkpointPath, target)
+	if plan != nil {
+		log.Info("GPU assignment changed, remapped device memory", logging.KeyPIDs, pids, "plan", plan.String())
+	}
+	return err
 }
 
 // Checkpoint intercepts the checkpoint request.
 func (s *Service) Checkpoint(ctx context.Context, req *task.CheckpointTaskRequest) (*emptypb.Empty, error) {
-	debugLog(fmt.Sprintf("Checkpointing container %s to: %s", req.ID, req.Path))
+	correlation := s.correlation(req.ID)
+	log := containerLogger(req.ID, correlation)
+	log.Info("Checkpointing container", "path", req.Path)
+
+	// A raised memory limit is put back once the dump is done
+	var offload *cuda.OffloadReservation
+	// op journals the checkpoint once GPU processes are involved
+	var op *journal.Operation
+	start := time.Now()
+	meta := manifest.New("shim", req.Path)
+	meta.Workload = s.workloadFor(req.ID).identity
+	meta.Workload.ContainerID = req.ID
+	meta.CorrelationID = correlation
+	defer func() {
+		if err := offload.Release(); err != nil {
+			log.Warn("Memory limit not restored", logging.Err(err))
+		}
+	}()
 
 	// If GPU support is available, perform CUDA checkpoint first
 	if s.cudaCheckpointer != nil {
 		// Get the task PID to find GPU processes
 		taskPID := s.getTaskPID(req.ID)
 		if taskPID > 0 {
-			if gpuPID, hasGPU := cuda.FindAnyGPUProcessForTask(taskPID); hasGPU {
-				debugLog(fmt.Sprintf("Found GPU process %d, performing CUDA checkpoint (VRAM → RAM)", gpuPID))
-
-				state, err := s.cudaCheckpointer.GetState(gpuPID)
+			workload := s.workloadFor(req.ID)
+			gpuPIDs, err := cuda.FindGPUProcessesAmong(cuda.ContainerProcesses(req.ID, taskPID))
+			if err != nil && workload.failurePolicy == cuda.PolicyFailClosed {
+				// Without discovery the dump could silently miss the GPU state
+				log.Error("GPU process discovery failed, aborting checkpoint", logging.KeyStage, "discovery", "policy", workload.failurePolicy, logging.Err(err))
+				return nil, errdefs.ToGRPCf(errdefs.ErrFailedPrecondition, "checkpoint %s: GPU process discovery failed: %v", req.ID, err)
+			}
+			if err != nil {
+				log.Warn("GPU process discovery failed, continuing with CRIU, GPU state may be lost", logging.KeyStage, "discovery", logging.Err(err))
+			}
+			if len(gpuPIDs) > 0 {
+				log.Info("Found GPU processes, performing CUDA checkpoint (VRAM → RAM)", logging.KeyPIDs, gpuPIDs)
+
+				// Own the container's GPU state until the dump is done
+				lock, err := s.acquire(ctx, req.ID, "checkpoint", correlation, workload)
+				defer lock.Release()
+				if err != nil && !s.vramMoved(err, workload, gpuPIDs) {
+					log.Error("Refusing checkpoint", logging.Err(err))
+					return nil, fmt.Errorf("checkpoint %s: %w", req.ID, err)
+				}
+				var processes []cuda.CheckpointedProcess
 				if err != nil {
-					debugLog(fmt.Sprintf("Failed to get CUDA state for PID %d: %v", gpuPID, err))
-				} else if state == cuda.StateRunning {
-					// Perform CUDA checkpoint with a shorter timeout to avoid long hangs
-					if err := s.cudaCheckpointer.CheckpointFull(gpuPID, 10000); err != nil {
-						debugLog(fmt.Sprintf("CUDA checkpoint failed or timed out for PID %d: %v (continuing with CRIU, GPU state may be lost)", gpuPID, err))
+					// Stacked below another tool that already moved the VRAM
+					log.Info("VRAM already moved, skipping CUDA stage", "lock", err.Error())
+					meta.GPU = manifest.DescribeGPU(s.cudaCheckpointer, gpuPIDs, nil)
+				} else if processes, err = cuda.RecordProcesses(req.Path, gpuPIDs); err != nil {
+					// Record the GPUs each process uses so restore can remap them
+					log.Warn("Failed to record GPU processes", logging.Err(err))
+				} else {
+					log.Debug("Recorded GPU processes", "processes", len(processes), "gpus", len(cuda.UnionGPUs(processes)))
+				}
+
+				running := s.cudaCheckpointer.ProcessesInState(gpuPIDs, cuda.StateRunning)
+				if len(running) != len(gpuPIDs) {
+					log.Warn("Not every GPU process is running", "running", running, logging.KeyPIDs, gpuPIDs)
+				}
+				if len(running) > 0 {
+					// Make sure the device memory fits into host memory before locking
+					reservation, err := cuda.PreflightOffload(running, workload.offload)
+					if err != nil {
+						log.Error("Refusing checkpoint", logging.Err(err))
+						return nil, fmt.Errorf("checkpoint %s: %w", req.ID, err)
+					}
+					log.Info("Host memory reserved for the device memory", "reservation", reservation.String())
+					offload = reservation
+					meta.Sizes.VRAM = reservation.Bytes
+
+					op, err = s.journal.Begin(req.ID, "shim", running, req.Path)
+					if err != nil {
+						log.Warn("Failed to start journal", logging.Err(err))
+					}
+					s.record(op, journal.StageLocked, nil)
+
+					// Lock all processes before checkpointing any; roll back on failure
+					timeout := workload.timeouts.Checkpoint
+					checkpointCtx, cancel := context.WithTimeout(ctx, timeout)
+					stageStart := time.Now()
+					err = s.cudaCheckpointer.CheckpointGroup(checkpointCtx, running)
+					cancel()
+					meta.Timings.CUDACheckpoint = time.Since(stageStart)
+					if cuda.IsExpired(err) {
+						log.Warn("CUDA checkpoint exceeded its timeout", "timeout", timeout)
+					}
+					if err != nil && workload.failurePolicy == cuda.PolicyFailClosed {
+						log.Error("CUDA checkpoint failed, aborting checkpoint", logging.KeyStage, "cuda-checkpoint", logging.KeyPIDs, running, "policy", workload.failurePolicy, logging.Err(err))
+						s.rollback(req.ID, running, op, err)
+						return nil, errdefs.ToGRPCf(errdefs.ErrFailedPrecondition, "checkpoint %s: CUDA checkpoint failed: %v", req.ID, err)
+					}
+					if err != nil {
+						log.Warn("CUDA checkpoint failed, all processes rolled back; continuing with CRIU, GPU state may be lost", logging.KeyStage, "cuda-checkpoint", logging.KeyPIDs, running, logging.Err(err))
+						s.record(op, journal.StageRolledBack, err)
+						op = nil
+						if err := cuda.MarkDegraded(req.Path, running, err); err != nil {
+							log.Warn("Failed to mark checkpoint degraded", logging.Err(err))
+						}
 					} else {
-						debugLog(fmt.Sprintf("CUDA checkpoint successful for PID %d - VRAM freed", gpuPID))
+						log.Info("CUDA checkpoint successful, VRAM freed", logging.KeyStage, "cuda-checkpoint", logging.KeyPIDs, running, logging.KeyDuration, meta.Timings.CUDACheckpoint)
+						s.record(op, journal.StageCUDACheckpointed, nil)
+						meta.GPU = manifest.DescribeGPU(s.cudaCheckpointer, running, processes)
 					}
-				} else {
-					debugLog(fmt.Sprintf("GPU process %d not in running state (state=%s), skipping CUDA checkpoint", gpuPID, state))
 				}
 			} else {
-				debugLog("No GPU process found in container - CPU-only checkpoint")
+				log.Info("No GPU process found in container, CPU-only checkpoint")
 			}
 
-			// Detect and save all NVIDIA mounts (needed for restore)
-			nvidiaMounts, err := cuda.FindNvidiaMounts(taskPID)
-			if err == nil && len(nvidiaMounts) > 0 {
-				debugLog(fmt.Sprintf("Found %d NVIDIA mounts", len(nvidiaMounts)))
-				mountsFile := filepath.Join(req.Path, "nvidia-mounts.json")
-				data, err := json.Marshal(nvidiaMounts)
-				if err == nil {
-					if err := os.WriteFile(mountsFile, data, 0644); err != nil {
-						debugLog(fmt.Sprintf("Failed to write nvidia-mounts.json: %v", err))
-					}
-				} else {
-					debugLog(fmt.Sprintf("Failed to marshal mounts: %v", err))
-				}
+			// Record the NVIDIA environment, the restored container needs it again
+			env := s.captureNvidiaEnv(log, taskPID, req.Path)
+			var uuids []string
+			if meta.GPU != nil {
+				uuids = meta.GPU.UUIDs
 			}
+			meta.Host = compat.Describe(env, uuids)
 		}
 	}
 
 	// Now perform the CRIU checkpoint via runc
+	criuStart := time.Now()
 	resp, err := s.Shim.Checkpoint(ctx, req)
-	if err == nil {
-		// Copy checkpoint to /tmp/kybernate-checkpoint for testing
-		exec.Command("rm", "-rf", "/tmp/kybernate-checkpoint").Run()
-		cmd := exec.Command("cp", "-r", req.Path, "/tmp/kybernate-checkpoint")
-		if err := cmd.Run(); err != nil {
-			debugLog(fmt.Sprintf("Failed to copy checkpoint: %v", err))
+	meta.Timings.CRIUDump = time.Since(criuStart)
+	if op != nil {
+		if err == nil {
+			s.record(op, journal.StageCRIUDone, nil)
+			if !exitAfterCheckpoint(req) {
+				// The container keeps running and needs its device memory back
+				meta.Timings.SnapshotToResume = s.resumeSource(ctx, req.ID, op)
+			}
 		} else {
-			debugLog("Copied checkpoint to /tmp/kybernate-checkpoint")
+			// The workload keeps running without its dump, give it its VRAM back
+			log.Error("CRIU checkpoint failed, restoring GPU processes", logging.KeyStage, "criu-dump", logging.KeyPIDs, op.PIDs, logging.Err(err))
+			s.rollback(req.ID, op.PIDs, op, err)
 		}
 	}
-	return resp, err
-}
-
-// getTaskPID returns the PID of the container's init process
-func (s *Service) getTaskPID(containerIDs ...string) int {
-	// Try multiple candidate IDs because bundle name and task ID can diverge on restore
-	for _, containerID := range containerIDs {
-		if containerID == "" {
-			continue
-		}
-
-		// 1. Try reading PID from containerd's task state files
-		pidFiles := []string{
-			filepath.Join("/run/containerd/io.containerd.runtime.v2.task/k8s.io", containerID, "init.pid"),
-			filepath.Join("/var/snap/microk8s/common/run/containerd/io.containerd.runtime.v2.task/k8s.io", containerID, "init.pid"),
-		}
-
-		for _, pidFile := range pidFiles {
-			data, err := os.ReadFile(pidFile)
-			if err == nil {
-				pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
-				if err == nil {
-					return pid
-				}
-			}
-		}
-
-		// 2. Fallback: Try querying runc state directly
-		// We try both standard runc and nvidia-container-runtime locations/binaries
-		runcRoots := []string{
-			"/run/containerd/runc/k8s.io",
-			"/var/snap/microk8s/common/run/containerd/runc/k8s.io",
-		}
-
-		binaries := []string{"runc", "nvidia-container-runtime", "/snap/microk8s/current/bin/runc"}
-
-		for _, root := range runcRoots {
-			for _, bin := range binaries {
-				cmd := exec.Command(bin, "--root", root, "state", containerID)
-				output, err := cmd.Output()
-				if err == nil {
-					var state struct {
-						InitProcessPID int `json:"init_process_pid"`
-					}
-					if err := json.Unmarshal(output, &state); err == nil && state.InitProcessPID > 0 {
-						return state.InitProcessPID
-					}
-				}
-			}
+	if err != nil && op == nil {
+		log.Error("CRIU checkpoint failed", logging.KeyStage, "criu-dump", logging.Err(err))
+	}
+	if err == nil {
+		meta.Timings.Total = time.Since(start)
+		log.Info("Checkpoint done", logging.KeyStage, "criu-dump", logging.KeyDuration, meta.Timings.Total, "criu", meta.Timings.CRIUDump)
+		if err := meta.Write(req.Path); err != nil {
+			log.Warn("Failed to write checkpoint manifest", logging.Err(err))
 		}
-
-		debugLog(fmt.Sprintf("Could not find init.pid for container %s", containerID))
+		s.exportCheckpoint(ctx, log, req.Path, s.workloadFor(req.ID))
 	}
-
-	return 0
+	return resp, err
 }
 
-func (s *Service) findPIDFromCgroup(containerIDs []string) int {
-	// Scan /proc to find a process belonging to the container's cgroup
-	// This is expensive but reliable if the runtime hides the PID
-	// We look for cgroup paths containing any of the candidate container IDs
-
-	procDirs, err := os.ReadDir("/proc")
-	if err != nil {
-		debugLog(fmt.Sprintf("Failed to read /proc: %v", err))
-		return 0
+// exitAfterCheckpoint reports whether the task was asked to exit after
+// the dump. Without options runc leaves it running, as the kubelet's
+// checkpoint does.
+func exitAfterCheckpoint(req *task.CheckpointTaskRequest) bool {
+	if req.Options == nil {
+		return false
 	}
-
-	for _, d := range procDirs {
-		if !d.IsDir() {
-			continue
-		}
-		pid, err := strconv.Atoi(d.Name())
-		if err != nil {
-			continue
-		}
-
-		cgroupPath := filepath.Join("/proc", d.Name(), "cgroup")
-		f, err := os.Open(cgroupPath)
-		if err != nil {
-			continue
-		}
-
-		scanner := bufio.NewScanner(f)
-		found := false
-		for scanner.Scan() {
-			line := scanner.Text()
-			for _, id := range containerIDs {
-				if id != "" && strings.Contains(line, id) {
-					found = true
-					debugLog(fmt.Sprintf("Found PID %d in cgroup matching %s: %s", pid, id, line))
-					break
-				}
-			}
-			if found {
-				break
-			}
-		}
-		f.Close()
-
-		if found {
-			return pid
-		}
+	v, err := req.Options.UnmarshalNew()
+	if err != nil {
+		logger.Warn("Failed to unmarshal checkpoint options", logging.Err(err))
+		return false
 	}
-	return 0
+	opts, ok := v.(*runcoptions.CheckpointOptions)
+	return ok && opts.Exit
 }
 
-func (s *Service) findPIDFromShim(containerIDs []string) int {
-	// Find the shim process by its command line and return its first child PID (container init)
-	procDirs, err := os.ReadDir("/proc")
+// getTaskPID returns the PID of the container's init process, or 0 if
+// the runtime does not know it
+func (s *Service) getTaskPID(containerIDs ...string) int {
+	res, err := s.initPIDs.Once(context.Background(), initpid.Request{IDs: containerIDs})
 	if err != nil {
-		debugLog(fmt.Sprintf("Failed to read /proc for shim scan: %v", err))
+		logger.Warn("Could not find init PID", "candidates", containerIDs, logging.Err(err))
 		return 0
 	}
-
-	for _, d := range procDirs {
-		if !d.IsDir() {
-			continue
-		}
-		pid := d.Name()
-		cmdlinePath := filepath.Join("/proc", pid, "cmdline")
-		data, err := os.ReadFile(cmdlinePath)
-		if err != nil {
-			continue
-		}
-
-		cmdline := strings.ReplaceAll(string(data), "\x00", " ")
-		if !strings.Contains(cmdline, "containerd-shim") {
-			continue
-		}
-
-		matched := false
-		for _, id := range containerIDs {
-			if id != "" && strings.Contains(cmdline, id) {
-				matched = true
-				break
-			}
-		}
-		if !matched {
-			continue
-		}
-
-		childrenPath := filepath.Join("/proc", pid, "task", pid, "children")
-		childData, err := os.ReadFile(childrenPath)
-		if err != nil {
-			continue
-		}
-
-		fields := strings.Fields(string(childData))
-		if len(fields) == 0 {
-			continue
-		}
-
-		childPID, err := strconv.Atoi(fields[0])
-		if err != nil || childPID <= 0 {
-			continue
-		}
-
-		debugLog(fmt.Sprintf("Found init PID %d via shim %s (cmdline match)", childPID, pid))
-		return childPID
-	}
-
-	return 0
+	return res.PID
 }
 
 func appendCandidate(list []string, id string) []string {
@@ -696,30 +558,3 @@ func appendCandidate(list []string, id string) []string {
 
 	return append(list, id)
 }
-
-func expandCandidatePrefixes(ids []string) []string {
-	out := append([]string{}, ids...)
-
-	for _, id := range ids {
-		if len(id) > 12 {
-			short := id[:12]
-			out = appendCandidate(out, short)
-		}
-	}
-
-	return out
-}
-
-func debugLog(msg string) {
-	f, err := os.OpenFile("/var/snap/microk8s/common/run/kybernate-shim.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		// Fallback to /tmp if the snap path is not accessible
-		f, err = os.OpenFile("/tmp/kybernate-shim.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			return
-		}
-	}
-	defer f.Close()
-	timestamp := time.Now().Format(time.RFC3339)
-	f.WriteString(fmt.Sprintf("%s: %s\n", timestamp, msg))
-}
@@ -0,0 +1,338 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	task "github.com/containerd/containerd/api/runtime/task/v2"
+	runcoptions "github.com/containerd/containerd/api/types/runc/options"
+	"github.com/containerd/containerd/runtime/v2/shim"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/kybernate/kybernate/pkg/config"
+	"github.com/kybernate/kybernate/pkg/cuda"
+	"github.com/kybernate/kybernate/pkg/initpid"
+	"github.com/kybernate/kybernate/pkg/journal"
+	"github.com/kybernate/kybernate/pkg/manifest"
+)
+
+const (
+	testContainer = "aaaa0000aaaa0000aaaa0000aaaa0000aaaa0000aaaa0000aaaa0000aaaa0000"
+	testRestored  = "bbbb1111bbbb1111bbbb1111bbbb1111bbbb1111bbbb1111bbbb1111bbbb1111"
+	testGPU       = "GPU-00000000-0000-0000-0000-000000000001"
+	testVRAM      = 64 << 20
+)
+
+// fakeRuntime stands in for the runc shim below the service. Create,
+// Start and State report pid as the task's init process; Checkpoint writes a dump
+// file unless checkpointErr is set.
+type fakeRuntime struct {
+	shim.Shim
+	pid           int
+	checkpointErr error
+
+	mu    sync.Mutex
+	dumps []string
+	kills []*task.KillRequest
+}
+
+func (r *fakeRuntime) Create(ctx context.Context, req *task.CreateTaskRequest) (*task.CreateTaskResponse, error) {
+	return &task.CreateTaskResponse{Pid: uint32(r.pid)}, nil
+}
+
+func (r *fakeRuntime) Start(ctx context.Context, req *task.StartRequest) (*task.StartResponse, error) {
+	return &task.StartResponse{Pid: uint32(r.pid)}, nil
+}
+
+func (r *fakeRuntime) State(ctx context.Context, req *task.StateRequest) (*task.StateResponse, error) {
+	return &task.StateResponse{ID: req.ID, Pid: uint32(r.pid)}, nil
+}
+
+func (r *fakeRuntime) Checkpoint(ctx context.Context, req *task.CheckpointTaskRequest) (*emptypb.Empty, error) {
+	if r.checkpointErr != nil {
+		return nil, r.checkpointErr
+	}
+	r.mu.Lock()
+	r.dumps = append(r.dumps, req.Path)
+	r.mu.Unlock()
+	return &emptypb.Empty{}, os.WriteFile(filepath.Join(req.Path, "pages-1.img"), []byte("dump"), 0644)
+}
+
+func (r *fakeRuntime) Kill(ctx context.Context, req *task.KillRequest) (*emptypb.Empty, error) {
+	r.mu.Lock()
+	r.kills = append(r.kills, req)
+	r.mu.Unlock()
+	return &emptypb.Empty{}, nil
+}
+
+func (r *fakeRuntime) Kills() []*task.KillRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*task.KillRequest(nil), r.kills...)
+}
+
+// knownPIDs resolves the init PID of the containers it lists
+type knownPIDs map[string]int
+
+func (k knownPIDs) Name() string { return "known" }
+
+func (k knownPIDs) Resolve(ctx context.Context, req initpid.Request) (int, error) {
+	for _, id := range req.IDs {
+		if pid, ok := k[id]; ok {
+			return pid, nil
+		}
+	}
+	return 0, initpid.ErrNotFound
+}
+
+// simNode is a node with one simulated GPU, running a shim whose
+// containers all share one real process as their task. The process is a
+// CUDA process of the simulated driver, reported by fixture discovery.
+type simNode struct {
+	t       *testing.T
+	svc     *Service
+	runtime *fakeRuntime
+	sim     *cuda.SimDriver
+	conf    *config.Config
+	pid     int
+}
+
+func newSimNode(t *testing.T) *simNode {
+	t.Helper()
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start task process: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	pid := cmd.Process.Pid
+
+	uuid, err := cuda.ParseUUID(testGPU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim := cuda.NewSimDriver(uuid)
+	if err := sim.AddProcess(pid, "sleep", testVRAM, uuid); err != nil {
+		t.Fatalf("AddProcess: %v", err)
+	}
+	cuda.SetDiscoverer(&cuda.FixtureDiscoverer{Fixture: cuda.GPUFixture{
+		Devices:   []cuda.GPUDevice{{Index: 0, UUID: testGPU, Name: "Simulated GPU"}},
+		Processes: []cuda.GPUProcess{{PID: pid, UsedMemory: testVRAM, Name: "sleep", GPUUUID: testGPU}},
+	}})
+	t.Cleanup(func() { cuda.SetDiscoverer(nil) })
+	ckpt, err := cuda.NewCheckpointerWithDriver(sim)
+	if err != nil {
+		t.Fatalf("NewCheckpointerWithDriver: %v", err)
+	}
+
+	conf, err := config.Profile(config.ProfileContainerd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Paths.StateDir = t.TempDir()
+	conf.Runtime.Nvidia = ""
+	conf.Features.Reconcile = false
+
+	runtime := &fakeRuntime{pid: pid}
+	svc := &Service{
+		Shim:             runtime,
+		cudaCheckpointer: ckpt,
+		gpuAvailable:     true,
+		workloads:        map[string]workloadConfig{},
+		restores:         map[string]*restoreJob{},
+	}
+	svc.applyConfig(conf)
+	svc.initPIDs = &initpid.Resolver{Steps: []initpid.Step{{Strategy: knownPIDs{testContainer: pid, testRestored: pid}}}}
+	return &simNode{t: t, svc: svc, runtime: runtime, sim: sim, conf: conf, pid: pid}
+}
+
+// bundle writes an OCI bundle for container id with annotations
+func (n *simNode) bundle(id string, annotations map[string]string) string {
+	n.t.Helper()
+	dir := filepath.Join(n.t.TempDir(), id)
+	if err := os.MkdirAll(filepath.Join(dir, "rootfs"), 0755); err != nil {
+		n.t.Fatal(err)
+	}
+	spec := specs.Spec{
+		Version:     specs.Version,
+		Process:     &specs.Process{Args: []string{"python3", "train.py"}, Env: []string{"NVIDIA_VISIBLE_DEVICES=all"}},
+		Annotations: annotations,
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), data, 0644); err != nil {
+		n.t.Fatal(err)
+	}
+	return dir
+}
+
+// create creates container id through the service
+func (n *simNode) create(id string, annotations map[string]string) *task.CreateTaskResponse {
+	n.t.Helper()
+	resp, err := n.svc.Create(context.Background(), &task.CreateTaskRequest{ID: id, Bundle: n.bundle(id, annotations)})
+	if err != nil {
+		n.t.Fatalf("Create: %v", err)
+	}
+	return resp
+}
+
+// checkpoint checkpoints container id into a new directory and returns it
+func (n *simNode) checkpoint(id string, exit bool) (string, error) {
+	n.t.Helper()
+	req := &task.CheckpointTaskRequest{ID: id, Path: n.t.TempDir()}
+	if exit {
+		opts, err := anypb.New(&runcoptions.CheckpointOptions{Exit: true})
+		if err != nil {
+			n.t.Fatal(err)
+		}
+		req.Options = opts
+	}
+	_, err := n.svc.Checkpoint(context.Background(), req)
+	return req.Path, err
+}
+
+func (n *simNode) expectState(want cuda.ProcessState) {
+	n.t.Helper()
+	p, ok := n.sim.Process(n.pid)
+	if !ok {
+		n.t.Fatalf("simulated process %d is gone", n.pid)
+	}
+	if p.State != want {
+		n.t.Fatalf("simulated process is %s, want %s", p.State, want)
+	}
+}
+
+// openOperations returns the checkpoints the journal still has open
+func (n *simNode) openOperations() []journal.Entry {
+	n.t.Helper()
+	ops, err := journal.New(n.conf.JournalDir()).Interrupted()
+	if err != nil {
+		n.t.Fatalf("Interrupted: %v", err)
+	}
+	return ops
+}
+
+func TestCreateRecordsWorkload(t *testing.T) {
+	n := newSimNode(t)
+	resp := n.create(testContainer, map[string]string{
+		"io.kubernetes.cri.sandbox-namespace": "ml",
+		"io.kubernetes.cri.sandbox-name":      "trainer-0",
+		"io.kubernetes.cri.container-name":    "trainer",
+		cuda.FailurePolicyAnnotation:          string(cuda.PolicyFailClosed),
+	})
+	if int(resp.Pid) != n.pid {
+		t.Errorf("Create() pid = %d, want %d", resp.Pid, n.pid)
+	}
+
+	workload := n.svc.workloadFor(testContainer)
+	if workload.failurePolicy != cuda.PolicyFailClosed {
+		t.Errorf("failure policy = %s, want the annotated %s", workload.failurePolicy, cuda.PolicyFailClosed)
+	}
+	if workload.identity.Pod != "trainer-0" || workload.identity.Container != "trainer" {
+		t.Errorf("workload = %s, want ml/trainer-0/trainer", workload.identity.String())
+	}
+	n.expectState(cuda.StateRunning)
+}
+
+func TestCheckpointLeaveRunning(t *testing.T) {
+	n := newSimNode(t)
+	n.create(testContainer, nil)
+
+	dir, err := n.checkpoint(testContainer, false)
+	if err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+	// The dump left the task running, it got its device memory back
+	n.expectState(cuda.StateRunning)
+
+	meta, err := manifest.Read(dir)
+	if err != nil {
+		t.Fatalf("manifest: %v", err)
+	}
+	if meta.GPU == nil || len(meta.GPU.PIDs) != 1 || meta.GPU.PIDs[0] != n.pid {
+		t.Fatalf("manifest GPU = %+v, want PID %d", meta.GPU, n.pid)
+	}
+	if len(meta.GPU.UUIDs) != 1 || meta.GPU.UUIDs[0] != testGPU {
+		t.Errorf("manifest GPUs = %v, want [%s]", meta.GPU.UUIDs, testGPU)
+	}
+	if meta.Sizes.VRAM != testVRAM {
+		t.Errorf("manifest VRAM = %d, want %d", meta.Sizes.VRAM, testVRAM)
+	}
+	if meta.Timings.SnapshotToResume <= 0 || meta.Timings.Total <= 0 {
+		t.Errorf("manifest timings = %+v, want a resume latency and a total", meta.Timings)
+	}
+	if ops := n.openOperations(); len(ops) != 0 {
+		t.Errorf("journal left %d checkpoint(s) open", len(ops))
+	}
+}
+
+func TestCheckpointExit(t *testing.T) {
+	n := newSimNode(t)
+	n.create(testContainer, nil)
+
+	dir, err := n.checkpoint(testContainer, true)
+	if err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+	// The task exits with the dump, its device memory stays in the checkpoint
+	n.expectState(cuda.StateCheckpointed)
+	p, _ := n.sim.Process(n.pid)
+	if p.VRAMBytes != 0 || p.HostBytes != testVRAM {
+		t.Errorf("process holds %d bytes of VRAM and %d of host memory, want 0 and %d", p.VRAMBytes, p.HostBytes, testVRAM)
+	}
+	if devices, err := cuda.ReadGPUDevices(dir); err != nil || len(devices) != 1 {
+		t.Errorf("recorded GPUs = %v, %v; want the simulated GPU", devices, err)
+	}
+	if meta, err := manifest.Read(dir); err != nil || meta.Timings.SnapshotToResume != 0 {
+		t.Errorf("manifest = %+v, %v; want one without resume", meta, err)
+	}
+}
+
+func TestCheckpointCRIUFailureRollsBack(t *testing.T) {
+	n := newSimNode(t)
+	n.create(testContainer, nil)
+	n.runtime.checkpointErr = errors.New("criu failed")
+
+	dir, err := n.checkpoint(testContainer, true)
+	if err == nil {
+		t.Fatal("Checkpoint succeeded although CRIU failed")
+	}
+	n.expectState(cuda.StateRunning)
+	if _, err := manifest.Read(dir); !errors.Is(err, manifest.ErrNotFound) {
+		t.Errorf("manifest of a failed checkpoint: %v", err)
+	}
+	if ops := n.openOperations(); len(ops) != 0 {
+		t.Errorf("journal left %d checkpoint(s) open after the rollback", len(ops))
+	}
+}
+
+func TestCheckpointFailClosed(t *testing.T) {
+	n := newSimNode(t)
+	n.create(testContainer, map[string]string{cuda.FailurePolicyAnnotation: string(cuda.PolicyFailClosed)})
+	if err := n.sim.FailNext(cuda.SimOpCheckpoint, cuda.ErrCodeNotReady); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := n.checkpoint(testContainer, true); err == nil {
+		t.Fatal("Checkpoint succeeded although the CUDA checkpoint failed")
+	}
+	n.expectState(cuda.StateRunning)
+	n.runtime.mu.Lock()
+	dumps := len(n.runtime.dumps)
+	n.runtime.mu.Unlock()
+	if dumps != 0 {
+		t.Error("CRIU ran after the CUDA checkpoint failed under fail-closed")
+	}
+}
@@ -0,0 +1,204 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"syscall"
+
+	task "github.com/containerd/containerd/api/runtime/task/v2"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"github.com/kybernate/kybernate/pkg/cgroup"
+	"github.com/kybernate/kybernate/pkg/cuda"
+	"github.com/kybernate/kybernate/pkg/logging"
+)
+
+// Kill releases locked or checkpointed CUDA processes before a signal
+// that terminates them: a process left in either state can hang its exit
+// in the driver, for example after a failed checkpoint. A GPU restore
+// still running is stopped first. A frozen container is thawed, since
+// neither the release nor the signal reaches frozen processes, and its
+// suspend record is dropped. Other signals, such as SIGHUP to reload,
+// are passed on without touching the GPU state.
+func (s *Service) Kill(ctx context.Context, req *task.KillRequest) (*emptypb.Empty, error) {
+	if !terminating(syscall.Signal(req.Signal)) {
+		return s.Shim.Kill(ctx, req)
+	}
+
+	if req.ExecID != "" {
+		// Thawing the container is up to the kill of its task
+		if !s.frozen(ctx, req.ID) {
+			s.releaseGPU(ctx, req.ID, req.ExecID, "kill")
+		}
+		return s.Shim.Kill(ctx, req)
+	}
+
+	s.stopRestore(ctx, req.ID)
+	if s.thaw(ctx, req.ID) {
+		s.releaseGPU(ctx, req.ID, "", "kill")
+	}
+	s.dropSuspend(req.ID)
+	return s.Shim.Kill(ctx, req)
+}
+
+// terminating reports whether sig ends a process that does not handle it
+// itself: the signals Kubernetes and containerd stop containers with
+func terminating(sig syscall.Signal) bool {
+	switch sig {
+	case syscall.SIGKILL, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT:
+		return true
+	}
+	return false
+}
+
+// freezer returns the freezer cgroup of container id if it is frozen,
+// by containerd's pause or a suspend that froze it
+func (s *Service) freezer(ctx context.Context, id string) *cgroup.Cgroup {
+	state, err := s.Shim.State(ctx, &task.StateRequest{ID: id})
+	if err != nil || state.Pid == 0 {
+		return nil
+	}
+	cg, err := cgroup.FreezerForPID(int(state.Pid))
+	if err != nil {
+		return nil
+	}
+	if frozen, err := cg.Frozen(); err != nil || !frozen {
+		return nil
+	}
+	return cg
+}
+
+func (s *Service) frozen(ctx context.Context, id string) bool {
+	return s.freezer(ctx, id) != nil
+}
+
+// thaw thaws container id if it is frozen and reports whether its
+// processes run, so that their CUDA state can be released
+func (s *Service) thaw(ctx context.Context, id string) bool {
+	cg := s.freezer(ctx, id)
+	if cg == nil {
+		return true
+	}
+	log := s.logFor(id)
+	if err := cg.Thaw(); err != nil {
+		log.Error("Failed to thaw container, not releasing its CUDA processes", "cgroup", cg.String(), logging.Err(err))
+		return false
+	}
+	log.Info("Thawed container to stop it", "cgroup", cg.String())
+	return true
+}
+
+// dropSuspend removes the suspend record of container id, lowering the
+// memory limits raised for it. The container is going away, so it will
+// not be resumed.
+func (s *Service) dropSuspend(id string) {
+	rec, err := s.suspended.Load(id)
+	if err != nil || rec == nil {
+		return
+	}
+	log := s.logFor(id)
+	if err := rec.Offload.Release(); err != nil {
+		log.Warn("Memory limit not restored", logging.Err(err))
+	}
+	if err := s.suspended.Remove(id); err != nil {
+		log.Warn("Failed to remove suspend record", logging.Err(err))
+		return
+	}
+	log.Info("Dropped suspend record of stopped container", logging.KeyPIDs, rec.PIDs)
+}
+
+// Delete releases CUDA processes that are still alive and drops the
+// state kept for the container
+func (s *Service) Delete(ctx context.Context, req *task.DeleteRequest) (*task.DeleteResponse, error) {
+	if req.ExecID == "" {
+		s.stopRestore(ctx, req.ID)
+	}
+	s.releaseGPU(ctx, req.ID, req.ExecID, "delete")
+
+	resp, err := s.Shim.Delete(ctx, req)
+	if err == nil && req.ExecID == "" {
+		s.forget(req.ID)
+	}
+	return resp, err
+}
+
+// Shutdown releases the CUDA processes of every container of this shim
+func (s *Service) Shutdown(ctx context.Context, req *task.ShutdownRequest) (*emptypb.Empty, error) {
+	for _, id := range s.containers() {
+		s.stopRestore(ctx, id)
+		s.releaseGPU(ctx, id, "", "shutdown")
+	}
+	return s.Shim.Shutdown(ctx, req)
+}
+
+// releaseGPU brings the CUDA processes of a task or exec back to running.
+// Failures are logged and reported, but never block the teardown.
+func (s *Service) releaseGPU(ctx context.Context, id, execID, reason string) {
+	if s.cudaCheckpointer == nil {
+		return
+	}
+
+	state, err := s.Shim.State(ctx, &task.StateRequest{ID: id, ExecID: execID})
+	if err != nil || state.Pid == 0 {
+		return
+	}
+
+	// An exec owns its process tree; the task owns the whole container
+	pids := cuda.TaskProcesses(int(state.Pid))
+	if execID == "" {
+		pids = cuda.ContainerProcesses(id, int(state.Pid))
+	}
+	released := s.cudaCheckpointer.Release(ctx, pids)
+	if len(released) == 0 {
+		return
+	}
+
+	log := s.logFor(id)
+	event := &GPUEvent{ContainerID: id, Reason: reason}
+	var failures []string
+	for _, r := range released {
+		event.PIDs = append(event.PIDs, r.PID)
+		if r.Err != nil {
+			log.Error("Failed to release CUDA process", logging.KeyPID, r.PID, "state", r.From, "reason", reason, logging.Err(r.Err))
+			failures = append(failures, fmt.Sprintf("PID %d (%s): %v", r.PID, r.From, r.Err))
+			continue
+		}
+		log.Info("Released CUDA process", logging.KeyPID, r.PID, "state", r.From, "reason", reason)
+	}
+	if len(failures) > 0 {
+		event.Error = strings.Join(failures, "; ")
+	}
+	s.publish(ctx, TopicGPUCleanup, event)
+}
+
+// containers returns the IDs of all containers created through this shim
+func (s *Service) containers() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.workloads))
+	for id := range s.workloads {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// forget drops the per-container state of a deleted container
+func (s *Service) forget(id string) {
+	log := s.logFor(id)
+	s.mu.Lock()
+	delete(s.workloads, id)
+	delete(s.restores, id)
+	s.mu.Unlock()
+
+	// A container deleted while paused leaves its suspend record behind
+	if err := s.suspended.Remove(id); err != nil {
+		log.Warn("Failed to remove suspend record", logging.Err(err))
+	}
+	if err := s.journal.Remove(id); err != nil {
+		log.Warn("Failed to remove journal", logging.Err(err))
+	}
+	if err := s.readiness.Remove(id); err != nil {
+		log.Warn("Failed to remove restore status", logging.Err(err))
+	}
+}
@@ -0,0 +1,157 @@
+package service
+
+import (
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+
+	"github.com/kybernate/kybernate/pkg/compat"
+	"github.com/kybernate/kybernate/pkg/config"
+	"github.com/kybernate/kybernate/pkg/cuda"
+	"github.com/kybernate/kybernate/pkg/export"
+	"github.com/kybernate/kybernate/pkg/logging"
+	"github.com/kybernate/kybernate/pkg/manifest"
+	"github.com/kybernate/kybernate/pkg/oplock"
+	"github.com/kybernate/kybernate/pkg/readiness"
+	"github.com/kybernate/kybernate/pkg/suspend"
+)
+
+// workloadConfig holds the per-container settings that workloads can
+// override through annotations on top of the shim defaults
+type workloadConfig struct {
+	timeouts cuda.Timeouts
+	offload  cuda.OffloadOptions
+	// suspendOnPause offloads VRAM when containerd pauses the task
+	suspendOnPause bool
+	// lockMode decides whether to skip or wait if another tool holds the
+	// container's lock
+	lockMode oplock.Mode
+	// failurePolicy decides whether a failed CUDA stage aborts the
+	// checkpoint or restore
+	failurePolicy cuda.FailurePolicy
+	// compatPolicy decides whether a restore onto a node that differs
+	// from the checkpoint's is refused
+	compatPolicy compat.Policy
+	// identity names the pod, container and image in checkpoint manifests
+	identity manifest.Workload
+	// restoreMarker is created inside the container once its GPU state is
+	// restored, for readiness probes
+	restoreMarker string
+	// correlation ties the log records of the container's operations
+	// together, and to those of the checkpoint it was restored from
+	correlation string
+	// export hands the container's checkpoints on once they are written
+	export export.Spec
+}
+
+// defaultWorkloadConfig reads the shim defaults from conf, overridden by
+// the environment
+func defaultWorkloadConfig(conf *config.Config) workloadConfig {
+	timeouts, err := cuda.TimeoutsFromEnv(conf.Timeouts)
+	if err != nil {
+		logger.Warn("Ignoring CUDA timeout override", logging.Err(err))
+	}
+	offload, err := cuda.OffloadOptionsFromEnv(cuda.OffloadOptions{})
+	if err != nil {
+		logger.Warn("Ignoring offload override", logging.Err(err))
+	}
+	suspendOnPause, err := suspend.OnPauseFromEnv(conf.Features.SuspendOnPause)
+	if err != nil {
+		logger.Warn("Ignoring suspend-on-pause override", logging.Err(err))
+	}
+	lockMode, err := oplock.ModeFromEnv(oplock.ModeSkip)
+	if err != nil {
+		logger.Warn("Ignoring lock mode override", logging.Err(err))
+	}
+	failurePolicy, err := cuda.FailurePolicyFromEnv(cuda.DefaultFailurePolicy)
+	if err != nil {
+		logger.Warn("Ignoring failure policy override", logging.Err(err))
+	}
+	compatPolicy, err := compat.PolicyFromEnv(compat.DefaultPolicy)
+	if err != nil {
+		logger.Warn("Ignoring compat policy override", logging.Err(err))
+	}
+	exportSpec, err := export.SpecFromEnv(conf.Export)
+	if err != nil {
+		logger.Warn("Ignoring checkpoint export override", logging.Err(err))
+	}
+	return workloadConfig{
+		timeouts:       timeouts,
+		offload:        offload,
+		suspendOnPause: suspendOnPause,
+		lockMode:       lockMode,
+		failurePolicy:  failurePolicy,
+		compatPolicy:   compatPolicy,
+		export:         exportSpec,
+	}
+}
+
+// setWorkload records the settings of container id from the annotations
+// of its spec and returns them. A container restored from a checkpoint
+// inherits its correlation ID unless the annotation sets one.
+func (s *Service) setWorkload(id string, spec *specs.Spec, inherited string) workloadConfig {
+	cfg := s.defaults
+	cfg.identity = manifest.Workload{ContainerID: id}
+	annotated := ""
+	if spec != nil {
+		annotated = spec.Annotations[logging.CorrelationAnnotation]
+	}
+	cfg.correlation = logging.FirstCorrelation(annotated, inherited)
+	log := containerLogger(id, cfg.correlation)
+	if spec != nil {
+		cfg.identity = manifest.WorkloadFromAnnotations(id, spec.Annotations)
+		if t, err := cuda.TimeoutsFromAnnotations(spec.Annotations, cfg.timeouts); err != nil {
+			log.Warn("Ignoring CUDA timeout annotation", logging.Err(err))
+		} else {
+			cfg.timeouts = t
+		}
+		if o, err := cuda.OffloadOptionsFromAnnotations(spec.Annotations, cfg.offload); err != nil {
+			log.Warn("Ignoring offload annotation", logging.Err(err))
+		} else {
+			cfg.offload = o
+		}
+		if v, err := suspend.OnPauseFromAnnotations(spec.Annotations, cfg.suspendOnPause); err != nil {
+			log.Warn("Ignoring suspend-on-pause annotation", logging.Err(err))
+		} else {
+			cfg.suspendOnPause = v
+		}
+		if m, err := oplock.ModeFromAnnotations(spec.Annotations, cfg.lockMode); err != nil {
+			log.Warn("Ignoring lock mode annotation", logging.Err(err))
+		} else {
+			cfg.lockMode = m
+		}
+		if p, err := cuda.FailurePolicyFromAnnotations(spec.Annotations, cfg.failurePolicy); err != nil {
+			log.Warn("Ignoring failure policy annotation", logging.Err(err))
+		} else {
+			cfg.failurePolicy = p
+		}
+		if p, err := compat.PolicyFromAnnotations(spec.Annotations, cfg.compatPolicy); err != nil {
+			log.Warn("Ignoring compat policy annotation", logging.Err(err))
+		} else {
+			cfg.compatPolicy = p
+		}
+		if e, err := export.SpecFromAnnotations(spec.Annotations, s.config().Exporters, cfg.export); err != nil {
+			log.Warn("Ignoring checkpoint export annotation", logging.Err(err))
+		} else {
+			cfg.export = e
+		}
+		if m, err := readiness.MarkerFromAnnotations(spec.Annotations); err != nil {
+			log.Warn("Ignoring readiness marker annotation", logging.Err(err))
+		} else {
+			cfg.restoreMarker = m
+		}
+	}
+
+	s.mu.Lock()
+	s.workloads[id] = cfg
+	s.mu.Unlock()
+	return cfg
+}
+
+// workloadFor returns the settings of container id
+func (s *Service) workloadFor(id string) workloadConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cfg, ok := s.workloads[id]; ok {
+		return cfg
+	}
+	return s.defaults
+}
@@ -0,0 +1,36 @@
+package suspend
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Annotation and environment variable that control whether pausing a GPU
+// container through containerd also suspends its GPU state ("true"/"false")
+const (
+	OnPauseAnnotation = "kybernate.io/gpu-suspend-on-pause"
+	OnPauseEnv        = "KYBERNATE_GPU_SUSPEND_ON_PAUSE"
+)
+
+// OnPauseFromEnv returns def overridden by KYBERNATE_GPU_SUSPEND_ON_PAUSE
+func OnPauseFromEnv(def bool) (bool, error) {
+	return parseOnPause(os.Getenv(OnPauseEnv), def, "environment")
+}
+
+// OnPauseFromAnnotations returns def overridden by the workload's
+// kybernate.io/gpu-suspend-on-pause annotation
+func OnPauseFromAnnotations(annotations map[string]string, def bool) (bool, error) {
+	return parseOnPause(annotations[OnPauseAnnotation], def, "annotation")
+}
+
+func parseOnPause(value string, def bool, source string) (bool, error) {
+	if value == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseBool(value)
+	if err != nil {
+		return def, fmt.Errorf("invalid gpu-suspend-on-pause %q in %s", value, source)
+	}
+	return v, nil
+}
@@ -0,0 +1,130 @@
+package suspend
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kybernate/kybernate/pkg/cgroup"
+	"github.com/kybernate/kybernate/pkg/cuda"
+)
+
+// DefaultDir holds one record per suspended container
+const DefaultDir = "/var/lib/kybernate/suspended"
+
+// Record describes a suspended container
+type Record struct {
+	ContainerID string `json:"containerID"`
+	Namespace   string `json:"namespace,omitempty"`
+	Pod         string `json:"pod,omitempty"`
+	Container   string `json:"container,omitempty"`
+	// Source names the tool that suspended the container
+	Source string `json:"source,omitempty"`
+
+	PIDs        []int     `json:"pids"`
+	VRAMBytes   int64     `json:"vramBytes"`
+	SuspendedAt time.Time `json:"suspendedAt"`
+
+	// Freezer is set if the container's cgroup was frozen
+	Freezer *cgroup.Cgroup `json:"freezer,omitempty"`
+	// Offload records memory limits raised for the suspension
+	Offload *cuda.OffloadReservation `json:"offload,omitempty"`
+
+	// ReleaseError is set by Resume if a raised limit could not be restored
+	ReleaseError string `json:"-"`
+}
+
+// Name renders the record as namespace/pod/container, or the container ID
+func (r *Record) Name() string {
+	if r.Pod == "" {
+		return r.ContainerID
+	}
+	return fmt.Sprintf("%s/%s/%s", r.Namespace, r.Pod, r.Container)
+}
+
+// Store persists records as <dir>/<container-id>.json
+type Store struct {
+	Dir string
+}
+
+// NewStore returns a store in dir, or DefaultDir if dir is empty
+func NewStore(dir string) *Store {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return &Store{Dir: dir}
+}
+
+func (s *Store) path(containerID string) string {
+	return filepath.Join(s.Dir, containerID+".json")
+}
+
+// Save writes rec atomically
+func (s *Store) Save(rec *Record) error {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path(rec.ContainerID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(rec.ContainerID))
+}
+
+// Load returns the record of a container, or nil if it is not suspended
+func (s *Store) Load(containerID string) (*Record, error) {
+	data, err := os.ReadFile(s.path(containerID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var rec Record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("parse suspend record of %s: %w", containerID, err)
+	}
+	return &rec, nil
+}
+
+// Remove deletes the record of a container
+func (s *Store) Remove(containerID string) error {
+	err := os.Remove(s.path(containerID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// List returns all records ordered by suspension time
+func (s *Store) List() ([]*Record, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var records []*Record
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		rec, err := s.Load(strings.TrimSuffix(e.Name(), ".json"))
+		if err != nil || rec == nil {
+			continue
+		}
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].SuspendedAt.Before(records[j].SuspendedAt) })
+	return records, nil
+}
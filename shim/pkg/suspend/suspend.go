@@ -0,0 +1,135 @@
+// Package suspend parks the GPU state of a running container in host
+// memory and brings it back later, without CRIU ("Instant Pause &
+// Resume"). The CUDA processes are checkpointed in place; optionally the
+// container's cgroup is frozen so the CPU side stops as well. Suspended
+// containers are recorded on disk so other tools can report them.
+package suspend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/kybernate/kybernate/pkg/cgroup"
+	"github.com/kybernate/kybernate/pkg/cuda"
+)
+
+// ErrNotSuspended is returned by Resume for containers without a record
+var ErrNotSuspended = errors.New("container is not suspended")
+
+// ErrAlreadySuspended is returned by Suspend for containers with a record
+var ErrAlreadySuspended = errors.New("container is already suspended")
+
+// Options control Suspend and Resume
+type Options struct {
+	// Freeze also freezes the container's cgroup after the GPU state is parked
+	Freeze   bool
+	Offload  cuda.OffloadOptions
+	Timeouts cuda.Timeouts
+}
+
+// Suspend checkpoints the CUDA processes pids of a container in place and
+// records it in store. rec identifies the container; its process, cgroup
+// and memory fields are filled in. If any step fails, the container is
+// left running and nothing is recorded.
+func Suspend(ctx context.Context, ckpt *cuda.Checkpointer, store *Store, rec *Record, pids []int, opts Options) error {
+	if existing, err := store.Load(rec.ContainerID); err != nil {
+		return err
+	} else if existing != nil {
+		return fmt.Errorf("%s: %w", rec.ContainerID, ErrAlreadySuspended)
+	}
+	if len(pids) == 0 {
+		return fmt.Errorf("%s: no GPU process to suspend", rec.ContainerID)
+	}
+
+	// Refuse before locking if the device memory cannot fit into host memory
+	offload, err := cuda.PreflightOffload(pids, opts.Offload)
+	if err != nil {
+		return err
+	}
+
+	checkpointCtx, cancel := context.WithTimeout(ctx, opts.Timeouts.Checkpoint)
+	err = ckpt.CheckpointGroup(checkpointCtx, pids)
+	cancel()
+	if err != nil {
+		_ = offload.Release()
+		return err
+	}
+
+	rec.PIDs = pids
+	rec.VRAMBytes = offload.Bytes
+	rec.Offload = offload
+	rec.SuspendedAt = time.Now()
+
+	// Freeze after the CUDA checkpoint: locking needs the process running
+	if opts.Freeze {
+		cg, err := cgroup.FreezerForPID(pids[0])
+		if err == nil {
+			err = cg.Freeze()
+		}
+		if err != nil {
+			rollback(ckpt, rec, opts)
+			return fmt.Errorf("freeze: %w", err)
+		}
+		rec.Freezer = cg
+	}
+
+	if err := store.Save(rec); err != nil {
+		rollback(ckpt, rec, opts)
+		return fmt.Errorf("record suspended container: %w", err)
+	}
+	return nil
+}
+
+// rollback undoes a partial Suspend
+func rollback(ckpt *cuda.Checkpointer, rec *Record, opts Options) {
+	if rec.Freezer != nil {
+		_ = rec.Freezer.Thaw()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeouts.Restore)
+	defer cancel()
+	_ = ckpt.RestoreGroup(ctx, rec.PIDs, nil)
+	_ = rec.Offload.Release()
+}
+
+// Resume brings a suspended container back: it thaws the cgroup, restores
+// the device memory of all its processes and removes the record. If the
+// restore fails, the processes stay checkpointed and the record is kept,
+// so Resume can be retried.
+func Resume(ctx context.Context, ckpt *cuda.Checkpointer, store *Store, containerID string, opts Options) (*Record, error) {
+	rec, err := store.Load(containerID)
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil {
+		return nil, fmt.Errorf("%s: %w", containerID, ErrNotSuspended)
+	}
+
+	// Thaw first: the CUDA restore needs the process running
+	if rec.Freezer != nil {
+		if err := rec.Freezer.Thaw(); err != nil {
+			return rec, fmt.Errorf("thaw: %w", err)
+		}
+	}
+
+	pids := ckpt.ProcessesInState(rec.PIDs, cuda.StateCheckpointed)
+	if len(pids) > 0 {
+		restoreCtx, cancel := context.WithTimeout(ctx, opts.Timeouts.Restore)
+		err := ckpt.RestoreGroup(restoreCtx, pids, nil)
+		cancel()
+		if err != nil {
+			if rec.Freezer != nil {
+				// Keep the record consistent: frozen and checkpointed
+				_ = rec.Freezer.Freeze()
+			}
+			return rec, err
+		}
+	}
+
+	if err := rec.Offload.Release(); err != nil {
+		// Not fatal, the workload runs again; report it with the record
+		rec.ReleaseError = err.Error()
+	}
+	return rec, store.Remove(containerID)
+}